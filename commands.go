@@ -0,0 +1,130 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"text/tabwriter"
+
+	"golang.org/x/net/context"
+	"golang.org/x/net/webdav"
+)
+
+// runFileCommand runs one of the ls, get and put commands against fs.
+func runFileCommand(fs webdav.FileSystem, cmd string, args []string) error {
+	ctx := context.Background()
+	switch {
+	case cmd == "ls" && len(args) <= 1:
+		p := "/"
+		if len(args) == 1 {
+			p = args[0]
+		}
+		return ls(ctx, fs, p)
+	case cmd == "get" && (len(args) == 1 || len(args) == 2):
+		local := path.Base(args[0])
+		if len(args) == 2 {
+			local = args[1]
+		}
+		return get(ctx, fs, args[0], local)
+	case cmd == "put" && len(args) == 2:
+		return put(ctx, fs, args[0], args[1])
+	}
+	usage()
+	return nil
+}
+
+func remotePath(p string) string {
+	return path.Join("/", p)
+}
+
+func ls(ctx context.Context, fs webdav.FileSystem, p string) error {
+	fi, err := fs.Stat(ctx, remotePath(p))
+	if err != nil {
+		return err
+	}
+	infos := []os.FileInfo{fi}
+	if fi.IsDir() {
+		f, err := fs.OpenFile(ctx, remotePath(p), os.O_RDONLY, 0)
+		if err != nil {
+			return err
+		}
+		infos, err = f.Readdir(-1)
+		f.Close()
+		if err != nil {
+			return err
+		}
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 1, ' ', tabwriter.AlignRight)
+	for _, fi := range infos {
+		name := fi.Name()
+		if fi.IsDir() {
+			name += "/"
+		}
+		fmt.Fprintf(w, "%d\t %s\t %s\n", fi.Size(), fi.ModTime().Format("2006-01-02 15:04"), name)
+	}
+	return w.Flush()
+}
+
+// get downloads the file at p to local, or to stdout if local is "-".
+func get(ctx context.Context, fs webdav.FileSystem, p string, local string) error {
+	f, err := fs.OpenFile(ctx, remotePath(p), os.O_RDONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if fi, err := f.Stat(); err == nil && fi.IsDir() {
+		return errors.New(p + " is a folder")
+	}
+
+	var out io.Writer = os.Stdout
+	if local != "-" {
+		lf, err := os.Create(local)
+		if err != nil {
+			return err
+		}
+		defer lf.Close()
+		out = lf
+	}
+	if _, err := io.Copy(out, f); err != nil {
+		return err
+	}
+	if lf, ok := out.(*os.File); ok && lf != os.Stdout {
+		return lf.Close()
+	}
+	return nil
+}
+
+// put uploads local, or stdin if local is "-", to p. If p is a folder, the
+// file is uploaded into it.
+func put(ctx context.Context, fs webdav.FileSystem, local string, p string) error {
+	var in io.Reader = os.Stdin
+	if local != "-" {
+		lf, err := os.Open(local)
+		if err != nil {
+			return err
+		}
+		defer lf.Close()
+		in = lf
+	}
+
+	p = remotePath(p)
+	if fi, err := fs.Stat(ctx, p); err == nil && fi.IsDir() {
+		if local == "-" {
+			return errors.New(p + " is a folder")
+		}
+		p = path.Join(p, path.Base(local))
+	}
+
+	f, err := fs.OpenFile(ctx, p, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, in); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strings"
+)
+
+var (
+	configFile = flag.String("config", "", "Config file of \"flag = value\" lines, used for flags not given on the command line. ~/.gdrive-webdav.conf by default.")
+)
+
+func configPath() string {
+	if *configFile != "" {
+		return *configFile
+	}
+	u, err := user.Current()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(u.HomeDir, ".gdrive-webdav.conf")
+}
+
+// loadConfig sets the flags listed in the config file, unless they were
+// given on the command line. A missing default config file is not an error.
+func loadConfig() error {
+	p := configPath()
+	if p == "" {
+		return nil
+	}
+	f, err := os.Open(p)
+	if os.IsNotExist(err) && *configFile == "" {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	given := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) { given[f.Name] = true })
+
+	s := bufio.NewScanner(f)
+	for n := 1; s.Scan(); n++ {
+		name, value, ok := parseConfigLine(s.Text())
+		if !ok {
+			continue
+		}
+		if flag.Lookup(name) == nil {
+			return fmt.Errorf("%v:%v: unknown flag %q", p, n, name)
+		}
+		if given[name] {
+			continue
+		}
+		if err := flag.Set(name, value); err != nil {
+			return fmt.Errorf("%v:%v: %v", p, n, err)
+		}
+	}
+	return s.Err()
+}
+
+// parseConfigLine splits a "name = value" line. Blank lines and comments
+// starting with # are skipped.
+func parseConfigLine(line string) (string, string, bool) {
+	line = strings.TrimSpace(line)
+	if line == "" || strings.HasPrefix(line, "#") {
+		return "", "", false
+	}
+	i := strings.Index(line, "=")
+	if i < 0 {
+		return strings.TrimLeft(line, "-"), "true", true
+	}
+	return strings.TrimLeft(strings.TrimSpace(line[:i]), "-"), strings.TrimSpace(line[i+1:]), true
+}
+
+// writeConfig sets values in the config file, keeping its other lines.
+func writeConfig(p string, values map[string]string, order []string) error {
+	var lines []string
+	if content, err := ioutil.ReadFile(p); err == nil {
+		lines = strings.Split(strings.TrimRight(string(content), "\n"), "\n")
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	written := make(map[string]bool)
+	for i, line := range lines {
+		name, _, ok := parseConfigLine(line)
+		if value, found := values[name]; ok && found {
+			lines[i] = name + " = " + value
+			written[name] = true
+		}
+	}
+	for _, name := range order {
+		if !written[name] {
+			lines = append(lines, name+" = "+values[name])
+		}
+	}
+
+	// The file holds the client secret.
+	return ioutil.WriteFile(p, []byte(strings.Join(lines, "\n")+"\n"), 0600)
+}
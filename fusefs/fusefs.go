@@ -0,0 +1,204 @@
+//go:build linux || darwin || freebsd
+// +build linux darwin freebsd
+
+// Package fusefs serves a webdav.FileSystem over FUSE.
+package fusefs
+
+import (
+	"context"
+	"io"
+	"os"
+	"path"
+	"sync"
+
+	"bazil.org/fuse"
+	"bazil.org/fuse/fs"
+	log "github.com/cihub/seelog"
+	"golang.org/x/net/webdav"
+)
+
+// Mount serves fsys at dir until it is unmounted.
+func Mount(fsys webdav.FileSystem, dir string) error {
+	c, err := fuse.Mount(dir, fuse.FSName("gdrive"), fuse.Subtype("gdrive-webdav"))
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	log.Info("Mounted on: ", dir)
+	return fs.Serve(c, &fileSystem{fs: fsys})
+}
+
+type fileSystem struct {
+	fs webdav.FileSystem
+}
+
+func (f *fileSystem) Root() (fs.Node, error) {
+	return &node{fs: f.fs, path: "/"}, nil
+}
+
+// node is a file or folder, looked up again by path on every call as the
+// file system caches metadata itself.
+type node struct {
+	fs   webdav.FileSystem
+	path string
+}
+
+// fuseError maps file system errors to the errno FUSE reports.
+func fuseError(err error) error {
+	switch {
+	case err == nil:
+		return nil
+	case os.IsNotExist(err):
+		return fuse.ENOENT
+	case os.IsExist(err):
+		return fuse.EEXIST
+	case os.IsPermission(err):
+		return fuse.EPERM
+	}
+	log.Debugf("FUSE: %v", err)
+	return fuse.EIO
+}
+
+func (n *node) Attr(ctx context.Context, a *fuse.Attr) error {
+	fi, err := n.fs.Stat(ctx, n.path)
+	if err != nil {
+		return fuseError(err)
+	}
+	a.Mode = fi.Mode()
+	a.Size = uint64(fi.Size())
+	a.Mtime = fi.ModTime()
+	a.Ctime = fi.ModTime()
+	return nil
+}
+
+func (n *node) child(name string) *node {
+	return &node{fs: n.fs, path: path.Join(n.path, name)}
+}
+
+func (n *node) Lookup(ctx context.Context, name string) (fs.Node, error) {
+	child := n.child(name)
+	if _, err := n.fs.Stat(ctx, child.path); err != nil {
+		return nil, fuseError(err)
+	}
+	return child, nil
+}
+
+func (n *node) ReadDirAll(ctx context.Context) ([]fuse.Dirent, error) {
+	f, err := n.fs.OpenFile(ctx, n.path, os.O_RDONLY, 0)
+	if err != nil {
+		return nil, fuseError(err)
+	}
+	defer f.Close()
+	infos, err := f.Readdir(-1)
+	if err != nil {
+		return nil, fuseError(err)
+	}
+
+	entries := make([]fuse.Dirent, 0, len(infos))
+	for _, fi := range infos {
+		t := fuse.DT_File
+		if fi.IsDir() {
+			t = fuse.DT_Dir
+		}
+		entries = append(entries, fuse.Dirent{Name: fi.Name(), Type: t})
+	}
+	return entries, nil
+}
+
+func (n *node) Mkdir(ctx context.Context, req *fuse.MkdirRequest) (fs.Node, error) {
+	child := n.child(req.Name)
+	if err := n.fs.Mkdir(ctx, child.path, req.Mode); err != nil {
+		return nil, fuseError(err)
+	}
+	return child, nil
+}
+
+func (n *node) Remove(ctx context.Context, req *fuse.RemoveRequest) error {
+	return fuseError(n.fs.RemoveAll(ctx, n.child(req.Name).path))
+}
+
+func (n *node) Rename(ctx context.Context, req *fuse.RenameRequest, newDir fs.Node) error {
+	dir, ok := newDir.(*node)
+	if !ok {
+		return fuse.EIO
+	}
+	return fuseError(n.fs.Rename(ctx, n.child(req.OldName).path, dir.child(req.NewName).path))
+}
+
+// Setattr accepts truncation, which always comes with a rewrite as files
+// are only written from the start.
+func (n *node) Setattr(ctx context.Context, req *fuse.SetattrRequest, resp *fuse.SetattrResponse) error {
+	if req.Valid.Size() && req.Size != 0 {
+		return fuse.ENOTSUP
+	}
+	return n.Attr(ctx, &resp.Attr)
+}
+
+func (n *node) Open(ctx context.Context, req *fuse.OpenRequest, resp *fuse.OpenResponse) (fs.Handle, error) {
+	if req.Dir || req.Flags.IsReadOnly() {
+		f, err := n.fs.OpenFile(ctx, n.path, os.O_RDONLY, 0)
+		if err != nil {
+			return nil, fuseError(err)
+		}
+		return &handle{f: f}, nil
+	}
+	return n.openWritable(ctx, n.path, 0644, &resp.Flags)
+}
+
+func (n *node) Create(ctx context.Context, req *fuse.CreateRequest, resp *fuse.CreateResponse) (fs.Node, fs.Handle, error) {
+	child := n.child(req.Name)
+	h, err := n.openWritable(ctx, child.path, req.Mode, &resp.Flags)
+	if err != nil {
+		return nil, nil, err
+	}
+	return child, h, nil
+}
+
+// openWritable opens name for writing. The file system only takes whole
+// files written in order, so the content is replaced.
+func (n *node) openWritable(ctx context.Context, name string, perm os.FileMode, flags *fuse.OpenResponseFlags) (fs.Handle, error) {
+	f, err := n.fs.OpenFile(ctx, name, os.O_RDWR|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return nil, fuseError(err)
+	}
+	*flags |= fuse.OpenNonSeekable | fuse.OpenDirectIO
+	return &handle{f: f, writable: true}, nil
+}
+
+type handle struct {
+	mu       sync.Mutex
+	f        webdav.File
+	writable bool
+	written  int64
+}
+
+func (h *handle) Read(ctx context.Context, req *fuse.ReadRequest, resp *fuse.ReadResponse) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if _, err := h.f.Seek(req.Offset, io.SeekStart); err != nil {
+		return fuseError(err)
+	}
+	buf := make([]byte, req.Size)
+	n, err := io.ReadFull(h.f, buf)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return fuseError(err)
+	}
+	resp.Data = buf[:n]
+	return nil
+}
+
+func (h *handle) Write(ctx context.Context, req *fuse.WriteRequest, resp *fuse.WriteResponse) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if !h.writable || req.Offset != h.written {
+		return fuse.ENOTSUP
+	}
+	n, err := h.f.Write(req.Data)
+	h.written += int64(n)
+	resp.Size = n
+	return fuseError(err)
+}
+
+func (h *handle) Release(ctx context.Context, req *fuse.ReleaseRequest) error {
+	return fuseError(h.f.Close())
+}
@@ -0,0 +1,37 @@
+package gdrive
+
+import (
+	"flag"
+	"net/http"
+	"strconv"
+
+	"golang.org/x/net/context"
+)
+
+const acknowledgeAbuseHeader = "X-Acknowledge-Abuse"
+
+var (
+	acknowledgeAbuseFlag = flag.Bool("acknowledge-abuse", false, "Download files Drive flagged as malware or spam, which it otherwise refuses with 403 Forbidden. Drive allows it to the owners of the files only. Clients can also ask for it per request with the X-Acknowledge-Abuse: true header, or turn it off with false.")
+)
+
+type acknowledgeAbuseKey struct{}
+
+// withAcknowledgeAbuse records in the context of r whether r acknowledges
+// the risk of downloading flagged files.
+func withAcknowledgeAbuse(r *http.Request) *http.Request {
+	ack := *acknowledgeAbuseFlag
+	if v := r.Header.Get(acknowledgeAbuseHeader); v != "" {
+		if b, err := strconv.ParseBool(v); err == nil {
+			ack = b
+		}
+	}
+	if !ack {
+		return r
+	}
+	return r.WithContext(context.WithValue(r.Context(), acknowledgeAbuseKey{}, true))
+}
+
+func acknowledgesAbuse(ctx context.Context) bool {
+	b, _ := ctx.Value(acknowledgeAbuseKey{}).(bool)
+	return b
+}
@@ -0,0 +1,114 @@
+package gdrive
+
+import (
+	"flag"
+	"net/http"
+	"strings"
+	"time"
+
+	log "github.com/cihub/seelog"
+	"golang.org/x/net/context"
+	"google.golang.org/api/drive/v3"
+	driveactivity "google.golang.org/api/driveactivity/v2"
+)
+
+var (
+	changeActivityFlag = flag.Bool("change-activity", false, "Log who made the changes found by --changes-poll-interval or --full-sync, asking the Drive Activity API. Changes by other users are logged at info level, ours at debug level. Requests an additional OAuth scope, delete the token file to authorize it.")
+)
+
+// newActivityService returns the client of the Drive Activity API, or nil
+// unless --change-activity is given.
+func newActivityService(transport http.RoundTripper) *driveactivity.Service {
+	if !*changeActivityFlag {
+		return nil
+	}
+	if *changesPollIntervalFlag <= 0 && !*fullSyncFlag {
+		log.Warn("--change-activity needs --changes-poll-interval or --full-sync")
+	}
+	s, err := driveactivity.New(&http.Client{Transport: transport})
+	if err != nil {
+		log.Errorf("An error occurred creating Drive Activity client: %v\n", err)
+		panic(-3)
+	}
+	return s
+}
+
+// logActivity logs who acted on the file changed at p since the given time.
+func (fs *fileSystem) logActivity(ctx context.Context, c *drive.Change, p string, since time.Time) {
+	if fs.activity == nil || p == "" || isHiddenPath(p) || isFilteredPath(p) {
+		return
+	}
+	req := &driveactivity.QueryDriveActivityRequest{
+		ItemName: "items/" + c.FileId,
+		Filter:   "time >= \"" + since.UTC().Format(time.RFC3339) + "\"",
+	}
+	err := fs.activity.Activity.Query(req).Pages(ctx, func(r *driveactivity.QueryDriveActivityResponse) error {
+		for _, a := range r.Activities {
+			actors, ours := activityActors(a.Actors)
+			if ours {
+				log.Debugf("activity: %v %v by %v", p, activityAction(a.PrimaryActionDetail), actors)
+			} else {
+				log.Infof("activity: %v %v by %v", p, activityAction(a.PrimaryActionDetail), actors)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		log.Errorf("can't get activity of %v: %v", p, err)
+	}
+}
+
+// activityActors describes who acted, and reports whether it was only us.
+// The API names users by person resource, e.g. people/123.
+func activityActors(actors []*driveactivity.Actor) (string, bool) {
+	names := []string{}
+	ours := len(actors) > 0
+	for _, a := range actors {
+		name := "unknown"
+		switch {
+		case a.User != nil && a.User.KnownUser != nil && a.User.KnownUser.IsCurrentUser:
+			name = "us"
+		case a.User != nil && a.User.KnownUser != nil:
+			name = a.User.KnownUser.PersonName
+		case a.User != nil && a.User.DeletedUser != nil:
+			name = "a deleted user"
+		case a.Administrator != nil:
+			name = "an administrator"
+		case a.Anonymous != nil:
+			name = "an anonymous user"
+		case a.System != nil:
+			name = "the system"
+		}
+		if name != "us" {
+			ours = false
+		}
+		names = append(names, name)
+	}
+	return strings.Join(names, ", "), ours
+}
+
+func activityAction(d *driveactivity.ActionDetail) string {
+	switch {
+	case d == nil:
+		return "changed"
+	case d.Create != nil:
+		return "created"
+	case d.Edit != nil:
+		return "edited"
+	case d.Move != nil:
+		return "moved"
+	case d.Rename != nil:
+		return "renamed from " + d.Rename.OldTitle
+	case d.Delete != nil:
+		return "deleted"
+	case d.Restore != nil:
+		return "restored"
+	case d.PermissionChange != nil:
+		return "shared"
+	case d.Comment != nil:
+		return "commented"
+	case d.SettingsChange != nil:
+		return "settings changed"
+	}
+	return "changed"
+}
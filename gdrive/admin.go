@@ -0,0 +1,126 @@
+package gdrive
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"flag"
+	"net/http"
+	"strings"
+	"time"
+
+	log "github.com/cihub/seelog"
+	"golang.org/x/net/webdav"
+	"google.golang.org/api/drive/v3"
+)
+
+var (
+	adminTokenFlag = flag.String("admin-token", "", "Enable the /admin/ endpoints, which then shadow a top-level admin folder, for requests with \"Authorization: Bearer <token>\".")
+)
+
+type adminHandler struct {
+	fs  *fileSystem
+	mux *http.ServeMux
+}
+
+// NewAdminHandler creates the handler of the /admin/ endpoints operating fs.
+// It returns nil unless --admin-token is given.
+func NewAdminHandler(fs webdav.FileSystem) http.Handler {
+	gfs, ok := driveFS(fs)
+	if *adminTokenFlag == "" || !ok {
+		return nil
+	}
+
+	h := &adminHandler{fs: gfs, mux: http.NewServeMux()}
+	h.mux.HandleFunc("/admin/cache/purge", h.purgeCache)
+	h.mux.HandleFunc("/admin/stats", h.stats)
+	h.mux.HandleFunc("/admin/about", h.about)
+	h.mux.HandleFunc("/admin/queue", h.queue)
+	h.mux.HandleFunc("/admin/version", h.version)
+	h.mux.HandleFunc("/admin/share", h.shareLink)
+	return h
+}
+
+func (h *adminHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !checkAdminToken(w, r) {
+		return
+	}
+	h.mux.ServeHTTP(w, r)
+}
+
+// checkAdminToken reports whether r carries the admin token, and answers it
+// otherwise.
+func checkAdminToken(w http.ResponseWriter, r *http.Request) bool {
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if subtle.ConstantTimeCompare([]byte(token), []byte(*adminTokenFlag)) != 1 {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return false
+	}
+	return true
+}
+
+// purgeCache drops cached metadata, of everything or of the tree at the
+// path given by the prefix parameter.
+func (h *adminHandler) purgeCache(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	prefix := r.FormValue("prefix")
+	h.fs.purgeCache(prefix)
+	log.Infof("Purged cache of %v", prefix)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// stats reports counters of cache lookups, Drive API calls and transfers.
+func (h *adminHandler) stats(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	snap := h.fs.stats.snapshot()
+	snap.CacheEntries = h.fs.cache.ItemCount()
+	snap.CacheBytes = h.fs.cache.size()
+	json.NewEncoder(w).Encode(snap)
+}
+
+type adminAbout struct {
+	Email        string                   `json:"email"`
+	DisplayName  string                   `json:"displayName"`
+	Scopes       []string                 `json:"scopes,omitempty"`
+	StorageQuota *drive.AboutStorageQuota `json:"storageQuota,omitempty"`
+	TokenExpiry  *time.Time               `json:"tokenExpiry,omitempty"`
+}
+
+// about reports the account the file system is bound to and its token.
+func (h *adminHandler) about(w http.ResponseWriter, r *http.Request) {
+	about, err := h.fs.about(r.Context())
+	if err != nil {
+		log.Errorf("can't get account: %v", err)
+		http.Error(w, http.StatusText(http.StatusBadGateway), http.StatusBadGateway)
+		return
+	}
+
+	result := &adminAbout{StorageQuota: about.StorageQuota}
+	if about.User != nil {
+		result.Email = about.User.EmailAddress
+		result.DisplayName = about.User.DisplayName
+	}
+	if h.fs.tokenSource != nil {
+		token, err := h.fs.tokenSource.Token()
+		if err != nil {
+			log.Errorf("can't get token: %v", err)
+		} else {
+			result.TokenExpiry = &token.Expiry
+			if result.Scopes, err = grantedScopes(r.Context(), token); err != nil {
+				log.Errorf("can't get token scopes: %v", err)
+			}
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+// queue lists the uploads spooled with --write-back-dir and not sent yet.
+func (h *adminHandler) queue(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(h.fs.queue.status())
+}
@@ -0,0 +1,42 @@
+package gdrive
+
+import (
+	"flag"
+	"path"
+
+	log "github.com/cihub/seelog"
+	"golang.org/x/net/context"
+)
+
+const (
+	// appDataRoot is where the hidden application data folder is served.
+	appDataRoot  = "/.appdata"
+	appDataScope = "https://www.googleapis.com/auth/drive.appdata"
+)
+
+var (
+	appDataFlag = flag.Bool("app-data", false, "Serve the application data folder at /.appdata. Requests an additional OAuth scope, delete the token file to authorize it.")
+)
+
+func isAppDataRoot(p string) bool {
+	return *appDataFlag && p == appDataRoot
+}
+
+// listSpaces returns the Drive spaces searched for files.
+func listSpaces() string {
+	if *appDataFlag {
+		return "drive,appDataFolder"
+	}
+	return "drive"
+}
+
+func (fs *fileSystem) getAppDataFolder(ctx context.Context) (*fileAndPath, error) {
+	f, err := fs.client.Files.Get("appDataFolder").Fields(fileFields).Context(ctx).Do()
+	if err != nil {
+		log.Error(err)
+		return nil, err
+	}
+	dir := *f
+	dir.Name = path.Base(appDataRoot)
+	return &fileAndPath{file: &dir, path: appDataRoot}, nil
+}
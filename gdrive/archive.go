@@ -0,0 +1,161 @@
+package gdrive
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+
+	log "github.com/cihub/seelog"
+	"golang.org/x/net/context"
+)
+
+// archiveWriter adds files to an archive.
+type archiveWriter interface {
+	add(name string, fi os.FileInfo, content io.Reader) error
+	Close() error
+}
+
+type zipArchive struct {
+	zw *zip.Writer
+}
+
+func (a *zipArchive) add(name string, fi os.FileInfo, content io.Reader) error {
+	hdr := &zip.FileHeader{Name: name, Method: zip.Deflate}
+	hdr.SetModTime(fi.ModTime())
+	if fi.IsDir() {
+		hdr.Name += "/"
+		hdr.Method = zip.Store
+	}
+	w, err := a.zw.CreateHeader(hdr)
+	if err != nil || content == nil {
+		return err
+	}
+	_, err = copyBuffered(w, content)
+	return err
+}
+
+func (a *zipArchive) Close() error {
+	return a.zw.Close()
+}
+
+type tarArchive struct {
+	gz *gzip.Writer
+	tw *tar.Writer
+}
+
+func (a *tarArchive) add(name string, fi os.FileInfo, content io.Reader) error {
+	hdr := &tar.Header{Name: name, ModTime: fi.ModTime(), Mode: 0644, Size: fi.Size(), Typeflag: tar.TypeReg}
+	if fi.IsDir() {
+		hdr.Name += "/"
+		hdr.Mode = 0755
+		hdr.Size = 0
+		hdr.Typeflag = tar.TypeDir
+	}
+	if err := a.tw.WriteHeader(hdr); err != nil || content == nil {
+		return err
+	}
+	_, err := copyBuffered(a.tw, content)
+	return err
+}
+
+func (a *tarArchive) Close() error {
+	if err := a.tw.Close(); err != nil {
+		return err
+	}
+	return a.gz.Close()
+}
+
+// serveArchive answers GET on a folder with ?archive=zip or tar.gz with an
+// archive of the folder, assembled while it's sent. It returns false if r
+// is not for a folder, to be served as usual.
+func (h *handler) serveArchive(w http.ResponseWriter, r *http.Request, format string) bool {
+	fi, err := h.dav.FileSystem.Stat(r.Context(), r.URL.Path)
+	if err != nil || !fi.IsDir() {
+		return false
+	}
+	name := fi.Name()
+	if name == "" || name == "/" {
+		name = "gdrive"
+	}
+
+	var a archiveWriter
+	switch format {
+	case "zip":
+		w.Header().Set("Content-Type", "application/zip")
+		a = &zipArchive{zw: zip.NewWriter(w)}
+		name += ".zip"
+	case "tar.gz", "tgz":
+		w.Header().Set("Content-Type", "application/gzip")
+		gz := gzip.NewWriter(w)
+		a = &tarArchive{gz: gz, tw: tar.NewWriter(gz)}
+		name += ".tar.gz"
+	default:
+		http.Error(w, "archive must be zip or tar.gz", http.StatusBadRequest)
+		return true
+	}
+	w.Header().Set("Content-Disposition", contentDisposition(name))
+
+	log.Infof("Sending %v as %v", r.URL.Path, name)
+	if err := h.archiveTree(r.Context(), a, normalizePath(r.URL.Path), ""); err != nil {
+		// The response has started, the client sees a truncated archive.
+		log.Errorf("can't send archive of %v: %v", r.URL.Path, err)
+		return true
+	}
+	if err := a.Close(); err != nil {
+		log.Errorf("can't send archive of %v: %v", r.URL.Path, err)
+	}
+	return true
+}
+
+// archiveTree adds the files of folder p to a under prefix.
+func (h *handler) archiveTree(ctx context.Context, a archiveWriter, p string, prefix string) error {
+	dir, err := h.dav.FileSystem.OpenFile(ctx, p, os.O_RDONLY, 0)
+	if err != nil {
+		return err
+	}
+	infos, err := dir.Readdir(0)
+	dir.Close()
+	if err != nil {
+		return err
+	}
+
+	for _, fi := range infos {
+		child := p + "/" + fi.Name()
+		if isVirtualPath(child) || isVersionsPath(child) {
+			// They list files found elsewhere in the tree.
+			continue
+		}
+		name := strings.TrimPrefix(path.Join(prefix, fi.Name()), "/")
+		if fi.IsDir() {
+			if err := a.add(name, fi, nil); err != nil {
+				return err
+			}
+			if err := h.archiveTree(ctx, a, child, name); err != nil {
+				return err
+			}
+			continue
+		}
+		if info, ok := fi.Sys().(*fileInfo); ok && isGoogleMimeType(info.mimeType) {
+			// Google documents have no content to download.
+			continue
+		}
+		if err := h.archiveFile(ctx, a, child, name, fi); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (h *handler) archiveFile(ctx context.Context, a archiveWriter, p string, name string, fi os.FileInfo) error {
+	f, err := h.dav.FileSystem.OpenFile(ctx, p, os.O_RDONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return a.add(name, fi, f)
+}
@@ -0,0 +1,134 @@
+package gdrive
+
+import (
+	"encoding/json"
+	"flag"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+
+	log "github.com/cihub/seelog"
+	"golang.org/x/net/context"
+)
+
+var (
+	auditLogFlag = flag.String("audit-log", "", "Append a JSON line for every PUT, DELETE, MOVE, COPY, MKCOL and PROPPATCH to this file, with user, client IP, path, file ID, size and result.")
+)
+
+// auditEntry is a line of the audit log.
+type auditEntry struct {
+	Time        time.Time `json:"time"`
+	User        string    `json:"user,omitempty"`
+	IP          string    `json:"ip"`
+	Method      string    `json:"method"`
+	Path        string    `json:"path"`
+	Destination string    `json:"destination,omitempty"`
+	FileID      string    `json:"fileId,omitempty"`
+	Size        int64     `json:"size,omitempty"`
+	Status      int       `json:"status"`
+}
+
+// auditLog appends entries to the file of --audit-log.
+type auditLog struct {
+	mu  sync.Mutex
+	enc *json.Encoder
+}
+
+func newAuditLog() *auditLog {
+	if *auditLogFlag == "" {
+		return nil
+	}
+	f, err := os.OpenFile(*auditLogFlag, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		log.Errorf("An error occurred opening audit log: %v\n", err)
+		panic(-3)
+	}
+	return &auditLog{enc: json.NewEncoder(f)}
+}
+
+func isAudited(method string) bool {
+	switch method {
+	case "PUT", "DELETE", "MOVE", "COPY", "MKCOL", "PROPPATCH":
+		return true
+	}
+	return false
+}
+
+// startAudit begins the entry of r, to be written by the returned function once
+// r is served through the returned writer.
+func (h *handler) startAudit(w http.ResponseWriter, r *http.Request) (http.ResponseWriter, func()) {
+	if h.audit == nil || !isAudited(r.Method) {
+		return w, func() {}
+	}
+
+	e := &auditEntry{
+		Time:   time.Now().UTC(),
+		IP:     clientIP(r),
+		Method: r.Method,
+		Path:   normalizePath(r.URL.Path),
+	}
+	if user, _, ok := r.BasicAuth(); ok {
+		e.User = user
+	}
+	if dest, err := url.Parse(r.Header.Get("Destination")); err == nil && dest.Path != "" {
+		e.Destination = normalizePath(dest.Path)
+	}
+	if r.Method == "DELETE" {
+		e.FileID, _ = h.fileStat(r.Context(), e.Path)
+	}
+
+	aw := &auditWriter{ResponseWriter: w}
+	return aw, func() {
+		e.Status = aw.status
+		if e.Status == 0 {
+			e.Status = http.StatusOK
+		}
+		if e.Status < 300 && r.Method != "DELETE" {
+			p := e.Path
+			if e.Destination != "" {
+				p = e.Destination
+			}
+			e.FileID, e.Size = h.fileStat(r.Context(), p)
+		}
+		h.audit.write(e)
+	}
+}
+
+// fileStat returns the Drive ID and the size of the file at p.
+func (h *handler) fileStat(ctx context.Context, p string) (string, int64) {
+	fi, err := h.dav.FileSystem.Stat(ctx, p)
+	if err != nil {
+		return "", 0
+	}
+	size := fi.Size()
+	if fi.IsDir() {
+		size = 0
+	}
+	if info, ok := fi.Sys().(*fileInfo); ok {
+		return info.id, size
+	}
+	return "", size
+}
+
+func (l *auditLog) write(e *auditEntry) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if err := l.enc.Encode(e); err != nil {
+		log.Errorf("can't write audit log: %v", err)
+	}
+}
+
+// auditWriter records the status of a response.
+type auditWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *auditWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
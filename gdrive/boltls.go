@@ -0,0 +1,314 @@
+package gdrive
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"sync"
+	"time"
+
+	log "github.com/cihub/seelog"
+	bolt "go.etcd.io/bbolt"
+	"golang.org/x/net/webdav"
+)
+
+var (
+	lockDBFlag = flag.String("lock-db", "", "Persist WebDAV locks to this bbolt database file, so that they survive restarts.")
+
+	locksBucket = []byte("locks")
+)
+
+const (
+	// lockPruneInterval is how often expired locks are deleted from the
+	// database.
+	lockPruneInterval = time.Minute
+)
+
+// boltLS is a lock system that keeps its locks in a webdav.NewMemLS and
+// mirrors them to a bbolt database, from which they are restored on start.
+//
+// Tokens of the in-memory lock system change with every restart, so clients
+// are handed tokens of our own which are mapped to the in-memory ones.
+type boltLS struct {
+	ls webdav.LockSystem
+	db *bolt.DB
+
+	mu     sync.Mutex
+	tokens map[string]string
+}
+
+type lockRecord struct {
+	Root      string
+	OwnerXML  string
+	ZeroDepth bool
+	Infinite  bool
+	Expiry    time.Time
+}
+
+func newBoltLS(path string) (*boltLS, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, err
+	}
+
+	ls := &boltLS{
+		ls:     webdav.NewMemLS(),
+		db:     db,
+		tokens: make(map[string]string),
+	}
+	if err := ls.restore(time.Now()); err != nil {
+		db.Close()
+		return nil, err
+	}
+	go func() {
+		for now := range time.Tick(lockPruneInterval) {
+			ls.prune(now)
+		}
+	}()
+	return ls, nil
+}
+
+// restore recreates the persisted locks which haven't expired yet.
+func (l *boltLS) restore(now time.Time) error {
+	return l.db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists(locksBucket)
+		if err != nil {
+			return err
+		}
+
+		stale := [][]byte{}
+		err = b.ForEach(func(k, v []byte) error {
+			var r lockRecord
+			if err := json.Unmarshal(v, &r); err != nil {
+				log.Errorf("can't decode lock %s: %v", k, err)
+				stale = append(stale, k)
+				return nil
+			}
+			details := webdav.LockDetails{
+				Root:      r.Root,
+				Duration:  -1,
+				OwnerXML:  r.OwnerXML,
+				ZeroDepth: r.ZeroDepth,
+			}
+			if !r.Infinite {
+				details.Duration = r.Expiry.Sub(now)
+				if details.Duration <= 0 {
+					stale = append(stale, k)
+					return nil
+				}
+			}
+			token, err := l.ls.Create(now, details)
+			if err != nil {
+				log.Errorf("can't restore lock %s on %v: %v", k, r.Root, err)
+				stale = append(stale, k)
+				return nil
+			}
+			l.tokens[string(k)] = token
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		for _, k := range stale {
+			if err := b.Delete(k); err != nil {
+				return err
+			}
+		}
+		log.Infof("Restored %v locks", len(l.tokens))
+		return nil
+	})
+}
+
+// prune deletes the persisted locks which have expired. The in-memory lock
+// system forgets them by itself.
+func (l *boltLS) prune(now time.Time) {
+	expired := []string{}
+	err := l.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(locksBucket)
+		err := b.ForEach(func(k, v []byte) error {
+			var r lockRecord
+			if err := json.Unmarshal(v, &r); err == nil && !r.Infinite && now.After(r.Expiry) {
+				expired = append(expired, string(k))
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, k := range expired {
+			if err := b.Delete([]byte(k)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		log.Errorf("can't delete expired locks: %v", err)
+		return
+	}
+
+	l.mu.Lock()
+	for _, k := range expired {
+		delete(l.tokens, k)
+	}
+	l.mu.Unlock()
+}
+
+// temporaryLocker is implemented by lock systems which handle the locks
+// taken for the duration of a single request apart from those of LOCK, as
+// such locks aren't worth persisting or reflecting in Drive.
+type temporaryLocker interface {
+	createTemporary(now time.Time, details webdav.LockDetails) (string, error)
+}
+
+// createTemporaryLock creates a lock for the duration of a single request.
+func createTemporaryLock(ls webdav.LockSystem, now time.Time, details webdav.LockDetails) (string, error) {
+	if tl, ok := ls.(temporaryLocker); ok {
+		return tl.createTemporary(now, details)
+	}
+	return ls.Create(now, details)
+}
+
+// requestLS is the lock system webdav.Handler is given for requests other
+// than LOCK, so that the locks it creates are known to be temporary.
+type requestLS struct {
+	webdav.LockSystem
+}
+
+func (l requestLS) Create(now time.Time, details webdav.LockDetails) (string, error) {
+	return createTemporaryLock(l.LockSystem, now, details)
+}
+
+func newLockToken() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("opaquelocktoken:%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:]), nil
+}
+
+// memToken returns the in-memory token for a token handed to a client.
+func (l *boltLS) memToken(token string) string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if t, ok := l.tokens[token]; ok {
+		return t
+	}
+	return token
+}
+
+func (l *boltLS) save(token string, now time.Time, details webdav.LockDetails) error {
+	r := lockRecord{
+		Root:      details.Root,
+		OwnerXML:  details.OwnerXML,
+		ZeroDepth: details.ZeroDepth,
+		Infinite:  details.Duration < 0,
+	}
+	if !r.Infinite {
+		r.Expiry = now.Add(details.Duration)
+	}
+	v, err := json.Marshal(&r)
+	if err != nil {
+		return err
+	}
+	return l.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(locksBucket).Put([]byte(token), v)
+	})
+}
+
+func (l *boltLS) forget(token string) {
+	l.mu.Lock()
+	delete(l.tokens, token)
+	l.mu.Unlock()
+
+	err := l.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(locksBucket).Delete([]byte(token))
+	})
+	if err != nil {
+		log.Errorf("can't delete lock %v: %v", token, err)
+	}
+}
+
+// lockRoot returns the root of the persisted lock with token.
+func (l *boltLS) lockRoot(token string) (string, bool) {
+	var r lockRecord
+	err := l.db.View(func(tx *bolt.Tx) error {
+		v := tx.Bucket(locksBucket).Get([]byte(token))
+		if v == nil {
+			return webdav.ErrNoSuchLock
+		}
+		return json.Unmarshal(v, &r)
+	})
+	return r.Root, err == nil
+}
+
+func (l *boltLS) isPersisted(token string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	_, ok := l.tokens[token]
+	return ok
+}
+
+func (l *boltLS) Confirm(now time.Time, name0, name1 string, conditions ...webdav.Condition) (func(), error) {
+	mapped := make([]webdav.Condition, len(conditions))
+	for i, c := range conditions {
+		mapped[i] = c
+		if c.Token != "" {
+			mapped[i].Token = l.memToken(c.Token)
+		}
+	}
+	return l.ls.Confirm(now, name0, name1, mapped...)
+}
+
+func (l *boltLS) Create(now time.Time, details webdav.LockDetails) (string, error) {
+	memToken, err := l.ls.Create(now, details)
+	if err != nil {
+		return "", err
+	}
+
+	token, err := newLockToken()
+	if err == nil {
+		err = l.save(token, now, details)
+	}
+	if err != nil {
+		log.Errorf("can't persist lock on %v: %v", details.Root, err)
+		l.ls.Unlock(now, memToken)
+		return "", err
+	}
+
+	l.mu.Lock()
+	l.tokens[token] = memToken
+	l.mu.Unlock()
+	return token, nil
+}
+
+func (l *boltLS) createTemporary(now time.Time, details webdav.LockDetails) (string, error) {
+	return l.ls.Create(now, details)
+}
+
+func (l *boltLS) Refresh(now time.Time, token string, duration time.Duration) (webdav.LockDetails, error) {
+	details, err := l.ls.Refresh(now, l.memToken(token), duration)
+	if !l.isPersisted(token) {
+		return details, err
+	}
+	if err == webdav.ErrNoSuchLock {
+		l.forget(token)
+	}
+	if err != nil {
+		return details, err
+	}
+	if err := l.save(token, now, details); err != nil {
+		log.Errorf("can't persist refreshed lock %v: %v", token, err)
+	}
+	return details, nil
+}
+
+func (l *boltLS) Unlock(now time.Time, token string) error {
+	err := l.ls.Unlock(now, l.memToken(token))
+	if l.isPersisted(token) && (err == nil || err == webdav.ErrNoSuchLock) {
+		l.forget(token)
+	}
+	return err
+}
@@ -0,0 +1,57 @@
+package gdrive
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/webdav"
+)
+
+// recordingLS records which locks are created as temporary ones.
+type recordingLS struct {
+	webdav.LockSystem
+	created   []webdav.LockDetails
+	temporary []webdav.LockDetails
+}
+
+func (l *recordingLS) Create(now time.Time, details webdav.LockDetails) (string, error) {
+	l.created = append(l.created, details)
+	return l.LockSystem.Create(now, details)
+}
+
+func (l *recordingLS) createTemporary(now time.Time, details webdav.LockDetails) (string, error) {
+	l.temporary = append(l.temporary, details)
+	return l.LockSystem.Create(now, details)
+}
+
+func TestTemporaryLocks(t *testing.T) {
+	ls := &recordingLS{LockSystem: webdav.NewMemLS()}
+	h := NewHandler(webdav.NewMemFS(), ls)
+
+	r := httptest.NewRequest("PUT", "/file.txt", strings.NewReader("content"))
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("PUT answered %v", w.Code)
+	}
+	if len(ls.temporary) != 1 || len(ls.created) != 0 {
+		t.Errorf("PUT created %v temporary and %v other locks, want 1 and 0", len(ls.temporary), len(ls.created))
+	}
+
+	// A lock without owner, as some clients take, is still a real one.
+	r = httptest.NewRequest("LOCK", "/file.txt", strings.NewReader(`<?xml version="1.0" encoding="utf-8"?>
+<D:lockinfo xmlns:D="DAV:"><D:lockscope><D:exclusive/></D:lockscope><D:locktype><D:write/></D:locktype></D:lockinfo>`))
+	r.Header.Set("Depth", "0")
+	r.Header.Set("Timeout", "Infinite")
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("LOCK answered %v", w.Code)
+	}
+	if len(ls.temporary) != 1 || len(ls.created) != 1 {
+		t.Errorf("LOCK created %v temporary and %v other locks, want 1 and 1", len(ls.temporary)-1, len(ls.created))
+	}
+}
@@ -1,20 +1,173 @@
 package gdrive
 
 import (
+	"os"
+	"strings"
+	"sync"
 	"time"
 
 	log "github.com/cihub/seelog"
+	"golang.org/x/net/context"
+	"google.golang.org/api/drive/v3"
 )
 
 const (
 	cacheKeyAbout = "global:about"
-	cacheKeyFile  = "file:"
-	cacheKeyDir  = "file:"
+	cacheKeyPath  = "path:"
+	cacheKeyID    = "id:"
+	cacheKeyDir   = "dir:"
+	// cacheKeyLabels keeps the labels of a file, listed for --labels.
+	cacheKeyLabels = "labels:"
+	// cacheKeyPermissions keeps the permissions of a file, listed for
+	// --show-permissions.
+	cacheKeyPermissions = "permissions:"
+
+	// Folders are looked up as components of the paths of all their files
+	// and rarely change, so they are cached longer.
+	fileCacheTTL   = time.Minute
+	folderCacheTTL = 10 * time.Minute
 )
 
+// File metadata is cached by ID, which never changes, and found by path
+// through an index of the paths looked up. Folder listings are cached by
+// the ID of the folder.
+
+// pathEntry is the file found at a path, under the name shown there.
+type pathEntry struct {
+	id   string
+	name string
+}
+
+// pathHistory remembers the paths at which files were seen, as Drive tells
+// the changes of files removed or moved away by ID only. Unlike the cache,
+// it doesn't expire.
+type pathHistory struct {
+	mu    sync.Mutex
+	paths map[string][]string
+}
+
+func newPathHistory() *pathHistory {
+	return &pathHistory{paths: make(map[string][]string)}
+}
+
+func (h *pathHistory) add(id string, p string) {
+	if h == nil {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	paths := h.paths[id]
+	for i, seen := range paths {
+		if seen == p {
+			// The last one is where the file was seen last.
+			paths = append(paths[:i], paths[i+1:]...)
+			break
+		}
+	}
+	h.paths[id] = append(paths, p)
+}
+
+// get returns the paths at which file id was seen, the latest last.
+func (h *pathHistory) get(id string) []string {
+	if h == nil {
+		return nil
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return append([]string{}, h.paths[id]...)
+}
+
+func (fs *fileSystem) cacheFile(p string, file *drive.File) {
+	ttl := cacheTTL(file)
+	fs.resourceKeys.add(file)
+	fs.history.add(file.Id, p)
+	fs.cache.Set(cacheKeyPath+p, &pathEntry{id: file.Id, name: file.Name}, ttl)
+	fs.cache.Set(cacheKeyID+file.Id, file, ttl)
+}
+
+// cachedFile returns the cached file at p.
+func (fs *fileSystem) cachedFile(p string) (*fileAndPath, bool) {
+	entry, found := fs.cache.Get(cacheKeyPath + p)
+	if !found {
+		return nil, false
+	}
+	e := entry.(*pathEntry)
+	cached, found := fs.cache.Get(cacheKeyID + e.id)
+	if !found {
+		return nil, false
+	}
+	file := cached.(*drive.File)
+	if file.Name != e.name {
+		named := *file
+		named.Name = e.name
+		file = &named
+	}
+	if p == "" {
+		p = "/"
+	}
+	return &fileAndPath{file: file, path: p}, true
+}
+
+// invalidateID drops the metadata of file id, its listing and the listings
+// of its parents, besides the given ones.
+func (fs *fileSystem) invalidateID(id string, parents ...string) {
+	if cached, found := fs.cache.Get(cacheKeyID + id); found {
+		parents = append(parents, cached.(*drive.File).Parents...)
+	}
+	fs.cache.Delete(cacheKeyID + id)
+	for _, folderID := range append(parents, id) {
+		fs.cache.Delete(cacheKeyDir + folderID)
+		fs.forget(cacheKeyDir + folderID)
+	}
+}
+
 func (fs *fileSystem) invalidatePath(p string) {
 	log.Tracef("invalidatePath %v", p)
-	fs.cache.Delete(cacheKeyFile + p)
+	fs.index.markDirty()
+	key := cacheKeyPath + normalizePath(p)
+	if entry, found := fs.cache.Get(key); found {
+		fs.invalidateID(entry.(*pathEntry).id)
+	}
+	fs.cache.Delete(key)
+	fs.forget(key)
+}
+
+// invalidateTree invalidates p and forgets the paths cached below it. The
+// files there are still cached by ID.
+func (fs *fileSystem) invalidateTree(p string) {
+	log.Tracef("invalidateTree %v", p)
+	prefix := cacheKeyPath + normalizePath(p) + "/"
+	for key := range fs.cache.Items() {
+		if strings.HasPrefix(key, prefix) {
+			fs.cache.Delete(key)
+			fs.forget(key)
+		}
+	}
+	fs.invalidatePath(p)
+}
+
+// purgeCache invalidates the tree at prefix, or everything if it is empty.
+func (fs *fileSystem) purgeCache(prefix string) {
+	if normalizePath(prefix) == "" {
+		fs.cache.Flush()
+		return
+	}
+	fs.invalidateTree(prefix)
+}
+
+// about returns the storage quota of the drive and its user, cached for a
+// minute.
+func (fs *fileSystem) about(ctx context.Context) (*drive.About, error) {
+	if about, found := fs.cache.Get(cacheKeyAbout); found {
+		return about.(*drive.About), nil
+	}
+
+	about, err := fs.client.About.Get().Fields("maxUploadSize,storageQuota,user(displayName,emailAddress)").Context(ctx).Do()
+	if err != nil {
+		return nil, err
+	}
+	fs.cache.Set(cacheKeyAbout, about, time.Minute)
+	return about, nil
 }
 
 type fileLookupResult struct {
@@ -22,21 +175,86 @@ type fileLookupResult struct {
 	err error
 }
 
-func (fs *fileSystem) getFile(p string, onlyFolder bool) (*fileAndPath, error) {
-	key := cacheKeyFile + p
+func (fs *fileSystem) getFile(ctx context.Context, p string, onlyFolder bool) (*fileAndPath, error) {
+	p = normalizePath(p)
+	key := cacheKeyPath + p
 
-	if lookup, found := fs.cache.Get(key); found {
+	fp, found := fs.cachedFile(p)
+	fs.stats.cacheLookup(found)
+	if found {
 		log.Tracef("getFile cache hit %v %v", p, onlyFolder)
-		result := lookup.(*fileLookupResult)
-		return result.fp, result.err
+		return fp, nil
 	}
 
 	log.Tracef("getFile %v %v", p, onlyFolder)
 
-	fp, err := fs.getFile0(p, onlyFolder)
-	lookup := &fileLookupResult{fp: fp, err: err}
+	fp, err := fs.getFile0(ctx, p, onlyFolder)
 	if err == nil {
-		fs.cache.Set(key, lookup, time.Minute)
+		fs.cacheFile(p, fp.file)
+		fs.remember(key, &fileLookupResult{fp: fp})
+	} else if result, ok := fs.fallback(key, err); ok {
+		return result.fp, result.err
+	}
+	return fp, err
+}
+
+func cacheTTL(file *drive.File) time.Duration {
+	if file.MimeType == mimeTypeFolder {
+		return folderCacheTTL
+	}
+	return fileCacheTTL
+}
+
+// getRoot returns the folder served as the root. Its ID never changes, so it
+// is only looked up once.
+func (fs *fileSystem) getRoot(ctx context.Context) (*fileAndPath, error) {
+	fs.rootMu.Lock()
+	defer fs.rootMu.Unlock()
+	if fs.root == nil {
+		f, err := fs.client.Files.Get(fs.rootID).SupportsAllDrives(true).Fields(fileFields).Context(ctx).Do()
+		if err != nil {
+			log.Error(err)
+			return nil, err
+		}
+		if f.MimeType != mimeTypeFolder {
+			log.Errorf("root %v is not a folder", f.Id)
+			return nil, os.ErrNotExist
+		}
+		fs.root = f
+	}
+	return &fileAndPath{file: fs.root, path: "/"}, nil
+}
+
+func (fs *fileSystem) listFolder(ctx context.Context, folderID string) ([]*drive.File, error) {
+	key := cacheKeyDir + folderID
+
+	lookup, found := fs.cache.Get(key)
+	fs.stats.cacheLookup(found)
+	if found {
+		log.Trace("Reusing cached file: ", folderID)
+		return lookup.(*fileLookupResult).fp.files, nil
+	}
+
+	files, err := fs.listFolder0(ctx, folderID)
+	if err != nil {
+		if result, ok := fs.fallback(key, err); ok {
+			return result.fp.files, nil
+		}
+		return nil, err
 	}
-	return lookup.fp, lookup.err
+
+	fs.cacheFolder(folderID, files, 5*time.Second)
+	return files, nil
+}
+
+// cacheFolder caches the listing of a folder for ttl.
+func (fs *fileSystem) cacheFolder(folderID string, files []*drive.File, ttl time.Duration) {
+	fs.resourceKeys.add(files...)
+	key := cacheKeyDir + folderID
+	result := &fileLookupResult{fp: &fileAndPath{
+		path:  folderID,
+		files: files,
+	}}
+	fs.cache.Set(key, result, ttl)
+	fs.remember(key, result)
 }
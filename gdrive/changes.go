@@ -0,0 +1,244 @@
+package gdrive
+
+import (
+	"flag"
+	"os"
+	"sync"
+	"time"
+
+	log "github.com/cihub/seelog"
+	"golang.org/x/net/context"
+	"google.golang.org/api/drive/v3"
+)
+
+const (
+	changeCreate = "create"
+	changeUpdate = "update"
+	changeDelete = "delete"
+)
+
+var (
+	changesPollIntervalFlag = flag.Duration("changes-poll-interval", 0, "Poll Drive for changes this often, to drop stale cache entries and to stream the changes at /events. 0 disables polling.")
+)
+
+// changeEvent describes a change of a file of the tree.
+type changeEvent struct {
+	Type string `json:"type"`
+	Path string `json:"path"`
+	ID   string `json:"id"`
+}
+
+// eventBroker passes change events to the subscribed streams.
+type eventBroker struct {
+	mu   sync.Mutex
+	subs map[chan *changeEvent]bool
+}
+
+func newEventBroker() *eventBroker {
+	return &eventBroker{subs: make(map[chan *changeEvent]bool)}
+}
+
+func (b *eventBroker) subscribe() chan *changeEvent {
+	ch := make(chan *changeEvent, 64)
+	b.mu.Lock()
+	b.subs[ch] = true
+	b.mu.Unlock()
+	return ch
+}
+
+func (b *eventBroker) unsubscribe(ch chan *changeEvent) {
+	b.mu.Lock()
+	delete(b.subs, ch)
+	b.mu.Unlock()
+}
+
+// publish sends ev to the subscribers, skipping those too slow to keep up.
+func (b *eventBroker) publish(ev *changeEvent) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for ch := range b.subs {
+		select {
+		case ch <- ev:
+		default:
+			log.Warnf("dropped %v event of %v for a slow subscriber", ev.Type, ev.Path)
+		}
+	}
+}
+
+// changesPolled reports whether a poller reads the changes of the drive,
+// with --changes-poll-interval or --full-sync.
+func changesPolled() bool {
+	return *changesPollIntervalFlag > 0 || *fullSyncFlag
+}
+
+// pollChanges reads the changes of the drive every interval, forever.
+func (fs *fileSystem) pollChanges(interval time.Duration) {
+	ctx := background(context.Background())
+	token := ""
+	last := time.Now()
+	for ; ; time.Sleep(interval) {
+		if token == "" {
+			t, err := fs.client.Changes.GetStartPageToken().SupportsAllDrives(true).Context(ctx).Do()
+			if err != nil {
+				log.Errorf("can't start polling changes: %v", err)
+				continue
+			}
+			token = t.StartPageToken
+			continue
+		}
+
+		now := time.Now()
+		next, err := fs.readChanges(ctx, token, last)
+		if err != nil {
+			log.Errorf("can't poll changes: %v", err)
+			continue
+		}
+		token, last = next, now
+	}
+}
+
+// readChanges handles the changes since token and returns the token of the
+// next ones. Files created after since are reported as created.
+func (fs *fileSystem) readChanges(ctx context.Context, token string, since time.Time) (string, error) {
+	for {
+		r, err := fs.client.Changes.List(token).Spaces(listSpaces()).IncludeRemoved(true).
+			SupportsAllDrives(true).IncludeItemsFromAllDrives(true).
+			Fields("nextPageToken,newStartPageToken,changes(fileId,removed,file(" + fileFields + "))").
+			Context(ctx).Do()
+		if err != nil {
+			return token, err
+		}
+		for _, c := range r.Changes {
+			fs.handleChange(ctx, c, since)
+		}
+		if r.NextPageToken == "" {
+			return r.NewStartPageToken, nil
+		}
+		token = r.NextPageToken
+	}
+}
+
+// handleChange drops the cache entries a change makes stale and publishes
+// it. A moved file is reported as deleted from its old path, which is looked
+// up in the index before the change is applied to it.
+func (fs *fileSystem) handleChange(ctx context.Context, c *drive.Change, since time.Time) {
+	oldPath, cached := "", false
+	if file := fs.index.file(c.FileId); file != nil {
+		if p, err := fs.pathByID(ctx, file); err == nil {
+			oldPath, cached = p, true
+		}
+	}
+	if !cached {
+		oldPath, cached = fs.lastPath(c.FileId)
+	}
+	fs.index.apply(c)
+
+	if cached {
+		fs.invalidateTree(oldPath)
+	}
+	if c.File != nil {
+		fs.invalidateID(c.FileId, c.File.Parents...)
+	} else {
+		fs.invalidateID(c.FileId)
+	}
+
+	if c.Removed || c.File == nil || c.File.Trashed {
+		if cached {
+			fs.publishChange(changeDelete, oldPath, c.FileId)
+			fs.logActivity(ctx, c, oldPath, since)
+		}
+		return
+	}
+
+	p, err := fs.pathByID(ctx, c.File)
+	if err != nil {
+		if cached {
+			fs.publishChange(changeDelete, oldPath, c.FileId)
+		}
+		return
+	}
+	fs.invalidatePath(p)
+	fs.history.add(c.FileId, p)
+
+	if cached && oldPath != p {
+		fs.publishChange(changeDelete, oldPath, c.FileId)
+	}
+	kind := changeUpdate
+	if created, err := time.Parse(time.RFC3339, c.File.CreatedTime); err == nil && created.After(since) {
+		kind = changeCreate
+	}
+	fs.publishChange(kind, p, c.FileId)
+	fs.logActivity(ctx, c, p, since)
+}
+
+func (fs *fileSystem) publishChange(kind string, p string, id string) {
+	if p == "" || isHiddenPath(p) || isFilteredPath(p) {
+		return
+	}
+	log.Debugf("change: %v %v", kind, p)
+	fs.events.publish(&changeEvent{Type: kind, Path: p, ID: id})
+}
+
+// lastPath returns the path at which file id was seen last.
+func (fs *fileSystem) lastPath(id string) (string, bool) {
+	paths := fs.history.get(id)
+	if len(paths) == 0 {
+		return "", false
+	}
+	return paths[len(paths)-1], true
+}
+
+// formerPaths returns the paths at which file id was seen, and where the
+// index has it.
+func (fs *fileSystem) formerPaths(ctx context.Context, id string) []string {
+	paths := fs.history.get(id)
+	if file := fs.index.file(id); file != nil {
+		if p, err := fs.pathByID(ctx, file); err == nil && !containsString(paths, p) {
+			paths = append(paths, p)
+		}
+	}
+	return paths
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// pathByID returns the path of file in the served tree by walking up its
+// parents, or os.ErrNotExist if it is outside the tree.
+func (fs *fileSystem) pathByID(ctx context.Context, file *drive.File) (string, error) {
+	root, err := fs.getFile(ctx, "", true)
+	if err != nil {
+		return "", err
+	}
+
+	p := ""
+	for depth := 0; depth < 64; depth++ {
+		for _, name := range mountNames() {
+			if id, _ := mountedFolderID("/" + name); id == file.Id {
+				return normalizePath("/" + name + p), nil
+			}
+		}
+		if file.Id == root.file.Id {
+			return p, nil
+		}
+		if len(file.Parents) == 0 {
+			return "", os.ErrNotExist
+		}
+		p = "/" + file.Name + p
+		if parent := fs.index.file(file.Parents[0]); parent != nil {
+			file = parent
+			continue
+		}
+		file, err = fs.client.Files.Get(file.Parents[0]).SupportsAllDrives(true).Fields("id,name,parents").Context(ctx).Do()
+		if err != nil {
+			return "", err
+		}
+	}
+	return "", os.ErrNotExist
+}
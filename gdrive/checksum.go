@@ -0,0 +1,30 @@
+package gdrive
+
+import (
+	"encoding/hex"
+	"flag"
+	"hash"
+	"net/http"
+
+	log "github.com/cihub/seelog"
+)
+
+var (
+	verifyChecksumsFlag = flag.Bool("verify-checksums", true, "Compare MD5 checksums of uploaded and downloaded content with the ones computed by Drive.")
+
+	errChecksumMismatch = &statusError{http.StatusInternalServerError, "checksum mismatch"}
+)
+
+// verifyChecksum compares the MD5 checksum computed by Drive with the one of
+// the transferred content. Files without checksum, such as Google
+// documents, always pass.
+func verifyChecksum(name string, expected string, h hash.Hash) error {
+	if expected == "" {
+		return nil
+	}
+	if actual := hex.EncodeToString(h.Sum(nil)); actual != expected {
+		log.Errorf("Checksum mismatch for %v: Drive has %v, transferred %v", name, expected, actual)
+		return errChecksumMismatch
+	}
+	return nil
+}
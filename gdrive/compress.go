@@ -0,0 +1,165 @@
+package gdrive
+
+import (
+	"compress/gzip"
+	"flag"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+
+	log "github.com/cihub/seelog"
+	"golang.org/x/net/webdav"
+	"google.golang.org/api/drive/v3"
+)
+
+const (
+	// Compressed files are marked by app properties, which also keep the
+	// size of the content.
+	encodingKey    = "contentEncoding"
+	encodedSizeKey = "contentSize"
+	encodingGzip   = "gzip"
+	encodingNone   = "identity"
+)
+
+var compressPatterns patternsValue
+
+func init() {
+	flag.Var(&compressPatterns, "compress", "Store files matching this glob, or regular expression if prefixed with \"re:\", gzipped in Drive. A glob without / matches the file name in any folder. Compressed files can only be read through gdrive-webdav. May be repeated.")
+}
+
+// shouldCompress reports whether the file at p is stored compressed.
+func shouldCompress(p string) bool {
+	for _, pp := range compressPatterns {
+		if pp.match(p) {
+			return true
+		}
+		if pp.re == nil && strings.Count(pp.glob, "/") == 1 && pp.match("/"+path.Base(p)) {
+			return true
+		}
+	}
+	return false
+}
+
+func isCompressed(file *drive.File) bool {
+	return file.AppProperties[encodingKey] == encodingGzip
+}
+
+// contentSize returns the size of the content of file, before compression.
+func contentSize(file *drive.File) int64 {
+	if isCompressed(file) {
+		if size, err := strconv.ParseInt(file.AppProperties[encodedSizeKey], 10, 64); err == nil {
+			return size
+		}
+	}
+	return file.Size
+}
+
+// compress gzips the content written if --compress asks for it and it
+// makes the content smaller. existing is the file being replaced, if any.
+func (f *openWritableFile) compress(existing *drive.File) {
+	wasCompressed := existing != nil && isCompressed(existing)
+	if !shouldCompress(f.name) {
+		if wasCompressed {
+			f.setProperty(encodingKey, encodingNone)
+		}
+		return
+	}
+
+	gz := getBuffer()
+	w, _ := gzip.NewWriterLevel(gz, gzip.BestSpeed)
+	w.Write(f.buffer.Bytes())
+	w.Close()
+	if int64(gz.Len()) >= f.size {
+		log.Debugf("%v doesn't compress, storing it as is", f.name)
+		putBuffer(gz)
+		if wasCompressed {
+			f.setProperty(encodingKey, encodingNone)
+		}
+		return
+	}
+
+	log.Debugf("Compressed %v from %v to %v", f.name, formatBytes(f.size), formatBytes(int64(gz.Len())))
+	f.setProperty(encodingKey, encodingGzip)
+	f.setProperty(encodedSizeKey, strconv.FormatInt(f.size, 10))
+	putBuffer(f.buffer)
+	f.buffer = gz
+	f.size = int64(gz.Len())
+}
+
+func (f *openWritableFile) setProperty(key string, value string) {
+	if f.appProperties == nil {
+		f.appProperties = make(map[string]string)
+	}
+	f.appProperties[key] = value
+}
+
+// gzipFile reads the content of a file stored compressed. Seeking back
+// reads it again from the start.
+type gzipFile struct {
+	*openReadonlyFile
+	zr *gzip.Reader
+	// pos is the position of zr in the content, want the position to read.
+	pos  int64
+	want int64
+}
+
+func (f *gzipFile) Read(p []byte) (int, error) {
+	if f.zr == nil || f.want < f.pos {
+		if err := f.reset(); err != nil {
+			return 0, err
+		}
+	}
+	if f.want > f.pos {
+		n, err := io.CopyN(ioutil.Discard, f.zr, f.want-f.pos)
+		f.pos += n
+		if err != nil {
+			return 0, err
+		}
+	}
+	n, err := f.zr.Read(p)
+	f.pos += int64(n)
+	f.want = f.pos
+	return n, err
+}
+
+func (f *gzipFile) reset() error {
+	if _, err := f.openReadonlyFile.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	zr, err := gzip.NewReader(f.openReadonlyFile)
+	if err != nil {
+		return err
+	}
+	f.zr = zr
+	f.pos = 0
+	return nil
+}
+
+func (f *gzipFile) Seek(offset int64, whence int) (int64, error) {
+	pos := offset
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		pos += f.want
+	case io.SeekEnd:
+		pos += contentSize(f.file)
+	default:
+		return 0, errNotImplemented
+	}
+	if pos < 0 {
+		return 0, os.ErrInvalid
+	}
+	f.want = pos
+	return pos, nil
+}
+
+// compressed wraps f to read the content of a compressed file.
+func compressed(f *openReadonlyFile) webdav.File {
+	if !isCompressed(f.file) {
+		return f
+	}
+	return &gzipFile{openReadonlyFile: f}
+}
@@ -0,0 +1,444 @@
+package gdrive
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base32"
+	"encoding/xml"
+	"errors"
+	"flag"
+	"io"
+	"mime"
+	"os"
+	"path"
+	"strings"
+
+	log "github.com/cihub/seelog"
+	"github.com/rfjakob/eme"
+	"golang.org/x/crypto/nacl/secretbox"
+	"golang.org/x/crypto/scrypt"
+	"golang.org/x/net/context"
+	"golang.org/x/net/webdav"
+)
+
+var (
+	cryptPasswordFlag  = flag.String("crypt-password", "", "Encrypt file names and content stored in Drive with this password, in the format of rclone crypt with standard file name encryption. The plain password is expected, not the one obscured by rclone. Versions, virtual and mounted folders, REPORT and SEARCH are not available with encryption.")
+	cryptPassword2Flag = flag.String("crypt-password2", "", "Salt of --crypt-password, the password2 of rclone crypt. Optional.")
+)
+
+const (
+	cryptMagic      = "RCLONE\x00\x00"
+	cryptNonceSize  = 24
+	cryptHeaderSize = len(cryptMagic) + cryptNonceSize
+	cryptBlockSize  = 64 << 10
+	cryptBoxSize    = cryptBlockSize + secretbox.Overhead
+)
+
+// cryptDefaultSalt is the salt rclone uses without password2.
+var cryptDefaultSalt = []byte{0xA8, 0x0D, 0xF4, 0x3A, 0x8F, 0xBD, 0x03, 0x08, 0xA7, 0xCA, 0xB8, 0x3E, 0x58, 0x1F, 0x86, 0xB1}
+
+var (
+	errBadCryptHeader = errors.New("not an encrypted file")
+	errBadCryptBlock  = errors.New("encrypted block is corrupted")
+	errBadCryptName   = errors.New("not an encrypted name")
+)
+
+// crypter encrypts names and content like rclone crypt.
+type crypter struct {
+	dataKey   [32]byte
+	nameTweak []byte
+	nameBlock cipher.Block
+}
+
+func newCrypter(password string, salt string) (*crypter, error) {
+	saltBytes := cryptDefaultSalt
+	if salt != "" {
+		saltBytes = []byte(salt)
+	}
+	key, err := scrypt.Key([]byte(password), saltBytes, 16384, 8, 1, 32+32+16)
+	if err != nil {
+		return nil, err
+	}
+	c := &crypter{nameTweak: key[64:]}
+	copy(c.dataKey[:], key)
+	if c.nameBlock, err = aes.NewCipher(key[32:64]); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+var nameEncoding = base32.HexEncoding.WithPadding(base32.NoPadding)
+
+func (c *crypter) encryptName(name string) string {
+	if name == "" {
+		return ""
+	}
+	padded := pkcs7Pad([]byte(name), aes.BlockSize)
+	return strings.ToLower(nameEncoding.EncodeToString(eme.Transform(c.nameBlock, c.nameTweak, padded, eme.DirectionEncrypt)))
+}
+
+func (c *crypter) decryptName(name string) (string, error) {
+	data, err := nameEncoding.DecodeString(strings.ToUpper(name))
+	if err != nil || len(data) == 0 || len(data)%aes.BlockSize != 0 {
+		return "", errBadCryptName
+	}
+	plain, err := pkcs7Unpad(eme.Transform(c.nameBlock, c.nameTweak, data, eme.DirectionDecrypt), aes.BlockSize)
+	if err != nil {
+		return "", err
+	}
+	return string(plain), nil
+}
+
+// encryptPath encrypts each component of p.
+func (c *crypter) encryptPath(p string) string {
+	parts := strings.Split(normalizePath(p), "/")
+	for i, part := range parts {
+		parts[i] = c.encryptName(part)
+	}
+	return strings.Join(parts, "/")
+}
+
+func pkcs7Pad(data []byte, size int) []byte {
+	n := size - len(data)%size
+	return append(data, bytes.Repeat([]byte{byte(n)}, n)...)
+}
+
+func pkcs7Unpad(data []byte, size int) ([]byte, error) {
+	if len(data) == 0 || len(data)%size != 0 {
+		return nil, errBadCryptName
+	}
+	n := int(data[len(data)-1])
+	if n == 0 || n > size {
+		return nil, errBadCryptName
+	}
+	for _, b := range data[len(data)-n:] {
+		if int(b) != n {
+			return nil, errBadCryptName
+		}
+	}
+	return data[:len(data)-n], nil
+}
+
+// decryptedSize returns the size of the content of an encrypted file of
+// size bytes.
+func decryptedSize(size int64) int64 {
+	size -= int64(cryptHeaderSize)
+	if size <= 0 {
+		return 0
+	}
+	blocks := (size + cryptBoxSize - 1) / cryptBoxSize
+	if size -= blocks * secretbox.Overhead; size < 0 {
+		return 0
+	}
+	return size
+}
+
+// cryptNonce is the nonce of a block: the one of the file header
+// incremented by the index of the block, little-endian.
+type cryptNonce [cryptNonceSize]byte
+
+func (n *cryptNonce) add(x uint64) {
+	carry := uint16(0)
+	for i := 0; i < len(n); i++ {
+		sum := uint16(n[i]) + uint16(x&0xff) + carry
+		n[i] = byte(sum)
+		carry = sum >> 8
+		x >>= 8
+		if x == 0 && carry == 0 {
+			break
+		}
+	}
+}
+
+// cryptFS encrypts the names and the content of the files of fs.
+type cryptFS struct {
+	fs webdav.FileSystem
+	c  *crypter
+}
+
+// withCrypt wraps fs if --crypt-password is given.
+func withCrypt(fs webdav.FileSystem) webdav.FileSystem {
+	if *cryptPasswordFlag == "" {
+		return fs
+	}
+	c, err := newCrypter(*cryptPasswordFlag, *cryptPassword2Flag)
+	if err != nil {
+		log.Errorf("An error occurred deriving encryption keys: %v\n", err)
+		panic(-3)
+	}
+	// They work on the names stored in Drive, which clients don't see.
+	log.Warn("--crypt-password disables REPORT, SEARCH, batched PROPFIND and restoring revisions")
+	return &cryptFS{fs: fs, c: c}
+}
+
+// driveFS returns the Drive file system fs serves.
+func driveFS(fs webdav.FileSystem) (*fileSystem, bool) {
+	if cfs, ok := fs.(*cryptFS); ok {
+		fs = cfs.fs
+	}
+	gfs, ok := fs.(*fileSystem)
+	return gfs, ok
+}
+
+func (fs *cryptFS) Mkdir(ctx context.Context, name string, perm os.FileMode) error {
+	return fs.fs.Mkdir(ctx, fs.c.encryptPath(name), perm)
+}
+
+func (fs *cryptFS) OpenFile(ctx context.Context, name string, flag int, perm os.FileMode) (webdav.File, error) {
+	f, err := fs.fs.OpenFile(ctx, fs.c.encryptPath(name), flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	cf := &cryptFile{File: f, c: fs.c, name: path.Base(normalizePath(name))}
+	if flag&os.O_CREATE != 0 {
+		if err := cf.writeHeader(); err != nil {
+			f.Close()
+			return nil, err
+		}
+	}
+	return cf, nil
+}
+
+func (fs *cryptFS) RemoveAll(ctx context.Context, name string) error {
+	return fs.fs.RemoveAll(ctx, fs.c.encryptPath(name))
+}
+
+func (fs *cryptFS) Rename(ctx context.Context, oldName, newName string) error {
+	return fs.fs.Rename(ctx, fs.c.encryptPath(oldName), fs.c.encryptPath(newName))
+}
+
+func (fs *cryptFS) Stat(ctx context.Context, name string) (os.FileInfo, error) {
+	fi, err := fs.fs.Stat(ctx, fs.c.encryptPath(name))
+	if err != nil {
+		return nil, err
+	}
+	return newCryptInfo(fi, path.Base(normalizePath(name))), nil
+}
+
+// cryptInfo shows the name and the size of the content of an encrypted
+// file.
+type cryptInfo struct {
+	os.FileInfo
+	name string
+}
+
+func newCryptInfo(fi os.FileInfo, name string) *cryptInfo {
+	if name == "" || name == "." {
+		name = fi.Name()
+	}
+	return &cryptInfo{FileInfo: fi, name: name}
+}
+
+func (fi *cryptInfo) Name() string {
+	return fi.name
+}
+
+func (fi *cryptInfo) Size() int64 {
+	if fi.IsDir() {
+		return fi.FileInfo.Size()
+	}
+	return decryptedSize(fi.FileInfo.Size())
+}
+
+// ContentType tells the type by the extension, the stored content is
+// always binary.
+func (fi *cryptInfo) ContentType(ctx context.Context) (string, error) {
+	if t := mime.TypeByExtension(path.Ext(fi.name)); t != "" {
+		return t, nil
+	}
+	return mimeTypeOctetStream, nil
+}
+
+// cryptFile decrypts what is read from File and encrypts what is written,
+// a block at a time.
+type cryptFile struct {
+	webdav.File
+	c    *crypter
+	name string
+
+	// nonce is the one of the file header, read once.
+	nonce     cryptNonce
+	haveNonce bool
+	// pos is the position in the content, block the decrypted block
+	// containing it.
+	pos      int64
+	block    []byte
+	blockPos int64
+	// rawPos is the position in the encrypted file.
+	rawPos int64
+
+	// pending is the content written and not sealed yet.
+	pending []byte
+}
+
+func (f *cryptFile) writeHeader() error {
+	if _, err := rand.Read(f.nonce[:]); err != nil {
+		return err
+	}
+	f.haveNonce = true
+	_, err := f.File.Write(append([]byte(cryptMagic), f.nonce[:]...))
+	return err
+}
+
+func (f *cryptFile) Write(p []byte) (int, error) {
+	f.pending = append(f.pending, p...)
+	for len(f.pending) >= cryptBlockSize {
+		if err := f.seal(f.pending[:cryptBlockSize]); err != nil {
+			return 0, err
+		}
+		f.pending = f.pending[cryptBlockSize:]
+	}
+	return len(p), nil
+}
+
+func (f *cryptFile) seal(block []byte) error {
+	box := secretbox.Seal(nil, block, (*[cryptNonceSize]byte)(&f.nonce), &f.c.dataKey)
+	f.nonce.add(1)
+	_, err := f.File.Write(box)
+	return err
+}
+
+func (f *cryptFile) Close() error {
+	if len(f.pending) > 0 {
+		if err := f.seal(f.pending); err != nil {
+			f.File.Close()
+			return err
+		}
+		f.pending = nil
+	}
+	return f.File.Close()
+}
+
+func (f *cryptFile) readHeader() error {
+	if _, err := f.File.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	header := make([]byte, cryptHeaderSize)
+	if _, err := io.ReadFull(f.File, header); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			err = errBadCryptHeader
+		}
+		return err
+	}
+	if string(header[:len(cryptMagic)]) != cryptMagic {
+		return errBadCryptHeader
+	}
+	copy(f.nonce[:], header[len(cryptMagic):])
+	f.haveNonce = true
+	f.rawPos = int64(cryptHeaderSize)
+	return nil
+}
+
+// readBlock decrypts the block containing f.pos.
+func (f *cryptFile) readBlock() error {
+	if !f.haveNonce {
+		if err := f.readHeader(); err != nil {
+			return err
+		}
+	}
+	index := f.pos / cryptBlockSize
+	raw := int64(cryptHeaderSize) + index*cryptBoxSize
+	if f.rawPos != raw {
+		if _, err := f.File.Seek(raw, io.SeekStart); err != nil {
+			return err
+		}
+		f.rawPos = raw
+	}
+
+	box := make([]byte, cryptBoxSize)
+	n, err := io.ReadFull(f.File, box)
+	f.rawPos += int64(n)
+	if err == io.EOF {
+		f.block, f.blockPos = nil, index*cryptBlockSize
+		return io.EOF
+	}
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return err
+	}
+
+	nonce := f.nonce
+	nonce.add(uint64(index))
+	block, ok := secretbox.Open(nil, box[:n], (*[cryptNonceSize]byte)(&nonce), &f.c.dataKey)
+	if !ok {
+		return errBadCryptBlock
+	}
+	f.block, f.blockPos = block, index*cryptBlockSize
+	return nil
+}
+
+func (f *cryptFile) Read(p []byte) (int, error) {
+	if f.block == nil || f.pos < f.blockPos || f.pos >= f.blockPos+int64(len(f.block)) {
+		if err := f.readBlock(); err != nil {
+			return 0, err
+		}
+		if f.pos >= f.blockPos+int64(len(f.block)) {
+			return 0, io.EOF
+		}
+	}
+	n := copy(p, f.block[f.pos-f.blockPos:])
+	f.pos += int64(n)
+	return n, nil
+}
+
+func (f *cryptFile) Seek(offset int64, whence int) (int64, error) {
+	pos := offset
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		pos += f.pos
+	case io.SeekEnd:
+		fi, err := f.File.Stat()
+		if err != nil {
+			return 0, err
+		}
+		pos += decryptedSize(fi.Size())
+	default:
+		return 0, errNotImplemented
+	}
+	if pos < 0 {
+		return 0, os.ErrInvalid
+	}
+	f.pos = pos
+	return pos, nil
+}
+
+func (f *cryptFile) Readdir(count int) ([]os.FileInfo, error) {
+	infos, err := f.File.Readdir(count)
+	if err != nil {
+		return nil, err
+	}
+	result := make([]os.FileInfo, 0, len(infos))
+	for _, fi := range infos {
+		name, err := f.c.decryptName(fi.Name())
+		if err != nil {
+			log.Debugf("skipping %v in %v: %v", fi.Name(), f.name, err)
+			continue
+		}
+		result = append(result, newCryptInfo(fi, name))
+	}
+	return result, nil
+}
+
+func (f *cryptFile) Stat() (os.FileInfo, error) {
+	fi, err := f.File.Stat()
+	if err != nil {
+		return nil, err
+	}
+	return newCryptInfo(fi, f.name), nil
+}
+
+func (f *cryptFile) DeadProps() (map[xml.Name]webdav.Property, error) {
+	if h, ok := f.File.(webdav.DeadPropsHolder); ok {
+		return h.DeadProps()
+	}
+	return nil, nil
+}
+
+func (f *cryptFile) Patch(patches []webdav.Proppatch) ([]webdav.Propstat, error) {
+	if h, ok := f.File.(webdav.DeadPropsHolder); ok {
+		return h.Patch(patches)
+	}
+	return nil, errNotSupported
+}
@@ -0,0 +1,34 @@
+package gdrive
+
+import (
+	"encoding/xml"
+	"time"
+
+	"golang.org/x/net/webdav"
+	"google.golang.org/api/drive/v3"
+)
+
+// driveTimeFormat is RFC 3339 with the milliseconds Drive keeps.
+const driveTimeFormat = "2006-01-02T15:04:05.000Z07:00"
+
+var (
+	creationDateProp = xml.Name{Space: "DAV:", Local: "creationdate"}
+	// modifiedTimeProp keeps the milliseconds of the modification time,
+	// which getlastmodified, in the format of RFC 1123, can't show.
+	modifiedTimeProp = xml.Name{Space: nsDrive, Local: "modifiedTime"}
+)
+
+// addDateProps adds the creation and the modification time of file as
+// properties.
+func addDateProps(props map[xml.Name]webdav.Property, file *drive.File) {
+	if t, err := time.Parse(time.RFC3339, file.CreatedTime); err == nil {
+		format := driveTimeFormat
+		if *windowsCompatFlag {
+			format = windowsCreationDateFormat
+		}
+		props[creationDateProp] = webdav.Property{XMLName: creationDateProp, InnerXML: []byte(t.UTC().Format(format))}
+	}
+	if t, err := getModTime(file); err == nil && !t.IsZero() {
+		props[modifiedTimeProp] = webdav.Property{XMLName: modifiedTimeProp, InnerXML: []byte(t.UTC().Format(driveTimeFormat))}
+	}
+}
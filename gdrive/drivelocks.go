@@ -0,0 +1,218 @@
+package gdrive
+
+import (
+	"flag"
+	"sync"
+	"time"
+
+	log "github.com/cihub/seelog"
+	"golang.org/x/net/context"
+	"golang.org/x/net/webdav"
+	"google.golang.org/api/drive/v3"
+)
+
+const (
+	// driveLockReason marks content restrictions set for WebDAV locks.
+	driveLockReason = "Locked by a WebDAV client"
+
+	// driveLockExpiryInterval is how often restrictions of expired locks
+	// are lifted.
+	driveLockExpiryInterval = time.Minute
+)
+
+var (
+	driveLocksFlag = flag.Bool("drive-locks", false, "Make files locked by WebDAV clients read-only in Drive, and refuse to lock files made read-only in Drive.")
+)
+
+// driveLS reflects WebDAV locks on files into Drive content restrictions,
+// so that a locked file can't be edited in Drive. Locks themselves are
+// managed by the wrapped lock system.
+type driveLS struct {
+	webdav.LockSystem
+	fs *fileSystem
+
+	mu    sync.Mutex
+	locks map[string]*driveLock
+}
+
+// lockRooter is implemented by lock systems which can tell the root of a
+// lock from its token, even after a restart or for a lock made by another
+// instance.
+type lockRooter interface {
+	lockRoot(token string) (string, bool)
+}
+
+type driveLock struct {
+	root   string
+	fileID string
+	expiry time.Time
+}
+
+func newDriveLS(ls webdav.LockSystem, fs *fileSystem) *driveLS {
+	l := &driveLS{
+		LockSystem: ls,
+		fs:         fs,
+		locks:      make(map[string]*driveLock),
+	}
+	go func() {
+		for now := range time.Tick(driveLockExpiryInterval) {
+			l.expire(now)
+		}
+	}()
+	return l
+}
+
+// contentRestriction reports whether file is read-only in Drive and
+// whether the restriction was set for a WebDAV lock.
+func contentRestriction(file *drive.File) (bool, bool) {
+	for _, r := range file.ContentRestrictions {
+		if r.ReadOnly {
+			return true, r.Reason == driveLockReason
+		}
+	}
+	return false, false
+}
+
+// setReadOnly sets or lifts the content restriction of a locked file.
+func (fs *fileSystem) setReadOnly(ctx context.Context, name string, fileID string, readOnly bool) error {
+	if skip, _ := dryRun("set %v read-only: %v", name, readOnly); skip {
+		// Locks are still kept in memory.
+		return nil
+	}
+	r := &drive.ContentRestriction{ReadOnly: readOnly, ForceSendFields: []string{"ReadOnly"}}
+	if readOnly {
+		r.Reason = driveLockReason
+	}
+	_, err := fs.client.Files.Update(fileID, &drive.File{ContentRestrictions: []*drive.ContentRestriction{r}}).SupportsAllDrives(true).Context(ctx).Do()
+	fs.invalidatePath(name)
+	return err
+}
+
+// expire lifts restrictions of locks which have expired.
+func (l *driveLS) expire(now time.Time) {
+	l.mu.Lock()
+	expired := []*driveLock{}
+	for token, lock := range l.locks {
+		if !lock.expiry.IsZero() && now.After(lock.expiry) {
+			expired = append(expired, lock)
+			delete(l.locks, token)
+		}
+	}
+	l.mu.Unlock()
+
+	for _, lock := range expired {
+		l.release(lock)
+	}
+}
+
+func (l *driveLS) release(lock *driveLock) {
+	if err := l.fs.setReadOnly(context.Background(), lock.root, lock.fileID, false); err != nil {
+		log.Errorf("can't unlock %v in Drive: %v", lock.root, err)
+	}
+}
+
+// releaseRoot lifts the restriction of the file at root if it was set for a
+// WebDAV lock.
+func (l *driveLS) releaseRoot(root string) {
+	fp, err := l.fs.getFile(context.Background(), root, false)
+	if err != nil {
+		log.Debugf("can't find unlocked %v: %v", root, err)
+		return
+	}
+	if _, ours := contentRestriction(fp.file); ours {
+		l.release(&driveLock{root: fp.path, fileID: fp.file.Id})
+	}
+}
+
+func lockExpiry(now time.Time, duration time.Duration) time.Time {
+	if duration < 0 {
+		return time.Time{}
+	}
+	return now.Add(duration)
+}
+
+func (l *driveLS) Confirm(now time.Time, name0, name1 string, conditions ...webdav.Condition) (func(), error) {
+	l.expire(now)
+	return l.LockSystem.Confirm(now, name0, name1, conditions...)
+}
+
+func (l *driveLS) Create(now time.Time, details webdav.LockDetails) (string, error) {
+	l.expire(now)
+	fp, err := l.fs.getFile(context.Background(), details.Root, false)
+	if err != nil || fp.file.MimeType == mimeTypeFolder {
+		// Nothing to restrict in Drive: the lock is on a folder or on a
+		// name that doesn't exist yet.
+		return l.LockSystem.Create(now, details)
+	}
+
+	// A restriction of our own left behind by a lock that no longer exists
+	// doesn't prevent locking, the wrapped lock system knows if it does.
+	if restricted, ours := contentRestriction(fp.file); restricted && !ours {
+		log.Debugf("%v is read-only in Drive", details.Root)
+		return "", webdav.ErrLocked
+	}
+
+	token, err := l.LockSystem.Create(now, details)
+	if err != nil {
+		return "", err
+	}
+
+	if err := l.fs.setReadOnly(context.Background(), fp.path, fp.file.Id, true); err != nil {
+		log.Errorf("can't lock %v in Drive: %v", details.Root, err)
+		l.LockSystem.Unlock(now, token)
+		return "", err
+	}
+
+	l.mu.Lock()
+	l.locks[token] = &driveLock{
+		root:   fp.path,
+		fileID: fp.file.Id,
+		expiry: lockExpiry(now, details.Duration),
+	}
+	l.mu.Unlock()
+	return token, nil
+}
+
+func (l *driveLS) createTemporary(now time.Time, details webdav.LockDetails) (string, error) {
+	l.expire(now)
+	return createTemporaryLock(l.LockSystem, now, details)
+}
+
+func (l *driveLS) Refresh(now time.Time, token string, duration time.Duration) (webdav.LockDetails, error) {
+	details, err := l.LockSystem.Refresh(now, token, duration)
+	if err == nil {
+		l.mu.Lock()
+		if lock, ok := l.locks[token]; ok {
+			lock.expiry = lockExpiry(now, duration)
+		}
+		l.mu.Unlock()
+	}
+	return details, err
+}
+
+// Unlock lifts the restriction of the file locked, found by the wrapped
+// lock system if it can, as locks made before a restart or by another
+// instance aren't known here.
+func (l *driveLS) Unlock(now time.Time, token string) error {
+	root := ""
+	if lr, ok := l.LockSystem.(lockRooter); ok {
+		root, _ = lr.lockRoot(token)
+	}
+	err := l.LockSystem.Unlock(now, token)
+	if err != nil && err != webdav.ErrNoSuchLock {
+		return err
+	}
+
+	l.mu.Lock()
+	lock, ok := l.locks[token]
+	delete(l.locks, token)
+	l.mu.Unlock()
+
+	switch {
+	case ok:
+		l.release(lock)
+	case root != "":
+		l.releaseRoot(root)
+	}
+	return err
+}
@@ -0,0 +1,50 @@
+package gdrive
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/context"
+	"golang.org/x/net/webdav"
+)
+
+const testLockInfo = `<?xml version="1.0" encoding="utf-8"?>
+<D:lockinfo xmlns:D="DAV:">
+  <D:lockscope><D:exclusive/></D:lockscope>
+  <D:locktype><D:write/></D:locktype>
+  <D:owner>test</D:owner>
+</D:lockinfo>`
+
+func TestDriveLocksMoveByHolder(t *testing.T) {
+	fs := newFakeFS(newFakeDrive())
+	writeTestFile(t, fs, "/file.txt", "content")
+	h := NewHandler(fs, newDriveLS(webdav.NewMemLS(), fs))
+
+	r := httptest.NewRequest("LOCK", "/file.txt", strings.NewReader(testLockInfo))
+	r.Header.Set("Timeout", "Second-600")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	token := w.Header().Get("Lock-Token")
+	if w.Code != http.StatusOK || token == "" {
+		t.Fatalf("LOCK answered %v with token %q", w.Code, token)
+	}
+
+	r = httptest.NewRequest("MOVE", "/file.txt", nil)
+	r.Header.Set("Destination", "http://example.com/moved.txt")
+	r.Header.Set("If", "("+token+")")
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("MOVE by the lock holder answered %v, want %v", w.Code, http.StatusCreated)
+	}
+
+	fp, err := fs.getFile(context.Background(), "/moved.txt", false)
+	if err != nil {
+		t.Fatalf("can't find moved file: %v", err)
+	}
+	if restricted, ours := contentRestriction(fp.file); !restricted || !ours {
+		t.Errorf("moved file restricted: %v, by a lock: %v, want it read-only again", restricted, ours)
+	}
+}
@@ -0,0 +1,115 @@
+package gdrive
+
+import (
+	"bytes"
+	"encoding/xml"
+	"flag"
+	"strconv"
+	"strings"
+
+	"golang.org/x/net/webdav"
+	"google.golang.org/api/drive/v3"
+)
+
+const (
+	// nsDrive is the namespace of the properties showing Drive metadata.
+	nsDrive = "https://drive.google.com/ns/"
+
+	// driveFields lists the file fields shown as properties.
+	driveFields = "webViewLink,iconLink,description,starred,owners(displayName,emailAddress),lastModifyingUser(displayName,emailAddress)"
+)
+
+var (
+	resourceIDFlag = flag.Bool("resource-id", false, "Also show the Drive file ID as the DAV:resource-id property of RFC 5842, as a https://drive.google.com/open?id= URL.")
+)
+
+// resourceIDProp identifies a file for as long as it exists, whatever its
+// path.
+var resourceIDProp = xml.Name{Space: "DAV:", Local: "resource-id"}
+
+// Unlike the other Drive metadata, the description and whether the file is
+// starred can be changed by PROPPATCH.
+var (
+	descriptionProp = xml.Name{Space: nsDrive, Local: "description"}
+	starredProp     = xml.Name{Space: nsDrive, Local: "starred"}
+)
+
+// isDriveProp reports whether name is a property showing Drive metadata,
+// which can't be changed by PROPPATCH except for descriptionProp and
+// starredProp.
+func isDriveProp(name xml.Name) bool {
+	return name.Space == nsDrive || name == resourceIDProp || name == creationDateProp
+}
+
+// addDriveProps adds the Drive metadata of file as properties.
+func addDriveProps(props map[xml.Name]webdav.Property, file *drive.File) {
+	owners := []string{}
+	for _, u := range file.Owners {
+		owners = append(owners, formatUser(u))
+	}
+	values := map[string]string{
+		"id":                file.Id,
+		"webViewLink":       file.WebViewLink,
+		"iconLink":          file.IconLink,
+		"description":       file.Description,
+		"owners":            strings.Join(owners, ", "),
+		"lastModifyingUser": formatUser(file.LastModifyingUser),
+		"starred":           strconv.FormatBool(file.Starred),
+	}
+	for local, value := range values {
+		if value == "" {
+			continue
+		}
+		var buf bytes.Buffer
+		xml.EscapeText(&buf, []byte(value))
+		name := xml.Name{Space: nsDrive, Local: local}
+		props[name] = webdav.Property{XMLName: name, InnerXML: buf.Bytes()}
+	}
+	if *resourceIDFlag && file.Id != "" {
+		var buf bytes.Buffer
+		buf.WriteString(`<D:href xmlns:D="DAV:">`)
+		xml.EscapeText(&buf, []byte("https://drive.google.com/open?id="+file.Id))
+		buf.WriteString("</D:href>")
+		props[resourceIDProp] = webdav.Property{XMLName: resourceIDProp, InnerXML: buf.Bytes()}
+	}
+	addDateProps(props, file)
+}
+
+// formatUser formats u as "Name <email>".
+func formatUser(u *drive.User) string {
+	switch {
+	case u == nil:
+		return ""
+	case u.EmailAddress == "":
+		return u.DisplayName
+	case u.DisplayName == "":
+		return u.EmailAddress
+	}
+	return u.DisplayName + " <" + u.EmailAddress + ">"
+}
+
+// withoutDriveMetadata drops the read-only Drive metadata from patches.
+func withoutDriveMetadata(patches []webdav.Proppatch) []webdav.Proppatch {
+	result := []webdav.Proppatch{}
+	for _, patch := range patches {
+		props := []webdav.Property{}
+		for _, p := range patch.Props {
+			if !isDriveProp(p.XMLName) || p.XMLName == descriptionProp {
+				props = append(props, p)
+			}
+		}
+		result = append(result, webdav.Proppatch{Remove: patch.Remove, Props: props})
+	}
+	return result
+}
+
+// propText returns the text of the value of a property.
+func propText(innerXML []byte) string {
+	var v struct {
+		Text string `xml:",chardata"`
+	}
+	if err := xml.Unmarshal(append(append([]byte("<v>"), innerXML...), "</v>"...), &v); err != nil {
+		return string(innerXML)
+	}
+	return v.Text
+}
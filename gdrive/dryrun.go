@@ -0,0 +1,30 @@
+package gdrive
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	log "github.com/cihub/seelog"
+)
+
+var (
+	dryRunFlag       = flag.Bool("dry-run", false, "Don't change anything in Drive. Writes, renames, deletes and property changes are validated and logged, then acknowledged as if they succeeded, for trying out new clients safely.")
+	dryRunRejectFlag = flag.Bool("dry-run-reject", false, "Refuse changes with 403 Forbidden in --dry-run mode instead of acknowledging them.")
+)
+
+// dryRun reports whether the change described by format and args must be
+// skipped because of --dry-run, logging it. The error is what the change
+// fails with, nil if it's acknowledged.
+func dryRun(format string, args ...interface{}) (bool, error) {
+	if !*dryRunFlag {
+		return false, nil
+	}
+	change := fmt.Sprintf(format, args...)
+	if *dryRunRejectFlag {
+		log.Infof("Dry run: refused to %v", change)
+		return true, os.ErrPermission
+	}
+	log.Infof("Dry run: would %v", change)
+	return true, nil
+}
@@ -0,0 +1,84 @@
+package gdrive
+
+import (
+	"flag"
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+
+	"google.golang.org/api/drive/v3"
+)
+
+const (
+	duplicatesNewest = "newest"
+	duplicatesSuffix = "suffix"
+)
+
+var (
+	duplicatesFlag = flag.String("duplicates", duplicatesNewest, "How to expose files sharing a name in one folder: \"newest\" shows only the most recently modified one, \"suffix\" also shows the others as \"name (id).ext\".")
+
+	duplicateNameRegexp = regexp.MustCompile(`^(.*) \(([A-Za-z0-9_-]+)\)(\.[^.() ]*)?$`)
+)
+
+// resolveDuplicates applies the duplicate names policy to the children of
+// a folder. The newest file of every name keeps it, the others are either
+// dropped or renamed depending on --duplicates.
+func resolveDuplicates(files []*drive.File) []*drive.File {
+	byName := make(map[string][]*drive.File)
+	for _, file := range files {
+		byName[file.Name] = append(byName[file.Name], file)
+	}
+
+	result := make([]*drive.File, 0, len(files))
+	for _, file := range files {
+		group := byName[file.Name]
+		if len(group) == 1 || newestFile(group) == file {
+			result = append(result, file)
+			continue
+		}
+		if *duplicatesFlag == duplicatesSuffix {
+			dup := *file
+			dup.Name = duplicateName(file)
+			result = append(result, &dup)
+		}
+	}
+	return result
+}
+
+// newestFile returns the most recently modified file. Ties are broken by
+// file ID so that the choice is stable between requests.
+func newestFile(files []*drive.File) *drive.File {
+	var newest *drive.File
+	for _, file := range files {
+		if newest == nil {
+			newest = file
+			continue
+		}
+		if file.ModifiedTime > newest.ModifiedTime ||
+			(file.ModifiedTime == newest.ModifiedTime && file.Id < newest.Id) {
+			newest = file
+		}
+	}
+	return newest
+}
+
+// duplicateName returns the name under which a shadowed duplicate is
+// exposed: the file ID is inserted before the extension.
+func duplicateName(file *drive.File) string {
+	ext := ""
+	if file.MimeType != mimeTypeFolder {
+		ext = path.Ext(file.Name)
+	}
+	return fmt.Sprintf("%s (%s)%s", strings.TrimSuffix(file.Name, ext), file.Id, ext)
+}
+
+// parseDuplicateName splits a name produced by duplicateName into the
+// original name and the file ID.
+func parseDuplicateName(name string) (string, string, bool) {
+	m := duplicateNameRegexp.FindStringSubmatch(name)
+	if m == nil {
+		return "", "", false
+	}
+	return m[1] + m[3], m[2], true
+}
@@ -0,0 +1,137 @@
+package gdrive
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	log "github.com/cihub/seelog"
+	"golang.org/x/net/webdav"
+	"google.golang.org/api/drive/v3"
+	"google.golang.org/api/googleapi"
+)
+
+// statusError is an error that knows which HTTP status a WebDAV client
+// should see for it.
+type statusError struct {
+	status int
+	msg    string
+}
+
+func (e *statusError) Error() string {
+	return e.msg
+}
+
+var (
+	errNotImplemented = &statusError{http.StatusNotImplemented, "not implemented"}
+	errNotSupported   = &statusError{http.StatusMethodNotAllowed, "operation not supported"}
+	errNoParent       = &statusError{http.StatusConflict, "parent collection does not exist"}
+	errLocked         = &statusError{webdav.StatusLocked, "locked"}
+	errUploadTooLarge = &statusError{http.StatusRequestEntityTooLarge, "the upload exceeds the size allowed by --upload-rule"}
+	errUploadsPending = &statusError{http.StatusServiceUnavailable, "spooled uploads are not in Drive yet"}
+	errReadOnlyFolder = &statusError{http.StatusForbidden, "the folder is shared with you read-only, files can't be added to it"}
+	errReadOnlyFile   = &statusError{http.StatusForbidden, "the file is shared with you read-only"}
+)
+
+// removeError lists the files RemoveAll failed to delete.
+type removeError struct {
+	errs []*os.PathError
+}
+
+func (e *removeError) add(p string, err error) {
+	if re, ok := err.(*removeError); ok {
+		e.errs = append(e.errs, re.errs...)
+		return
+	}
+	e.errs = append(e.errs, &os.PathError{Op: "delete", Path: p, Err: err})
+}
+
+func (e *removeError) Error() string {
+	msgs := make([]string, len(e.errs))
+	for i, err := range e.errs {
+		msgs[i] = err.Error()
+	}
+	return fmt.Sprintf("%d files not deleted: %s", len(e.errs), strings.Join(msgs, "; "))
+}
+
+// errorStatus returns the HTTP status that best describes err, or 0 if
+// err has no better status than the one picked by webdav.Handler.
+func errorStatus(err error) int {
+	if err == nil {
+		return 0
+	}
+
+	if se, ok := err.(*statusError); ok {
+		return se.status
+	}
+
+	if re, ok := err.(*removeError); ok {
+		return errorStatus(re.errs[0].Err)
+	}
+
+	if os.IsPermission(err) {
+		return http.StatusForbidden
+	}
+
+	if ge, ok := err.(*googleapi.Error); ok {
+		if hasErrorReason(ge, "storageQuotaExceeded") {
+			return webdav.StatusInsufficientStorage
+		}
+		if hasErrorReason(ge, "rateLimitExceeded") || hasErrorReason(ge, "userRateLimitExceeded") || ge.Code == http.StatusTooManyRequests {
+			// Still refused after --drive-retries.
+			return http.StatusServiceUnavailable
+		}
+		switch ge.Code {
+		case http.StatusForbidden, http.StatusNotFound:
+			return ge.Code
+		}
+	}
+
+	return 0
+}
+
+// hasErrorReason reports whether Drive gave reason as one of the reasons of
+// the error.
+func hasErrorReason(err *googleapi.Error, reason string) bool {
+	for _, item := range err.Errors {
+		if item.Reason == reason {
+			return true
+		}
+	}
+	return false
+}
+
+// checkCanAddChildren refuses to create files in folder p when Drive says
+// we may not, rather than letting Drive fail the request.
+func checkCanAddChildren(p string, folder *drive.File) error {
+	if folder.Capabilities != nil && !folder.Capabilities.CanAddChildren {
+		log.Errorf("can't add files to %v: no permission", p)
+		return errReadOnlyFolder
+	}
+	return nil
+}
+
+// checkCanEdit refuses to change the content of file p when Drive says we
+// may not.
+func checkCanEdit(p string, file *drive.File) error {
+	if file.Capabilities != nil && !file.Capabilities.CanEdit {
+		log.Errorf("can't change %v: no permission", p)
+		return errReadOnlyFile
+	}
+	return nil
+}
+
+// errorMessage explains a permission error to the client, or returns "".
+func errorMessage(err error) string {
+	if se, ok := err.(*statusError); ok && se.status == http.StatusForbidden {
+		return se.msg
+	}
+	if re, ok := err.(*removeError); ok {
+		return errorMessage(re.errs[0].Err)
+	}
+	if ge, ok := err.(*googleapi.Error); ok && hasErrorReason(ge, "insufficientFilePermissions") {
+		return "Drive denied permission: " + ge.Message
+	}
+	return ""
+}
@@ -0,0 +1,62 @@
+package gdrive
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"golang.org/x/net/webdav"
+)
+
+type eventsHandler struct {
+	fs *fileSystem
+}
+
+// NewEventsHandler creates the handler streaming changes of fs found by
+// --changes-poll-interval or --full-sync as server-sent events. It returns
+// nil if changes aren't polled. With --admin-token, the stream requires the
+// token.
+func NewEventsHandler(fs webdav.FileSystem) http.Handler {
+	gfs, ok := fs.(*fileSystem)
+	if !changesPolled() || !ok {
+		return nil
+	}
+	return &eventsHandler{fs: gfs}
+}
+
+func (h *eventsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if *adminTokenFlag != "" && !checkAdminToken(w, r) {
+		return
+	}
+	if r.Method != "GET" {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	ch := h.fs.events.subscribe()
+	defer h.fs.events.unsubscribe(ch)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case ev := <-ch:
+			data, err := json.Marshal(ev)
+			if err != nil {
+				continue
+			}
+			fmt.Fprintf(w, "event: %s\ndata: %s\n\n", ev.Type, data)
+			flusher.Flush()
+		}
+	}
+}
@@ -0,0 +1,761 @@
+package gdrive
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/cihub/seelog"
+	"google.golang.org/api/drive/v3"
+)
+
+// fakeDrive is an in-memory implementation of the subset of Drive v3 REST
+// API used by this package. It lets WebDAV clients and test suites such as
+// litmus exercise the file system without a Google account.
+type fakeDrive struct {
+	mu      sync.Mutex
+	files   map[string]*fakeFile
+	uploads map[string]*fakeUpload
+	lastID  int
+	changes []*fakeChange
+	local   *localMirror
+}
+
+// fakeChange records that a file was modified, or removed.
+type fakeChange struct {
+	fileID  string
+	removed bool
+	time    string
+}
+
+type fakeFile struct {
+	meta      drive.File
+	content   []byte
+	revisions []*fakeRevision
+}
+
+type fakeRevision struct {
+	meta    drive.Revision
+	content []byte
+}
+
+type fakeUpload struct {
+	fileID string
+	meta   map[string]json.RawMessage
+	data   bytes.Buffer
+}
+
+const (
+	fakeRootID    = "root"
+	fakeAppDataID = "appDataFolder"
+)
+
+func newFakeDrive() *fakeDrive {
+	d := &fakeDrive{
+		files:   make(map[string]*fakeFile),
+		uploads: make(map[string]*fakeUpload),
+	}
+	now := fakeNow()
+	d.files[fakeRootID] = &fakeFile{meta: drive.File{
+		Id:           fakeRootID,
+		Name:         "My Drive",
+		MimeType:     mimeTypeFolder,
+		CreatedTime:  now,
+		ModifiedTime: now,
+		Capabilities: fakeCapabilities(),
+	}}
+	d.files[fakeAppDataID] = &fakeFile{meta: drive.File{
+		Id:           fakeAppDataID,
+		Name:         "Application Data",
+		MimeType:     mimeTypeFolder,
+		CreatedTime:  now,
+		ModifiedTime: now,
+		Capabilities: fakeCapabilities(),
+	}}
+	return d
+}
+
+// startFakeDrive serves d on a loopback port and returns its base URL.
+func startFakeDrive(d *fakeDrive) (string, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return "", err
+	}
+	go http.Serve(l, d)
+	return "http://" + l.Addr().String(), nil
+}
+
+func fakeNow() string {
+	return time.Now().UTC().Format("2006-01-02T15:04:05.000Z")
+}
+
+func fakeCapabilities() *drive.FileCapabilities {
+	return &drive.FileCapabilities{
+		CanAddChildren:   true,
+		CanDelete:        true,
+		CanDownload:      true,
+		CanEdit:          true,
+		CanModifyContent: true,
+		CanRename:        true,
+		CanTrash:         true,
+	}
+}
+
+func (d *fakeDrive) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	log.Tracef("fake drive: %v %v", r.Method, r.URL)
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	defer d.syncLocal()
+
+	upload := strings.HasPrefix(r.URL.Path, "/upload/drive/v3/")
+	p := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/upload"), "/drive/v3/")
+	parts := strings.Split(p, "/")
+
+	switch {
+	case upload && r.URL.Query().Get("upload_id") != "":
+		d.uploadChunk(w, r)
+	case p == "about" && r.Method == "GET":
+		d.about(w, r)
+	case p == "changes/startPageToken" && r.Method == "GET":
+		fakeJSON(w, &drive.StartPageToken{Kind: "drive#startPageToken", StartPageToken: strconv.Itoa(len(d.changes))})
+	case p == "changes" && r.Method == "GET":
+		d.listChanges(w, r)
+	case p == "files" && r.Method == "GET":
+		d.list(w, r)
+	case p == "files" && r.Method == "POST":
+		d.create(w, r, upload)
+	case len(parts) == 2 && parts[0] == "files" && r.Method == "GET":
+		d.get(w, r, parts[1])
+	case len(parts) == 2 && parts[0] == "files" && r.Method == "PATCH":
+		d.update(w, r, parts[1], upload)
+	case len(parts) == 2 && parts[0] == "files" && r.Method == "DELETE":
+		d.delete(w, r, parts[1])
+	case len(parts) == 3 && parts[0] == "files" && parts[2] == "copy" && r.Method == "POST":
+		d.copy(w, r, parts[1])
+	case len(parts) == 3 && parts[0] == "files" && parts[2] == "revisions" && r.Method == "GET":
+		d.listRevisions(w, r, parts[1])
+	case len(parts) == 4 && parts[0] == "files" && parts[2] == "revisions" && r.Method == "GET":
+		d.getRevision(w, r, parts[1], parts[3])
+	default:
+		fakeError(w, http.StatusNotFound, "notFound", "unknown method "+r.Method+" "+r.URL.Path)
+	}
+}
+
+func fakeError(w http.ResponseWriter, code int, reason string, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"error": map[string]interface{}{
+			"code":    code,
+			"message": message,
+			"errors": []map[string]string{
+				{"reason": reason, "message": message},
+			},
+		},
+	})
+}
+
+func fakeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+func (d *fakeDrive) lookup(id string) *fakeFile {
+	return d.files[id]
+}
+
+func (d *fakeDrive) newID() string {
+	d.lastID++
+	return fmt.Sprintf("fake%08d", d.lastID)
+}
+
+func (d *fakeDrive) about(w http.ResponseWriter, r *http.Request) {
+	var usage int64
+	for _, f := range d.files {
+		usage += int64(len(f.content))
+	}
+	fakeJSON(w, &drive.About{
+		Kind: "drive#about",
+		User: &drive.User{
+			DisplayName:  "Fake User",
+			EmailAddress: "fake@example.com",
+			Me:           true,
+		},
+		StorageQuota: &drive.AboutStorageQuota{
+			Usage:        usage,
+			UsageInDrive: usage,
+		},
+	})
+}
+
+func (d *fakeDrive) get(w http.ResponseWriter, r *http.Request, id string) {
+	f := d.lookup(id)
+	if f == nil {
+		fakeError(w, http.StatusNotFound, "notFound", "File not found: "+id)
+		return
+	}
+
+	if r.URL.Query().Get("alt") != "media" {
+		fakeJSON(w, &f.meta)
+		return
+	}
+
+	if f.meta.MimeType == mimeTypeFolder {
+		fakeError(w, http.StatusForbidden, "fileNotDownloadable", "Only files with binary content can be downloaded")
+		return
+	}
+	f.meta.ViewedByMeTime = fakeNow()
+	w.Header().Set("Content-Type", f.meta.MimeType)
+	http.ServeContent(w, r, f.meta.Name, time.Time{}, bytes.NewReader(f.content))
+}
+
+func (d *fakeDrive) list(w http.ResponseWriter, r *http.Request) {
+	q, err := parseFakeQuery(r.URL.Query().Get("q"))
+	if err != nil {
+		fakeError(w, http.StatusBadRequest, "invalid", "Invalid Value: "+err.Error())
+		return
+	}
+
+	ids := make([]string, 0, len(d.files))
+	for id := range d.files {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	if orderBy := r.URL.Query().Get("orderBy"); orderBy != "" {
+		sortFakeFiles(ids, d.files, orderBy)
+	}
+
+	pageSize := 100
+	if s, err := strconv.Atoi(r.URL.Query().Get("pageSize")); err == nil && s > 0 {
+		pageSize = s
+	}
+	offset, _ := strconv.Atoi(r.URL.Query().Get("pageToken"))
+
+	list := &drive.FileList{Kind: "drive#fileList", Files: []*drive.File{}}
+	matched := 0
+	for _, id := range ids {
+		f := d.files[id]
+		if id == fakeRootID || id == fakeAppDataID || !q.match(f) {
+			continue
+		}
+		matched++
+		if matched <= offset {
+			continue
+		}
+		if len(list.Files) == pageSize {
+			list.NextPageToken = strconv.Itoa(offset + pageSize)
+			break
+		}
+		list.Files = append(list.Files, &f.meta)
+	}
+	fakeJSON(w, list)
+}
+
+// sortFakeFiles sorts file IDs as requested by orderBy, a comma separated
+// list of fields optionally followed by "desc".
+func sortFakeFiles(ids []string, files map[string]*fakeFile, orderBy string) {
+	keys := strings.Split(orderBy, ",")
+	sort.SliceStable(ids, func(i, j int) bool {
+		a, b := &files[ids[i]].meta, &files[ids[j]].meta
+		for _, key := range keys {
+			fields := strings.Fields(key)
+			if len(fields) == 0 {
+				continue
+			}
+			var x, y string
+			switch fields[0] {
+			case "name":
+				x, y = a.Name, b.Name
+			case "modifiedTime":
+				x, y = a.ModifiedTime, b.ModifiedTime
+			case "createdTime":
+				x, y = a.CreatedTime, b.CreatedTime
+			case "viewedByMeTime":
+				x, y = a.ViewedByMeTime, b.ViewedByMeTime
+			}
+			if x == y {
+				continue
+			}
+			if len(fields) > 1 && fields[1] == "desc" {
+				return x > y
+			}
+			return x < y
+		}
+		return false
+	})
+}
+
+// readMetadata reads file metadata from a JSON request body, keeping track
+// of the fields present so that PATCH only touches them.
+func readMetadata(r io.Reader) (map[string]json.RawMessage, error) {
+	meta := make(map[string]json.RawMessage)
+	data, err := ioutil.ReadAll(r)
+	if err != nil || len(bytes.TrimSpace(data)) == 0 {
+		return meta, err
+	}
+	return meta, json.Unmarshal(data, &meta)
+}
+
+// readUpload splits a simple or multipart upload into metadata and content.
+func readUpload(r *http.Request) (map[string]json.RawMessage, []byte, error) {
+	mediaType, params, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil || !strings.HasPrefix(mediaType, "multipart/") {
+		content, err := ioutil.ReadAll(r.Body)
+		return map[string]json.RawMessage{}, content, err
+	}
+
+	mr := multipart.NewReader(r.Body, params["boundary"])
+	part, err := mr.NextPart()
+	if err != nil {
+		return nil, nil, err
+	}
+	meta, err := readMetadata(part)
+	if err != nil {
+		return nil, nil, err
+	}
+	part, err = mr.NextPart()
+	if err != nil {
+		return nil, nil, err
+	}
+	content, err := ioutil.ReadAll(part)
+	return meta, content, err
+}
+
+func (d *fakeDrive) create(w http.ResponseWriter, r *http.Request, upload bool) {
+	uploadType := r.URL.Query().Get("uploadType")
+	if upload && uploadType == "resumable" {
+		d.startUpload(w, r, "")
+		return
+	}
+
+	var meta map[string]json.RawMessage
+	var content []byte
+	var err error
+	if upload {
+		meta, content, err = readUpload(r)
+	} else {
+		meta, err = readMetadata(r.Body)
+	}
+	if err != nil {
+		fakeError(w, http.StatusBadRequest, "badRequest", err.Error())
+		return
+	}
+
+	f, status, err := d.createFile(meta, content)
+	if err != nil {
+		fakeError(w, status, "badRequest", err.Error())
+		return
+	}
+	fakeJSON(w, &f.meta)
+}
+
+func (d *fakeDrive) createFile(meta map[string]json.RawMessage, content []byte) (*fakeFile, int, error) {
+	now := fakeNow()
+	f := &fakeFile{meta: drive.File{
+		Id:           d.newID(),
+		Kind:         "drive#file",
+		MimeType:     mimeTypeOctetStream,
+		CreatedTime:  now,
+		ModifiedTime: now,
+		Capabilities: fakeCapabilities(),
+		Parents:      []string{fakeRootID},
+	}}
+	if err := applyMetadata(&f.meta, meta); err != nil {
+		return nil, http.StatusBadRequest, err
+	}
+	for _, parent := range f.meta.Parents {
+		if d.lookup(parent) == nil {
+			return nil, http.StatusNotFound, fmt.Errorf("File not found: %v", parent)
+		}
+	}
+	f.setContent(content)
+	d.files[f.meta.Id] = f
+	d.recordChange(f.meta.Id, false)
+	return f, http.StatusOK, nil
+}
+
+func (f *fakeFile) setContent(content []byte) {
+	f.content = content
+	if f.meta.MimeType == mimeTypeFolder {
+		return
+	}
+	sum := md5.Sum(content)
+	f.meta.Md5Checksum = hex.EncodeToString(sum[:])
+	f.meta.Size = int64(len(content))
+	f.meta.QuotaBytesUsed = f.meta.Size
+	f.meta.Version++
+	f.meta.HeadRevisionId = strconv.FormatInt(f.meta.Version, 10)
+	f.revisions = append(f.revisions, &fakeRevision{
+		meta: drive.Revision{
+			Kind:         "drive#revision",
+			Id:           f.meta.HeadRevisionId,
+			MimeType:     f.meta.MimeType,
+			ModifiedTime: fakeNow(),
+			Size:         f.meta.Size,
+			Md5Checksum:  f.meta.Md5Checksum,
+		},
+		content: content,
+	})
+}
+
+func (d *fakeDrive) listRevisions(w http.ResponseWriter, r *http.Request, id string) {
+	f := d.lookup(id)
+	if f == nil {
+		fakeError(w, http.StatusNotFound, "notFound", "File not found: "+id)
+		return
+	}
+	list := &drive.RevisionList{Kind: "drive#revisionList", Revisions: []*drive.Revision{}}
+	for _, rev := range f.revisions {
+		list.Revisions = append(list.Revisions, &rev.meta)
+	}
+	fakeJSON(w, list)
+}
+
+func (d *fakeDrive) getRevision(w http.ResponseWriter, r *http.Request, id string, revisionID string) {
+	f := d.lookup(id)
+	if f == nil {
+		fakeError(w, http.StatusNotFound, "notFound", "File not found: "+id)
+		return
+	}
+	for _, rev := range f.revisions {
+		if rev.meta.Id != revisionID {
+			continue
+		}
+		if r.URL.Query().Get("alt") != "media" {
+			fakeJSON(w, &rev.meta)
+			return
+		}
+		w.Header().Set("Content-Type", rev.meta.MimeType)
+		http.ServeContent(w, r, f.meta.Name, time.Time{}, bytes.NewReader(rev.content))
+		return
+	}
+	fakeError(w, http.StatusNotFound, "notFound", "Revision not found: "+revisionID)
+}
+
+// applyMetadata copies writable fields present in meta to file.
+func applyMetadata(file *drive.File, meta map[string]json.RawMessage) error {
+	for key, value := range meta {
+		var err error
+		switch key {
+		case "name":
+			err = json.Unmarshal(value, &file.Name)
+		case "mimeType":
+			err = json.Unmarshal(value, &file.MimeType)
+		case "description":
+			err = json.Unmarshal(value, &file.Description)
+		case "starred":
+			err = json.Unmarshal(value, &file.Starred)
+		case "trashed":
+			err = json.Unmarshal(value, &file.Trashed)
+		case "modifiedTime":
+			err = json.Unmarshal(value, &file.ModifiedTime)
+		case "parents":
+			err = json.Unmarshal(value, &file.Parents)
+		case "contentRestrictions":
+			err = json.Unmarshal(value, &file.ContentRestrictions)
+		case "appProperties":
+			file.AppProperties, err = mergeProperties(file.AppProperties, value)
+		case "properties":
+			file.Properties, err = mergeProperties(file.Properties, value)
+		}
+		if err != nil {
+			return fmt.Errorf("invalid %v: %v", key, err)
+		}
+	}
+	return nil
+}
+
+// mergeProperties merges a JSON properties object into props, null values
+// delete properties.
+func mergeProperties(props map[string]string, value json.RawMessage) (map[string]string, error) {
+	update := make(map[string]*string)
+	if err := json.Unmarshal(value, &update); err != nil {
+		return props, err
+	}
+	if props == nil {
+		props = make(map[string]string)
+	}
+	for k, v := range update {
+		if v == nil {
+			delete(props, k)
+			continue
+		}
+		props[k] = *v
+	}
+	return props, nil
+}
+
+func (d *fakeDrive) update(w http.ResponseWriter, r *http.Request, id string, upload bool) {
+	f := d.lookup(id)
+	if f == nil {
+		fakeError(w, http.StatusNotFound, "notFound", "File not found: "+id)
+		return
+	}
+
+	if upload && r.URL.Query().Get("uploadType") == "resumable" {
+		d.startUpload(w, r, id)
+		return
+	}
+
+	var meta map[string]json.RawMessage
+	var content []byte
+	var err error
+	if upload {
+		meta, content, err = readUpload(r)
+	} else {
+		meta, err = readMetadata(r.Body)
+	}
+	if err != nil {
+		fakeError(w, http.StatusBadRequest, "badRequest", err.Error())
+		return
+	}
+
+	// Read-only files can't be renamed either.
+	_, renamed := meta["name"]
+	if restricted, _ := contentRestriction(&f.meta); restricted && (len(content) > 0 || renamed) {
+		fakeError(w, http.StatusForbidden, "fileNotModifiable", "The file is read-only")
+		return
+	}
+
+	status, err := d.updateFile(f, r, meta)
+	if err != nil {
+		fakeError(w, status, "badRequest", err.Error())
+		return
+	}
+	if upload {
+		f.setContent(content)
+	}
+	fakeJSON(w, &f.meta)
+}
+
+func (d *fakeDrive) updateFile(f *fakeFile, r *http.Request, meta map[string]json.RawMessage) (int, error) {
+	if err := applyMetadata(&f.meta, meta); err != nil {
+		return http.StatusBadRequest, err
+	}
+
+	query := r.URL.Query()
+	if remove := query.Get("removeParents"); remove != "" {
+		parents := []string{}
+		for _, parent := range f.meta.Parents {
+			if !strings.Contains(","+remove+",", ","+parent+",") {
+				parents = append(parents, parent)
+			}
+		}
+		f.meta.Parents = parents
+	}
+	if add := query.Get("addParents"); add != "" {
+		for _, parent := range strings.Split(add, ",") {
+			if d.lookup(parent) == nil {
+				return http.StatusNotFound, fmt.Errorf("File not found: %v", parent)
+			}
+			f.meta.Parents = append(f.meta.Parents, parent)
+		}
+	}
+
+	if _, ok := meta["modifiedTime"]; !ok {
+		f.meta.ModifiedTime = fakeNow()
+	}
+	d.recordChange(f.meta.Id, false)
+	return http.StatusOK, nil
+}
+
+func (d *fakeDrive) startUpload(w http.ResponseWriter, r *http.Request, fileID string) {
+	meta, err := readMetadata(r.Body)
+	if err != nil {
+		fakeError(w, http.StatusBadRequest, "badRequest", err.Error())
+		return
+	}
+
+	uploadID := d.newID()
+	d.uploads[uploadID] = &fakeUpload{fileID: fileID, meta: meta}
+	location := fmt.Sprintf("http://%v%v?uploadType=resumable&upload_id=%v", r.Host, r.URL.Path, uploadID)
+	w.Header().Set("Location", location)
+	w.WriteHeader(http.StatusOK)
+}
+
+// uploadChunk handles PUT requests of the resumable upload protocol.
+func (d *fakeDrive) uploadChunk(w http.ResponseWriter, r *http.Request) {
+	uploadID := r.URL.Query().Get("upload_id")
+	u := d.uploads[uploadID]
+	if u == nil {
+		fakeError(w, http.StatusNotFound, "notFound", "upload not found")
+		return
+	}
+
+	data, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		fakeError(w, http.StatusBadRequest, "badRequest", err.Error())
+		return
+	}
+
+	// Content-Range is "bytes start-end/total", "bytes */total" or
+	// "bytes start-end/*" while the total is still unknown.
+	var start, total int64 = 0, -1
+	if cr := strings.TrimPrefix(r.Header.Get("Content-Range"), "bytes "); cr != "" {
+		rng := strings.SplitN(cr, "/", 2)
+		if len(rng) == 2 && rng[1] != "*" {
+			total, _ = strconv.ParseInt(rng[1], 10, 64)
+		}
+		if rng[0] != "*" {
+			start, _ = strconv.ParseInt(strings.SplitN(rng[0], "-", 2)[0], 10, 64)
+		} else {
+			start = int64(u.data.Len())
+		}
+	}
+
+	if start != int64(u.data.Len()) {
+		// Chunk doesn't continue the upload, report what we have.
+		fakeUploadIncomplete(w, r, int64(u.data.Len()))
+		return
+	}
+	u.data.Write(data)
+
+	if total < 0 || int64(u.data.Len()) < total {
+		fakeUploadIncomplete(w, r, int64(u.data.Len()))
+		return
+	}
+
+	delete(d.uploads, uploadID)
+	if u.fileID == "" {
+		f, status, err := d.createFile(u.meta, u.data.Bytes())
+		if err != nil {
+			fakeError(w, status, "badRequest", err.Error())
+			return
+		}
+		fakeJSON(w, &f.meta)
+		return
+	}
+
+	f := d.lookup(u.fileID)
+	if f == nil {
+		fakeError(w, http.StatusNotFound, "notFound", "File not found: "+u.fileID)
+		return
+	}
+	if status, err := d.updateFile(f, r, u.meta); err != nil {
+		fakeError(w, status, "badRequest", err.Error())
+		return
+	}
+	f.setContent(u.data.Bytes())
+	fakeJSON(w, &f.meta)
+}
+
+// fakeUploadIncomplete tells the client to send the rest of the upload.
+// Drive answers with 308, or with 200 and a status override header when
+// the client asks for it to avoid confusion with 308 redirects.
+func fakeUploadIncomplete(w http.ResponseWriter, r *http.Request, received int64) {
+	if received > 0 {
+		w.Header().Set("Range", fmt.Sprintf("bytes=0-%d", received-1))
+	}
+	if r.Header.Get("X-GUploader-No-308") == "yes" {
+		w.Header().Set("X-HTTP-Status-Code-Override", "308")
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	w.WriteHeader(http.StatusPermanentRedirect)
+}
+
+func (d *fakeDrive) delete(w http.ResponseWriter, r *http.Request, id string) {
+	if d.lookup(id) == nil || id == fakeRootID {
+		fakeError(w, http.StatusNotFound, "notFound", "File not found: "+id)
+		return
+	}
+	d.deleteTree(id)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// deleteTree deletes file id and the files that are left without parents.
+func (d *fakeDrive) deleteTree(id string) {
+	delete(d.files, id)
+	d.recordChange(id, true)
+	for childID, child := range d.files {
+		if !hasParent(&child.meta, id) {
+			continue
+		}
+		parents := []string{}
+		for _, parent := range child.meta.Parents {
+			if parent != id {
+				parents = append(parents, parent)
+			}
+		}
+		child.meta.Parents = parents
+		if len(parents) == 0 {
+			d.deleteTree(childID)
+		}
+	}
+}
+
+func (d *fakeDrive) copy(w http.ResponseWriter, r *http.Request, id string) {
+	src := d.lookup(id)
+	if src == nil {
+		fakeError(w, http.StatusNotFound, "notFound", "File not found: "+id)
+		return
+	}
+	if src.meta.MimeType == mimeTypeFolder {
+		fakeError(w, http.StatusForbidden, "cannotCopyFile", "Folders can't be copied")
+		return
+	}
+
+	meta, err := readMetadata(r.Body)
+	if err != nil {
+		fakeError(w, http.StatusBadRequest, "badRequest", err.Error())
+		return
+	}
+
+	now := fakeNow()
+	f := &fakeFile{meta: src.meta}
+	f.meta.Id = d.newID()
+	f.meta.CreatedTime = now
+	f.meta.ModifiedTime = now
+	f.meta.Version = 0
+	f.revisions = nil
+	f.meta.Parents = append([]string(nil), src.meta.Parents...)
+	f.meta.AppProperties = nil
+	f.meta.Properties = nil
+	if err := applyMetadata(&f.meta, meta); err != nil {
+		fakeError(w, http.StatusBadRequest, "badRequest", err.Error())
+		return
+	}
+	f.setContent(append([]byte(nil), src.content...))
+	d.files[f.meta.Id] = f
+	d.recordChange(f.meta.Id, false)
+	fakeJSON(w, &f.meta)
+}
+
+func (d *fakeDrive) recordChange(id string, removed bool) {
+	d.changes = append(d.changes, &fakeChange{fileID: id, removed: removed, time: fakeNow()})
+}
+
+// listChanges lists the changes since pageToken, the index of the first one.
+// Like Drive, it reports the current state of changed files.
+func (d *fakeDrive) listChanges(w http.ResponseWriter, r *http.Request) {
+	start, err := strconv.Atoi(r.URL.Query().Get("pageToken"))
+	if err != nil || start < 0 || start > len(d.changes) {
+		fakeError(w, http.StatusBadRequest, "invalid", "Invalid Value: pageToken")
+		return
+	}
+
+	list := &drive.ChangeList{Kind: "drive#changeList", Changes: []*drive.Change{}, NewStartPageToken: strconv.Itoa(len(d.changes))}
+	for _, c := range d.changes[start:] {
+		change := &drive.Change{Kind: "drive#change", ChangeType: "file", FileId: c.fileID, Time: c.time}
+		if f := d.lookup(c.fileID); f != nil && !c.removed {
+			change.File = &f.meta
+		} else {
+			change.Removed = true
+		}
+		list.Changes = append(list.Changes, change)
+	}
+	fakeJSON(w, list)
+}
@@ -0,0 +1,175 @@
+package gdrive
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	log "github.com/cihub/seelog"
+	"google.golang.org/api/drive/v3"
+)
+
+// localMirror backs a fakeDrive with a local directory: the directory is
+// loaded at start, and the changes made through the Drive API are written
+// back to it.
+type localMirror struct {
+	root string
+	// paths and versions record where each file is on disk, relative to
+	// root, and which version of its content is there.
+	paths    map[string]string
+	versions map[string]int64
+	// synced is the number of changes of the drive written to disk.
+	synced int
+}
+
+// loadLocal adds the tree at root to d and mirrors later changes to it.
+func (d *fakeDrive) loadLocal(root string) error {
+	m := &localMirror{root: root, paths: make(map[string]string), versions: make(map[string]int64)}
+	ids := map[string]string{".": fakeRootID}
+	err := filepath.Walk(root, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(root, p)
+		if err != nil || rel == "." {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+
+		modTime := fi.ModTime().UTC().Format("2006-01-02T15:04:05.000Z")
+		f := &fakeFile{meta: drive.File{
+			Id:           d.newID(),
+			Kind:         "drive#file",
+			Name:         fi.Name(),
+			MimeType:     mimeTypeOctetStream,
+			CreatedTime:  modTime,
+			ModifiedTime: modTime,
+			Capabilities: fakeCapabilities(),
+			Parents:      []string{ids[filepath.ToSlash(filepath.Dir(rel))]},
+		}}
+		switch {
+		case fi.IsDir():
+			f.meta.MimeType = mimeTypeFolder
+			ids[rel] = f.meta.Id
+		case fi.Mode().IsRegular():
+			content, err := ioutil.ReadFile(p)
+			if err != nil {
+				return err
+			}
+			f.setContent(content)
+		default:
+			return nil
+		}
+		d.files[f.meta.Id] = f
+		m.paths[f.meta.Id] = rel
+		m.versions[f.meta.Id] = f.meta.Version
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	m.synced = len(d.changes)
+	d.local = m
+	return nil
+}
+
+// syncLocal writes the changes made since the last call to disk.
+func (d *fakeDrive) syncLocal() {
+	m := d.local
+	if m == nil {
+		return
+	}
+	for _, c := range d.changes[m.synced:] {
+		if err := m.sync(d, c.fileID); err != nil {
+			log.Errorf("can't write change of %v to %v: %v", c.fileID, m.root, err)
+		}
+	}
+	m.synced = len(d.changes)
+}
+
+func (m *localMirror) sync(d *fakeDrive, id string) error {
+	f := d.lookup(id)
+	p, ok := "", false
+	if f != nil && !f.meta.Trashed {
+		p, ok = m.path(d, f)
+	}
+	old, exists := m.paths[id]
+	if !ok {
+		if exists {
+			m.forget(old)
+			return os.RemoveAll(m.local(old))
+		}
+		return nil
+	}
+
+	if exists && old != p {
+		if err := os.MkdirAll(filepath.Dir(m.local(p)), 0755); err != nil {
+			return err
+		}
+		if err := os.Rename(m.local(old), m.local(p)); err != nil {
+			return err
+		}
+		m.move(old, p)
+	}
+	m.paths[id] = p
+
+	if f.meta.MimeType == mimeTypeFolder {
+		return os.MkdirAll(m.local(p), 0755)
+	}
+	if exists && m.versions[id] == f.meta.Version {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(m.local(p)), 0755); err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(m.local(p), f.content, 0644); err != nil {
+		return err
+	}
+	m.versions[id] = f.meta.Version
+	if t, err := time.Parse(time.RFC3339, f.meta.ModifiedTime); err == nil {
+		os.Chtimes(m.local(p), t, t)
+	}
+	return nil
+}
+
+// path returns the path of f relative to the root, following first parents.
+// Files outside of My Drive, like application data, have no path.
+func (m *localMirror) path(d *fakeDrive, f *fakeFile) (string, bool) {
+	names := []string{}
+	for depth := 0; f.meta.Id != fakeRootID; depth++ {
+		if len(f.meta.Parents) == 0 || depth > 100 {
+			return "", false
+		}
+		names = append([]string{f.meta.Name}, names...)
+		f = d.lookup(f.meta.Parents[0])
+		if f == nil || f.meta.Trashed {
+			return "", false
+		}
+	}
+	return strings.Join(names, "/"), true
+}
+
+func (m *localMirror) local(p string) string {
+	return filepath.Join(m.root, filepath.FromSlash(p))
+}
+
+// move updates the recorded paths of the files below a renamed folder.
+func (m *localMirror) move(old string, p string) {
+	for id, q := range m.paths {
+		if strings.HasPrefix(q, old+"/") {
+			m.paths[id] = p + strings.TrimPrefix(q, old)
+		}
+	}
+}
+
+// forget drops the files at and below p removed from disk.
+func (m *localMirror) forget(p string) {
+	for id, q := range m.paths {
+		if q == p || strings.HasPrefix(q, p+"/") {
+			delete(m.paths, id)
+			delete(m.versions, id)
+		}
+	}
+}
@@ -0,0 +1,278 @@
+package gdrive
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+// fakeQuery is a parsed Drive search query evaluated by fakeDrive.
+type fakeQuery interface {
+	match(f *fakeFile) bool
+}
+
+type fakeAnd []fakeQuery
+type fakeOr []fakeQuery
+type fakeNot struct{ q fakeQuery }
+type fakeAll struct{}
+
+// fakeTerm is a single "field op value" or "value in field" comparison.
+type fakeTerm struct {
+	field string
+	op    string
+	value string
+}
+
+func (q fakeAnd) match(f *fakeFile) bool {
+	for _, sub := range q {
+		if !sub.match(f) {
+			return false
+		}
+	}
+	return true
+}
+
+func (q fakeOr) match(f *fakeFile) bool {
+	for _, sub := range q {
+		if sub.match(f) {
+			return true
+		}
+	}
+	return false
+}
+
+func (q fakeNot) match(f *fakeFile) bool {
+	return !q.q.match(f)
+}
+
+func (q fakeAll) match(f *fakeFile) bool {
+	return true
+}
+
+func (t *fakeTerm) match(f *fakeFile) bool {
+	switch t.field {
+	case "parents":
+		return hasParent(&f.meta, t.value)
+	case "owners", "writers", "readers":
+		return t.value == "me"
+	case "fullText":
+		value := strings.ToLower(t.value)
+		return strings.Contains(strings.ToLower(f.meta.Name), value) ||
+			strings.Contains(strings.ToLower(f.meta.Description), value) ||
+			bytes.Contains(bytes.ToLower(f.content), []byte(value))
+	case "name":
+		return compareFakeValue(f.meta.Name, t.op, t.value)
+	case "mimeType":
+		return compareFakeValue(f.meta.MimeType, t.op, t.value)
+	case "modifiedTime":
+		return compareFakeValue(f.meta.ModifiedTime, t.op, t.value)
+	case "createdTime":
+		return compareFakeValue(f.meta.CreatedTime, t.op, t.value)
+	case "viewedByMeTime":
+		return compareFakeValue(f.meta.ViewedByMeTime, t.op, t.value)
+	case "trashed":
+		return compareFakeValue(fmt.Sprint(f.meta.Trashed), t.op, t.value)
+	case "starred":
+		return compareFakeValue(fmt.Sprint(f.meta.Starred), t.op, t.value)
+	case "sharedWithMe":
+		return compareFakeValue("false", t.op, t.value)
+	}
+	return false
+}
+
+func compareFakeValue(actual string, op string, value string) bool {
+	switch op {
+	case "=":
+		return actual == value
+	case "!=":
+		return actual != value
+	case "<":
+		return actual < value
+	case "<=":
+		return actual <= value
+	case ">":
+		return actual > value
+	case ">=":
+		return actual >= value
+	case "contains":
+		if value == "" {
+			return true
+		}
+		return strings.Contains(strings.ToLower(actual), strings.ToLower(value))
+	}
+	return false
+}
+
+// parseFakeQuery parses the subset of the Drive query language used by
+// this package: comparisons joined with and, or, not and parentheses.
+func parseFakeQuery(s string) (fakeQuery, error) {
+	tokens, err := tokenizeFakeQuery(s)
+	if err != nil {
+		return nil, err
+	}
+	if len(tokens) == 0 {
+		return fakeAll{}, nil
+	}
+	p := &fakeQueryParser{tokens: tokens}
+	q, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if p.pos != len(p.tokens) {
+		return nil, fmt.Errorf("unexpected %q", p.tokens[p.pos].text)
+	}
+	return q, nil
+}
+
+type fakeToken struct {
+	text   string
+	quoted bool
+}
+
+func tokenizeFakeQuery(s string) ([]fakeToken, error) {
+	tokens := []fakeToken{}
+	for i := 0; i < len(s); {
+		c := s[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n':
+			i++
+		case c == '(' || c == ')':
+			tokens = append(tokens, fakeToken{text: string(c)})
+			i++
+		case c == '\'' || c == '"':
+			var b strings.Builder
+			i++
+			for ; i < len(s) && s[i] != c; i++ {
+				if s[i] == '\\' && i+1 < len(s) {
+					i++
+				}
+				b.WriteByte(s[i])
+			}
+			if i == len(s) {
+				return nil, fmt.Errorf("unterminated string")
+			}
+			i++
+			tokens = append(tokens, fakeToken{text: b.String(), quoted: true})
+		case strings.IndexByte("=!<>", c) >= 0:
+			j := i + 1
+			if j < len(s) && s[j] == '=' {
+				j++
+			}
+			tokens = append(tokens, fakeToken{text: s[i:j]})
+			i = j
+		default:
+			j := i
+			for j < len(s) && (unicode.IsLetter(rune(s[j])) || unicode.IsDigit(rune(s[j])) || s[j] == '_' || s[j] == '.' || s[j] == '-' || s[j] == ':') {
+				j++
+			}
+			if j == i {
+				return nil, fmt.Errorf("unexpected character %q", c)
+			}
+			tokens = append(tokens, fakeToken{text: s[i:j]})
+			i = j
+		}
+	}
+	return tokens, nil
+}
+
+type fakeQueryParser struct {
+	tokens []fakeToken
+	pos    int
+}
+
+func (p *fakeQueryParser) peek(keyword string) bool {
+	return p.pos < len(p.tokens) && !p.tokens[p.pos].quoted && p.tokens[p.pos].text == keyword
+}
+
+func (p *fakeQueryParser) next() (fakeToken, error) {
+	if p.pos == len(p.tokens) {
+		return fakeToken{}, fmt.Errorf("unexpected end of query")
+	}
+	t := p.tokens[p.pos]
+	p.pos++
+	return t, nil
+}
+
+func (p *fakeQueryParser) parseOr() (fakeQuery, error) {
+	q, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	or := fakeOr{q}
+	for p.peek("or") {
+		p.pos++
+		q, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		or = append(or, q)
+	}
+	if len(or) == 1 {
+		return q, nil
+	}
+	return or, nil
+}
+
+func (p *fakeQueryParser) parseAnd() (fakeQuery, error) {
+	q, err := p.parseNot()
+	if err != nil {
+		return nil, err
+	}
+	and := fakeAnd{q}
+	for p.peek("and") {
+		p.pos++
+		q, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		and = append(and, q)
+	}
+	if len(and) == 1 {
+		return q, nil
+	}
+	return and, nil
+}
+
+func (p *fakeQueryParser) parseNot() (fakeQuery, error) {
+	if p.peek("not") {
+		p.pos++
+		q, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		return fakeNot{q}, nil
+	}
+	if p.peek("(") {
+		p.pos++
+		q, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if !p.peek(")") {
+			return nil, fmt.Errorf("missing )")
+		}
+		p.pos++
+		return q, nil
+	}
+	return p.parseTerm()
+}
+
+func (p *fakeQueryParser) parseTerm() (fakeQuery, error) {
+	left, err := p.next()
+	if err != nil {
+		return nil, err
+	}
+	op, err := p.next()
+	if err != nil {
+		return nil, err
+	}
+	right, err := p.next()
+	if err != nil {
+		return nil, err
+	}
+	if op.text == "in" {
+		return &fakeTerm{field: right.text, op: op.text, value: left.text}, nil
+	}
+	return &fakeTerm{field: left.text, op: op.text, value: right.text}, nil
+}
@@ -0,0 +1,117 @@
+package gdrive
+
+import (
+	"flag"
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// pathPattern matches paths with a glob, or with a regular expression when
+// given as "re:<expression>".
+type pathPattern struct {
+	glob string
+	re   *regexp.Regexp
+}
+
+// patternsValue is a list of path patterns given with a repeated flag.
+type patternsValue []pathPattern
+
+var (
+	excludes patternsValue
+	includes patternsValue
+)
+
+func init() {
+	flag.Var(&excludes, "exclude", "Hide paths matching this glob, or regular expression if prefixed with \"re:\", together with everything below them, and refuse to write them. May be repeated.")
+	flag.Var(&includes, "include", "Only serve paths matching this glob, or regular expression if prefixed with \"re:\", and everything below them. May be repeated.")
+}
+
+func (v *patternsValue) String() string {
+	s := []string{}
+	for _, p := range *v {
+		if p.re != nil {
+			s = append(s, "re:"+p.re.String())
+		} else {
+			s = append(s, p.glob)
+		}
+	}
+	return strings.Join(s, ",")
+}
+
+func (v *patternsValue) Set(value string) error {
+	if strings.HasPrefix(value, "re:") {
+		re, err := regexp.Compile(strings.TrimPrefix(value, "re:"))
+		if err != nil {
+			return err
+		}
+		*v = append(*v, pathPattern{re: re})
+		return nil
+	}
+	if _, err := path.Match(value, ""); err != nil {
+		return fmt.Errorf("bad pattern %q: %v", value, err)
+	}
+	*v = append(*v, pathPattern{glob: "/" + strings.Trim(value, "/")})
+	return nil
+}
+
+// matchTree reports whether p or one of its ancestors matches.
+func (pp pathPattern) matchTree(p string) bool {
+	for ; p != "/" && p != "."; p = path.Dir(p) {
+		if pp.match(p) {
+			return true
+		}
+	}
+	return false
+}
+
+func (pp pathPattern) match(p string) bool {
+	if pp.re != nil {
+		return pp.re.MatchString(p)
+	}
+	ok, _ := path.Match(pp.glob, p)
+	return ok
+}
+
+// matchAncestor reports whether p may be an ancestor of matching paths.
+// Regular expressions can't tell, so they never do.
+func (pp pathPattern) matchAncestor(p string) bool {
+	if pp.re != nil {
+		return false
+	}
+	globs := strings.Split(pp.glob, "/")
+	parts := strings.Split(p, "/")
+	if len(parts) >= len(globs) {
+		return false
+	}
+	for i, part := range parts {
+		if ok, _ := path.Match(globs[i], part); !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// isFilteredPath reports whether p is excluded from the served tree by
+// --exclude or --include.
+func isFilteredPath(p string) bool {
+	p = normalizePath(p)
+	if p == "" {
+		return false
+	}
+	for _, pp := range excludes {
+		if pp.matchTree(p) {
+			return true
+		}
+	}
+	if len(includes) == 0 {
+		return false
+	}
+	for _, pp := range includes {
+		if pp.matchTree(p) || pp.matchAncestor(p) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,42 @@
+package gdrive
+
+import (
+	"flag"
+	"time"
+
+	"google.golang.org/api/drive/v3"
+)
+
+var (
+	folderMtimeFromChildrenFlag = flag.Bool("folder-mtime-from-children", false, "Show the modification time of a folder as that of its newest file or folder below, as far as their listings are cached, so that sync tools notice changes below it.")
+)
+
+// fileInfo returns the info of file, with the modification time of a folder
+// taken from its children if --folder-mtime-from-children asks for it.
+func (fs *fileSystem) fileInfo(file *drive.File) *fileInfo {
+	fi := newFileInfo(file)
+	if *folderMtimeFromChildrenFlag && fi.isDir {
+		fi.modTime = fs.newestModTime(file.Id, fi.modTime, 0)
+	}
+	return fi
+}
+
+// newestModTime returns the latest of t and the modification times of the
+// files below folder id found in cached listings. Listing a folder would
+// cost more than the client saves by checking the time.
+func (fs *fileSystem) newestModTime(id string, t time.Time, depth int) time.Time {
+	cached, found := fs.cache.Get(cacheKeyDir + id)
+	if !found || depth > 32 {
+		return t
+	}
+	for _, child := range cached.(*fileLookupResult).fp.files {
+		modTime, err := getModTime(child)
+		if err == nil && modTime.After(t) {
+			t = modTime
+		}
+		if child.MimeType == mimeTypeFolder {
+			t = fs.newestModTime(child.Id, t, depth+1)
+		}
+	}
+	return t
+}
@@ -0,0 +1,194 @@
+package gdrive
+
+import (
+	"flag"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/cihub/seelog"
+	"golang.org/x/net/context"
+	"google.golang.org/api/drive/v3"
+)
+
+var (
+	fullSyncFlag = flag.Bool("full-sync", false, "Load the metadata of the whole drive at start and keep it fresh with the Changes API, so that lookups don't wait for Drive. Polls changes every --changes-poll-interval, a minute by default.")
+)
+
+// treeIndex holds the metadata of all the files of the drive.
+type treeIndex struct {
+	mu       sync.RWMutex
+	files    map[string]*drive.File
+	children map[string]map[string]bool
+	// token is the page token of the next changes, ready is set once the
+	// tree is loaded and dirty when this server changed files since the
+	// changes were last read.
+	token  string
+	ready  int32
+	dirty  int32
+	syncMu sync.Mutex
+}
+
+func newTreeIndex() *treeIndex {
+	if !*fullSyncFlag {
+		return nil
+	}
+	return &treeIndex{}
+}
+
+func (ix *treeIndex) isReady() bool {
+	return ix != nil && atomic.LoadInt32(&ix.ready) == 1
+}
+
+// markDirty makes the next lookup read the changes first.
+func (ix *treeIndex) markDirty() {
+	if ix != nil {
+		atomic.StoreInt32(&ix.dirty, 1)
+	}
+}
+
+// loadIndex lists the whole drive. The changes are read from the start of the
+// listing, so that none made meanwhile are missed.
+func (fs *fileSystem) loadIndex(ctx context.Context) error {
+	ix := fs.index
+	t, err := fs.client.Changes.GetStartPageToken().SupportsAllDrives(true).Context(ctx).Do()
+	if err != nil {
+		return err
+	}
+
+	start := time.Now()
+	query := "trashed = false"
+	if *showTrashedFlag {
+		query = ""
+	}
+	files := make(map[string]*drive.File)
+	children := make(map[string]map[string]bool)
+	err = fs.listFiles().Q(query).PageSize(1000).Fields("nextPageToken, files("+fileFields+")").Pages(ctx, func(r *drive.FileList) error {
+		for _, file := range r.Files {
+			files[file.Id] = file
+			addChild(children, file)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	ix.mu.Lock()
+	ix.files, ix.children, ix.token = files, children, t.StartPageToken
+	ix.mu.Unlock()
+	atomic.StoreInt32(&ix.ready, 1)
+	log.Infof("Loaded %v files in %v", len(files), time.Since(start))
+	return nil
+}
+
+func addChild(children map[string]map[string]bool, file *drive.File) {
+	for _, parent := range file.Parents {
+		if children[parent] == nil {
+			children[parent] = make(map[string]bool)
+		}
+		children[parent][file.Id] = true
+	}
+}
+
+// file returns the indexed file id, if any.
+func (ix *treeIndex) file(id string) *drive.File {
+	if !ix.isReady() {
+		return nil
+	}
+	ix.mu.RLock()
+	defer ix.mu.RUnlock()
+	return ix.files[id]
+}
+
+// apply updates the index with a change.
+func (ix *treeIndex) apply(c *drive.Change) {
+	if !ix.isReady() {
+		return
+	}
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+	if old := ix.files[c.FileId]; old != nil {
+		for _, parent := range old.Parents {
+			delete(ix.children[parent], old.Id)
+		}
+		delete(ix.files, c.FileId)
+	}
+	if c.Removed || c.File == nil || c.File.Trashed && !*showTrashedFlag {
+		return
+	}
+	ix.files[c.FileId] = c.File
+	addChild(ix.children, c.File)
+}
+
+// syncIndex reads the changes since the index was loaded or last synced.
+func (fs *fileSystem) syncIndex(ctx context.Context) error {
+	ix := fs.index
+	ix.syncMu.Lock()
+	defer ix.syncMu.Unlock()
+	atomic.StoreInt32(&ix.dirty, 0)
+
+	ix.mu.RLock()
+	token := ix.token
+	ix.mu.RUnlock()
+
+	next, err := fs.readChanges(ctx, token, time.Now().Add(-*changesPollIntervalFlag))
+	if err != nil {
+		atomic.StoreInt32(&ix.dirty, 1)
+		return err
+	}
+	ix.mu.Lock()
+	ix.token = next
+	ix.mu.Unlock()
+	// Invalidating the entries of the changes marked the index dirty.
+	atomic.StoreInt32(&ix.dirty, 0)
+	return nil
+}
+
+// indexChildren returns the files of folderID, once the index is ready and
+// holds the changes made by this server.
+func (fs *fileSystem) indexChildren(ctx context.Context, folderID string) ([]*drive.File, bool) {
+	ix := fs.index
+	if !ix.isReady() {
+		return nil, false
+	}
+	if atomic.LoadInt32(&ix.dirty) == 1 {
+		if err := fs.syncIndex(ctx); err != nil {
+			log.Errorf("can't read changes: %v", err)
+			return nil, false
+		}
+	}
+
+	ix.mu.RLock()
+	defer ix.mu.RUnlock()
+	files := []*drive.File{}
+	for id := range ix.children[folderID] {
+		files = append(files, ix.files[id])
+	}
+	return files, true
+}
+
+// syncInterval returns how often changes are polled with --full-sync.
+func syncInterval() time.Duration {
+	if *changesPollIntervalFlag > 0 {
+		return *changesPollIntervalFlag
+	}
+	return time.Minute
+}
+
+// pollIndex loads the index and then reads the changes every interval,
+// forever.
+func (fs *fileSystem) pollIndex(interval time.Duration) {
+	ctx := background(context.Background())
+	for ; ; time.Sleep(interval) {
+		if !fs.index.isReady() {
+			if err := fs.loadIndex(ctx); err != nil {
+				log.Errorf("can't load the drive: %v", err)
+			}
+			continue
+		}
+		if err := fs.syncIndex(ctx); err != nil {
+			log.Errorf("can't poll changes: %v", err)
+		}
+	}
+}
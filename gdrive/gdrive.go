@@ -2,30 +2,79 @@ package gdrive
 
 import (
 	"bytes"
+	"crypto/md5"
+	"encoding/hex"
+	"flag"
 	"fmt"
+	"hash"
 	"net/http"
 	"os"
 	"path"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"io"
+	"mime"
 
 	log "github.com/cihub/seelog"
 	gocache "github.com/pmylund/go-cache"
 	"golang.org/x/net/context"
 	"golang.org/x/net/webdav"
+	"golang.org/x/oauth2"
 	"google.golang.org/api/drive/v3"
+	driveactivity "google.golang.org/api/driveactivity/v2"
+	"google.golang.org/api/googleapi"
 )
 
 type fileSystem struct {
 	client       *drive.Service
 	roundTripper http.RoundTripper
-	cache        *gocache.Cache
+	cache        *metadataCache
+	stats        *stats
+	tokenSource  oauth2.TokenSource
+	events       *eventBroker
+	queue        *uploadQueue
+	// stale keeps lookups for the offline fallback, offlineUntil is when
+	// Drive is to be tried again after it was found unreachable.
+	stale        *gocache.Cache
+	offlineUntil int64
+	index        *treeIndex
+	// history has the paths files were seen at, synced the folders
+	// listed for sync-collection.
+	history *pathHistory
+	synced  *syncScopes
+	rootMu  sync.Mutex
+	root    *drive.File
+	// uploads caps the uploads running at once.
+	uploads *transferLimiter
+	// rootID is the ID of the folder served as the root, mirror replays
+	// the changes made to a secondary drive.
+	rootID   string
+	mirror   *mirror
+	activity *driveactivity.Service
+	// transient keeps editor lock and temporary files out of Drive.
+	transient    *transientStore
+	resourceKeys *resourceKeys
 }
 
 const (
-	mimeTypeFolder = "application/vnd.google-apps.folder"
+	mimeTypeFolder       = "application/vnd.google-apps.folder"
+	mimeTypeGooglePrefix = "application/vnd.google-apps."
+	mimeTypeOctetStream  = "application/octet-stream"
+
+	// fileFields lists the file fields requested from Drive.
+	fileFields = "id,name,mimeType,trashed,parents,size,createdTime,modifiedTime,capabilities(canEdit,canDelete,canAddChildren),appProperties,contentRestrictions,md5Checksum,resourceKey," + driveFields
+)
+
+var (
+	downloadTimeoutFlag = flag.Duration("download-timeout", 15*time.Second, "Abort a download when no data was received for this long. 0 disables the timeout.")
+	downloadRetriesFlag = flag.Int("download-retries", 5, "How many times an interrupted download is resumed from the current position before failing.")
+	caseInsensitiveFlag = flag.Bool("case-insensitive", false, "Resolve path components ignoring case when there is no exact match.")
+	rootFolderIDFlag    = flag.String("root-folder-id", "", "Serve the Drive folder with this ID instead of the whole drive.")
+	hideGoogleDocsFlag  = flag.Bool("hide-google-docs", false, "Hide Google Docs, Sheets, Slides and other Google-native files, which have no binary content.")
+	driveEndpointFlag   = flag.String("drive-endpoint", "", "Base URL of the Drive API, e.g. an emulator or a private access endpoint. https://www.googleapis.com/ by default.")
 )
 
 type fileAndPath struct {
@@ -36,30 +85,162 @@ type fileAndPath struct {
 
 // NewFS creates new gdrive file system.
 func NewFS(ctx context.Context, clientID string, clientSecret string) webdav.FileSystem {
-	httpClient := newHTTPClient(ctx, clientID, clientSecret)
+	file, err := tokenFile()
+	if err != nil {
+		log.Errorf("An error occurred locating token file: %v\n", err)
+		panic(-3)
+	}
+	httpClient, ts := newHTTPClient(ctx, clientID, clientSecret, file)
+	fs := newFS(httpClient, driveBasePath(*driveEndpointFlag))
+	fs.tokenSource = ts
+	fs.mirror = newMirror(ctx, fs, clientID, clientSecret)
+	return withCrypt(fs)
+}
+
+// NewFakeFS creates gdrive file system backed by an in-memory fake of the
+// Drive API, so that WebDAV clients can be tested without a Google account.
+func NewFakeFS(ctx context.Context) webdav.FileSystem {
+	return withCrypt(newFakeFS(newFakeDrive()))
+}
+
+// NewLocalFS creates gdrive file system serving the local directory root
+// through the fake Drive, for development and offline testing. The whole
+// tree is held in memory.
+func NewLocalFS(ctx context.Context, root string) webdav.FileSystem {
+	d := newFakeDrive()
+	if err := d.loadLocal(root); err != nil {
+		log.Errorf("An error occurred loading %v: %v\n", root, err)
+		panic(-3)
+	}
+	log.Infof("Serving %v files from %v", len(d.local.paths), root)
+	return withCrypt(newFakeFS(d))
+}
+
+func newFakeFS(d *fakeDrive) *fileSystem {
+	url, err := startFakeDrive(d)
+	if err != nil {
+		log.Errorf("An error occurred starting fake Drive: %v\n", err)
+		panic(-3)
+	}
+	log.Info("Serving fake Drive at ", url)
+	return newFS(&http.Client{}, driveBasePath(url))
+}
+
+// driveBasePath returns the base path of the Drive v3 API at endpoint, or ""
+// for the default one.
+func driveBasePath(endpoint string) string {
+	if endpoint == "" {
+		return ""
+	}
+	return strings.TrimSuffix(endpoint, "/") + "/drive/v3/"
+}
+
+func newFS(httpClient *http.Client, basePath string) *fileSystem {
+	st := newStats()
+	keys := newResourceKeys()
+	httpClient.Transport = &retryTransport{base: &statsTransport{base: withScheduler(withIdentity(&resourceKeyTransport{base: httpClient.Transport, keys: keys})), stats: st}}
 	client, err := drive.New(httpClient)
 	if err != nil {
 		log.Errorf("An error occurred creating Drive client: %v\n", err)
 		panic(-3)
 	}
+	if basePath != "" {
+		client.BasePath = basePath
+	}
+	if *rootFolderIDFlag != "" && (*recentFlag > 0 || *orphanedFlag) {
+		log.Warn("--recent and --orphaned search the whole drive, they are disabled by --root-folder-id")
+	}
 
 	fs := &fileSystem{
 		client:       client,
 		roundTripper: httpClient.Transport,
-		cache:        gocache.New(5*time.Minute, 30*time.Second),
+		cache:        newMetadataCache(st),
+		stale:        newStaleCache(),
+		history:      newPathHistory(),
+		synced:       newSyncScopes(),
+		index:        newTreeIndex(),
+		stats:        st,
+		events:       newEventBroker(),
+		uploads:      newTransferLimiter(*maxConcurrentUploadsFlag),
+		rootID:       rootFolderID(),
+		activity:     newActivityService(httpClient.Transport),
+		transient:    newTransientStore(),
+		resourceKeys: keys,
+	}
+	if fs.index != nil {
+		go fs.pollIndex(syncInterval())
+	} else if *changesPollIntervalFlag > 0 {
+		go fs.pollChanges(*changesPollIntervalFlag)
+	}
+	if *writeBackDirFlag != "" && *dryRunFlag {
+		// Without a running queue, waiting for it would block forever.
+		log.Warnf("Dry run: uploads spooled in %v are left alone", *writeBackDirFlag)
+	} else if *writeBackDirFlag != "" {
+		if fs.queue, err = newUploadQueue(fs, *writeBackDirFlag); err != nil {
+			log.Errorf("An error occurred opening %v: %v\n", *writeBackDirFlag, err)
+			panic(-3)
+		}
+		go fs.queue.run()
+	}
+	if *snapshotDirFlag != "" {
+		go fs.takeSnapshots(*snapshotDirFlag, *snapshotIntervalFlag)
+	}
+	if len(warmPathsValue) > 0 {
+		go fs.warmFolders(warmPathsValue, *warmIntervalFlag)
+	}
+	if *trashRetentionFlag > 0 {
+		p := &trashPurger{fs: fs, retention: time.Duration(*trashRetentionFlag) * 24 * time.Hour}
+		go p.run()
 	}
 	return fs
 }
 
-// NewLS creates new GDrive locking system
-func NewLS() webdav.LockSystem {
-	return webdav.NewMemLS()
+// NewLS creates new GDrive locking system for fs. Locks are kept in memory
+// unless --redis-locks or --lock-db is given.
+func NewLS(fs webdav.FileSystem) webdav.LockSystem {
+	ls := newLS()
+	if gfs, ok := fs.(*fileSystem); ok && *driveLocksFlag {
+		return newDriveLS(ls, gfs)
+	}
+	return ls
+}
+
+func newLS() webdav.LockSystem {
+	if *redisLocksFlag != "" {
+		ls, err := newRedisLS(*redisLocksFlag, *redisLockPrefixFlag)
+		if err != nil {
+			log.Errorf("An error occurred connecting to Redis: %v\n", err)
+			panic(-3)
+		}
+		return ls
+	}
+
+	if *lockDBFlag == "" {
+		return webdav.NewMemLS()
+	}
+
+	ls, err := newBoltLS(*lockDBFlag)
+	if err != nil {
+		log.Errorf("An error occurred opening lock database: %v\n", err)
+		panic(-3)
+	}
+	return ls
 }
 
 func (fs *fileSystem) Mkdir(ctx context.Context, name string, perm os.FileMode) error {
 	log.Debugf("Mkdir %v %v", name, perm)
 	name = normalizePath(name)
-	pID, err := fs.getFileID(name, false)
+	if isVersionsPath(name) || isVirtualPath(name) || isFilteredPath(name) {
+		return os.ErrPermission
+	}
+	if isHiddenPath(name) {
+		log.Debugf("Mkdir %v: hidden, ignored", name)
+		return nil
+	}
+	if err := fs.checkWritable(name); err != nil {
+		return err
+	}
+	pID, err := fs.getFileID(ctx, name, false)
 	if err != nil && err != os.ErrNotExist {
 		log.Error(err)
 		return err
@@ -72,15 +253,22 @@ func (fs *fileSystem) Mkdir(ctx context.Context, name string, perm os.FileMode)
 	parent := path.Dir(name)
 	dir := path.Base(name)
 
-	parentID, err := fs.getFileID(parent, true)
+	parentFile, err := fs.getFile(ctx, parent, true)
 	if err != nil {
 		return err
 	}
+	parentID := parentFile.file.Id
 
 	if parentID == "" {
 		log.Errorf("parent not found")
 		return os.ErrNotExist
 	}
+	if err := checkCanAddChildren(parent, parentFile.file); err != nil {
+		return err
+	}
+	if skip, err := dryRun("create folder %v", name); skip {
+		return err
+	}
 
 	f := &drive.File{
 		MimeType: mimeTypeFolder,
@@ -88,25 +276,29 @@ func (fs *fileSystem) Mkdir(ctx context.Context, name string, perm os.FileMode)
 		Parents:  []string{parentID},
 	}
 
-	_, err = fs.client.Files.Create(f).Do()
+	_, err = fs.client.Files.Create(f).SupportsAllDrives(true).Context(ctx).Do()
 	if err != nil {
 		return err
 	}
 
 	fs.invalidatePath(name)
 	fs.invalidatePath(parent)
+	fs.mirror.add(mirrorMkdir, name, "")
 
 	return nil
 }
 
 type openWritableFile struct {
-	ctx        context.Context
-	fileSystem *fileSystem
-	buffer     bytes.Buffer
-	size       int64
-	name       string
-	flag       int
-	perm       os.FileMode
+	ctx           context.Context
+	fileSystem    *fileSystem
+	buffer        *bytes.Buffer
+	size          int64
+	name          string
+	flag          int
+	perm          os.FileMode
+	appProperties map[string]string
+	// description is copied by COPY.
+	description string
 }
 
 func (f *openWritableFile) Write(p []byte) (int, error) {
@@ -116,35 +308,57 @@ func (f *openWritableFile) Write(p []byte) (int, error) {
 }
 
 func (f *openWritableFile) Readdir(count int) ([]os.FileInfo, error) {
-	panic("not supported")
+	return nil, errNotSupported
 }
 
 func (f *openWritableFile) Stat() (os.FileInfo, error) {
 	return &fileInfo{
-		isDir:        false,
-		size:         f.size,
+		isDir: false,
+		size:  f.size,
 	}, nil
 }
 
 func (f *openWritableFile) Close() error {
 	log.Debugf("Close %v", f.name)
+	defer func() {
+		putBuffer(f.buffer)
+		f.buffer = nil
+	}()
+	if err := bodyError(f.ctx); err != nil {
+		// webdav.Handler closes the file even when the body of the PUT
+		// couldn't be read to the end.
+		log.Errorf("Discarding %v, its content is incomplete: %v", f.name, err)
+		return err
+	}
+	if q := f.fileSystem.queue; q != nil {
+		return q.add(f.name, f.appProperties, f.buffer.Bytes())
+	}
+	return f.flush()
+}
+
+// flush uploads the content written to Drive.
+func (f *openWritableFile) flush() error {
 	fs := f.fileSystem
-	fileID, err := fs.getFileID(f.name, false)
+	existing, err := fs.getFile(f.ctx, f.name, false)
 	if err != nil && err != os.ErrNotExist {
 		log.Error(err)
 		return err
 	}
 
-	if fileID != "" {
-		err = os.ErrExist
-		log.Error(err)
-		return err
+	if existing != nil {
+		f.compress(existing.file)
+		if err := f.update(existing.file); err != nil {
+			return err
+		}
+		fs.mirror.add(mirrorWrite, f.name, "")
+		return nil
 	}
+	f.compress(nil)
 
 	parent := path.Dir(f.name)
 	base := path.Base(f.name)
 
-	parentID, err := fs.getFileID(parent, true)
+	parentID, err := fs.getFileID(f.ctx, parent, true)
 	if err != nil {
 		log.Error(err)
 		return err
@@ -157,11 +371,13 @@ func (f *openWritableFile) Close() error {
 	}
 
 	file := &drive.File{
-		Name:    base,
-		Parents: []string{parentID},
+		Name:          base,
+		Parents:       []string{parentID},
+		AppProperties: f.appProperties,
+		Description:   f.description,
 	}
 
-	_, err = fs.client.Files.Create(file).Media(&f.buffer).Do()
+	_, err = fs.upload(f.ctx, f.name, "", file, f.buffer, f.size)
 	if err != nil {
 		log.Error(err)
 		return err
@@ -169,91 +385,152 @@ func (f *openWritableFile) Close() error {
 
 	fs.invalidatePath(f.name)
 	fs.invalidatePath(parent)
+	fs.cache.Delete(cacheKeyAbout)
+	fs.mirror.add(mirrorWrite, f.name, "")
 
 	log.Debug("Close succesfull ", f.name)
 	return nil
 }
+
+// update replaces content of an existing file.
+func (f *openWritableFile) update(file *drive.File) error {
+	fs := f.fileSystem
+	if file.MimeType == mimeTypeFolder {
+		log.Errorf("can't overwrite folder %v", f.name)
+		return errNotSupported
+	}
+
+	// Files locked by WebDAV clients are read-only in Drive, the client
+	// holding the lock has been confirmed by webdav.Handler already.
+	restricted, ours := contentRestriction(file)
+	if restricted && !ours {
+		log.Errorf("%v is read-only in Drive", f.name)
+		return errLocked
+	}
+	if restricted {
+		if err := fs.setReadOnly(f.ctx, f.name, file.Id, false); err != nil {
+			log.Error(err)
+			return err
+		}
+		defer func() {
+			if err := fs.setReadOnly(f.ctx, f.name, file.Id, true); err != nil {
+				log.Errorf("can't lock %v in Drive again: %v", f.name, err)
+			}
+		}()
+	}
+
+	meta := &drive.File{AppProperties: f.appProperties}
+	var err error
+	if sum := md5.Sum(f.buffer.Bytes()); file.Md5Checksum != "" && file.Md5Checksum == hex.EncodeToString(sum[:]) {
+		// Clients syncing folders often push files again unchanged.
+		log.Debugf("%v is unchanged, updating modification time only", f.name)
+		meta.ModifiedTime = time.Now().UTC().Format(driveTimeFormat)
+		_, err = fs.client.Files.Update(file.Id, meta).SupportsAllDrives(true).Context(f.ctx).Do()
+	} else {
+		_, err = fs.upload(f.ctx, f.name, file.Id, meta, f.buffer, f.size)
+	}
+	if err != nil {
+		log.Error(err)
+		return err
+	}
+
+	fs.invalidatePath(f.name)
+	fs.invalidatePath(path.Dir(f.name))
+	fs.cache.Delete(cacheKeyAbout)
+
+	log.Debug("Update succesfull ", f.name)
+	return nil
+}
 func (f *openWritableFile) Read(p []byte) (n int, err error) {
-	log.Critical("not implemented")
-	panic("not implemented")
+	log.Error("Read is not supported on writable file ", f.name)
+	return 0, errNotSupported
 }
 func (f *openWritableFile) Seek(offset int64, whence int) (int64, error) {
-	log.Critical("not implemented")
-	panic("not implemented")
+	log.Error("Seek is not supported on writable file ", f.name)
+	return 0, errNotSupported
 }
 
 type openReadonlyFile struct {
+	ctx           context.Context
 	fs            *fileSystem
 	file          *drive.File
 	content       []byte
-	size          int64
 	pos           int64
 	contentReader io.Reader
 	name          string
-	body		  io.ReadCloser
+	body          io.ReadCloser
+	retries       int
+	hash          hash.Hash
+	revisionID    string
+	// cached is the content kept for the offline fallback read instead of
+	// a download, spool the copy of a download being kept.
+	cached *os.File
+	spool  *contentSpool
 }
 
 func (f *openReadonlyFile) Write(p []byte) (int, error) {
-	log.Critical("not implemented")
-	panic("not implemented")
+	log.Error("Write is not supported on read-only file ", f.name)
+	return 0, errNotSupported
 }
 
 func (f *openReadonlyFile) Readdir(count int) ([]os.FileInfo, error) {
 
 	files := []os.FileInfo{}
-	aLookup := &fileLookupResult{}
 
-	if lookup, found := f.fs.cache.Get(cacheKeyDir + f.file.Id); found {
-		log.Trace("Reusing cached file: ", f.file.Id)
-		aLookup = lookup.(*fileLookupResult)
-	} else {
-		query := fmt.Sprintf("'%s' in parents", f.file.Id)
-		r, err := f.fs.client.Files.List().Q(query).Fields("files(id,name,mimeType,trashed,parents,size,parents,createdTime,modifiedTime)").Do()
-
-		if err != nil {
-			log.Error("Can't list children ", err)
-			return nil, err
-		}
-
-		lookup := &fileLookupResult{fp: &fileAndPath{
-			file:  f.file,
-			path:  f.file.Id,
-			files: r.Files,
-		}, err: nil}
-
-		f.fs.cache.Set(cacheKeyDir + lookup.fp.path, lookup, 5*time.Second)
+	children, err := f.fs.listFolder(f.ctx, f.file.Id)
+	if err != nil {
+		return nil, err
+	}
 
-		aLookup = lookup
+	pending := make(map[string]*queuedUpload)
+	for _, e := range f.fs.queue.pendingIn(f.name) {
+		pending[path.Base(e.Name)] = e
 	}
 
-	for _, file := range aLookup.fp.files {
-		if ignoreFile(file) {
+	for _, file := range children {
+		if isFilteredPath(f.name + "/" + file.Name) {
 			continue
 		}
-		files = append(files, newFileInfo(file))
+		if e := pending[file.Name]; e != nil {
+			files = append(files, e.info())
+			delete(pending, file.Name)
+		} else {
+			files = append(files, f.fs.fileInfo(file))
+		}
 
-		lookup := &fileLookupResult{fp: &fileAndPath{
-			file: file,
-			path: f.name + "/" + file.Name,
-		}, err: nil}
+		f.fs.cacheFile(f.name+"/"+file.Name, file)
+	}
+
+	for _, e := range pending {
+		files = append(files, e.info())
+	}
+	for _, t := range f.fs.transient.in(f.name) {
+		files = append(files, t.info())
+	}
 
-		f.fs.cache.Set(cacheKeyFile + lookup.fp.path, lookup, time.Minute)
+	if f.name == "" {
+		for _, name := range mountNames() {
+			if mount, err := f.fs.getFile(f.ctx, "/"+name, true); err == nil {
+				files = append(files, f.fs.fileInfo(mount.file))
+			}
+		}
+		for _, vf := range virtualFolders() {
+			files = append(files, vf.info())
+		}
 	}
 
 	return files, nil
 }
 
 func (f *openReadonlyFile) Stat() (os.FileInfo, error) {
-	return newFileInfo(f.file), nil
+	return f.fs.fileInfo(f.file), nil
 }
 
 func (f *openReadonlyFile) Close() error {
 	log.Debug("Close ", f.name)
 	f.content = nil
-	if f.body != nil {
-		f.body.Close()
-	}
-	f.contentReader = nil
+	f.closeContentReader()
+	f.spool.abort()
 	return nil
 }
 
@@ -262,88 +539,241 @@ func (f *openReadonlyFile) initContentReader() error {
 		return nil
 	}
 
-	// Get timeout reader wrapper and context
-	timeoutReaderWrapper, ctx := getTimeoutReaderWrapperContext(time.Second * 15)
+	if f.pos > 0 && f.pos >= f.file.Size {
+		// Nothing left, Drive would answer the range request with 416.
+		f.contentReader = &bytes.Buffer{}
+		return nil
+	}
 
-	res, err := f.fs.client.Files.Get(f.file.Id).Context(ctx).Download()
+	// Get timeout reader wrapper and context
+	timeout := *downloadTimeoutFlag
+	timeoutReaderWrapper, ctx := getTimeoutReaderWrapperContext(f.ctx, timeout)
+
+	var res *http.Response
+	var err error
+	if f.revisionID != "" {
+		q := f.fs.client.Revisions.Get(f.file.Id, f.revisionID).AcknowledgeAbuse(acknowledgesAbuse(ctx)).Context(ctx)
+		setRangeHeader(q.Header(), f.pos)
+		res, err = q.Download()
+	} else {
+		q := f.fs.client.Files.Get(f.file.Id).SupportsAllDrives(true).AcknowledgeAbuse(acknowledgesAbuse(ctx)).Context(ctx)
+		setRangeHeader(q.Header(), f.pos)
+		res, err = q.Download()
+	}
 
 	if err != nil {
 		if err == context.Canceled {
-			log.Errorf("Failed to download file: timeout, no data was transferred for %v", time.Second*15)
+			log.Errorf("Failed to download file: timeout, no data was transferred for %v", timeout)
+			return err
+		}
+		if f.revisionID == "" && f.fs.stale != nil && isUnreachable(err) {
+			if cached, cerr := openCachedContent(f.file); cerr == nil {
+				f.fs.setOffline(err)
+				log.Debugf("Reading %v from cache, Drive is unreachable", f.name)
+				if _, err := cached.Seek(f.pos, io.SeekStart); err != nil {
+					cached.Close()
+					return err
+				}
+				f.cached = cached
+				f.contentReader = cached
+				return nil
+			}
+		}
+		if ge, ok := err.(*googleapi.Error); ok && hasErrorReason(ge, "cannotDownloadAbusiveFile") {
+			log.Errorf("Drive flagged %v as malware or spam, its owner may download it with --acknowledge-abuse or the %v header: %v", f.name, acknowledgeAbuseHeader, err)
 			return err
 		}
 		log.Errorf("Failed to download file: %s", err)
 		return err
 	}
 
+	if f.pos > 0 && res.StatusCode != http.StatusPartialContent {
+		res.Body.Close()
+		log.Errorf("Failed to download file from byte %v: got status %v", f.pos, res.Status)
+		return fmt.Errorf("range request not honored")
+	}
+
+	if f.pos == 0 && *verifyChecksumsFlag {
+		// Only content read from the start can be verified.
+		f.hash = md5.New()
+	}
+	if f.pos == 0 && f.revisionID == "" && f.spool == nil {
+		f.spool = newContentSpool(f.file)
+	}
+
 	f.body = res.Body
-	f.contentReader = timeoutReaderWrapper(f.body)
+	atomic.AddInt64(&f.fs.stats.activeDownloads, 1)
+	f.contentReader = newProgressReader(timeoutReaderWrapper(f.body), "Download", f.name, f.pos, f.file.Size)
 
 	return nil
 }
 
+func setRangeHeader(h http.Header, pos int64) {
+	if pos > 0 {
+		h.Set("Range", fmt.Sprintf("bytes=%d-", pos))
+	}
+}
+
+// closeContentReader closes the download, the next Read starts a new one
+// at the current position.
+func (f *openReadonlyFile) closeContentReader() {
+	if f.body != nil {
+		f.body.Close()
+		f.body = nil
+		atomic.AddInt64(&f.fs.stats.activeDownloads, -1)
+	}
+	if f.cached != nil {
+		f.cached.Close()
+		f.cached = nil
+	}
+	f.contentReader = nil
+}
+
 func (f *openReadonlyFile) Read(p []byte) (n int, err error) {
 	log.Debug("Read ", len(p))
-	//err = f.initContent()
-	err = f.initContentReader()
+	for {
+		err = f.initContentReader()
+		if err != nil {
+			log.Error(err)
+			return 0, err
+		}
 
-	if err != nil {
-		log.Error(err)
-		return 0, err
-	}
+		n, err = f.contentReader.Read(p)
+		f.pos += int64(n)
+		if f.hash != nil {
+			f.hash.Write(p[:n])
+		}
+		if f.spool != nil && f.cached == nil {
+			f.spool.write(p[:n])
+		}
+		if err == io.EOF && f.pos < f.file.Size {
+			err = io.ErrUnexpectedEOF
+		}
+		if err == io.EOF && f.hash != nil {
+			if verr := verifyChecksum(f.name, f.file.Md5Checksum, f.hash); verr != nil {
+				return n, verr
+			}
+		}
+		if err == io.EOF && f.spool != nil {
+			f.spool.commit(f.file.Size)
+		}
+		if err == nil || err == io.EOF {
+			return n, err
+		}
 
-	n, err = f.contentReader.Read(p)
-	if err != nil {
-		log.Error(err)
-		return 0, err
+		// The download broke, continue it from the current position.
+		if f.ctx.Err() != nil || f.retries >= *downloadRetriesFlag {
+			log.Error(err)
+			return n, err
+		}
+		f.retries++
+		log.Warnf("Download %v interrupted at byte %v, resuming (attempt %v of %v): %v", f.name, f.pos, f.retries, *downloadRetriesFlag, err)
+		f.closeContentReader()
+		if n > 0 {
+			return n, nil
+		}
 	}
-
-	f.pos += int64(n)
-	return n, err
 }
 
 func (f *openReadonlyFile) Seek(offset int64, whence int) (int64, error) {
 	log.Debug("Seek ", offset, whence)
 
-	if whence == 0 {
-		//// io.SeekStart
-		//if f.content != nil {
-		//	f.pos = 0
-		//	f.contentReader = bytes.NewBuffer(f.content)
-		//	return 0, nil
-		//}
-		f.pos = 0
-		return f.pos, nil
+	pos := offset
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		pos += f.pos
+	case io.SeekEnd:
+		pos += f.file.Size
+	default:
+		log.Errorf("Seek whence %v is not supported", whence)
+		return 0, errNotImplemented
 	}
-
-	if whence == 2 {
-		//// io.SeekEnd
-		//err := f.initContent()
-		//if err != nil {
-		//	return 0, err
-		//}
-		//f.contentReader = &bytes.Buffer{}
-		//f.pos = f.size
-		f.size = f.file.Size
-		f.pos = f.size
-		return f.pos, nil
+	if pos < 0 {
+		return 0, os.ErrInvalid
 	}
 
-	panic("not implemented")
+	if pos != f.pos {
+		f.closeContentReader()
+		f.pos = pos
+		f.hash = nil
+		f.spool.abort()
+	}
+	return f.pos, nil
 }
 
 func (fs *fileSystem) OpenFile(ctx context.Context, name string, flag int, perm os.FileMode) (webdav.File, error) {
 	log.Debugf("OpenFile %v %v %v", name, flag, perm)
 	name = normalizePath(name)
 
+	if isVersionsPath(name) {
+		return fs.openVersions(ctx, name, flag)
+	}
+	if vf := findVirtualFolder(name); vf != nil {
+		return fs.openVirtual(ctx, vf, name, flag)
+	}
+
+	if flag == os.O_RDWR {
+		// Opened by PROPPATCH to update properties of an existing file.
+		if err := fs.queue.wait(ctx, name); err != nil {
+			return nil, err
+		}
+		return fs.openReadonlyFile(ctx, name)
+	}
+
 	if flag&os.O_RDWR != 0 {
 		if flag != os.O_RDWR|os.O_CREATE|os.O_TRUNC {
-			panic("not implemented")
+			log.Errorf("unsupported open mode: %v", flag)
+			return nil, errNotImplemented
+		}
+
+		if isFilteredPath(name) {
+			log.Errorf("can't write filtered %v", name)
+			return nil, os.ErrPermission
+		}
+		if isHiddenPath(name) {
+			return &discardFile{name: name}, nil
+		}
+		if fs.queue == nil {
+			if err := fs.checkWritable(name); err != nil {
+				return nil, err
+			}
+		}
+
+		parent, err := fs.getFile(ctx, path.Dir(name), true)
+		if err != nil {
+			log.Errorf("can't locate parent of %v: %v", name, err)
+			if err == os.ErrNotExist {
+				err = errNoParent
+			}
+			return nil, err
+		}
+		if fs.transient.holds(name) {
+			return fs.transient.create(name), nil
+		}
+		if existing, err := fs.getFile(ctx, name, false); err == nil {
+			if err := checkCanEdit(name, existing.file); err != nil {
+				return nil, err
+			}
+		} else if err := checkCanAddChildren(path.Dir(name), parent.file); err != nil {
+			return nil, err
+		}
+		if skip, err := dryRun("write %v", name); skip {
+			if err != nil {
+				return nil, err
+			}
+			return &discardFile{name: name, dryRun: true}, nil
+		}
+		if isStreamedUpload(ctx) {
+			if f := fs.openStreamed(ctx, name, parent.file.Id); f != nil {
+				return f, nil
+			}
 		}
 
 		return &openWritableFile{
 			ctx:        ctx,
 			fileSystem: fs,
+			buffer:     getBuffer(),
 			name:       name,
 			flag:       flag,
 			perm:       perm,
@@ -351,64 +781,265 @@ func (fs *fileSystem) OpenFile(ctx context.Context, name string, flag int, perm
 	}
 
 	if flag == os.O_RDONLY {
-		file, err := fs.getFile(name, false)
-		if err != nil {
-			return nil, err
+		if t := fs.transient.get(name); t != nil {
+			return t.open(), nil
 		}
-		return &openReadonlyFile{fs: fs, file: file.file, name: name}, nil
+		if e := fs.queue.pending(name); e != nil {
+			return fs.queue.open(e)
+		}
+		return fs.openReadonlyFile(ctx, name)
 	}
 
-	return nil, fmt.Errorf("unsupported open mode: %v", flag)
+	log.Errorf("unsupported open mode: %v", flag)
+	return nil, errNotImplemented
+}
+
+func (fs *fileSystem) openReadonlyFile(ctx context.Context, name string) (webdav.File, error) {
+	file, err := fs.getFile(ctx, name, false)
+	if err != nil {
+		return nil, err
+	}
+	return compressed(&openReadonlyFile{ctx: ctx, fs: fs, file: file.file, name: name}), nil
 }
 
 func (fs *fileSystem) RemoveAll(ctx context.Context, name string) error {
 	log.Debugf("RemoveAll %v", name)
 	name = normalizePath(name)
-	id, err := fs.getFileID(name, false)
-	if err != nil {
+	if _, ok := mountedFolderID(name); ok || name == "" || isVersionsPath(name) || isVirtualPath(name) || isAppDataRoot(name) {
+		log.Errorf("can't delete %v", name)
+		return os.ErrPermission
+	}
+	if fs.transient.remove(name) {
+		return nil
+	}
+	if err := fs.queue.wait(ctx, name); err != nil {
+		return err
+	}
+	if err := fs.checkWritable(name); err != nil {
 		return err
 	}
 
-	err = fs.client.Files.Delete(id).Do()
+	fp, err := fs.getFile(ctx, name, false)
 	if err != nil {
-		log.Errorf("can't delete file %v", err)
+		return err
+	}
+	if skip, err := dryRun("delete %v", name); skip {
 		return err
 	}
 
-	fs.invalidatePath(name)
+	err = fs.removeTree(ctx, name, fp.file)
+	fs.invalidateTree(name)
 	fs.invalidatePath(path.Dir(name))
+	if err == nil {
+		fs.mirror.add(mirrorRemove, name, "")
+	}
+	return err
+}
+
+// removeTree deletes file. Drive deletes the files of a folder together with
+// it, except those we can't delete which are silently left orphaned. So
+// subfolders are walked and the files we can't delete are reported, the
+// folders containing them are kept.
+func (fs *fileSystem) removeTree(ctx context.Context, p string, file *drive.File) error {
+	if file.MimeType == mimeTypeFolder {
+		children, err := fs.listChildren(ctx, file.Id)
+		if err != nil {
+			return err
+		}
+
+		failed := &removeError{}
+		for _, child := range children {
+			if child.MimeType != mimeTypeFolder && child.Capabilities != nil && child.Capabilities.CanDelete {
+				continue
+			}
+			childPath := path.Join(p, child.Name)
+			if err := fs.removeTree(ctx, childPath, child); err != nil {
+				failed.add(childPath, err)
+			}
+		}
+		if len(failed.errs) > 0 {
+			return failed
+		}
+	}
+
+	err := fs.client.Files.Delete(file.Id).SupportsAllDrives(true).Context(ctx).Do()
+	if err != nil {
+		log.Errorf("can't delete file %v: %v", p, err)
+		failed := &removeError{}
+		failed.add(p, err)
+		return failed
+	}
 	return nil
+}
 
+// listChildren lists all children of a folder, unlike listFolder it
+// doesn't hide or rename any.
+func (fs *fileSystem) listChildren(ctx context.Context, folderID string) ([]*drive.File, error) {
+	query := fmt.Sprintf("%s in parents and trashed = false", quoteQueryString(folderID))
+	children := []*drive.File{}
+	err := fs.listFiles().Q(query).Fields("nextPageToken, files("+fileFields+")").Pages(ctx, func(r *drive.FileList) error {
+		children = append(children, r.Files...)
+		return nil
+	})
+	if err != nil {
+		log.Error("Can't list children ", err)
+		return nil, err
+	}
+	return children, nil
 }
 func (fs *fileSystem) Rename(ctx context.Context, oldName, newName string) error {
-	log.Critical("not implemented")
-	panic("not implemented")
+	log.Debugf("Rename %v %v", oldName, newName)
+	oldName = normalizePath(oldName)
+	newName = normalizePath(newName)
+	if isVersionsPath(oldName) || isVersionsPath(newName) || isVirtualPath(newName) {
+		return os.ErrPermission
+	}
+	if _, ok := mountedFolderID(oldName); ok {
+		log.Errorf("can't rename mounted folder %v", oldName)
+		return os.ErrPermission
+	}
+	if isHiddenPath(newName) || isFilteredPath(newName) {
+		log.Errorf("can't rename %v to hidden %v", oldName, newName)
+		return os.ErrPermission
+	}
+	if vf := findVirtualFolder(oldName); vf != nil {
+		return fs.renameVirtual(ctx, vf, oldName, newName)
+	}
+	if t := fs.transient.get(oldName); t != nil {
+		return fs.renameTransient(ctx, t, newName)
+	}
+	if err := fs.queue.wait(ctx, oldName); err != nil {
+		return err
+	}
+	if err := fs.queue.wait(ctx, newName); err != nil {
+		return err
+	}
+	if err := fs.checkWritable(oldName); err != nil {
+		return err
+	}
+
+	src, err := fs.getFile(ctx, oldName, false)
+	if err != nil {
+		return err
+	}
+
+	if _, err := fs.getFile(ctx, newName, false); err != os.ErrNotExist {
+		if err == nil {
+			err = os.ErrExist
+		}
+		return err
+	}
+
+	oldParentID, err := fs.getFileID(ctx, path.Dir(oldName), true)
+	if err != nil {
+		return err
+	}
+	newParent, err := fs.getFile(ctx, path.Dir(newName), true)
+	if err == os.ErrNotExist {
+		return errNoParent
+	}
+	if err != nil {
+		return err
+	}
+	newParentID := newParent.file.Id
+	if newParentID != oldParentID {
+		if err := checkCanAddChildren(path.Dir(newName), newParent.file); err != nil {
+			return err
+		}
+	}
+	if skip, err := dryRun("rename %v to %v", oldName, newName); skip {
+		return err
+	}
+
+	// Drive doesn't rename read-only files either, the client holding the
+	// lock has been confirmed by webdav.Handler already.
+	restricted, ours := contentRestriction(src.file)
+	if restricted && !ours {
+		log.Errorf("%v is read-only in Drive", oldName)
+		return errLocked
+	}
+	lockedName := oldName
+	if restricted {
+		if err := fs.setReadOnly(ctx, oldName, src.file.Id, false); err != nil {
+			log.Error(err)
+			return err
+		}
+		defer func() {
+			if err := fs.setReadOnly(ctx, lockedName, src.file.Id, true); err != nil {
+				log.Errorf("can't lock %v in Drive again: %v", lockedName, err)
+			}
+		}()
+	}
+
+	meta := &drive.File{Name: path.Base(newName)}
+	if src.file.Trashed {
+		// Restore trashed files listed with --show-trashed.
+		meta.Trashed = false
+		meta.ForceSendFields = []string{"Trashed"}
+	}
+	q := fs.client.Files.Update(src.file.Id, meta).SupportsAllDrives(true)
+	if newParentID != oldParentID {
+		q.AddParents(newParentID).RemoveParents(oldParentID)
+	}
+	_, err = q.Context(ctx).Do()
+	if err != nil {
+		log.Errorf("can't rename file %v", err)
+		return err
+	}
+	lockedName = newName
+
+	fs.invalidateTree(oldName)
+	fs.invalidatePath(newName)
+	fs.invalidatePath(path.Dir(oldName))
+	fs.invalidatePath(path.Dir(newName))
+	fs.mirror.add(mirrorRename, oldName, newName)
+	return nil
 }
 
 type fileInfo struct {
-	name         string
-	isDir        bool
-	modTime      time.Time
-	size         int64
+	id       string
+	name     string
+	isDir    bool
+	modTime  time.Time
+	size     int64
+	mimeType string
+	readOnly bool
+	// webViewLink opens the file in the Drive web UI.
+	webViewLink string
 }
 
-
 func (fi *fileInfo) ContentType(ctx context.Context) (string, error) {
-	return "application/octet-stream", nil
+	if fi.mimeType != "" && fi.mimeType != mimeTypeOctetStream && !isGoogleMimeType(fi.mimeType) {
+		return fi.mimeType, nil
+	}
+	if t := mime.TypeByExtension(path.Ext(fi.name)); t != "" {
+		return t, nil
+	}
+	return mimeTypeOctetStream, nil
+}
+
+// isGoogleMimeType reports whether mimeType denotes a Google-native
+// document or a folder, which have no downloadable content type.
+func isGoogleMimeType(mimeType string) bool {
+	return strings.HasPrefix(mimeType, mimeTypeGooglePrefix)
 }
 
 func newFileInfo(file *drive.File) *fileInfo {
 	modTime, err := getModTime(file)
 	if err != nil {
-		log.Error(err)
-		panic(err)
+		log.Errorf("can't parse modification time of %v: %v", file.Name, err)
 	}
 
 	return &fileInfo{
-		name:         file.Name,
-		isDir:        file.MimeType == mimeTypeFolder,
-		modTime:      modTime,
-		size:         file.Size,
+		id:       file.Id,
+		name:     file.Name,
+		isDir:    file.MimeType == mimeTypeFolder,
+		modTime:  modTime,
+		size:     contentSize(file),
+		mimeType: file.MimeType,
+		readOnly: file.Capabilities != nil && !file.Capabilities.CanEdit,
+
+		webViewLink: file.WebViewLink,
 	}
 }
 
@@ -441,8 +1072,15 @@ func (fi *fileInfo) Size() int64 {
 	return fi.size
 }
 func (fi *fileInfo) Mode() os.FileMode {
-	log.Critical("not implemented")
-	panic("not implemented")
+	mode := os.FileMode(0644)
+	if fi.isDir {
+		mode = os.ModeDir | 0755
+	}
+	if fi.readOnly {
+		// Files shared with us without edit rights.
+		mode &^= 0222
+	}
+	return mode
 }
 func (fi *fileInfo) ModTime() time.Time {
 	return fi.modTime
@@ -453,7 +1091,19 @@ func (fi *fileInfo) Sys() interface{} {
 
 func (fs *fileSystem) Stat(ctx context.Context, name string) (os.FileInfo, error) {
 	log.Debugf("Stat %v", name)
-	f, err := fs.getFile(name, false)
+	if isVersionsPath(normalizePath(name)) {
+		return fs.statVersions(ctx, normalizePath(name))
+	}
+	if vf := findVirtualFolder(normalizePath(name)); vf != nil {
+		return fs.statVirtual(ctx, vf, normalizePath(name))
+	}
+	if t := fs.transient.get(normalizePath(name)); t != nil {
+		return t.info(), nil
+	}
+	if e := fs.queue.pending(name); e != nil {
+		return e.info(), nil
+	}
+	f, err := fs.getFile(ctx, name, false)
 
 	if err != nil {
 		log.Error(err)
@@ -465,11 +1115,43 @@ func (fs *fileSystem) Stat(ctx context.Context, name string) (os.FileInfo, error
 		return nil, os.ErrNotExist
 	}
 
-	return newFileInfo(f.file), nil
+	return fs.fileInfo(f.file), nil
+}
+
+func (fs *fileSystem) listFolder0(ctx context.Context, folderID string) ([]*drive.File, error) {
+	log.Tracef("listFolder0 %v", folderID)
+	files, indexed := fs.indexChildren(ctx, folderID)
+	if !indexed {
+		query := fmt.Sprintf("%s in parents", quoteQueryString(folderID))
+		err := fs.listFiles().Q(query).Fields("nextPageToken, files("+fileFields+")").Pages(ctx, func(r *drive.FileList) error {
+			files = append(files, r.Files...)
+			return nil
+		})
+		if err != nil {
+			log.Error("Can't list children ", err)
+			return nil, err
+		}
+	}
+
+	children := []*drive.File{}
+	for _, file := range files {
+		if !ignoreFile(file) {
+			children = append(children, file)
+		}
+	}
+	return resolveDuplicates(markTrashed(normalizeFileNames(children))), nil
+}
+
+// rootFolderID returns the ID of the folder served as the root.
+func rootFolderID() string {
+	if *rootFolderIDFlag != "" {
+		return *rootFolderIDFlag
+	}
+	return "root"
 }
 
-func (fs *fileSystem) getFileID(p string, onlyFolder bool) (string, error) {
-	f, err := fs.getFile(p, onlyFolder)
+func (fs *fileSystem) getFileID(ctx context.Context, p string, onlyFolder bool) (string, error) {
+	f, err := fs.getFile(ctx, p, onlyFolder)
 
 	if err != nil {
 		return "", err
@@ -478,59 +1160,165 @@ func (fs *fileSystem) getFileID(p string, onlyFolder bool) (string, error) {
 	return f.file.Id, nil
 }
 
-func (fs *fileSystem) getFile0(p string, onlyFolder bool) (*fileAndPath, error) {
+func (fs *fileSystem) getFile0(ctx context.Context, p string, onlyFolder bool) (*fileAndPath, error) {
 	log.Tracef("getFile0 %v %v", p, onlyFolder)
 	p = normalizePath(p)
 
+	if isHiddenPath(p) || isFilteredPath(p) {
+		return nil, os.ErrNotExist
+	}
+
 	if p == "" {
-		f, err := fs.client.Files.Get("root").Do()
-		if err != nil {
-			log.Error(err)
-			return nil, err
-		}
-		return &fileAndPath{file: f, path: "/"}, nil
+		return fs.getRoot(ctx)
+	}
+
+	if isAppDataRoot(p) {
+		return fs.getAppDataFolder(ctx)
+	}
+	if id, ok := mountedFolderID(p); ok {
+		return fs.getMountedFolder(ctx, p, id)
 	}
 
 	parent := path.Dir(p)
 	base := path.Base(p)
 
-	parentID, err := fs.getFileID(parent, true)
+	parentID, err := fs.getFileID(ctx, parent, true)
 	if err != nil {
 		log.Errorf("can't locate parent %v error: %v", parent, err)
 		return nil, err
 	}
 
-	q := fs.client.Files.List()
-	query := fmt.Sprintf("'%s' in parents and name=\"%s\"", parentID, base)
-	if onlyFolder {
-		query += " and mimeType='" + mimeTypeFolder + "'"
+	found, err := fs.findChildren(ctx, parentID, base, onlyFolder)
+	if err != nil {
+		log.Error(err)
+		return nil, err
+	}
+
+	files := []*drive.File{}
+	for _, file := range found {
+		if !ignoreFile(file) && !file.Trashed {
+			files = append(files, file)
+		}
+	}
+
+	if len(files) > 0 {
+		files = normalizeFileNames(files)
+		return &fileAndPath{file: newestFile(files), path: p}, nil
 	}
-	q.Q(query)
-	q.Fields("files(id,name,mimeType,trashed,parents,size,parents,createdTime,modifiedTime)")
-	log.Tracef("Query: %v", query)
 
-	r, err := q.Do()
+	if *showTrashedFlag {
+		if name, ok := parseTrashedName(base); ok {
+			if fp, err := fs.getTrashed(ctx, p, parentID, name, onlyFolder); err == nil {
+				return fp, nil
+			}
+		}
+	}
 
+	if *duplicatesFlag == duplicatesSuffix {
+		if name, id, ok := parseDuplicateName(base); ok {
+			if fp, err := fs.getDuplicate(ctx, p, parentID, name, id, onlyFolder); err == nil {
+				return fp, nil
+			}
+		}
+	}
+
+	if *caseInsensitiveFlag {
+		return fs.getFileCaseInsensitive(ctx, p, parentID, onlyFolder)
+	}
+
+	return nil, os.ErrNotExist
+}
+
+// findChildren returns the files of folder parentID called name.
+func (fs *fileSystem) findChildren(ctx context.Context, parentID string, name string, onlyFolder bool) ([]*drive.File, error) {
+	if children, ok := fs.indexChildren(ctx, parentID); ok {
+		files := []*drive.File{}
+		for _, file := range children {
+			if normalizeName(file.Name) == name && (!onlyFolder || file.MimeType == mimeTypeFolder) {
+				files = append(files, file)
+			}
+		}
+		return files, nil
+	}
+
+	query := childQuery(parentID, name, onlyFolder)
+	log.Tracef("Query: %v", query)
+	r, err := fs.listFiles().Q(query).Fields("files(" + fileFields + ")").Context(ctx).Do()
+	if err != nil {
+		return nil, err
+	}
+	return r.Files, nil
+}
+
+// getFileCaseInsensitive looks up the last component of p among the
+// children of parentID ignoring case. When several children match, the
+// one whose name sorts first wins.
+func (fs *fileSystem) getFileCaseInsensitive(ctx context.Context, p string, parentID string, onlyFolder bool) (*fileAndPath, error) {
+	children, err := fs.listFolder(ctx, parentID)
 	if err != nil {
-		log.Error(err)
 		return nil, err
 	}
 
-	for _, file := range r.Files {
-		if ignoreFile(file) {
+	base := path.Base(p)
+	var match *drive.File
+	for _, file := range children {
+		if !strings.EqualFold(file.Name, base) {
+			continue
+		}
+		if onlyFolder && file.MimeType != mimeTypeFolder {
 			continue
 		}
+		if match == nil || file.Name < match.Name {
+			match = file
+		}
+	}
 
-		return &fileAndPath{file: file, path: p}, nil
+	if match == nil {
+		return nil, os.ErrNotExist
 	}
+	return &fileAndPath{file: match, path: p}, nil
+}
 
-	return nil, os.ErrNotExist
+// getDuplicate looks up a file exposed under a name produced by duplicateName.
+func (fs *fileSystem) getDuplicate(ctx context.Context, p string, parentID string, name string, id string, onlyFolder bool) (*fileAndPath, error) {
+	file, err := fs.client.Files.Get(id).SupportsAllDrives(true).Fields(fileFields).Context(ctx).Do()
+	if err != nil {
+		log.Debugf("can't get duplicate %v: %v", id, err)
+		return nil, os.ErrNotExist
+	}
+
+	if file.Trashed {
+		file.Name = trashedName(file)
+	}
+	if normalizeName(file.Name) != name || ignoreFile(file) || !hasParent(file, parentID) {
+		return nil, os.ErrNotExist
+	}
+	if onlyFolder && file.MimeType != mimeTypeFolder {
+		return nil, os.ErrNotExist
+	}
+
+	dup := *file
+	dup.Name = path.Base(p)
+	return &fileAndPath{file: &dup, path: p}, nil
+}
+
+func hasParent(file *drive.File, parentID string) bool {
+	for _, id := range file.Parents {
+		if id == parentID {
+			return true
+		}
+	}
+	return false
 }
 
 func ignoreFile(f *drive.File) bool {
-	return f.Trashed
+	return (f.Trashed && !*showTrashedFlag) || isHiddenName(f.Name) || isHiddenGoogleDoc(f)
+}
+
+func isHiddenGoogleDoc(f *drive.File) bool {
+	return *hideGoogleDocsFlag && f.MimeType != mimeTypeFolder && isGoogleMimeType(f.MimeType)
 }
 
 func normalizePath(p string) string {
-	return strings.TrimRight(p, "/")
+	return normalizeName(strings.TrimRight(p, "/"))
 }
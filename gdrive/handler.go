@@ -0,0 +1,394 @@
+package gdrive
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"path"
+	"strings"
+
+	log "github.com/cihub/seelog"
+	"golang.org/x/net/context"
+	"golang.org/x/net/webdav"
+)
+
+var (
+	cacheControlFlag = flag.String("cache-control", "no-cache", "Cache-Control header of file downloads. The default lets browsers and proxies keep files but makes them check the ETag or modification time before reusing them. Empty leaves it out.")
+)
+
+type contextKey int
+
+const (
+	statusWriterKey contextKey = iota
+)
+
+type handler struct {
+	dav       *webdav.Handler
+	limiter   *rateLimiter
+	downloads *transferLimiter
+	uploads   *transferLimiter
+	audit     *auditLog
+}
+
+// NewHandler creates WebDAV handler serving the given file and lock systems.
+// Errors returned by the file system are translated to HTTP statuses more
+// precise than the generic ones picked by webdav.Handler.
+func NewHandler(fs webdav.FileSystem, ls webdav.LockSystem) http.Handler {
+	dav := &webdav.Handler{
+		FileSystem: fs,
+		LockSystem: ls,
+		Logger: func(r *http.Request, err error) {
+			if err == nil {
+				return
+			}
+			log.Debugf("%v %v: %v", r.Method, r.URL.Path, err)
+			if w, ok := r.Context().Value(statusWriterKey).(*statusWriter); ok {
+				w.err = err
+			}
+		},
+	}
+	return &handler{
+		dav:       dav,
+		limiter:   newRateLimiter(),
+		downloads: newTransferLimiter(*maxUserDownloadsFlag),
+		uploads:   newTransferLimiter(*maxUserUploadsFlag),
+		audit:     newAuditLog(),
+	}
+}
+
+func (h *handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !h.limiter.limit(w, r) {
+		return
+	}
+	transfers := h.downloads
+	if r.Method == "PUT" {
+		transfers = h.uploads
+	}
+	if r.Method == "GET" || r.Method == "PUT" {
+		release, err := transfers.acquire(r.Context(), requestUser(r))
+		if err != nil {
+			return
+		}
+		defer release()
+	}
+	w, audit := h.startAudit(w, r)
+	defer audit()
+	if r.Method == "PUT" || r.Method == "MKCOL" || r.Method == "MOVE" || r.Method == "COPY" {
+		if reason := sanitizeRequest(r); reason != "" {
+			log.Infof("%v %v refused: %v", r.Method, r.URL.Path, reason)
+			http.Error(w, "Bad Request: "+reason, http.StatusBadRequest)
+			return
+		}
+	}
+	if r.Method == "PUT" || r.Method == "MOVE" || r.Method == "COPY" {
+		if reason := checkUploadRules(r); reason != "" {
+			log.Infof("%v %v refused: %v", r.Method, r.URL.Path, reason)
+			http.Error(w, "Forbidden: "+reason, http.StatusForbidden)
+			return
+		}
+	}
+	sw := &statusWriter{ResponseWriter: w}
+	r = r.WithContext(context.WithValue(r.Context(), statusWriterKey, sw))
+	if r.Method == "GET" {
+		r = withAcknowledgeAbuse(r)
+	}
+	if r.Method == "PUT" {
+		r = withStreamedUpload(r)
+	}
+	if *windowsCompatFlag {
+		setWindowsHeaders(sw, r)
+	}
+	if r.Method == "GET" || r.Method == "HEAD" {
+		h.setContentType(sw, r)
+		if *cacheControlFlag != "" {
+			sw.Header().Set("Cache-Control", *cacheControlFlag)
+		}
+	}
+	if r.Method == "GET" && isBrowser(r) {
+		h.setContentDisposition(sw, r)
+	}
+	if r.Method == "GET" && r.URL.Query().Get("view") == "web" {
+		h.redirectToDrive(sw, r)
+		sw.flush()
+		return
+	}
+	if format := r.URL.Query().Get("archive"); r.Method == "GET" && format != "" && h.serveArchive(sw, r, format) {
+		sw.flush()
+		return
+	}
+	if r.Method == "HEAD" && h.serveHead(sw, r) {
+		sw.flush()
+		return
+	}
+	// The methods below serve the names stored in Drive, so they are left to
+	// webdav.Handler when the file system is wrapped by --crypt-password.
+	if isInfinitePropfind(r) {
+		if *propfindInfinityFlag == propfindInfinityDeny {
+			denyInfinitePropfind(sw)
+			sw.flush()
+			return
+		}
+		if fs, ok := h.dav.FileSystem.(*fileSystem); ok && *propfindInfinityFlag == propfindInfinityBatched && h.servePropfind(sw, r, fs, true) {
+			sw.flush()
+			return
+		}
+	}
+	if r.Method == "PROPFIND" && r.Header.Get("Depth") == "1" {
+		if fs, ok := h.dav.FileSystem.(*fileSystem); ok && h.servePropfind(sw, r, fs, false) {
+			sw.flush()
+			return
+		}
+	}
+	if r.Method == "REPORT" {
+		if fs, ok := h.dav.FileSystem.(*fileSystem); ok {
+			h.handleReport(sw, r, fs)
+			sw.flush()
+			return
+		}
+	}
+	if r.Method == "SEARCH" {
+		if fs, ok := h.dav.FileSystem.(*fileSystem); ok {
+			h.handleSearch(sw, r, fs)
+			sw.flush()
+			return
+		}
+	}
+	if r.Method == "OPTIONS" {
+		if _, ok := h.dav.FileSystem.(*fileSystem); ok {
+			sw.Header().Set("DASL", "<DAV:basicsearch>")
+		}
+	}
+	if (r.Method == "COPY" || r.Method == "MOVE") && isVersionsPath(normalizePath(r.URL.Path)) {
+		if fs, ok := h.dav.FileSystem.(*fileSystem); ok {
+			h.restoreRevision(sw, r, fs)
+			sw.flush()
+			return
+		}
+	}
+	if r.Method == "PUT" && *quotaCheckFlag {
+		if fs, ok := driveFS(h.dav.FileSystem); ok {
+			if err := fs.checkQuota(r.Context(), r.ContentLength); err != nil {
+				status := errorStatus(err)
+				http.Error(w, webdav.StatusText(status), status)
+				return
+			}
+		}
+	}
+	h.davFor(r).ServeHTTP(sw, r)
+	sw.flush()
+}
+
+// davFor returns the webdav.Handler serving r. Locks are only created for
+// clients by LOCK, those of other methods last for the request.
+func (h *handler) davFor(r *http.Request) *webdav.Handler {
+	if r.Method == "LOCK" || h.dav.LockSystem == nil {
+		return h.dav
+	}
+	dav := *h.dav
+	dav.LockSystem = requestLS{h.dav.LockSystem}
+	return &dav
+}
+
+// setContentType sets Content-Type of the response from file metadata,
+// otherwise http.ServeContent would sniff it by reading the content.
+func (h *handler) setContentType(w http.ResponseWriter, r *http.Request) {
+	fi, err := h.dav.FileSystem.Stat(r.Context(), r.URL.Path)
+	if err != nil || fi.IsDir() {
+		return
+	}
+	if ct, ok := fi.(webdav.ContentTyper); ok {
+		if t, err := ct.ContentType(r.Context()); err == nil {
+			w.Header().Set("Content-Type", t)
+		}
+	}
+}
+
+// serveHead answers HEAD on a file from its metadata alone. webdav.Handler
+// would open the file, and start a download if anything reads it. Folders
+// and errors are left to webdav.Handler.
+func (h *handler) serveHead(w http.ResponseWriter, r *http.Request) bool {
+	fi, err := h.dav.FileSystem.Stat(r.Context(), r.URL.Path)
+	if err != nil || fi.IsDir() {
+		return false
+	}
+	if w.Header().Get("Content-Type") == "" {
+		t := mime.TypeByExtension(path.Ext(fi.Name()))
+		if t == "" {
+			t = mimeTypeOctetStream
+		}
+		w.Header().Set("Content-Type", t)
+	}
+	// The same ETag as webdav.Handler's.
+	etag := fmt.Sprintf(`"%x%x"`, fi.ModTime().UnixNano(), fi.Size())
+	if e, ok := fi.(webdav.ETager); ok {
+		if s, err := e.ETag(r.Context()); err == nil {
+			etag = s
+		}
+	}
+	w.Header().Set("ETag", etag)
+	http.ServeContent(w, r, fi.Name(), fi.ModTime(), &sizeSeeker{size: fi.Size()})
+	return true
+}
+
+// redirectToDrive answers GET with ?view=web by redirecting to the page of
+// the file or folder in the Drive web UI, for commenting or sharing.
+func (h *handler) redirectToDrive(w http.ResponseWriter, r *http.Request) {
+	fi, err := h.dav.FileSystem.Stat(r.Context(), r.URL.Path)
+	if err != nil {
+		status := errorStatus(err)
+		if status == 0 {
+			status = http.StatusNotFound
+		}
+		http.Error(w, webdav.StatusText(status), status)
+		return
+	}
+	info, ok := fi.Sys().(*fileInfo)
+	if !ok || info.webViewLink == "" {
+		http.Error(w, "Not Found: no Drive page for "+r.URL.Path, http.StatusNotFound)
+		return
+	}
+	http.Redirect(w, r, info.webViewLink, http.StatusFound)
+}
+
+// sizeSeeker lets http.ServeContent find the size of content it doesn't
+// read.
+type sizeSeeker struct {
+	size int64
+	pos  int64
+}
+
+func (s *sizeSeeker) Read(p []byte) (int, error) {
+	return 0, errNotSupported
+}
+
+func (s *sizeSeeker) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+		s.pos = offset
+	case io.SeekCurrent:
+		s.pos += offset
+	case io.SeekEnd:
+		s.pos = s.size + offset
+	}
+	return s.pos, nil
+}
+
+// isBrowser reports whether r comes from a web browser rather than from a
+// WebDAV client.
+func isBrowser(r *http.Request) bool {
+	if *windowsCompatFlag && wantsSource(r) {
+		return false
+	}
+	return strings.HasPrefix(r.UserAgent(), "Mozilla/")
+}
+
+// setContentDisposition makes browsers save downloaded files under their
+// names, which they would otherwise take from the escaped URL.
+func (h *handler) setContentDisposition(w http.ResponseWriter, r *http.Request) {
+	fi, err := h.dav.FileSystem.Stat(r.Context(), r.URL.Path)
+	if err != nil || fi.IsDir() {
+		return
+	}
+	w.Header().Set("Content-Disposition", contentDisposition(fi.Name()))
+}
+
+// contentDisposition returns an attachment disposition for name with an
+// ASCII fallback filename and the exact name encoded as of RFC 5987.
+func contentDisposition(name string) string {
+	var ascii, ext bytes.Buffer
+	for _, r := range name {
+		switch {
+		case r == '"' || r == '\\' || r < 0x20 || r > 0x7e:
+			ascii.WriteRune('_')
+		default:
+			ascii.WriteRune(r)
+		}
+	}
+	for _, b := range []byte(name) {
+		if isAttrChar(b) {
+			ext.WriteByte(b)
+		} else {
+			fmt.Fprintf(&ext, "%%%02X", b)
+		}
+	}
+	return fmt.Sprintf(`attachment; filename="%s"; filename*=UTF-8''%s`, ascii.String(), ext.String())
+}
+
+// isAttrChar reports whether b may appear unescaped in an RFC 5987 value.
+func isAttrChar(b byte) bool {
+	switch {
+	case 'a' <= b && b <= 'z', 'A' <= b && b <= 'Z', '0' <= b && b <= '9':
+		return true
+	}
+	return strings.IndexByte("!#$&+-.^_`|~", b) >= 0
+}
+
+// statusWriter holds back generic error responses until the error that
+// caused them is known, so that it can be replaced with a better status.
+type statusWriter struct {
+	http.ResponseWriter
+	status      int
+	body        bytes.Buffer
+	wroteHeader bool
+	err         error
+}
+
+// isGenericStatus reports whether webdav.Handler uses status as a catch-all
+// for file system errors.
+func isGenericStatus(status int) bool {
+	switch status {
+	case http.StatusForbidden, http.StatusNotFound, http.StatusMethodNotAllowed, http.StatusInternalServerError:
+		return true
+	}
+	return false
+}
+
+func (w *statusWriter) WriteHeader(status int) {
+	if w.wroteHeader {
+		return
+	}
+	w.wroteHeader = true
+	if isGenericStatus(status) {
+		w.status = status
+		return
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusWriter) Write(p []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.status != 0 {
+		return w.body.Write(p)
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+func (w *statusWriter) flush() {
+	if w.status == 0 {
+		return
+	}
+
+	status := errorStatus(w.err)
+	msg := errorMessage(w.err)
+	if msg == "" && (status == 0 || status == w.status) {
+		w.ResponseWriter.WriteHeader(w.status)
+		w.ResponseWriter.Write(w.body.Bytes())
+		return
+	}
+	if status == 0 {
+		status = w.status
+	}
+
+	w.ResponseWriter.Header().Del("Content-Length")
+	w.ResponseWriter.WriteHeader(status)
+	if msg != "" {
+		w.ResponseWriter.Write([]byte(webdav.StatusText(status) + ": " + msg))
+		return
+	}
+	w.ResponseWriter.Write([]byte(webdav.StatusText(status)))
+}
@@ -0,0 +1,85 @@
+package gdrive
+
+import (
+	"flag"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	log "github.com/cihub/seelog"
+)
+
+var (
+	hideMacOSMetadataFlag = flag.Bool("hide-macos-metadata", false, "Hide .DS_Store, ._* and other macOS metadata files: they are reported as missing and writes to them are discarded.")
+
+	macOSMetadataNames = map[string]bool{
+		".DS_Store":       true,
+		".Spotlight-V100": true,
+		".Trashes":        true,
+		".fseventsd":      true,
+		".TemporaryItems": true,
+	}
+)
+
+func isMacOSMetadata(name string) bool {
+	return macOSMetadataNames[name] || strings.HasPrefix(name, "._")
+}
+
+// isHiddenName reports whether files called name are hidden from clients.
+func isHiddenName(name string) bool {
+	return *hideMacOSMetadataFlag && isMacOSMetadata(name)
+}
+
+// isHiddenPath reports whether any component of p is hidden from clients.
+func isHiddenPath(p string) bool {
+	for _, name := range strings.Split(p, "/") {
+		if isHiddenName(name) {
+			return true
+		}
+	}
+	return false
+}
+
+// discardFile is a writable file whose content is thrown away. It is opened
+// instead of hidden files, so that clients writing them don't fail.
+type discardFile struct {
+	name string
+	size int64
+	// dryRun is set for writes skipped by --dry-run.
+	dryRun bool
+}
+
+func (f *discardFile) Write(p []byte) (int, error) {
+	f.size += int64(len(p))
+	return len(p), nil
+}
+
+func (f *discardFile) Read(p []byte) (int, error) {
+	return 0, errNotSupported
+}
+
+func (f *discardFile) Seek(offset int64, whence int) (int64, error) {
+	return 0, errNotSupported
+}
+
+func (f *discardFile) Readdir(count int) ([]os.FileInfo, error) {
+	return nil, errNotSupported
+}
+
+func (f *discardFile) Stat() (os.FileInfo, error) {
+	return &fileInfo{
+		name:    path.Base(f.name),
+		size:    f.size,
+		modTime: time.Now(),
+	}, nil
+}
+
+func (f *discardFile) Close() error {
+	if f.dryRun {
+		log.Infof("Dry run: discarded %v written to %v", formatBytes(f.size), f.name)
+		return nil
+	}
+	log.Debugf("Discarded %v bytes written to %v", f.size, f.name)
+	return nil
+}
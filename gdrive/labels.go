@@ -0,0 +1,217 @@
+package gdrive
+
+import (
+	"encoding/xml"
+	"flag"
+	"fmt"
+	"strconv"
+
+	log "github.com/cihub/seelog"
+	"golang.org/x/net/context"
+	"golang.org/x/net/webdav"
+	"google.golang.org/api/drive/v3"
+)
+
+const (
+	labelsOff   = "off"
+	labelsRead  = "read"
+	labelsWrite = "write"
+)
+
+var (
+	labelsFlag = flag.String("labels", labelsOff, "Show the Drive Labels of files, a Google Workspace feature, as the labels property in the https://drive.google.com/ns/ namespace: off, read, or write to also let PROPPATCH apply, change and remove them. Costs a Drive request per file listed.")
+)
+
+// labelsProp lists the labels applied to a file, as
+// <label id="..."><field id="..." type="text"><value>...</value></field></label>.
+var labelsProp = xml.Name{Space: nsDrive, Local: "labels"}
+
+type xmlLabel struct {
+	XMLName xml.Name        `xml:"https://drive.google.com/ns/ label"`
+	ID      string          `xml:"id,attr"`
+	Fields  []xmlLabelField `xml:"https://drive.google.com/ns/ field"`
+}
+
+type xmlLabelField struct {
+	ID     string   `xml:"id,attr"`
+	Type   string   `xml:"type,attr,omitempty"`
+	Values []string `xml:"https://drive.google.com/ns/ value"`
+}
+
+// fileLabels returns the labels applied to the file with the given ID.
+func (fs *fileSystem) fileLabels(ctx context.Context, id string) ([]*drive.Label, error) {
+	key := cacheKeyLabels + id
+	if cached, found := fs.cache.Get(key); found {
+		return cached.([]*drive.Label), nil
+	}
+	labels := []*drive.Label{}
+	err := fs.client.Files.ListLabels(id).Pages(ctx, func(r *drive.LabelList) error {
+		labels = append(labels, r.Labels...)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	fs.cache.Set(key, labels, fileCacheTTL)
+	return labels, nil
+}
+
+// addLabelProps adds the labels of f as a property, if --labels asks for it.
+func (f *openReadonlyFile) addLabelProps(props map[xml.Name]webdav.Property) {
+	if *labelsFlag != labelsRead && *labelsFlag != labelsWrite {
+		return
+	}
+	labels, err := f.fs.fileLabels(f.ctx, f.file.Id)
+	if err != nil {
+		log.Errorf("can't list labels of %v: %v", f.name, err)
+		return
+	}
+	inner, err := xml.Marshal(toXMLLabels(labels))
+	if err != nil {
+		log.Errorf("can't encode labels of %v: %v", f.name, err)
+		return
+	}
+	props[labelsProp] = webdav.Property{XMLName: labelsProp, InnerXML: inner}
+}
+
+func toXMLLabels(labels []*drive.Label) []xmlLabel {
+	result := []xmlLabel{}
+	for _, label := range labels {
+		xl := xmlLabel{ID: label.Id}
+		for id, field := range label.Fields {
+			xf := xmlLabelField{ID: id, Type: field.ValueType}
+			switch field.ValueType {
+			case "integer":
+				for _, n := range field.Integer {
+					xf.Values = append(xf.Values, strconv.FormatInt(n, 10))
+				}
+			case "selection":
+				xf.Values = field.Selection
+			case "dateString":
+				xf.Values = field.DateString
+			case "user":
+				for _, u := range field.User {
+					xf.Values = append(xf.Values, u.EmailAddress)
+				}
+			default:
+				xf.Values = field.Text
+			}
+			xl.Fields = append(xl.Fields, xf)
+		}
+		result = append(result, xl)
+	}
+	return result
+}
+
+// takeLabelPatches removes the patches of labelsProp from patches when
+// --labels=write, returning the changes they ask for.
+func takeLabelPatches(patches []webdav.Proppatch) ([]webdav.Proppatch, []webdav.Proppatch) {
+	if *labelsFlag != labelsWrite {
+		return patches, nil
+	}
+	rest := []webdav.Proppatch{}
+	labels := []webdav.Proppatch{}
+	for _, patch := range patches {
+		props := []webdav.Property{}
+		for _, p := range patch.Props {
+			if p.XMLName == labelsProp {
+				labels = append(labels, webdav.Proppatch{Remove: patch.Remove, Props: []webdav.Property{p}})
+			} else {
+				props = append(props, p)
+			}
+		}
+		rest = append(rest, webdav.Proppatch{Remove: patch.Remove, Props: props})
+	}
+	return rest, labels
+}
+
+// labelModifications translates patches of labelsProp to Drive label
+// changes. Removing the property removes all labels of the file, setting it
+// applies the labels given and sets the values of their fields given, a
+// field without values is unset.
+func (f *openReadonlyFile) labelModifications(patches []webdav.Proppatch) ([]*drive.LabelModification, error) {
+	mods := []*drive.LabelModification{}
+	for _, patch := range patches {
+		if patch.Remove {
+			labels, err := f.fs.fileLabels(f.ctx, f.file.Id)
+			if err != nil {
+				return nil, err
+			}
+			for _, label := range labels {
+				mods = append(mods, &drive.LabelModification{LabelId: label.Id, RemoveLabel: true})
+			}
+			continue
+		}
+		var labels []xmlLabel
+		for _, p := range patch.Props {
+			var v struct {
+				Labels []xmlLabel `xml:"https://drive.google.com/ns/ label"`
+			}
+			if err := xml.Unmarshal(append(append([]byte("<v>"), p.InnerXML...), "</v>"...), &v); err != nil {
+				return nil, fmt.Errorf("bad labels: %v", err)
+			}
+			labels = append(labels, v.Labels...)
+		}
+		for _, label := range labels {
+			if label.ID == "" {
+				return nil, fmt.Errorf("label without id")
+			}
+			mod := &drive.LabelModification{LabelId: label.ID}
+			for _, field := range label.Fields {
+				fm, err := fieldModification(field)
+				if err != nil {
+					return nil, err
+				}
+				mod.FieldModifications = append(mod.FieldModifications, fm)
+			}
+			mods = append(mods, mod)
+		}
+	}
+	return mods, nil
+}
+
+func fieldModification(field xmlLabelField) (*drive.LabelFieldModification, error) {
+	fm := &drive.LabelFieldModification{FieldId: field.ID}
+	if field.ID == "" {
+		return nil, fmt.Errorf("label field without id")
+	}
+	if len(field.Values) == 0 {
+		fm.UnsetValues = true
+		return fm, nil
+	}
+	switch field.Type {
+	case "", "text":
+		fm.SetTextValues = field.Values
+	case "integer":
+		for _, v := range field.Values {
+			n, err := strconv.ParseInt(v, 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("bad integer %q of label field %v", v, field.ID)
+			}
+			fm.SetIntegerValues = append(fm.SetIntegerValues, n)
+		}
+	case "selection":
+		fm.SetSelectionValues = field.Values
+	case "dateString":
+		fm.SetDateValues = field.Values
+	case "user":
+		fm.SetUserValues = field.Values
+	default:
+		return nil, fmt.Errorf("unknown type %q of label field %v", field.Type, field.ID)
+	}
+	return fm, nil
+}
+
+// modifyLabels applies the label changes to f.
+func (f *openReadonlyFile) modifyLabels(mods []*drive.LabelModification) error {
+	if len(mods) == 0 {
+		return nil
+	}
+	req := &drive.ModifyLabelsRequest{LabelModifications: mods}
+	_, err := f.fs.client.Files.ModifyLabels(f.file.Id, req).Context(f.ctx).Do()
+	f.fs.cache.Delete(cacheKeyLabels + f.file.Id)
+	if err != nil {
+		log.Errorf("can't change labels of %v: %v", f.name, err)
+	}
+	return err
+}
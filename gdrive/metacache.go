@@ -0,0 +1,183 @@
+package gdrive
+
+import (
+	"flag"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/cihub/seelog"
+	gocache "github.com/pmylund/go-cache"
+	"google.golang.org/api/drive/v3"
+)
+
+var (
+	cacheMaxEntriesFlag = flag.Int("cache-max-entries", 0, "Evict the least recently used metadata from the cache beyond this many entries. 0 means no limit.")
+	cacheMaxBytesFlag   = flag.Int64("cache-max-bytes", 0, "Evict the least recently used metadata from the cache beyond this estimated size in bytes. 0 means no limit.")
+)
+
+const (
+	// cacheJanitorInterval is how often the cache bounds are enforced.
+	cacheJanitorInterval = 10 * time.Second
+	// cacheEntryOverhead approximates the memory used by an entry besides
+	// its strings.
+	cacheEntryOverhead = 200
+)
+
+// metadataCache is the cache of Drive metadata. When bounded, it tracks
+// when each entry was last used and a janitor evicts the least recently
+// used ones.
+type metadataCache struct {
+	*gocache.Cache
+	stats *stats
+
+	mu      sync.Mutex
+	entries map[string]*cacheEntry
+	bytes   int64
+}
+
+type cacheEntry struct {
+	used int64
+	size int64
+}
+
+func newMetadataCache(st *stats) *metadataCache {
+	c := &metadataCache{Cache: gocache.New(5*time.Minute, 30*time.Second), stats: st}
+	if *cacheMaxEntriesFlag > 0 || *cacheMaxBytesFlag > 0 {
+		c.entries = make(map[string]*cacheEntry)
+		c.Cache.OnEvicted(c.evicted)
+		go c.janitor()
+	}
+	return c
+}
+
+func (c *metadataCache) Get(k string) (interface{}, bool) {
+	v, found := c.Cache.Get(k)
+	if found && c.entries != nil {
+		c.mu.Lock()
+		if e := c.entries[k]; e != nil {
+			e.used = time.Now().UnixNano()
+		}
+		c.mu.Unlock()
+	}
+	return v, found
+}
+
+func (c *metadataCache) Set(k string, v interface{}, d time.Duration) {
+	c.Cache.Set(k, v, d)
+	if c.entries == nil {
+		return
+	}
+	size := int64(len(k)) + estimateSize(v)
+	c.mu.Lock()
+	if e := c.entries[k]; e != nil {
+		c.bytes -= e.size
+	}
+	c.entries[k] = &cacheEntry{used: time.Now().UnixNano(), size: size}
+	c.bytes += size
+	c.mu.Unlock()
+}
+
+func (c *metadataCache) Flush() {
+	c.Cache.Flush()
+	if c.entries == nil {
+		return
+	}
+	c.mu.Lock()
+	c.entries = make(map[string]*cacheEntry)
+	c.bytes = 0
+	c.mu.Unlock()
+}
+
+// evicted forgets an entry deleted or expired.
+func (c *metadataCache) evicted(k string, v interface{}) {
+	c.mu.Lock()
+	if e := c.entries[k]; e != nil {
+		c.bytes -= e.size
+		delete(c.entries, k)
+	}
+	c.mu.Unlock()
+}
+
+// janitor evicts the least recently used entries beyond the bounds, down
+// to 90% of them, forever.
+func (c *metadataCache) janitor() {
+	for range time.Tick(cacheJanitorInterval) {
+		victims := c.victims()
+		for _, k := range victims {
+			c.Cache.Delete(k)
+		}
+		if len(victims) > 0 {
+			atomic.AddInt64(&c.stats.cacheEvictions, int64(len(victims)))
+			log.Debugf("Evicted %v cache entries", len(victims))
+		}
+	}
+}
+
+func (c *metadataCache) victims() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	maxEntries, maxBytes := *cacheMaxEntriesFlag, *cacheMaxBytesFlag
+	if (maxEntries <= 0 || len(c.entries) <= maxEntries) && (maxBytes <= 0 || c.bytes <= maxBytes) {
+		return nil
+	}
+
+	keys := make([]string, 0, len(c.entries))
+	for k := range c.entries {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool { return c.entries[keys[i]].used < c.entries[keys[j]].used })
+
+	count, bytes := len(c.entries), c.bytes
+	victims := []string{}
+	for _, k := range keys {
+		if (maxEntries <= 0 || count <= maxEntries*9/10) && (maxBytes <= 0 || bytes <= maxBytes*9/10) {
+			break
+		}
+		victims = append(victims, k)
+		count--
+		bytes -= c.entries[k].size
+	}
+	return victims
+}
+
+// size returns the estimated size of the cached metadata.
+func (c *metadataCache) size() int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.bytes
+}
+
+// estimateSize approximates the memory used by a cached value.
+func estimateSize(v interface{}) int64 {
+	switch v := v.(type) {
+	case *drive.File:
+		return estimateFileSize(v)
+	case *pathEntry:
+		return cacheEntryOverhead + int64(len(v.id)+len(v.name))
+	case *fileLookupResult:
+		size := int64(cacheEntryOverhead)
+		if v.fp != nil {
+			if v.fp.file != nil {
+				size += estimateFileSize(v.fp.file)
+			}
+			for _, file := range v.fp.files {
+				size += estimateFileSize(file)
+			}
+		}
+		return size
+	}
+	return cacheEntryOverhead
+}
+
+func estimateFileSize(f *drive.File) int64 {
+	size := int64(4*cacheEntryOverhead + len(f.Id) + len(f.Name) + len(f.MimeType) + len(f.Md5Checksum) + len(f.CreatedTime) + len(f.ModifiedTime))
+	for _, parent := range f.Parents {
+		size += int64(len(parent))
+	}
+	for k, v := range f.AppProperties {
+		size += int64(len(k) + len(v))
+	}
+	return size
+}
@@ -0,0 +1,332 @@
+package gdrive
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/cihub/seelog"
+	"golang.org/x/net/context"
+	"golang.org/x/net/webdav"
+	"google.golang.org/api/drive/v3"
+)
+
+var (
+	mirrorTokenFileFlag = flag.String("mirror-token-file", "", "Replay every write, rename and delete on the drive authorized by this OAuth token file, for redundancy. Create it with \"gdrive-webdav --token-file=<file> auth\" signed in to the secondary account.")
+	mirrorFolderIDFlag  = flag.String("mirror-folder-id", "", "ID of the folder of the secondary drive that --mirror-token-file mirrors to. Its root by default.")
+)
+
+const (
+	mirrorWrite  = "write"
+	mirrorMkdir  = "mkdir"
+	mirrorRemove = "remove"
+	mirrorRename = "rename"
+)
+
+// mirrorOp is a change to replay on the mirror.
+type mirrorOp struct {
+	kind    string
+	name    string
+	newName string
+}
+
+// mirror replays the changes made to src on dst, in order. Changes that
+// fail are retried until they succeed, changes lost on exit are repaired by
+// reconcile.
+type mirror struct {
+	src *fileSystem
+	dst *fileSystem
+
+	mu   sync.Mutex
+	ops  []*mirrorOp
+	wake chan struct{}
+}
+
+// newMirror returns the mirror of src, or nil unless --mirror-token-file is
+// given.
+func newMirror(ctx context.Context, src *fileSystem, clientID string, clientSecret string) *mirror {
+	if *mirrorTokenFileFlag == "" {
+		return nil
+	}
+	httpClient, _ := newHTTPClient(ctx, clientID, clientSecret, *mirrorTokenFileFlag)
+	client, err := drive.New(httpClient)
+	if err != nil {
+		log.Errorf("An error occurred creating Drive client of the mirror: %v\n", err)
+		panic(-3)
+	}
+	client.BasePath = src.client.BasePath
+
+	st := newStats()
+	dst := &fileSystem{
+		client:       client,
+		roundTripper: httpClient.Transport,
+		cache:        newMetadataCache(st),
+		stats:        st,
+		events:       newEventBroker(),
+		rootID:       "root",
+	}
+	if *mirrorFolderIDFlag != "" {
+		dst.rootID = *mirrorFolderIDFlag
+	}
+
+	m := &mirror{src: src, dst: dst, wake: make(chan struct{}, 1)}
+	go m.run()
+	return m
+}
+
+// isMirrored reports whether changes of p are mirrored. Folders that aren't
+// part of the drive are not.
+func isMirrored(p string) bool {
+	if p == "" || isVersionsPath(p) || isVirtualPath(p) || isHiddenPath(p) || isFilteredPath(p) {
+		return false
+	}
+	if *appDataFlag && (p == appDataRoot || strings.HasPrefix(p, appDataRoot+"/")) {
+		return false
+	}
+	top := "/" + strings.SplitN(strings.TrimPrefix(p, "/"), "/", 2)[0]
+	_, mounted := mountedFolderID(top)
+	return !mounted
+}
+
+// add queues a change made to the source.
+func (m *mirror) add(kind string, name string, newName string) {
+	if m == nil || !isMirrored(name) {
+		return
+	}
+	if kind == mirrorRename && !isMirrored(newName) {
+		kind, newName = mirrorRemove, ""
+	}
+	m.mu.Lock()
+	m.ops = append(m.ops, &mirrorOp{kind: kind, name: name, newName: newName})
+	m.mu.Unlock()
+	select {
+	case m.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (m *mirror) run() {
+	ctx := background(context.Background())
+	for {
+		m.mu.Lock()
+		var op *mirrorOp
+		if len(m.ops) > 0 {
+			op = m.ops[0]
+		}
+		m.mu.Unlock()
+		if op == nil {
+			<-m.wake
+			continue
+		}
+
+		if err := m.replay(ctx, op); err != nil {
+			log.Errorf("can't mirror %v of %v, retrying: %v", op.kind, op.name, err)
+			time.Sleep(*writeBackRetryFlag)
+			continue
+		}
+		m.mu.Lock()
+		m.ops = m.ops[1:]
+		m.mu.Unlock()
+	}
+}
+
+func (m *mirror) replay(ctx context.Context, op *mirrorOp) error {
+	log.Debugf("Mirroring %v of %v", op.kind, op.name)
+	switch op.kind {
+	case mirrorWrite:
+		err := m.copy(ctx, op.name)
+		if os.IsNotExist(err) {
+			// Deleted or renamed since, a later change follows.
+			return nil
+		}
+		return err
+	case mirrorMkdir:
+		err := m.mkdirAll(ctx, op.name)
+		if os.IsExist(err) {
+			return nil
+		}
+		return err
+	case mirrorRemove:
+		err := m.dst.RemoveAll(ctx, op.name)
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	case mirrorRename:
+		err := m.dst.Rename(ctx, op.name, op.newName)
+		if err == errNoParent {
+			if err = m.mkdirAll(ctx, path.Dir(op.newName)); err == nil {
+				err = m.dst.Rename(ctx, op.name, op.newName)
+			}
+		}
+		if os.IsNotExist(err) {
+			// Never mirrored, copy it instead.
+			return m.copyTree(ctx, op.newName)
+		}
+		return err
+	}
+	return fmt.Errorf("unknown change %q", op.kind)
+}
+
+// copy writes the content of file p of the source to the mirror.
+func (m *mirror) copy(ctx context.Context, p string) error {
+	src, err := m.src.openReadonlyFile(ctx, p)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	dst, err := m.dst.OpenFile(ctx, p, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err == errNoParent {
+		if err = m.mkdirAll(ctx, path.Dir(p)); err == nil {
+			dst, err = m.dst.OpenFile(ctx, p, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+		}
+	}
+	if err != nil {
+		return err
+	}
+	if _, err := copyBuffered(dst, src); err != nil {
+		dst.Close()
+		return err
+	}
+	return dst.Close()
+}
+
+// copyTree copies file or folder p of the source to the mirror.
+func (m *mirror) copyTree(ctx context.Context, p string) error {
+	fi, err := m.src.Stat(ctx, p)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	if !fi.IsDir() {
+		return m.copy(ctx, p)
+	}
+	if err := m.mkdirAll(ctx, p); err != nil && !os.IsExist(err) {
+		return err
+	}
+	_, err = m.reconcile(ctx, p)
+	return err
+}
+
+func (m *mirror) mkdirAll(ctx context.Context, p string) error {
+	err := m.dst.Mkdir(ctx, p, 0755)
+	if os.IsNotExist(err) || err == errNoParent {
+		if err := m.mkdirAll(ctx, path.Dir(p)); err != nil && !os.IsExist(err) {
+			return err
+		}
+		err = m.dst.Mkdir(ctx, p, 0755)
+	}
+	return err
+}
+
+// children lists the files of folder p of fs by name, without the trashed
+// and hidden ones. A missing folder has none.
+func (fs *fileSystem) children(ctx context.Context, p string) (map[string]*drive.File, error) {
+	folder, err := fs.getFile(ctx, p, true)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	files, err := fs.listFolder(ctx, folder.file.Id)
+	if err != nil {
+		return nil, err
+	}
+	children := make(map[string]*drive.File)
+	for _, file := range files {
+		if !file.Trashed && isMirrored(p+"/"+file.Name) {
+			children[file.Name] = file
+		}
+	}
+	return children, nil
+}
+
+// reconcile makes folder p of the mirror match the source, copying the
+// files that differ and deleting those the source lacks. It returns the
+// number of files fixed.
+func (m *mirror) reconcile(ctx context.Context, p string) (int, error) {
+	src, err := m.src.children(ctx, p)
+	if err != nil {
+		return 0, err
+	}
+	dst, err := m.dst.children(ctx, p)
+	if err != nil {
+		return 0, err
+	}
+
+	fixed := 0
+	for name, s := range src {
+		q := p + "/" + name
+		d := dst[name]
+		isDir := s.MimeType == mimeTypeFolder
+		if d != nil && (d.MimeType == mimeTypeFolder) != isDir {
+			log.Infof("Mirror: replacing %v", q)
+			if err := m.dst.RemoveAll(ctx, q); err != nil {
+				return fixed, err
+			}
+			d = nil
+		}
+
+		if isDir {
+			if d == nil {
+				if err := m.mkdirAll(ctx, q); err != nil && !os.IsExist(err) {
+					return fixed, err
+				}
+			}
+			n, err := m.reconcile(ctx, q)
+			fixed += n
+			if err != nil {
+				return fixed, err
+			}
+			continue
+		}
+		if isGoogleMimeType(s.MimeType) || d != nil && sameContent(s, d) {
+			continue
+		}
+		log.Infof("Mirror: copying %v", q)
+		if err := m.copy(ctx, q); err != nil {
+			return fixed, err
+		}
+		fixed++
+	}
+
+	for name := range dst {
+		if src[name] != nil {
+			continue
+		}
+		q := p + "/" + name
+		log.Infof("Mirror: deleting %v", q)
+		if err := m.dst.RemoveAll(ctx, q); err != nil {
+			return fixed, err
+		}
+		fixed++
+	}
+	return fixed, nil
+}
+
+func sameContent(a *drive.File, b *drive.File) bool {
+	if a.Md5Checksum != "" && b.Md5Checksum != "" {
+		return a.Md5Checksum == b.Md5Checksum
+	}
+	return a.Size == b.Size
+}
+
+// Reconcile repairs drift between fs and its mirror, e.g. after changes
+// were lost on exit or made to Drive directly.
+func Reconcile(ctx context.Context, fs webdav.FileSystem) error {
+	gfs, ok := driveFS(fs)
+	if !ok || gfs.mirror == nil {
+		return fmt.Errorf("no mirror, --mirror-token-file is not given")
+	}
+	fixed, err := gfs.mirror.reconcile(ctx, "")
+	log.Infof("Mirror: fixed %v files", fixed)
+	return err
+}
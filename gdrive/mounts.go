@@ -0,0 +1,86 @@
+package gdrive
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	log "github.com/cihub/seelog"
+	"golang.org/x/net/context"
+	"google.golang.org/api/drive/v3"
+)
+
+// mountsValue maps top-level directory names to Drive folder IDs.
+type mountsValue map[string]string
+
+var (
+	mounts = mountsValue{}
+)
+
+func init() {
+	flag.Var(mounts, "mount", "Serve the Drive folder with the given ID, possibly in a shared drive, as a top-level directory: name=folderID. May be repeated.")
+}
+
+func (m mountsValue) String() string {
+	s := []string{}
+	for name, id := range m {
+		s = append(s, name+"="+id)
+	}
+	sort.Strings(s)
+	return strings.Join(s, ",")
+}
+
+func (m mountsValue) Set(value string) error {
+	parts := strings.SplitN(value, "=", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" || strings.Contains(parts[0], "/") {
+		return fmt.Errorf("expected name=folderID, got %q", value)
+	}
+	m[normalizeName(parts[0])] = parts[1]
+	return nil
+}
+
+// mountedFolderID returns the ID of the folder mounted at p, if any.
+func mountedFolderID(p string) (string, bool) {
+	if !strings.HasPrefix(p, "/") || strings.Contains(p[1:], "/") {
+		return "", false
+	}
+	id, ok := mounts[p[1:]]
+	return id, ok
+}
+
+// mountNames returns the names of the mounted folders in order.
+func mountNames() []string {
+	names := []string{}
+	for name := range mounts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (fs *fileSystem) getMountedFolder(ctx context.Context, p string, id string) (*fileAndPath, error) {
+	f, err := fs.client.Files.Get(id).SupportsAllDrives(true).Fields(fileFields).Context(ctx).Do()
+	if err != nil {
+		log.Errorf("can't get folder %v mounted at %v: %v", id, p, err)
+		return nil, err
+	}
+	if f.MimeType != mimeTypeFolder {
+		log.Errorf("%v mounted at %v is not a folder", id, p)
+		return nil, os.ErrNotExist
+	}
+	dir := *f
+	dir.Name = p[1:]
+	return &fileAndPath{file: &dir, path: p}, nil
+}
+
+// listFiles starts a search for files of the served tree. Mounted folders
+// may be in shared drives, which are only searched on request.
+func (fs *fileSystem) listFiles() *drive.FilesListCall {
+	q := fs.client.Files.List().Spaces(listSpaces()).SupportsAllDrives(true).IncludeItemsFromAllDrives(true)
+	if len(mounts) > 0 {
+		q.Corpora("allDrives")
+	}
+	return q
+}
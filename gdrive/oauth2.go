@@ -5,22 +5,26 @@ import (
 	"flag"
 	"fmt"
 	"net/http"
+	"net/url"
 	"os"
 	"os/user"
+	"strings"
+	"time"
 
 	log "github.com/cihub/seelog"
 	"golang.org/x/net/context"
 
 	"golang.org/x/oauth2"
+	driveactivity "google.golang.org/api/driveactivity/v2"
 )
 
 var (
 	tokenFileFlag = flag.String("token-file", "", "OAuth token cache file. ~/.gdrive_token by default.")
 )
 
-func newHTTPClient(ctx context.Context, clientID string, clientSecret string) *http.Client {
-	config := &oauth2.Config{
-		Scopes:      []string{"https://www.googleapis.com/auth/drive"},
+func oauthConfig(clientID string, clientSecret string) *oauth2.Config {
+	return &oauth2.Config{
+		Scopes:      scopes(),
 		RedirectURL: "urn:ietf:wg:oauth:2.0:oob",
 		Endpoint: oauth2.Endpoint{
 			AuthURL:  "https://accounts.google.com/o/oauth2/auth",
@@ -29,17 +33,81 @@ func newHTTPClient(ctx context.Context, clientID string, clientSecret string) *h
 		ClientID:     clientID,
 		ClientSecret: clientSecret,
 	}
+}
 
-	tok, err := getTokenFromFile()
+// newHTTPClient creates a client authorized by the token saved in file.
+func newHTTPClient(ctx context.Context, clientID string, clientSecret string, file string) (*http.Client, oauth2.TokenSource) {
+	ctx = withProxy(ctx)
+	config := oauthConfig(clientID, clientSecret)
+	tok, err := getTokenFromFile(file)
 	if err != nil {
-		tok = getTokenFromWeb(config)
-		err = saveToken(tok)
+		tok = getTokenFromWeb(ctx, config)
+		err = saveToken(file, tok)
 		if err != nil {
 			log.Errorf("An error occurred saving token file: %v\n", err)
 		}
 	}
 
-	return config.Client(ctx, tok)
+	ts := config.TokenSource(ctx, tok)
+	return oauth2.NewClient(ctx, ts), ts
+}
+
+// Authorize refreshes the saved OAuth token, or asks the user to authorize
+// access in the browser if there is no usable token, and saves the result.
+func Authorize(ctx context.Context, clientID string, clientSecret string) error {
+	ctx = withProxy(ctx)
+	config := oauthConfig(clientID, clientSecret)
+	file, err := tokenFile()
+	if err != nil {
+		return err
+	}
+	if tok, err := getTokenFromFile(file); err == nil {
+		// Expire the token so that the token source refreshes it.
+		tok.Expiry = time.Now().Add(-time.Minute)
+		fresh, err := config.TokenSource(ctx, tok).Token()
+		if err == nil {
+			return saveToken(file, fresh)
+		}
+		log.Warnf("Can't refresh saved token, authorizing again: %v", err)
+	}
+	return saveToken(file, getTokenFromWeb(ctx, config))
+}
+
+// grantedScopes asks Google which scopes token grants.
+func grantedScopes(ctx context.Context, token *oauth2.Token) ([]string, error) {
+	req, err := http.NewRequest("GET", "https://oauth2.googleapis.com/tokeninfo?access_token="+url.QueryEscape(token.AccessToken), nil)
+	if err != nil {
+		return nil, err
+	}
+	client := &http.Client{Transport: proxyTransport()}
+	res, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("tokeninfo: %v", res.Status)
+	}
+
+	var info struct {
+		Scope string `json:"scope"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&info); err != nil {
+		return nil, err
+	}
+	return strings.Fields(info.Scope), nil
+}
+
+// scopes returns the OAuth scopes to request.
+func scopes() []string {
+	s := []string{"https://www.googleapis.com/auth/drive"}
+	if *appDataFlag {
+		s = append(s, appDataScope)
+	}
+	if *changeActivityFlag {
+		s = append(s, driveactivity.DriveActivityReadonlyScope)
+	}
+	return s
 }
 
 func tokenFile() (string, error) {
@@ -54,13 +122,8 @@ func tokenFile() (string, error) {
 	return u.HomeDir + "/.gdrive_token", nil
 }
 
-func getTokenFromFile() (*oauth2.Token, error) {
-	tokenFile, err := tokenFile()
-	if err != nil {
-		return nil, err
-	}
-
-	f, err := os.Open(tokenFile)
+func getTokenFromFile(file string) (*oauth2.Token, error) {
+	f, err := os.Open(file)
 	if err != nil {
 		return nil, err
 	}
@@ -74,7 +137,7 @@ func getTokenFromFile() (*oauth2.Token, error) {
 	return t, err
 }
 
-func getTokenFromWeb(config *oauth2.Config) *oauth2.Token {
+func getTokenFromWeb(ctx context.Context, config *oauth2.Config) *oauth2.Token {
 	authURL := config.AuthCodeURL("state-token", oauth2.AccessTypeOffline)
 	fmt.Printf("Go to the following link in your browser then type the "+
 		"authorization code: \n%v\n", authURL)
@@ -84,18 +147,14 @@ func getTokenFromWeb(config *oauth2.Config) *oauth2.Token {
 		log.Criticalf("Unable to read authorization code %v", err)
 	}
 
-	tok, err := config.Exchange(oauth2.NoContext, code)
+	tok, err := config.Exchange(ctx, code)
 	if err != nil {
 		log.Criticalf("Unable to retrieve token from web %v", err)
 	}
 	return tok
 }
 
-func saveToken(token *oauth2.Token) error {
-	file, err := tokenFile()
-	if err != nil {
-		return err
-	}
+func saveToken(file string, token *oauth2.Token) error {
 	fmt.Printf("Saving credential file to: %s\n", file)
 	f, err := os.Create(file)
 	if err != nil {
@@ -0,0 +1,197 @@
+package gdrive
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"flag"
+	"hash"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+
+	log "github.com/cihub/seelog"
+	gocache "github.com/pmylund/go-cache"
+	"golang.org/x/net/context"
+	"google.golang.org/api/drive/v3"
+	"google.golang.org/api/googleapi"
+)
+
+var (
+	offlineTTLFlag        = flag.Duration("offline-ttl", 0, "When Drive is unreachable, serve metadata looked up to this long ago, read-only. 0 disables the fallback.")
+	offlineContentDirFlag = flag.String("offline-content-dir", "", "Keep the content of files downloaded in full in this directory, to serve it when Drive is unreachable. Requires --offline-ttl.")
+)
+
+const (
+	// offlineRetry is how long the file system stays read-only after Drive
+	// was found unreachable, unless a lookup succeeds before.
+	offlineRetry = 30 * time.Second
+)
+
+// newStaleCache returns the cache keeping lookups for the offline fallback,
+// or nil if it is disabled.
+func newStaleCache() *gocache.Cache {
+	if *offlineTTLFlag <= 0 {
+		return nil
+	}
+	if *offlineContentDirFlag != "" {
+		if err := os.MkdirAll(*offlineContentDirFlag, 0700); err != nil {
+			log.Errorf("can't create %v: %v", *offlineContentDirFlag, err)
+		}
+	}
+	return gocache.New(*offlineTTLFlag, 10*time.Minute)
+}
+
+// isUnreachable reports whether err means Drive can't be used at the
+// moment: the network or Drive is down, or the token is refused.
+func isUnreachable(err error) bool {
+	if err == nil || err == context.Canceled || err == context.DeadlineExceeded {
+		return false
+	}
+	if ge, ok := err.(*googleapi.Error); ok {
+		return ge.Code == 401 || ge.Code >= 500
+	}
+	if _, ok := err.(*statusError); ok {
+		return false
+	}
+	return !os.IsNotExist(err) && !os.IsPermission(err) && !os.IsExist(err)
+}
+
+func (fs *fileSystem) isOffline() bool {
+	until := atomic.LoadInt64(&fs.offlineUntil)
+	return until != 0 && time.Now().UnixNano() < until
+}
+
+func (fs *fileSystem) setOffline(err error) {
+	if atomic.SwapInt64(&fs.offlineUntil, time.Now().Add(offlineRetry).UnixNano()) == 0 {
+		log.Warnf("Drive is unreachable, serving cached files read-only: %v", err)
+	}
+}
+
+func (fs *fileSystem) setOnline() {
+	if atomic.SwapInt64(&fs.offlineUntil, 0) != 0 {
+		log.Info("Drive is reachable again")
+	}
+}
+
+// checkWritable refuses changes to name while Drive is unreachable.
+func (fs *fileSystem) checkWritable(name string) error {
+	if fs.isOffline() {
+		log.Errorf("can't change %v, Drive is unreachable", name)
+		return os.ErrPermission
+	}
+	return nil
+}
+
+// remember keeps a successful lookup for the offline fallback.
+func (fs *fileSystem) remember(key string, result *fileLookupResult) {
+	fs.setOnline()
+	if fs.stale != nil {
+		fs.stale.Set(key, result, gocache.DefaultExpiration)
+	}
+}
+
+// forget drops the lookup of key kept for the offline fallback.
+func (fs *fileSystem) forget(key string) {
+	if fs.stale != nil {
+		fs.stale.Delete(key)
+	}
+}
+
+// fallback returns the last successful lookup of key if it failed with err
+// because Drive is unreachable.
+func (fs *fileSystem) fallback(key string, err error) (*fileLookupResult, bool) {
+	if fs.stale == nil || !isUnreachable(err) {
+		return nil, false
+	}
+	fs.setOffline(err)
+	lookup, found := fs.stale.Get(key)
+	if !found {
+		return nil, false
+	}
+	log.Debugf("Serving %v from cache, Drive is unreachable", key)
+	return lookup.(*fileLookupResult), true
+}
+
+// cachedContentPath returns where the content of file is kept for the
+// offline fallback, or "" if it isn't.
+func cachedContentPath(file *drive.File) string {
+	if *offlineTTLFlag <= 0 || *offlineContentDirFlag == "" || file.Md5Checksum == "" {
+		return ""
+	}
+	return filepath.Join(*offlineContentDirFlag, file.Md5Checksum)
+}
+
+// openCachedContent opens the content of file kept for the offline fallback.
+func openCachedContent(file *drive.File) (*os.File, error) {
+	p := cachedContentPath(file)
+	if p == "" {
+		return nil, os.ErrNotExist
+	}
+	return os.Open(p)
+}
+
+// contentSpool copies the content of a download, and keeps it once
+// complete and matching the checksum of the file.
+type contentSpool struct {
+	file *os.File
+	dst  string
+	hash hash.Hash
+	size int64
+}
+
+func newContentSpool(file *drive.File) *contentSpool {
+	dst := cachedContentPath(file)
+	if dst == "" {
+		return nil
+	}
+	if _, err := os.Stat(dst); err == nil {
+		return nil
+	}
+	f, err := ioutil.TempFile(*offlineContentDirFlag, ".tmp")
+	if err != nil {
+		log.Errorf("can't cache content: %v", err)
+		return nil
+	}
+	return &contentSpool{file: f, dst: dst, hash: md5.New()}
+}
+
+func (s *contentSpool) write(p []byte) {
+	if s == nil || s.file == nil {
+		return
+	}
+	s.hash.Write(p)
+	s.size += int64(len(p))
+	if _, err := s.file.Write(p); err != nil {
+		log.Errorf("can't cache content: %v", err)
+		s.abort()
+	}
+}
+
+// commit keeps the content if it is complete.
+func (s *contentSpool) commit(size int64) {
+	if s == nil || s.file == nil {
+		return
+	}
+	name := s.file.Name()
+	err := s.file.Close()
+	s.file = nil
+	if err != nil || s.size != size || hex.EncodeToString(s.hash.Sum(nil)) != filepath.Base(s.dst) {
+		os.Remove(name)
+		return
+	}
+	if err := os.Rename(name, s.dst); err != nil {
+		log.Errorf("can't cache content: %v", err)
+		os.Remove(name)
+	}
+}
+
+func (s *contentSpool) abort() {
+	if s == nil || s.file == nil {
+		return
+	}
+	s.file.Close()
+	os.Remove(s.file.Name())
+	s.file = nil
+}
@@ -0,0 +1,38 @@
+package gdrive
+
+import (
+	"flag"
+
+	log "github.com/cihub/seelog"
+	"golang.org/x/net/context"
+	"google.golang.org/api/drive/v3"
+)
+
+const (
+	// orphanedRoot lists files left without a parent, e.g. when the folder
+	// they were in was deleted by someone who couldn't delete them.
+	orphanedRoot = "/Orphaned"
+)
+
+var (
+	orphanedFlag = flag.Bool("orphaned", false, "List files of yours without a parent folder in /Orphaned, from where they can be moved back into the tree. Searches the whole drive.")
+)
+
+// listOrphaned returns the files owned by the user which have no parent.
+// Drive can't search for them, so all the files are listed.
+func (fs *fileSystem) listOrphaned(ctx context.Context) ([]*drive.File, error) {
+	orphaned := []*drive.File{}
+	err := fs.client.Files.List().Spaces("drive").Q("'me' in owners and trashed = false").PageSize(1000).Fields("nextPageToken, files("+fileFields+")").Pages(ctx, func(r *drive.FileList) error {
+		for _, file := range r.Files {
+			if len(file.Parents) == 0 {
+				orphaned = append(orphaned, file)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		log.Error("Can't list orphaned files ", err)
+		return nil, err
+	}
+	return orphaned, nil
+}
@@ -0,0 +1,84 @@
+package gdrive
+
+import (
+	"encoding/xml"
+	"flag"
+
+	log "github.com/cihub/seelog"
+	"golang.org/x/net/context"
+	"golang.org/x/net/webdav"
+	"google.golang.org/api/drive/v3"
+)
+
+var (
+	showPermissionsFlag = flag.Bool("show-permissions", false, "Show who files are shared with, and whether anyone with the link may access them, as the read-only permissions property in the https://drive.google.com/ns/ namespace. Costs a Drive request per file listed.")
+)
+
+// permissionsProp lists the permissions of a file, as
+// <permission type="user" role="writer" email="..."/>. Link sharing has
+// type "anyone".
+var permissionsProp = xml.Name{Space: nsDrive, Local: "permissions"}
+
+type xmlPermission struct {
+	XMLName xml.Name `xml:"https://drive.google.com/ns/ permission"`
+	ID      string   `xml:"id,attr"`
+	Type    string   `xml:"type,attr"`
+	Role    string   `xml:"role,attr"`
+	Email   string   `xml:"email,attr,omitempty"`
+	Domain  string   `xml:"domain,attr,omitempty"`
+	Name    string   `xml:"name,attr,omitempty"`
+	// Discoverable is set for link sharing that lets the file be found by
+	// search.
+	Discoverable bool `xml:"discoverable,attr,omitempty"`
+}
+
+// filePermissions returns the permissions of the file with the given ID.
+func (fs *fileSystem) filePermissions(ctx context.Context, id string) ([]*drive.Permission, error) {
+	key := cacheKeyPermissions + id
+	if cached, found := fs.cache.Get(key); found {
+		return cached.([]*drive.Permission), nil
+	}
+	perms := []*drive.Permission{}
+	err := fs.client.Permissions.List(id).SupportsAllDrives(true).
+		Fields("nextPageToken, permissions(id,type,role,emailAddress,domain,displayName,allowFileDiscovery)").
+		Pages(ctx, func(r *drive.PermissionList) error {
+			perms = append(perms, r.Permissions...)
+			return nil
+		})
+	if err != nil {
+		return nil, err
+	}
+	fs.cache.Set(key, perms, fileCacheTTL)
+	return perms, nil
+}
+
+// addPermissionProps adds the permissions of f as a property, if
+// --show-permissions asks for it.
+func (f *openReadonlyFile) addPermissionProps(props map[xml.Name]webdav.Property) {
+	if !*showPermissionsFlag {
+		return
+	}
+	perms, err := f.fs.filePermissions(f.ctx, f.file.Id)
+	if err != nil {
+		log.Errorf("can't list permissions of %v: %v", f.name, err)
+		return
+	}
+	xperms := []xmlPermission{}
+	for _, p := range perms {
+		xperms = append(xperms, xmlPermission{
+			ID:           p.Id,
+			Type:         p.Type,
+			Role:         p.Role,
+			Email:        p.EmailAddress,
+			Domain:       p.Domain,
+			Name:         p.DisplayName,
+			Discoverable: p.AllowFileDiscovery,
+		})
+	}
+	inner, err := xml.Marshal(xperms)
+	if err != nil {
+		log.Errorf("can't encode permissions of %v: %v", f.name, err)
+		return
+	}
+	props[permissionsProp] = webdav.Property{XMLName: permissionsProp, InnerXML: inner}
+}
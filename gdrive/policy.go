@@ -0,0 +1,213 @@
+package gdrive
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// uploadRule restricts uploads below a path prefix.
+type uploadRule struct {
+	prefix string
+	kind   string
+	values []string
+	size   int64
+}
+
+const (
+	ruleDenyExt  = "deny-ext"
+	ruleDenyType = "deny-type"
+	ruleMaxSize  = "max-size"
+)
+
+// uploadRulesValue is the list of rules given with --upload-rule.
+type uploadRulesValue []*uploadRule
+
+var uploadRules uploadRulesValue
+
+func init() {
+	flag.Var(&uploadRules, "upload-rule", "Refuse uploads below a path with 403 Forbidden: prefix:deny-ext=.exe,.bat, prefix:deny-type=application/x-*,video/* or prefix:max-size=100M. May be repeated.")
+}
+
+func (v *uploadRulesValue) String() string {
+	s := []string{}
+	for _, r := range *v {
+		s = append(s, r.String())
+	}
+	return strings.Join(s, " ")
+}
+
+func (v *uploadRulesValue) Set(value string) error {
+	i := strings.LastIndex(value, ":")
+	if i < 0 {
+		return fmt.Errorf("expected prefix:rule=values, got %q", value)
+	}
+	parts := strings.SplitN(value[i+1:], "=", 2)
+	if len(parts) != 2 || parts[1] == "" {
+		return fmt.Errorf("expected prefix:rule=values, got %q", value)
+	}
+	r := &uploadRule{prefix: normalizePath(value[:i]), kind: parts[0]}
+	switch r.kind {
+	case ruleDenyExt:
+		for _, ext := range strings.Split(parts[1], ",") {
+			r.values = append(r.values, "."+strings.ToLower(strings.TrimPrefix(ext, ".")))
+		}
+	case ruleDenyType:
+		for _, t := range strings.Split(parts[1], ",") {
+			if _, err := path.Match(t, ""); err != nil {
+				return fmt.Errorf("bad MIME type pattern %q: %v", t, err)
+			}
+			r.values = append(r.values, strings.ToLower(t))
+		}
+	case ruleMaxSize:
+		size, err := parseSize(parts[1])
+		if err != nil {
+			return err
+		}
+		r.size = size
+	default:
+		return fmt.Errorf("unknown upload rule %q", r.kind)
+	}
+	*v = append(*v, r)
+	return nil
+}
+
+func (r *uploadRule) String() string {
+	prefix := r.prefix
+	if prefix == "" {
+		prefix = "/"
+	}
+	if r.kind == ruleMaxSize {
+		return fmt.Sprintf("%v:%v=%v", prefix, r.kind, r.size)
+	}
+	return fmt.Sprintf("%v:%v=%v", prefix, r.kind, strings.Join(r.values, ","))
+}
+
+// parseSize parses a number of bytes with an optional K, M, G or T suffix.
+func parseSize(s string) (int64, error) {
+	unit := int64(1)
+	if n := len(s); n > 0 {
+		switch strings.ToUpper(s[n-1:]) {
+		case "K":
+			unit = 1 << 10
+		case "M":
+			unit = 1 << 20
+		case "G":
+			unit = 1 << 30
+		case "T":
+			unit = 1 << 40
+		}
+		if unit > 1 {
+			s = s[:n-1]
+		}
+	}
+	size, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || size < 0 {
+		return 0, fmt.Errorf("bad size %q", s)
+	}
+	return size * unit, nil
+}
+
+// applies reports whether r covers p.
+func (r *uploadRule) applies(p string) bool {
+	return r.prefix == "" || p == r.prefix || strings.HasPrefix(p, r.prefix+"/")
+}
+
+// check returns why a file named p of the given type and size, -1 if
+// unknown, is refused, or "".
+func (r *uploadRule) check(p string, mimeType string, size int64) string {
+	where := r.prefix
+	if where == "" {
+		where = "/"
+	}
+	switch r.kind {
+	case ruleDenyExt:
+		ext := strings.ToLower(path.Ext(p))
+		for _, v := range r.values {
+			if ext == v {
+				return fmt.Sprintf("files with extension %v are not allowed in %v", ext, where)
+			}
+		}
+	case ruleDenyType:
+		for _, v := range r.values {
+			if ok, _ := path.Match(v, mimeType); ok {
+				return fmt.Sprintf("files of type %v are not allowed in %v", mimeType, where)
+			}
+		}
+	case ruleMaxSize:
+		if size > r.size {
+			return fmt.Sprintf("files larger than %v are not allowed in %v", formatBytes(r.size), where)
+		}
+	}
+	return ""
+}
+
+// checkUploadRules returns why the upload or the move or copy target of r
+// is refused by --upload-rule, or "". The body of an upload of unknown
+// length fails with errUploadTooLarge once it exceeds max-size, which
+// discards the file written.
+func checkUploadRules(r *http.Request) string {
+	if len(uploadRules) == 0 {
+		return ""
+	}
+	p := normalizePath(r.URL.Path)
+	size := r.ContentLength
+	mimeType := ""
+	if r.Method == "PUT" {
+		mimeType = r.Header.Get("Content-Type")
+	} else {
+		u, err := url.Parse(r.Header.Get("Destination"))
+		if err != nil {
+			return ""
+		}
+		p = normalizePath(u.Path)
+		size = -1
+	}
+	if t, _, err := mime.ParseMediaType(mimeType); err == nil && t != mimeTypeOctetStream {
+		mimeType = t
+	} else {
+		mimeType = mime.TypeByExtension(path.Ext(p))
+		if t, _, err := mime.ParseMediaType(mimeType); err == nil {
+			mimeType = t
+		}
+	}
+	mimeType = strings.ToLower(mimeType)
+
+	for _, rule := range uploadRules {
+		if !rule.applies(p) {
+			continue
+		}
+		if reason := rule.check(p, mimeType, size); reason != "" {
+			return reason
+		}
+		if rule.kind == ruleMaxSize && r.Method == "PUT" && size < 0 {
+			r.Body = &limitedBody{ReadCloser: r.Body, left: rule.size}
+		}
+	}
+	return ""
+}
+
+// limitedBody fails reading more than left bytes.
+type limitedBody struct {
+	io.ReadCloser
+	left int64
+}
+
+func (b *limitedBody) Read(p []byte) (int, error) {
+	if int64(len(p)) > b.left+1 {
+		p = p[:b.left+1]
+	}
+	n, err := b.ReadCloser.Read(p)
+	if int64(n) > b.left {
+		b.left = 0
+		return 0, errUploadTooLarge
+	}
+	b.left -= int64(n)
+	return n, err
+}
@@ -0,0 +1,140 @@
+package gdrive
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/context"
+	"golang.org/x/net/webdav"
+)
+
+func setUploadRules(t *testing.T, rules ...string) {
+	saved := uploadRules
+	t.Cleanup(func() { uploadRules = saved })
+	uploadRules = nil
+	for _, rule := range rules {
+		if err := uploadRules.Set(rule); err != nil {
+			t.Fatalf("can't set rule %q: %v", rule, err)
+		}
+	}
+}
+
+func TestUploadRuleParsing(t *testing.T) {
+	tests := []struct {
+		value string
+		want  string
+	}{
+		{"/in:deny-ext=.exe,BAT", "/in:deny-ext=.exe,.bat"},
+		{"/:deny-type=application/x-*,Video/*", "/:deny-type=application/x-*,video/*"},
+		{"/media:max-size=100M", "/media:max-size=104857600"},
+		{"/a:b:max-size=2K", "/a:b:max-size=2048"},
+		{"/a:max-size=10", "/a:max-size=10"},
+	}
+	for _, tt := range tests {
+		var v uploadRulesValue
+		if err := v.Set(tt.value); err != nil {
+			t.Errorf("Set(%q): %v", tt.value, err)
+			continue
+		}
+		if got := v.String(); got != tt.want {
+			t.Errorf("Set(%q) gave %v, want %v", tt.value, got, tt.want)
+		}
+	}
+
+	for _, value := range []string{"deny-ext=.exe", "/in:deny-ext", "/in:deny-ext=", "/in:allow-ext=.txt", "/in:max-size=1X", "/in:max-size=-1", "/in:deny-type=[a"} {
+		var v uploadRulesValue
+		if err := v.Set(value); err == nil {
+			t.Errorf("Set(%q) succeeded, want an error", value)
+		}
+	}
+}
+
+func TestCheckUploadRules(t *testing.T) {
+	setUploadRules(t, "/in:deny-ext=.exe,.bat", "/media:deny-type=video/*,application/x-*", "/small:max-size=10")
+
+	tests := []struct {
+		method      string
+		path        string
+		destination string
+		contentType string
+		size        int64
+		refused     bool
+	}{
+		{"PUT", "/in/setup.exe", "", "", 5, true},
+		{"PUT", "/in/SETUP.EXE", "", "", 5, true},
+		{"PUT", "/in/sub/run.bat", "", "", 5, true},
+		{"PUT", "/in/notes.txt", "", "", 5, false},
+		{"PUT", "/inbox/setup.exe", "", "", 5, false},
+		{"PUT", "/out/setup.exe", "", "", 5, false},
+		{"MOVE", "/out/setup.exe", "http://example.com/in/setup.exe", "", 5, true},
+		{"COPY", "/in/setup.exe", "http://example.com/out/setup.exe", "", 5, false},
+		{"PUT", "/media/clip.mp4", "", "", 5, true},
+		{"PUT", "/media/clip", "", "Video/MP4; codecs=avc1", 5, true},
+		{"PUT", "/media/clip.bin", "", "application/x-msdownload", 5, true},
+		{"PUT", "/media/clip.mp4", "", "application/octet-stream", 5, true},
+		{"PUT", "/media/photo.jpg", "", "image/jpeg", 5, false},
+		{"PUT", "/small/a.txt", "", "", 10, false},
+		{"PUT", "/small/a.txt", "", "", 11, true},
+		{"PUT", "/small/a.txt", "", "", -1, false},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(tt.method, tt.path, strings.NewReader(""))
+		r.ContentLength = tt.size
+		if tt.destination != "" {
+			r.Header.Set("Destination", tt.destination)
+		}
+		if tt.contentType != "" {
+			r.Header.Set("Content-Type", tt.contentType)
+		}
+		if reason := checkUploadRules(r); (reason != "") != tt.refused {
+			t.Errorf("%v %v %v: refused %q, want refused %v", tt.method, tt.path, tt.destination, reason, tt.refused)
+		}
+	}
+}
+
+func TestUploadRuleMaxSizeUnknownLength(t *testing.T) {
+	setUploadRules(t, "/small:max-size=10")
+
+	for _, tt := range []struct {
+		content string
+		err     error
+	}{
+		{"0123456789", nil},
+		{"0123456789a", errUploadTooLarge},
+	} {
+		r := httptest.NewRequest("PUT", "/small/a.txt", strings.NewReader(tt.content))
+		r.ContentLength = -1
+		if reason := checkUploadRules(r); reason != "" {
+			t.Errorf("upload of unknown length refused before reading: %v", reason)
+		}
+		r = withStreamedUpload(r)
+		_, err := ioutil.ReadAll(r.Body)
+		if err != tt.err {
+			t.Errorf("reading %q: %v, want %v", tt.content, err, tt.err)
+		}
+		if err := bodyError(r.Context()); err != tt.err {
+			t.Errorf("body error of %q: %v, want %v", tt.content, err, tt.err)
+		}
+	}
+}
+
+func TestUploadRuleMaxSizeDiscardsUpload(t *testing.T) {
+	setUploadRules(t, "/:max-size=10")
+	fs := newFakeFS(newFakeDrive())
+
+	r := httptest.NewRequest("PUT", "/big.txt", strings.NewReader("more than ten bytes"))
+	r.ContentLength = -1
+	w := httptest.NewRecorder()
+	NewHandler(fs, webdav.NewMemLS()).ServeHTTP(w, r)
+
+	if w.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("PUT answered %v, want %v", w.Code, http.StatusRequestEntityTooLarge)
+	}
+	if _, err := fs.Stat(context.Background(), "/big.txt"); !os.IsNotExist(err) {
+		t.Errorf("Stat of refused upload: %v, want not exist", err)
+	}
+}
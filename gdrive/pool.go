@@ -0,0 +1,42 @@
+package gdrive
+
+import (
+	"bytes"
+	"io"
+	"sync"
+)
+
+const (
+	// maxPooledBuffer is the capacity beyond which write buffers are left
+	// to the garbage collector, so that a few large uploads don't keep
+	// their memory.
+	maxPooledBuffer = 4 * uploadChunkSize
+	copyBufferSize  = 32 << 10
+)
+
+// Pools of the buffers of transfers, which are otherwise allocated for each
+// request.
+var (
+	chunkPool  = sync.Pool{New: func() interface{} { b := make([]byte, uploadChunkSize); return &b }}
+	bufferPool = sync.Pool{New: func() interface{} { return new(bytes.Buffer) }}
+	copyPool   = sync.Pool{New: func() interface{} { b := make([]byte, copyBufferSize); return &b }}
+)
+
+func getBuffer() *bytes.Buffer {
+	return bufferPool.Get().(*bytes.Buffer)
+}
+
+func putBuffer(b *bytes.Buffer) {
+	if b == nil || b.Cap() > maxPooledBuffer {
+		return
+	}
+	b.Reset()
+	bufferPool.Put(b)
+}
+
+// copyBuffered is io.Copy with a pooled buffer.
+func copyBuffered(dst io.Writer, src io.Reader) (int64, error) {
+	b := copyPool.Get().(*[]byte)
+	defer copyPool.Put(b)
+	return io.CopyBuffer(dst, src, *b)
+}
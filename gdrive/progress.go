@@ -0,0 +1,92 @@
+package gdrive
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"time"
+
+	log "github.com/cihub/seelog"
+)
+
+var (
+	progressIntervalFlag = flag.Duration("progress-interval", 30*time.Second, "Log progress of uploads and downloads running longer than this. 0 disables progress logging.")
+)
+
+// progressReader logs how a transfer proceeds while its data is read.
+type progressReader struct {
+	r         io.Reader
+	op        string
+	name      string
+	total     int64
+	done      int64
+	offset    int64
+	start     time.Time
+	lastLog   time.Time
+	interval  time.Duration
+	completed bool
+}
+
+// newProgressReader wraps r which reads the data of a transfer of total
+// bytes starting at offset. total is 0 if unknown.
+func newProgressReader(r io.Reader, op string, name string, offset int64, total int64) io.Reader {
+	if *progressIntervalFlag <= 0 {
+		return r
+	}
+	now := time.Now()
+	return &progressReader{
+		r:        r,
+		op:       op,
+		name:     name,
+		total:    total,
+		offset:   offset,
+		start:    now,
+		lastLog:  now,
+		interval: *progressIntervalFlag,
+	}
+}
+
+func (p *progressReader) Read(b []byte) (int, error) {
+	n, err := p.r.Read(b)
+	p.done += int64(n)
+
+	now := time.Now()
+	if err == io.EOF && !p.completed && now.Sub(p.start) >= p.interval {
+		p.completed = true
+		log.Infof("%v %v: completed %v in %v", p.op, p.name, formatBytes(p.done), now.Sub(p.start))
+	} else if now.Sub(p.lastLog) >= p.interval {
+		p.lastLog = now
+		log.Infof("%v %v: %v", p.op, p.name, p.status(now))
+	}
+	return n, err
+}
+
+func (p *progressReader) status(now time.Time) string {
+	elapsed := now.Sub(p.start)
+	rate := float64(p.done) / elapsed.Seconds()
+	position := p.offset + p.done
+	if p.total <= 0 {
+		return fmt.Sprintf("%v, %v/s", formatBytes(position), formatBytes(int64(rate)))
+	}
+
+	eta := "unknown"
+	if rate > 0 {
+		eta = (time.Duration(float64(p.total-position)/rate) * time.Second).String()
+	}
+	return fmt.Sprintf("%v of %v (%.1f%%), %v/s, ETA %v",
+		formatBytes(position), formatBytes(p.total), 100*float64(position)/float64(p.total),
+		formatBytes(int64(rate)), eta)
+}
+
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
@@ -0,0 +1,206 @@
+package gdrive
+
+import (
+	"bytes"
+	"encoding/xml"
+	"flag"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	log "github.com/cihub/seelog"
+	"golang.org/x/net/context"
+	"google.golang.org/api/drive/v3"
+)
+
+const (
+	propfindInfinityWebDAV  = "webdav"
+	propfindInfinityBatched = "batched"
+	propfindInfinityDeny    = "deny"
+
+	// propfindBatchSize is how many folders are listed by one Drive query.
+	propfindBatchSize = 50
+)
+
+var (
+	propfindInfinityFlag = flag.String("propfind-infinity", propfindInfinityWebDAV, "How to answer PROPFIND with Depth: infinity: webdav lists folder by folder, batched lists many folders per Drive query and streams the answer, deny refuses it. batched doesn't list uploads still queued.")
+)
+
+// propfindRequest is the body of a PROPFIND.
+type propfindRequest struct {
+	XMLName  xml.Name  `xml:"DAV: propfind"`
+	Propname *struct{} `xml:"DAV: propname"`
+	Prop     *struct {
+		Names []struct {
+			XMLName xml.Name
+		} `xml:",any"`
+	} `xml:"DAV: prop"`
+}
+
+// isInfinitePropfind reports whether r is a PROPFIND of a whole tree.
+func isInfinitePropfind(r *http.Request) bool {
+	depth := r.Header.Get("Depth")
+	return r.Method == "PROPFIND" && (depth == "" || strings.EqualFold(depth, "infinity"))
+}
+
+// denyInfinitePropfind refuses a PROPFIND with Depth: infinity as RFC 4918
+// says.
+func denyInfinitePropfind(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "text/xml; charset=utf-8")
+	w.WriteHeader(http.StatusForbidden)
+	w.Write([]byte(`<?xml version="1.0" encoding="UTF-8"?>` + "\n" + `<D:error xmlns:D="DAV:"><D:propfind-finite-depth/></D:error>`))
+}
+
+// servePropfind answers a PROPFIND with Depth: 1, or infinity when
+// infinite is set, from the listings of the folders, which populate the
+// cache, without opening each file. A tree is listed a level at a time,
+// with a Drive query for many folders, writing the responses as they're
+// found. It returns false if r is left to the webdav handler: for virtual
+// folders, the root when it lists mounts or virtual folders, folders with
+// uploads queued or transient files, and propname requests.
+func (h *handler) servePropfind(w http.ResponseWriter, r *http.Request, fs *fileSystem, infinite bool) bool {
+	body, err := ioutil.ReadAll(r.Body)
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	if err != nil {
+		return false
+	}
+	var req propfindRequest
+	if len(bytes.TrimSpace(body)) > 0 {
+		if err := xml.Unmarshal(body, &req); err != nil || req.Propname != nil {
+			return false
+		}
+	}
+	var names []xml.Name
+	if req.Prop != nil {
+		names = []xml.Name{}
+		for _, n := range req.Prop.Names {
+			names = append(names, n.XMLName)
+		}
+	}
+
+	p := normalizePath(r.URL.Path)
+	if isVersionsPath(p) || isVirtualPath(p) || p == "" && (len(mountNames()) > 0 || len(virtualFolders()) > 0) {
+		return false
+	}
+	if len(fs.queue.pendingIn(p)) > 0 || len(fs.transient.in(p)) > 0 {
+		return false
+	}
+	fp, err := fs.getFile(r.Context(), p, false)
+	if err != nil {
+		return false
+	}
+	var children []*drive.File
+	if fp.file.MimeType == mimeTypeFolder && !infinite {
+		// Listed before answering, to leave errors to the webdav handler.
+		if children, err = fs.listFolder(r.Context(), fp.file.Id); err != nil {
+			return false
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/xml; charset=utf-8")
+	w.WriteHeader(http.StatusMultiStatus)
+	var b bytes.Buffer
+	b.WriteString(`<?xml version="1.0" encoding="UTF-8"?>` + "\n")
+	b.WriteString(`<D:multistatus xmlns:D="DAV:">`)
+	fs.writeFileResponse(r.Context(), &b, p, fp.file, names)
+
+	if !infinite {
+		fs.writeChildren(r.Context(), &b, p, children, nil, names)
+		b.WriteString("</D:multistatus>")
+		w.Write(b.Bytes())
+		return true
+	}
+
+	level := map[string]string{}
+	if fp.file.MimeType == mimeTypeFolder {
+		level[fp.file.Id] = p
+	}
+	for len(level) > 0 {
+		ids := []string{}
+		for id := range level {
+			ids = append(ids, id)
+		}
+		sort.Strings(ids)
+		next := map[string]string{}
+		for len(ids) > 0 {
+			n := len(ids)
+			if n > propfindBatchSize {
+				n = propfindBatchSize
+			}
+			batch := map[string]string{}
+			for _, id := range ids[:n] {
+				batch[id] = level[id]
+			}
+			ids = ids[n:]
+
+			if err := fs.listBatch(r.Context(), &b, batch, next, names); err != nil {
+				// The response has started, the client sees a truncated
+				// listing.
+				log.Errorf("can't list %v: %v", p, err)
+				w.Write(b.Bytes())
+				return true
+			}
+			w.Write(b.Bytes())
+			b.Reset()
+		}
+		level = next
+	}
+	b.WriteString("</D:multistatus>")
+	w.Write(b.Bytes())
+	return true
+}
+
+// listBatch lists the children of the folders of batch, given by ID with
+// their paths, writing their responses to b. Children that are folders are
+// added to next.
+func (fs *fileSystem) listBatch(ctx context.Context, b *bytes.Buffer, batch map[string]string, next map[string]string, names []xml.Name) error {
+	terms := []string{}
+	for id := range batch {
+		terms = append(terms, quoteQueryString(id)+" in parents")
+	}
+	children := map[string][]*drive.File{}
+	err := fs.listFiles().Q(strings.Join(terms, " or ")).Fields("nextPageToken, files("+fileFields+")").Pages(ctx, func(l *drive.FileList) error {
+		for _, file := range l.Files {
+			for _, parent := range file.Parents {
+				if _, ok := batch[parent]; ok {
+					children[parent] = append(children[parent], file)
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for id, p := range batch {
+		visible := []*drive.File{}
+		for _, file := range children[id] {
+			if !ignoreFile(file) {
+				visible = append(visible, file)
+			}
+		}
+		visible = resolveDuplicates(markTrashed(normalizeFileNames(visible)))
+		fs.cacheFolder(id, visible, 5*time.Second)
+		fs.writeChildren(ctx, b, p, visible, next, names)
+	}
+	return nil
+}
+
+// writeChildren caches the children of folder p and writes their responses
+// to b. Children that are folders are added to next, if given.
+func (fs *fileSystem) writeChildren(ctx context.Context, b *bytes.Buffer, p string, children []*drive.File, next map[string]string, names []xml.Name) {
+	for _, file := range children {
+		child := p + "/" + file.Name
+		if isFilteredPath(child) {
+			continue
+		}
+		fs.cacheFile(child, file)
+		fs.writeFileResponse(ctx, b, child, file, names)
+		if next != nil && file.MimeType == mimeTypeFolder {
+			next[file.Id] = child
+		}
+	}
+}
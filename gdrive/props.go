@@ -0,0 +1,235 @@
+package gdrive
+
+import (
+	"encoding/xml"
+	"fmt"
+	"hash/fnv"
+	"net/http"
+	"strconv"
+	"strings"
+
+	log "github.com/cihub/seelog"
+	"golang.org/x/net/webdav"
+	"google.golang.org/api/drive/v3"
+)
+
+const (
+	// Dead properties are stored in Drive app properties. A property is
+	// stored under propKeyPrefix + namespace hash + "." + local name, the
+	// namespace itself under propNamespacePrefix + namespace hash.
+	propKeyPrefix       = "dav."
+	propNamespacePrefix = "davns."
+
+	// maxAppPropertySize is the limit Drive puts on the UTF-8 length of
+	// key and value of an app property together.
+	maxAppPropertySize = 124
+)
+
+func namespaceHash(space string) string {
+	h := fnv.New32a()
+	h.Write([]byte(space))
+	return fmt.Sprintf("%08x", h.Sum32())
+}
+
+func propKey(name xml.Name) string {
+	return propKeyPrefix + namespaceHash(name.Space) + "." + name.Local
+}
+
+// deadProps decodes the dead properties stored in app properties of file.
+func deadProps(file *drive.File) map[xml.Name]webdav.Property {
+	props := make(map[xml.Name]webdav.Property)
+	for key, value := range file.AppProperties {
+		if !strings.HasPrefix(key, propKeyPrefix) {
+			continue
+		}
+		parts := strings.SplitN(strings.TrimPrefix(key, propKeyPrefix), ".", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		space, ok := file.AppProperties[propNamespacePrefix+parts[0]]
+		if !ok {
+			continue
+		}
+		name := xml.Name{Space: space, Local: parts[1]}
+		props[name] = webdav.Property{XMLName: name, InnerXML: []byte(value)}
+	}
+	return props
+}
+
+// DeadProps implements webdav.DeadPropsHolder. Besides the properties
+// stored by PROPPATCH, files expose properties derived from Drive metadata.
+func (f *openReadonlyFile) DeadProps() (map[xml.Name]webdav.Property, error) {
+	props := deadProps(f.file)
+	addDriveProps(props, f.file)
+	f.addLabelProps(props)
+	f.addPermissionProps(props)
+	return props, nil
+}
+
+// Patch implements webdav.DeadPropsHolder. Properties too large for Drive
+// are rejected with 507, those showing read-only Drive metadata with 403,
+// invalid labels or starred values with 409 and, as PROPPATCH is atomic, the rest with 424.
+func (f *openReadonlyFile) Patch(patches []webdav.Proppatch) ([]webdav.Propstat, error) {
+	patches, labelPatches := takeLabelPatches(patches)
+	mods, err := f.labelModifications(labelPatches)
+	if err != nil {
+		log.Errorf("can't change labels of %v: %v", f.name, err)
+		failed := webdav.Propstat{Status: webdav.StatusFailedDependency}
+		for _, patch := range patches {
+			for _, p := range patch.Props {
+				failed.Props = append(failed.Props, webdav.Property{XMLName: p.XMLName})
+			}
+		}
+		propstats := []webdav.Propstat{{Status: http.StatusConflict, Props: []webdav.Property{{XMLName: labelsProp}}}}
+		if len(failed.Props) > 0 {
+			propstats = append(propstats, failed)
+		}
+		return propstats, nil
+	}
+
+	update, propstats := preparePatch(patches)
+	if propstats[0].Status != http.StatusOK {
+		return propstats, nil
+	}
+	if len(labelPatches) > 0 {
+		propstats[0].Props = append(propstats[0].Props, webdav.Property{XMLName: labelsProp})
+	}
+	if len(update.AppProperties) == 0 && len(update.NullFields) == 0 && len(update.ForceSendFields) == 0 && len(mods) == 0 {
+		return propstats, nil
+	}
+	if skip, err := dryRun("update properties of %v", f.name); skip {
+		if err != nil {
+			return nil, err
+		}
+		return propstats, nil
+	}
+
+	if len(update.AppProperties) > 0 || len(update.NullFields) > 0 || len(update.ForceSendFields) > 0 || update.ModifiedTime != "" {
+		file, err := f.fs.client.Files.Update(f.file.Id, update).SupportsAllDrives(true).Fields(fileFields).Context(f.ctx).Do()
+		if err != nil {
+			log.Errorf("can't update properties of %v: %v", f.name, err)
+			return nil, err
+		}
+		f.file = file
+		f.fs.invalidatePath(f.name)
+	}
+	if err := f.modifyLabels(mods); err != nil {
+		return nil, err
+	}
+	return propstats, nil
+}
+
+// preparePatch translates patches to an update of the app properties, the
+// description and the star of a file. The first returned propstat has
+// status 200 only if all properties were accepted, otherwise nothing is to
+// be changed.
+func preparePatch(patches []webdav.Proppatch) (*drive.File, []webdav.Propstat) {
+	update := &drive.File{}
+	set := make(map[string]string)
+	removed := make(map[string]bool)
+	accepted := webdav.Propstat{Status: http.StatusOK}
+	tooLarge := webdav.Propstat{Status: webdav.StatusInsufficientStorage}
+	forbidden := webdav.Propstat{Status: http.StatusForbidden}
+	invalid := webdav.Propstat{Status: http.StatusConflict}
+
+	for _, patch := range patches {
+		for _, p := range patch.Props {
+			name := webdav.Property{XMLName: p.XMLName}
+			if *windowsCompatFlag && isWindowsProp(p.XMLName) {
+				if p.XMLName == win32LastModifiedTimeProp && !patch.Remove {
+					if t, err := parseWindowsTime(propText(p.InnerXML)); err == nil {
+						update.ModifiedTime = t.UTC().Format(driveTimeFormat)
+					}
+				}
+				accepted.Props = append(accepted.Props, name)
+				continue
+			}
+			if p.XMLName == descriptionProp {
+				update.Description = ""
+				if !patch.Remove {
+					update.Description = propText(p.InnerXML)
+				}
+				update.ForceSendFields = append(update.ForceSendFields, "Description")
+				accepted.Props = append(accepted.Props, name)
+				continue
+			}
+			if p.XMLName == starredProp {
+				starred := false
+				if !patch.Remove {
+					var err error
+					if starred, err = strconv.ParseBool(strings.TrimSpace(propText(p.InnerXML))); err != nil {
+						invalid.Props = append(invalid.Props, name)
+						continue
+					}
+				}
+				update.Starred = starred
+				update.ForceSendFields = append(update.ForceSendFields, "Starred")
+				accepted.Props = append(accepted.Props, name)
+				continue
+			}
+			if isDriveProp(p.XMLName) {
+				forbidden.Props = append(forbidden.Props, name)
+				continue
+			}
+			key := propKey(p.XMLName)
+			if patch.Remove {
+				delete(set, key)
+				removed[key] = true
+				accepted.Props = append(accepted.Props, name)
+				continue
+			}
+
+			nsKey := propNamespacePrefix + namespaceHash(p.XMLName.Space)
+			if len(key)+len(p.InnerXML) > maxAppPropertySize || len(nsKey)+len(p.XMLName.Space) > maxAppPropertySize {
+				tooLarge.Props = append(tooLarge.Props, name)
+				continue
+			}
+			delete(removed, key)
+			set[key] = string(p.InnerXML)
+			set[nsKey] = p.XMLName.Space
+			accepted.Props = append(accepted.Props, name)
+		}
+	}
+
+	if len(tooLarge.Props) == 0 && len(forbidden.Props) == 0 && len(invalid.Props) == 0 {
+		update.AppProperties = set
+		for key := range removed {
+			update.NullFields = append(update.NullFields, "AppProperties."+key)
+		}
+		return update, []webdav.Propstat{accepted}
+	}
+	failed := []webdav.Propstat{}
+	for _, ps := range []webdav.Propstat{tooLarge, forbidden, invalid} {
+		if len(ps.Props) > 0 {
+			failed = append(failed, ps)
+		}
+	}
+	if len(accepted.Props) == 0 {
+		return nil, failed
+	}
+	accepted.Status = webdav.StatusFailedDependency
+	return nil, append(failed, accepted)
+}
+
+// DeadProps implements webdav.DeadPropsHolder, new files have none.
+func (f *openWritableFile) DeadProps() (map[xml.Name]webdav.Property, error) {
+	return map[xml.Name]webdav.Property{}, nil
+}
+
+// Patch implements webdav.DeadPropsHolder. It's used by COPY, the
+// properties are stored together with the content on Close. Of the Drive
+// metadata of the source, only the description is copied.
+func (f *openWritableFile) Patch(patches []webdav.Proppatch) ([]webdav.Propstat, error) {
+	update, propstats := preparePatch(withoutDriveMetadata(patches))
+	if propstats[0].Status != http.StatusOK {
+		return propstats, nil
+	}
+	if f.appProperties == nil {
+		f.appProperties = make(map[string]string)
+	}
+	for key, value := range update.AppProperties {
+		f.appProperties[key] = value
+	}
+	f.description = update.Description
+	return propstats, nil
+}
@@ -0,0 +1,59 @@
+package gdrive
+
+import (
+	"flag"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	log "github.com/cihub/seelog"
+	"golang.org/x/net/context"
+	"golang.org/x/oauth2"
+)
+
+var (
+	proxyFlag = flag.String("proxy", "", "Send Drive and OAuth requests through this proxy, e.g. http://proxy:3128. HTTPS_PROXY, HTTP_PROXY and NO_PROXY are honored otherwise.")
+)
+
+var (
+	transportOnce sync.Once
+	transport     http.RoundTripper
+)
+
+// proxyTransport returns the transport of requests to Google.
+func proxyTransport() http.RoundTripper {
+	transportOnce.Do(func() {
+		transport = newProxyTransport()
+	})
+	return transport
+}
+
+func newProxyTransport() http.RoundTripper {
+	if *proxyFlag == "" {
+		// Uses the proxy given by the environment.
+		return http.DefaultTransport
+	}
+	u, err := url.Parse(*proxyFlag)
+	if err != nil || u.Host == "" {
+		log.Errorf("Invalid --proxy %q: %v\n", *proxyFlag, err)
+		panic(-3)
+	}
+	return &http.Transport{
+		Proxy: http.ProxyURL(u),
+		DialContext: (&net.Dialer{
+			Timeout:   30 * time.Second,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		MaxIdleConns:          100,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: time.Second,
+	}
+}
+
+// withProxy makes the oauth2 clients created with ctx use proxyTransport.
+func withProxy(ctx context.Context) context.Context {
+	return context.WithValue(ctx, oauth2.HTTPClient, &http.Client{Transport: proxyTransport()})
+}
@@ -0,0 +1,24 @@
+package gdrive
+
+import (
+	"strings"
+)
+
+var queryStringEscaper = strings.NewReplacer(`\`, `\\`, `'`, `\'`)
+
+// quoteQueryString quotes s for use as a string literal in a Drive search
+// query. Backslashes and single quotes are the only characters that need
+// escaping there.
+func quoteQueryString(s string) string {
+	return "'" + queryStringEscaper.Replace(s) + "'"
+}
+
+// childQuery is the Drive search query for the files named name in the
+// folder parentID, only folders if onlyFolder.
+func childQuery(parentID string, name string, onlyFolder bool) string {
+	query := quoteQueryString(parentID) + " in parents and " + nameQuery(name)
+	if onlyFolder {
+		query += " and mimeType=" + quoteQueryString(mimeTypeFolder)
+	}
+	return query
+}
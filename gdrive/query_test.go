@@ -0,0 +1,44 @@
+package gdrive
+
+import (
+	"testing"
+
+	"google.golang.org/api/drive/v3"
+)
+
+func TestQuoteQueryString(t *testing.T) {
+	tests := []struct {
+		name   string
+		quoted string
+		query  string
+	}{
+		{`plain.txt`, `'plain.txt'`, `'root' in parents and name='plain.txt'`},
+		{`say "hi".txt`, `'say "hi".txt'`, `'root' in parents and name='say "hi".txt'`},
+		{`it's.txt`, `'it\'s.txt'`, `'root' in parents and name='it\'s.txt'`},
+		{`back\slash.txt`, `'back\\slash.txt'`, `'root' in parents and name='back\\slash.txt'`},
+		{`\'`, `'\\\''`, `'root' in parents and name='\\\''`},
+		{`'"\`, `'\'"\\'`, `'root' in parents and name='\'"\\'`},
+	}
+	for _, tt := range tests {
+		if got := quoteQueryString(tt.name); got != tt.quoted {
+			t.Errorf("quoteQueryString(%q) = %v, want %v", tt.name, got, tt.quoted)
+		}
+		query := childQuery("root", tt.name, false)
+		if query != tt.query {
+			t.Errorf("childQuery(%q) = %v, want %v", tt.name, query, tt.query)
+		}
+
+		// The query finds the file named so, and only it.
+		q, err := parseFakeQuery(query)
+		if err != nil {
+			t.Errorf("can't parse %v: %v", query, err)
+			continue
+		}
+		if !q.match(&fakeFile{meta: drive.File{Name: tt.name, Parents: []string{"root"}}}) {
+			t.Errorf("%v doesn't match %q", query, tt.name)
+		}
+		if q.match(&fakeFile{meta: drive.File{Name: tt.name + "x", Parents: []string{"root"}}}) {
+			t.Errorf("%v matches %q", query, tt.name+"x")
+		}
+	}
+}
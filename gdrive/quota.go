@@ -0,0 +1,45 @@
+package gdrive
+
+import (
+	"flag"
+
+	log "github.com/cihub/seelog"
+	"golang.org/x/net/context"
+	"golang.org/x/net/webdav"
+)
+
+var (
+	quotaCheckFlag = flag.Bool("quota-check", false, "Reject uploads larger than the free Drive storage before receiving them.")
+
+	errQuotaExceeded = &statusError{webdav.StatusInsufficientStorage, "storage quota exceeded"}
+)
+
+// checkQuota fails with errQuotaExceeded if an upload of size bytes can't
+// fit into the free Drive storage. Unknown sizes and quota always pass.
+func (fs *fileSystem) checkQuota(ctx context.Context, size int64) error {
+	if size <= 0 {
+		return nil
+	}
+
+	about, err := fs.about(ctx)
+	if err != nil {
+		log.Errorf("can't check quota: %v", err)
+		return nil
+	}
+
+	if about.MaxUploadSize > 0 && size > about.MaxUploadSize {
+		log.Errorf("upload of %v bytes exceeds maximum upload size %v", size, about.MaxUploadSize)
+		return errQuotaExceeded
+	}
+
+	quota := about.StorageQuota
+	if quota == nil || quota.Limit == 0 {
+		// Unlimited storage.
+		return nil
+	}
+	if free := quota.Limit - quota.Usage; size > free {
+		log.Errorf("upload of %v bytes exceeds free storage %v", size, free)
+		return errQuotaExceeded
+	}
+	return nil
+}
@@ -0,0 +1,103 @@
+package gdrive
+
+import (
+	"flag"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	log "github.com/cihub/seelog"
+)
+
+var (
+	rateLimitFlag = flag.Float64("rate-limit", 0, "Maximum WebDAV requests per second from one client IP, beyond which requests are refused with 429. 0 disables the limit.")
+	rateBurstFlag = flag.Int("rate-burst", 20, "Requests a client IP may make at once above --rate-limit.")
+)
+
+// rateLimiter keeps a token bucket per client IP.
+type rateLimiter struct {
+	rate  float64
+	burst float64
+
+	mu      sync.Mutex
+	buckets map[string]*bucket
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// newRateLimiter returns the limiter set up by flags, or nil if disabled.
+func newRateLimiter() *rateLimiter {
+	if *rateLimitFlag <= 0 {
+		return nil
+	}
+	burst := float64(*rateBurstFlag)
+	if burst < 1 {
+		burst = 1
+	}
+	l := &rateLimiter{rate: *rateLimitFlag, burst: burst, buckets: make(map[string]*bucket)}
+	go l.janitor()
+	return l
+}
+
+// allow takes a token from the bucket of ip, if there is one.
+func (l *rateLimiter) allow(ip string) bool {
+	if l == nil {
+		return true
+	}
+	now := time.Now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	b := l.buckets[ip]
+	if b == nil {
+		b = &bucket{tokens: l.burst, last: now}
+		l.buckets[ip] = b
+	}
+	b.tokens += now.Sub(b.last).Seconds() * l.rate
+	if b.tokens > l.burst {
+		b.tokens = l.burst
+	}
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// janitor drops the buckets which are full again, forever.
+func (l *rateLimiter) janitor() {
+	full := time.Duration(l.burst / l.rate * float64(time.Second))
+	for range time.Tick(time.Minute) {
+		l.mu.Lock()
+		for ip, b := range l.buckets {
+			if time.Since(b.last) > full {
+				delete(l.buckets, ip)
+			}
+		}
+		l.mu.Unlock()
+	}
+}
+
+// limit answers r with 429 and returns false if its client is over the limit.
+func (l *rateLimiter) limit(w http.ResponseWriter, r *http.Request) bool {
+	ip := clientIP(r)
+	if l.allow(ip) {
+		return true
+	}
+	log.Debugf("Rate limited %v %v from %v", r.Method, r.URL.Path, ip)
+	w.Header().Set("Retry-After", "1")
+	http.Error(w, http.StatusText(http.StatusTooManyRequests), http.StatusTooManyRequests)
+	return false
+}
+
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
@@ -0,0 +1,32 @@
+package gdrive
+
+import (
+	"flag"
+
+	log "github.com/cihub/seelog"
+	"golang.org/x/net/context"
+	"google.golang.org/api/drive/v3"
+)
+
+const (
+	recentRoot = "/Recent"
+)
+
+var (
+	recentFlag = flag.Int("recent", 0, "List this many most recently viewed or modified files in a read-only /Recent folder. 0 disables it.")
+)
+
+// listRecent returns the files last viewed or modified by the user, most
+// recent first.
+func (fs *fileSystem) listRecent(ctx context.Context) ([]*drive.File, error) {
+	query := "trashed = false and mimeType != " + quoteQueryString(mimeTypeFolder)
+	r, err := fs.client.Files.List().Spaces("drive").Q(query).
+		OrderBy("viewedByMeTime desc,modifiedTime desc").
+		PageSize(int64(*recentFlag)).
+		Fields("files(" + fileFields + ")").Context(ctx).Do()
+	if err != nil {
+		log.Error("Can't list recent files ", err)
+		return nil, err
+	}
+	return r.Files, nil
+}
@@ -0,0 +1,462 @@
+package gdrive
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/cihub/seelog"
+	"github.com/gomodule/redigo/redis"
+	"golang.org/x/net/webdav"
+)
+
+var (
+	redisLocksFlag      = flag.String("redis-locks", "", "Keep WebDAV locks in the Redis server at this address, so that several instances share them.")
+	redisLockPrefixFlag = flag.String("redis-lock-prefix", "gdrive-webdav:", "Prefix of the Redis keys used for WebDAV locks.")
+)
+
+const (
+	// redisMutexTimeout bounds how long a crashed instance can keep the lock
+	// system mutex and how long others wait for it.
+	redisMutexTimeout = 10 * time.Second
+
+	// redisHoldTimeout bounds how long a lock stays held by a request of a
+	// crashed instance, and how long a lock without timeout, such as the
+	// temporary locks of webdav.Handler, outlives its instance.
+	redisHoldTimeout = 10 * time.Minute
+)
+
+var redisUnlockScript = redis.NewScript(1, `
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("DEL", KEYS[1])
+end
+return 0`)
+
+// redisLS is a lock system kept in Redis, so that instances behind a load
+// balancer see each others' locks. Every lock is stored under
+// "lock:<token>" and indexed by its root under "name:<root>" and in the
+// "roots" sorted set. Operations are serialized with a mutex key. Locks
+// without timeout expire after redisHoldTimeout too, unless the instance
+// which made them is still running and keeps them alive.
+type redisLS struct {
+	pool   *redis.Pool
+	prefix string
+
+	mu       sync.Mutex
+	infinite map[string]string // token to root of the locks without timeout made here
+}
+
+func newRedisLS(addr string, prefix string) (*redisLS, error) {
+	pool := &redis.Pool{
+		MaxIdle:     3,
+		IdleTimeout: 4 * time.Minute,
+		Dial: func() (redis.Conn, error) {
+			return redis.Dial("tcp", addr, redis.DialConnectTimeout(5*time.Second))
+		},
+	}
+
+	c := pool.Get()
+	defer c.Close()
+	if _, err := c.Do("PING"); err != nil {
+		return nil, err
+	}
+	l := &redisLS{pool: pool, prefix: prefix, infinite: make(map[string]string)}
+	go l.keepAlive(redisHoldTimeout / 3)
+	return l, nil
+}
+
+// keepAlive pushes back the expiry of the locks without timeout made by
+// this instance, every interval.
+func (l *redisLS) keepAlive(interval time.Duration) {
+	for range time.Tick(interval) {
+		l.mu.Lock()
+		locks := make(map[string]string, len(l.infinite))
+		for token, root := range l.infinite {
+			locks[token] = root
+		}
+		l.mu.Unlock()
+		if len(locks) == 0 {
+			continue
+		}
+
+		c := l.pool.Get()
+		for token, root := range locks {
+			ok, err := redis.Bool(c.Do("PEXPIRE", l.lockKey(token), int64(redisHoldTimeout/time.Millisecond)))
+			if err == nil && ok {
+				_, err = c.Do("PEXPIRE", l.nameKey(root), int64(redisHoldTimeout/time.Millisecond))
+			}
+			if err != nil {
+				log.Errorf("can't keep lock %v alive: %v", token, err)
+				continue
+			}
+			if !ok {
+				// Unlocked by another instance.
+				l.setInfinite(token, "", false)
+			}
+		}
+		c.Close()
+	}
+}
+
+// setInfinite records whether the lock with token is one without timeout
+// to keep alive.
+func (l *redisLS) setInfinite(token string, root string, infinite bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if infinite {
+		l.infinite[token] = root
+	} else {
+		delete(l.infinite, token)
+	}
+}
+
+func (l *redisLS) lockKey(token string) string {
+	return l.prefix + "lock:" + token
+}
+
+func (l *redisLS) nameKey(name string) string {
+	return l.prefix + "name:" + name
+}
+
+func (l *redisLS) heldKey(token string) string {
+	return l.prefix + "held:" + token
+}
+
+func (l *redisLS) rootsKey() string {
+	return l.prefix + "roots"
+}
+
+func lockSlashClean(name string) string {
+	if name == "" || name[0] != '/' {
+		name = "/" + name
+	}
+	return path.Clean(name)
+}
+
+// withMutex runs fn holding the lock system mutex.
+func (l *redisLS) withMutex(fn func(c redis.Conn) error) error {
+	c := l.pool.Get()
+	defer c.Close()
+
+	id, err := newLockToken()
+	if err != nil {
+		return err
+	}
+	key := l.prefix + "mutex"
+	deadline := time.Now().Add(redisMutexTimeout)
+	for {
+		_, err := redis.String(c.Do("SET", key, id, "NX", "PX", int64(redisMutexTimeout/time.Millisecond)))
+		if err == nil {
+			break
+		}
+		if err != redis.ErrNil {
+			return err
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("timeout waiting for lock system mutex")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	defer redisUnlockScript.Do(c, key, id)
+
+	return fn(c)
+}
+
+// get returns the lock with the given token, or nil if it doesn't exist or
+// has expired.
+func (l *redisLS) get(c redis.Conn, token string) (*lockRecord, error) {
+	v, err := redis.Bytes(c.Do("GET", l.lockKey(token)))
+	if err == redis.ErrNil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var r lockRecord
+	if err := json.Unmarshal(v, &r); err != nil {
+		return nil, err
+	}
+	return &r, nil
+}
+
+// getByName returns the token and the lock rooted at name, cleaning up the
+// index if the lock has expired.
+func (l *redisLS) getByName(c redis.Conn, name string) (string, *lockRecord, error) {
+	token, err := redis.String(c.Do("GET", l.nameKey(name)))
+	if err == redis.ErrNil {
+		return "", nil, nil
+	}
+	if err != nil {
+		return "", nil, err
+	}
+	r, err := l.get(c, token)
+	if err != nil || r != nil {
+		return token, r, err
+	}
+	if _, err := c.Do("DEL", l.nameKey(name)); err != nil {
+		return "", nil, err
+	}
+	if _, err := c.Do("ZREM", l.rootsKey(), name); err != nil {
+		return "", nil, err
+	}
+	return "", nil, nil
+}
+
+// lockRoot returns the root of the lock with token.
+func (l *redisLS) lockRoot(token string) (string, bool) {
+	c := l.pool.Get()
+	defer c.Close()
+	r, err := l.get(c, token)
+	if err != nil || r == nil {
+		return "", false
+	}
+	return r.Root, true
+}
+
+func (l *redisLS) isHeld(c redis.Conn, token string) (bool, error) {
+	return redis.Bool(c.Do("EXISTS", l.heldKey(token)))
+}
+
+func (l *redisLS) put(c redis.Conn, token string, r *lockRecord) error {
+	v, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	for _, kv := range [][2]string{{l.lockKey(token), string(v)}, {l.nameKey(r.Root), token}} {
+		ttl := int64(redisHoldTimeout / time.Millisecond)
+		if !r.Infinite {
+			ttl = int64(r.Expiry.Sub(time.Now()) / time.Millisecond)
+			if ttl < 1 {
+				ttl = 1
+			}
+		}
+		if _, err := c.Do("SET", kv[0], kv[1], "PX", ttl); err != nil {
+			return err
+		}
+	}
+	_, err = c.Do("ZADD", l.rootsKey(), 0, r.Root)
+	return err
+}
+
+// lookup returns the token of the lock on name claimed by one of the
+// conditions, or "" if there is none or it is held by another request.
+func (l *redisLS) lookup(c redis.Conn, name string, conditions []webdav.Condition) (string, error) {
+	for _, cond := range conditions {
+		if cond.Token == "" {
+			continue
+		}
+		r, err := l.get(c, cond.Token)
+		if err != nil {
+			return "", err
+		}
+		if r == nil {
+			continue
+		}
+		held, err := l.isHeld(c, cond.Token)
+		if err != nil {
+			return "", err
+		}
+		if held {
+			continue
+		}
+		if name == r.Root {
+			return cond.Token, nil
+		}
+		if r.ZeroDepth {
+			continue
+		}
+		if r.Root == "/" || strings.HasPrefix(name, r.Root+"/") {
+			return cond.Token, nil
+		}
+	}
+	return "", nil
+}
+
+func (l *redisLS) Confirm(now time.Time, name0, name1 string, conditions ...webdav.Condition) (func(), error) {
+	var held []string
+	err := l.withMutex(func(c redis.Conn) error {
+		for _, name := range []string{name0, name1} {
+			if name == "" {
+				continue
+			}
+			token, err := l.lookup(c, lockSlashClean(name), conditions)
+			if err != nil {
+				return err
+			}
+			if token == "" {
+				return webdav.ErrConfirmationFailed
+			}
+			if len(held) == 0 || held[0] != token {
+				held = append(held, token)
+			}
+		}
+		for _, token := range held {
+			if _, err := c.Do("SET", l.heldKey(token), 1, "PX", int64(redisHoldTimeout/time.Millisecond)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return func() {
+		c := l.pool.Get()
+		defer c.Close()
+		for _, token := range held {
+			if _, err := c.Do("DEL", l.heldKey(token)); err != nil {
+				log.Errorf("can't release lock %v: %v", token, err)
+			}
+		}
+	}, nil
+}
+
+// canCreate reports whether a lock rooted at root conflicts with no other
+// lock: none on root itself, no infinite one on its ancestors and, if the
+// new lock has infinite depth, none on its descendants.
+func (l *redisLS) canCreate(c redis.Conn, root string, zeroDepth bool) (bool, error) {
+	for name := root; ; name = path.Dir(name) {
+		_, r, err := l.getByName(c, name)
+		if err != nil {
+			return false, err
+		}
+		if r != nil && (name == root || !r.ZeroDepth) {
+			return false, nil
+		}
+		if name == "/" {
+			break
+		}
+	}
+
+	if zeroDepth {
+		return true, nil
+	}
+
+	prefix := root + "/"
+	if root == "/" {
+		prefix = "/"
+	}
+	names, err := redis.Strings(c.Do("ZRANGEBYLEX", l.rootsKey(), "["+prefix, "["+prefix+"\xff"))
+	if err != nil {
+		return false, err
+	}
+	for _, name := range names {
+		if name == root {
+			continue
+		}
+		_, r, err := l.getByName(c, name)
+		if err != nil {
+			return false, err
+		}
+		if r != nil {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+func (l *redisLS) Create(now time.Time, details webdav.LockDetails) (string, error) {
+	details.Root = lockSlashClean(details.Root)
+	var token string
+	err := l.withMutex(func(c redis.Conn) error {
+		ok, err := l.canCreate(c, details.Root, details.ZeroDepth)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return webdav.ErrLocked
+		}
+
+		token, err = newLockToken()
+		if err != nil {
+			return err
+		}
+		r := &lockRecord{
+			Root:      details.Root,
+			OwnerXML:  details.OwnerXML,
+			ZeroDepth: details.ZeroDepth,
+			Infinite:  details.Duration < 0,
+		}
+		if !r.Infinite {
+			r.Expiry = now.Add(details.Duration)
+		}
+		if err := l.put(c, token, r); err != nil {
+			return err
+		}
+		l.setInfinite(token, r.Root, r.Infinite)
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+func (l *redisLS) Refresh(now time.Time, token string, duration time.Duration) (webdav.LockDetails, error) {
+	var details webdav.LockDetails
+	err := l.withMutex(func(c redis.Conn) error {
+		r, err := l.get(c, token)
+		if err != nil {
+			return err
+		}
+		if r == nil {
+			return webdav.ErrNoSuchLock
+		}
+		held, err := l.isHeld(c, token)
+		if err != nil {
+			return err
+		}
+		if held {
+			return webdav.ErrLocked
+		}
+
+		r.Infinite = duration < 0
+		r.Expiry = time.Time{}
+		if !r.Infinite {
+			r.Expiry = now.Add(duration)
+		}
+		details = webdav.LockDetails{
+			Root:      r.Root,
+			Duration:  duration,
+			OwnerXML:  r.OwnerXML,
+			ZeroDepth: r.ZeroDepth,
+		}
+		if err := l.put(c, token, r); err != nil {
+			return err
+		}
+		l.setInfinite(token, r.Root, r.Infinite)
+		return nil
+	})
+	return details, err
+}
+
+func (l *redisLS) Unlock(now time.Time, token string) error {
+	return l.withMutex(func(c redis.Conn) error {
+		r, err := l.get(c, token)
+		if err != nil {
+			return err
+		}
+		if r == nil {
+			return webdav.ErrNoSuchLock
+		}
+		held, err := l.isHeld(c, token)
+		if err != nil {
+			return err
+		}
+		if held {
+			return webdav.ErrLocked
+		}
+
+		if _, err := c.Do("DEL", l.lockKey(token), l.nameKey(r.Root)); err != nil {
+			return err
+		}
+		l.setInfinite(token, "", false)
+		_, err = c.Do("ZREM", l.rootsKey(), r.Root)
+		return err
+	})
+}
@@ -0,0 +1,173 @@
+package gdrive
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"time"
+
+	log "github.com/cihub/seelog"
+	"golang.org/x/net/webdav"
+	"google.golang.org/api/drive/v3"
+)
+
+// versionTreeRequest is the body of a DeltaV (RFC 3253) version-tree REPORT.
+type versionTreeRequest struct {
+	XMLName xml.Name `xml:"DAV: version-tree"`
+	Prop    *struct {
+		Names []struct {
+			XMLName xml.Name
+		} `xml:",any"`
+	} `xml:"DAV: prop"`
+}
+
+var versionTreeProps = []xml.Name{
+	{Space: "DAV:", Local: "version-name"},
+	{Space: "DAV:", Local: "creator-displayname"},
+	{Space: "DAV:", Local: "getlastmodified"},
+	{Space: "DAV:", Local: "getcontentlength"},
+	{Space: "DAV:", Local: "getetag"},
+}
+
+// versionTreeProp returns the value of a property of a revision.
+func versionTreeProp(rev *drive.Revision, name xml.Name) (string, bool) {
+	if name.Space != "DAV:" {
+		return "", false
+	}
+	switch name.Local {
+	case "version-name":
+		return rev.Id, true
+	case "creator-displayname":
+		if rev.LastModifyingUser == nil {
+			return "", true
+		}
+		return rev.LastModifyingUser.DisplayName, true
+	case "getlastmodified":
+		t, err := time.Parse(time.RFC3339, rev.ModifiedTime)
+		if err != nil {
+			return "", false
+		}
+		return t.UTC().Format(http.TimeFormat), true
+	case "getcontentlength":
+		return strconv.FormatInt(rev.Size, 10), true
+	case "getetag":
+		if rev.Md5Checksum == "" {
+			return "", false
+		}
+		return `"` + rev.Md5Checksum + `"`, true
+	}
+	return "", false
+}
+
+// handleReport answers a version-tree REPORT with the revisions of a file.
+// Revisions are referred to by their paths below versionsRoot, readable
+// when --versions is given. sync-collection REPORTs are passed on to
+// handleSyncCollection.
+func (h *handler) handleReport(w http.ResponseWriter, r *http.Request, fs *fileSystem) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, webdav.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	if reportName(body) == (xml.Name{Space: "DAV:", Local: "sync-collection"}) {
+		h.handleSyncCollection(w, r, fs, body)
+		return
+	}
+
+	var req versionTreeRequest
+	if err := xml.Unmarshal(body, &req); err != nil {
+		log.Debugf("unsupported REPORT on %v: %v", r.URL.Path, err)
+		http.Error(w, "only the version-tree and sync-collection reports are supported", http.StatusForbidden)
+		return
+	}
+
+	name := normalizePath(r.URL.Path)
+	fp, err := fs.getFile(r.Context(), name, false)
+	if err != nil {
+		status := errorStatus(err)
+		if status == 0 {
+			status = http.StatusNotFound
+		}
+		http.Error(w, webdav.StatusText(status), status)
+		return
+	}
+	if fp.file.MimeType == mimeTypeFolder {
+		http.Error(w, "folders have no versions", http.StatusForbidden)
+		return
+	}
+
+	revisions, err := fs.listRevisions(r.Context(), fp.file.Id)
+	if err != nil {
+		http.Error(w, webdav.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	names := versionTreeProps
+	if req.Prop != nil {
+		names = nil
+		for _, n := range req.Prop.Names {
+			names = append(names, n.XMLName)
+		}
+	}
+
+	var b bytes.Buffer
+	b.WriteString(`<?xml version="1.0" encoding="UTF-8"?>` + "\n")
+	b.WriteString(`<D:multistatus xmlns:D="DAV:">`)
+	for _, rev := range revisions {
+		href := (&url.URL{Path: path.Join(versionsRoot, name, revisionName(fp.file, rev))}).EscapedPath()
+		b.WriteString("<D:response><D:href>")
+		xml.EscapeText(&b, []byte(href))
+		b.WriteString("</D:href>")
+
+		found, missing := &bytes.Buffer{}, &bytes.Buffer{}
+		for _, n := range names {
+			value, ok := versionTreeProp(rev, n)
+			if !ok {
+				fmt.Fprintf(missing, `<x:%s xmlns:x="%s"/>`, n.Local, escapeXML(n.Space))
+				continue
+			}
+			fmt.Fprintf(found, `<x:%s xmlns:x="%s">%s</x:%s>`, n.Local, escapeXML(n.Space), escapeXML(value), n.Local)
+		}
+		writePropstat(&b, found, http.StatusOK)
+		writePropstat(&b, missing, http.StatusNotFound)
+		b.WriteString("</D:response>")
+	}
+	b.WriteString("</D:multistatus>")
+
+	w.Header().Set("Content-Type", "text/xml; charset=utf-8")
+	w.WriteHeader(webdav.StatusMulti)
+	w.Write(b.Bytes())
+}
+
+// reportName returns the name of the root element of a REPORT body.
+func reportName(body []byte) xml.Name {
+	d := xml.NewDecoder(bytes.NewReader(body))
+	for {
+		t, err := d.Token()
+		if err != nil {
+			return xml.Name{}
+		}
+		if start, ok := t.(xml.StartElement); ok {
+			return start.Name
+		}
+	}
+}
+
+func writePropstat(b *bytes.Buffer, props *bytes.Buffer, status int) {
+	if props.Len() == 0 {
+		return
+	}
+	fmt.Fprintf(b, "<D:propstat><D:prop>%s</D:prop><D:status>HTTP/1.1 %d %s</D:status></D:propstat>",
+		props.Bytes(), status, webdav.StatusText(status))
+}
+
+func escapeXML(s string) string {
+	var b bytes.Buffer
+	xml.EscapeText(&b, []byte(s))
+	return b.String()
+}
@@ -0,0 +1,84 @@
+package gdrive
+
+import (
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+
+	"google.golang.org/api/drive/v3"
+)
+
+// resourceKeysHeader gives Drive the resource keys of link-shared files,
+// without which files shared before the security update of 2021 are not
+// found.
+const resourceKeysHeader = "X-Goog-Drive-Resource-Keys"
+
+// parentsQuery finds the folder listed by a files.list query.
+var parentsQuery = regexp.MustCompile(`^'([^']+)' in parents`)
+
+// resourceKeys remembers the resource keys of the files listed, by ID.
+type resourceKeys struct {
+	mu   sync.RWMutex
+	keys map[string]string
+}
+
+func newResourceKeys() *resourceKeys {
+	return &resourceKeys{keys: make(map[string]string)}
+}
+
+func (k *resourceKeys) add(files ...*drive.File) {
+	if k == nil {
+		return
+	}
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	for _, file := range files {
+		if file != nil && file.ResourceKey != "" {
+			k.keys[file.Id] = file.ResourceKey
+		}
+	}
+}
+
+func (k *resourceKeys) get(id string) string {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	return k.keys[id]
+}
+
+// resourceKeyTransport adds the resource key of the file a Drive request
+// is about, if it has one.
+type resourceKeyTransport struct {
+	base http.RoundTripper
+	keys *resourceKeys
+}
+
+func (t *resourceKeyTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if id := requestFileID(req); id != "" {
+		if key := t.keys.get(id); key != "" {
+			r := *req
+			r.Header = make(http.Header, len(req.Header)+1)
+			for name, values := range req.Header {
+				r.Header[name] = values
+			}
+			r.Header.Set(resourceKeysHeader, id+"/"+key)
+			req = &r
+		}
+	}
+	return t.base.RoundTrip(req)
+}
+
+// requestFileID returns the ID of the file in the path of a Drive request,
+// as in /drive/v3/files/{fileId}/revisions, or of the folder it lists, or "".
+func requestFileID(req *http.Request) string {
+	parts := strings.Split(req.URL.Path, "/")
+	for i := 0; i+1 < len(parts); i++ {
+		if parts[i] == "files" {
+			return parts[i+1]
+		}
+	}
+	if m := parentsQuery.FindStringSubmatch(req.URL.Query().Get("q")); m != nil {
+		return m[1]
+	}
+	return ""
+}
@@ -0,0 +1,66 @@
+package gdrive
+
+import (
+	"bytes"
+	"flag"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"time"
+
+	log "github.com/cihub/seelog"
+)
+
+var (
+	driveRetriesFlag = flag.Int("drive-retries", 5, "How many times a Drive request refused for exceeding a rate limit is retried, with exponential backoff, before failing with 503.")
+)
+
+// isRateLimitReason reports whether Drive refused a request with reason
+// because too many were sent, so that it may succeed later.
+func isRateLimitReason(reason string) bool {
+	switch reason {
+	case "rateLimitExceeded", "userRateLimitExceeded", "429":
+		return true
+	}
+	return false
+}
+
+// retryTransport retries Drive requests refused by rate limits. Requests
+// whose body can't be sent again, such as streamed uploads, are not.
+type retryTransport struct {
+	base http.RoundTripper
+}
+
+func (t *retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	for attempt := 0; ; attempt++ {
+		res, err := t.base.RoundTrip(req)
+		if err != nil || attempt >= *driveRetriesFlag || (req.Body != nil && req.GetBody == nil) {
+			return res, err
+		}
+		if res.StatusCode != http.StatusForbidden && res.StatusCode != http.StatusTooManyRequests {
+			return res, nil
+		}
+		body, _ := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		res.Body = ioutil.NopCloser(bytes.NewReader(body))
+		reason := errorReason(res.StatusCode, body)
+		if !isRateLimitReason(reason) {
+			return res, nil
+		}
+
+		delay := time.Duration(1<<uint(attempt))*time.Second + time.Duration(rand.Int63n(int64(time.Second)))
+		log.Warnf("Drive %v refused with %v, retrying in %v", apiMethod(req), reason, delay)
+		select {
+		case <-time.After(delay):
+		case <-req.Context().Done():
+			return res, nil
+		}
+		if req.GetBody != nil {
+			r := *req
+			if r.Body, err = req.GetBody(); err != nil {
+				return nil, err
+			}
+			req = &r
+		}
+	}
+}
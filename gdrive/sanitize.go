@@ -0,0 +1,136 @@
+package gdrive
+
+import (
+	"flag"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+
+	log "github.com/cihub/seelog"
+)
+
+const (
+	filenameReject  = "reject"
+	filenameRewrite = "rewrite"
+)
+
+var (
+	filenamePolicyFlag      = flag.String("filename-policy", "off", "What to do with new file and folder names that are problematic for Drive or for clients: off, reject with 400 Bad Request, or rewrite them to acceptable ones.")
+	filenameRulesFlag       = flag.String("filename-rules", "trailing,control,reserved", "Comma separated problems --filename-policy looks for: trailing (trailing spaces and dots), control (control characters), reserved (names reserved by Windows such as CON or NUL.txt) and chars (characters Windows doesn't allow: <>:\"\\|?*).")
+	filenameReplacementFlag = flag.String("filename-replacement", "_", "What --filename-policy=rewrite replaces bad characters with, and appends to reserved names.")
+)
+
+// windowsReserved are the names Windows doesn't allow, with any extension.
+var windowsReserved = map[string]bool{
+	"CON": true, "PRN": true, "AUX": true, "NUL": true,
+	"COM1": true, "COM2": true, "COM3": true, "COM4": true, "COM5": true, "COM6": true, "COM7": true, "COM8": true, "COM9": true,
+	"LPT1": true, "LPT2": true, "LPT3": true, "LPT4": true, "LPT5": true, "LPT6": true, "LPT7": true, "LPT8": true, "LPT9": true,
+}
+
+// filenameRule reports whether --filename-rules includes rule.
+func filenameRule(rule string) bool {
+	for _, r := range strings.Split(*filenameRulesFlag, ",") {
+		if strings.TrimSpace(r) == rule {
+			return true
+		}
+	}
+	return false
+}
+
+// sanitizeName returns name rewritten to avoid the problems of
+// --filename-rules, and what the first problem found was, if any.
+func sanitizeName(name string) (string, string) {
+	repl := *filenameReplacementFlag
+	problem := ""
+	if filenameRule("control") || filenameRule("chars") {
+		var b strings.Builder
+		for _, r := range name {
+			switch {
+			case r < 0x20 || r == 0x7f:
+				if filenameRule("control") {
+					if problem == "" {
+						problem = "it contains control characters"
+					}
+					b.WriteString(repl)
+					continue
+				}
+			case strings.ContainsRune(`<>:"\|?*`, r):
+				if filenameRule("chars") {
+					if problem == "" {
+						problem = fmt.Sprintf("it contains %q", r)
+					}
+					b.WriteString(repl)
+					continue
+				}
+			}
+			b.WriteRune(r)
+		}
+		name = b.String()
+	}
+	if filenameRule("trailing") {
+		if trimmed := strings.TrimRight(name, " ."); trimmed != name {
+			if problem == "" {
+				problem = "it ends with a space or a dot"
+			}
+			name = trimmed
+			if name == "" {
+				name = repl
+			}
+		}
+	}
+	if filenameRule("reserved") {
+		base := strings.ToUpper(strings.SplitN(name, ".", 2)[0])
+		if windowsReserved[strings.TrimRight(base, " ")] {
+			if problem == "" {
+				problem = "it is reserved by Windows"
+			}
+			if i := strings.Index(name, "."); i >= 0 {
+				name = name[:i] + repl + name[i:]
+			} else {
+				name += repl
+			}
+		}
+	}
+	return name, problem
+}
+
+// sanitizeRequest applies --filename-policy to the file or folder r
+// creates, which is its target for MOVE and COPY. It returns why r is
+// rejected, or "" after rewriting r if needed.
+func sanitizeRequest(r *http.Request) string {
+	if *filenamePolicyFlag != filenameReject && *filenamePolicyFlag != filenameRewrite {
+		return ""
+	}
+	u := r.URL
+	if r.Method == "MOVE" || r.Method == "COPY" {
+		var err error
+		if u, err = url.Parse(r.Header.Get("Destination")); err != nil {
+			return ""
+		}
+	}
+	p := strings.TrimRight(u.Path, "/")
+	dir, name := path.Split(p)
+	if name == "" {
+		return ""
+	}
+	sanitized, problem := sanitizeName(name)
+	if problem == "" {
+		return ""
+	}
+	if *filenamePolicyFlag == filenameReject {
+		return fmt.Sprintf("name %q is not allowed, %v", name, problem)
+	}
+
+	log.Infof("%v %v: storing %q as %q, %v", r.Method, r.URL.Path, name, sanitized, problem)
+	rewritten := *u
+	rewritten.Path = dir + sanitized
+	rewritten.RawPath = ""
+	if u == r.URL {
+		r.URL = &rewritten
+	} else {
+		r.Header.Set("Destination", rewritten.String())
+	}
+	return ""
+}
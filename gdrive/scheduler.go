@@ -0,0 +1,98 @@
+package gdrive
+
+import (
+	"flag"
+	"net/http"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+var (
+	driveRateLimitFlag = flag.Float64("drive-rate-limit", 0, "Maximum Drive requests per second. Interactive requests are sent before those of background work: change polling, index sync and write-back. 0 means no limit.")
+	driveRateBurstFlag = flag.Int("drive-rate-burst", 10, "Drive requests that may be sent at once above --drive-rate-limit.")
+)
+
+type backgroundKey struct{}
+
+// background marks ctx as background work, whose Drive requests wait while
+// interactive ones are pending.
+func background(ctx context.Context) context.Context {
+	return context.WithValue(ctx, backgroundKey{}, true)
+}
+
+func isBackground(ctx context.Context) bool {
+	b, _ := ctx.Value(backgroundKey{}).(bool)
+	return b
+}
+
+// scheduledTransport sends Drive requests at --drive-rate-limit, giving
+// each free slot to an interactive request before a background one.
+type scheduledTransport struct {
+	base        http.RoundTripper
+	interactive chan struct{}
+	background  chan struct{}
+}
+
+// withScheduler wraps base if --drive-rate-limit is given.
+func withScheduler(base http.RoundTripper) http.RoundTripper {
+	if *driveRateLimitFlag <= 0 {
+		return base
+	}
+	t := &scheduledTransport{
+		base:        base,
+		interactive: make(chan struct{}),
+		background:  make(chan struct{}),
+	}
+	go t.run(time.Duration(float64(time.Second) / *driveRateLimitFlag), *driveRateBurstFlag)
+	return t
+}
+
+// run hands out a slot every interval, keeping up to burst unused ones.
+func (t *scheduledTransport) run(interval time.Duration, burst int) {
+	if burst < 1 {
+		burst = 1
+	}
+	tick := time.NewTicker(interval)
+	tokens := burst
+	for {
+		if tokens == 0 {
+			<-tick.C
+			tokens++
+		}
+		select {
+		case t.interactive <- struct{}{}:
+			tokens--
+			continue
+		default:
+		}
+		select {
+		case t.interactive <- struct{}{}:
+			tokens--
+		case t.background <- struct{}{}:
+			tokens--
+		case <-tick.C:
+			if tokens < burst {
+				tokens++
+			}
+		}
+	}
+}
+
+func (t *scheduledTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	slots := t.interactive
+	if isBackground(req.Context()) {
+		slots = t.background
+	}
+	select {
+	case <-slots:
+	case <-req.Context().Done():
+		return nil, req.Context().Err()
+	}
+
+	base := t.base
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	return base.RoundTrip(req)
+}
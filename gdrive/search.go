@@ -0,0 +1,319 @@
+package gdrive
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+
+	log "github.com/cihub/seelog"
+	"golang.org/x/net/context"
+	"golang.org/x/net/webdav"
+	"google.golang.org/api/drive/v3"
+)
+
+const (
+	// searchDefaultResults and searchMaxResults bound the results of a
+	// SEARCH without and with a limit.
+	searchDefaultResults = 100
+	searchMaxResults     = 1000
+)
+
+// searchRequest is the body of a DASL (RFC 5323) basicsearch SEARCH.
+type searchRequest struct {
+	XMLName xml.Name `xml:"DAV: searchrequest"`
+	Basic   *struct {
+		Select struct {
+			Prop *struct {
+				Names []struct {
+					XMLName xml.Name
+				} `xml:",any"`
+			} `xml:"DAV: prop"`
+		} `xml:"DAV: select"`
+		Scopes []struct {
+			Href  string `xml:"DAV: href"`
+			Depth string `xml:"DAV: depth"`
+		} `xml:"DAV: from>scope"`
+		Where struct {
+			Ops []searchOp `xml:",any"`
+		} `xml:"DAV: where"`
+		Limit int `xml:"DAV: limit>nresults"`
+	} `xml:"DAV: basicsearch"`
+}
+
+// searchOp is an operator of the where clause of a basicsearch.
+type searchOp struct {
+	XMLName xml.Name
+	Prop    *struct {
+		Names []struct {
+			XMLName xml.Name
+		} `xml:",any"`
+	} `xml:"DAV: prop"`
+	Literal string     `xml:"DAV: literal"`
+	Ops     []searchOp `xml:",any"`
+	Text    string     `xml:",chardata"`
+}
+
+var searchProps = []xml.Name{
+	{Space: "DAV:", Local: "displayname"},
+	{Space: "DAV:", Local: "resourcetype"},
+	{Space: "DAV:", Local: "getcontentlength"},
+	{Space: "DAV:", Local: "getcontenttype"},
+	{Space: "DAV:", Local: "getlastmodified"},
+	{Space: "DAV:", Local: "getetag"},
+}
+
+// driveQuery translates op to a Drive query. Supported are and, or, not,
+// contains on the content, like and eq on displayname and eq on
+// getcontenttype, and is-collection.
+func (op *searchOp) driveQuery() (string, error) {
+	if op.XMLName.Space != "DAV:" {
+		return "", fmt.Errorf("unsupported operator %v", op.XMLName.Local)
+	}
+	switch op.XMLName.Local {
+	case "and", "or":
+		terms := []string{}
+		for i := range op.Ops {
+			q, err := op.Ops[i].driveQuery()
+			if err != nil {
+				return "", err
+			}
+			terms = append(terms, "("+q+")")
+		}
+		if len(terms) == 0 {
+			return "", fmt.Errorf("empty %v", op.XMLName.Local)
+		}
+		return strings.Join(terms, " "+op.XMLName.Local+" "), nil
+	case "not":
+		if len(op.Ops) != 1 {
+			return "", fmt.Errorf("not takes one operand")
+		}
+		q, err := op.Ops[0].driveQuery()
+		if err != nil {
+			return "", err
+		}
+		return "not (" + q + ")", nil
+	case "contains":
+		return "fullText contains " + quoteQueryString(strings.TrimSpace(op.Text)), nil
+	case "is-collection":
+		return "mimeType = " + quoteQueryString(mimeTypeFolder), nil
+	case "like", "eq":
+		if op.Prop == nil || len(op.Prop.Names) != 1 {
+			return "", fmt.Errorf("%v takes one property", op.XMLName.Local)
+		}
+		prop := op.Prop.Names[0].XMLName
+		switch {
+		case prop == xml.Name{Space: "DAV:", Local: "displayname"} && op.XMLName.Local == "eq":
+			return "name = " + quoteQueryString(op.Literal), nil
+		case prop == xml.Name{Space: "DAV:", Local: "displayname"}:
+			// Drive matches name prefixes of words only.
+			s := strings.Trim(op.Literal, "%")
+			if strings.ContainsAny(s, "%_") {
+				return "", fmt.Errorf("only %%text%% patterns are supported")
+			}
+			return "name contains " + quoteQueryString(s), nil
+		case prop == xml.Name{Space: "DAV:", Local: "getcontenttype"} && op.XMLName.Local == "eq":
+			return "mimeType = " + quoteQueryString(op.Literal), nil
+		}
+		return "", fmt.Errorf("unsupported property %v", prop.Local)
+	}
+	return "", fmt.Errorf("unsupported operator %v", op.XMLName.Local)
+}
+
+// handleSearch answers a basicsearch SEARCH with the files found by Drive
+// within its scope, which is the request path by default.
+func (h *handler) handleSearch(w http.ResponseWriter, r *http.Request, fs *fileSystem) {
+	var req searchRequest
+	if err := xml.NewDecoder(r.Body).Decode(&req); err != nil || req.Basic == nil {
+		log.Debugf("unsupported SEARCH on %v: %v", r.URL.Path, err)
+		http.Error(w, "only basicsearch is supported", http.StatusUnprocessableEntity)
+		return
+	}
+	if len(req.Basic.Where.Ops) != 1 {
+		http.Error(w, "where needs one operator", http.StatusBadRequest)
+		return
+	}
+	q, err := req.Basic.Where.Ops[0].driveQuery()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	scope, depth := normalizePath(r.URL.Path), "infinity"
+	if len(req.Basic.Scopes) > 0 {
+		u, err := url.Parse(req.Basic.Scopes[0].Href)
+		if err != nil {
+			http.Error(w, "bad scope", http.StatusBadRequest)
+			return
+		}
+		scope = normalizePath(u.Path)
+		if d := strings.TrimSpace(req.Basic.Scopes[0].Depth); d != "" {
+			depth = d
+		}
+	}
+	limit := req.Basic.Limit
+	if limit <= 0 {
+		limit = searchDefaultResults
+	}
+	if limit > searchMaxResults {
+		limit = searchMaxResults
+	}
+	names := searchProps
+	if req.Basic.Select.Prop != nil {
+		names = nil
+		for _, n := range req.Basic.Select.Prop.Names {
+			names = append(names, n.XMLName)
+		}
+	}
+
+	found, err := fs.search(r.Context(), q, scope, depth, limit)
+	if err != nil {
+		log.Errorf("can't search %v: %v", q, err)
+		status := errorStatus(err)
+		if status == 0 {
+			status = http.StatusBadGateway
+		}
+		http.Error(w, webdav.StatusText(status), status)
+		return
+	}
+
+	var b bytes.Buffer
+	b.WriteString(`<?xml version="1.0" encoding="UTF-8"?>` + "\n")
+	b.WriteString(`<D:multistatus xmlns:D="DAV:">`)
+	for _, fp := range found {
+		fs.writeFileResponse(r.Context(), &b, fp.path, fp.file, names)
+	}
+	b.WriteString("</D:multistatus>")
+
+	w.Header().Set("Content-Type", "text/xml; charset=utf-8")
+	w.WriteHeader(webdav.StatusMulti)
+	w.Write(b.Bytes())
+}
+
+// writeFileResponse writes the response of a multistatus giving the
+// properties names of file at p, all of them if names is nil, as PROPFIND
+// would.
+func (fs *fileSystem) writeFileResponse(ctx context.Context, b *bytes.Buffer, p string, file *drive.File, names []xml.Name) {
+	href := (&url.URL{Path: p}).EscapedPath()
+	if file.MimeType == mimeTypeFolder {
+		href += "/"
+	}
+	b.WriteString("<D:response><D:href>")
+	xml.EscapeText(b, []byte(href))
+	b.WriteString("</D:href>")
+
+	fi := fs.fileInfo(file)
+	props, _ := (&openReadonlyFile{ctx: ctx, fs: fs, file: file, name: p}).DeadProps()
+	if names == nil {
+		names = append([]xml.Name{}, searchProps...)
+		names = append(names, xml.Name{Space: "DAV:", Local: "supportedlock"})
+		for n := range props {
+			names = append(names, n)
+		}
+	}
+	present, missing := &bytes.Buffer{}, &bytes.Buffer{}
+	for _, n := range names {
+		if prop, ok := props[n]; ok {
+			fmt.Fprintf(present, `<x:%s xmlns:x="%s">%s</x:%s>`, n.Local, escapeXML(n.Space), prop.InnerXML, n.Local)
+			continue
+		}
+		value, ok := fileProp(fi, n)
+		if p == "" && n.Local == "displayname" && n.Space == "DAV:" {
+			// The root has no name, as with the webdav handler.
+			value = ""
+		}
+		if !ok {
+			fmt.Fprintf(missing, `<x:%s xmlns:x="%s"/>`, n.Local, escapeXML(n.Space))
+			continue
+		}
+		fmt.Fprintf(present, `<x:%s xmlns:x="%s">%s</x:%s>`, n.Local, escapeXML(n.Space), value, n.Local)
+	}
+	writePropstat(b, present, http.StatusOK)
+	writePropstat(b, missing, http.StatusNotFound)
+	b.WriteString("</D:response>")
+}
+
+// fileProp returns the XML value of a live property of fi.
+func fileProp(fi *fileInfo, name xml.Name) (string, bool) {
+	if name.Space != "DAV:" {
+		return "", false
+	}
+	switch name.Local {
+	case "displayname":
+		return escapeXML(fi.Name()), true
+	case "resourcetype":
+		if fi.IsDir() {
+			return "<D:collection/>", true
+		}
+		return "", true
+	case "getcontentlength":
+		if fi.IsDir() {
+			return "", false
+		}
+		return strconv.FormatInt(fi.Size(), 10), true
+	case "getcontenttype":
+		if fi.IsDir() {
+			return "", false
+		}
+		t, _ := fi.ContentType(nil)
+		return escapeXML(t), true
+	case "getlastmodified":
+		return fi.ModTime().UTC().Format(http.TimeFormat), true
+	case "supportedlock":
+		return `<D:lockentry><D:lockscope><D:exclusive/></D:lockscope><D:locktype><D:write/></D:locktype></D:lockentry>`, true
+	case "getetag":
+		if fi.IsDir() {
+			return "", false
+		}
+		return escapeXML(fmt.Sprintf(`"%x%x"`, fi.ModTime().UnixNano(), fi.Size())), true
+	}
+	return "", false
+}
+
+// search runs query and returns up to limit of the files found within
+// depth of the folder scope, with their paths.
+func (fs *fileSystem) search(ctx context.Context, query string, scope string, depth string, limit int) ([]*fileAndPath, error) {
+	found := []*fileAndPath{}
+	err := fs.listFiles().Q("("+query+") and trashed = false").
+		Fields("nextPageToken, files("+fileFields+")").
+		Pages(ctx, func(r *drive.FileList) error {
+			for _, file := range r.Files {
+				if ignoreFile(file) {
+					continue
+				}
+				p, err := fs.pathByID(ctx, file)
+				if err != nil {
+					// Outside the served tree.
+					continue
+				}
+				if !inSearchScope(p, scope, depth) || isHiddenPath(p) || isFilteredPath(p) {
+					continue
+				}
+				found = append(found, &fileAndPath{file: file, path: p})
+				if len(found) >= limit {
+					return errSearchDone
+				}
+			}
+			return nil
+		})
+	if err == errSearchDone {
+		err = nil
+	}
+	return found, err
+}
+
+var errSearchDone = fmt.Errorf("enough results")
+
+func inSearchScope(p string, scope string, depth string) bool {
+	switch depth {
+	case "0":
+		return p == scope
+	case "1":
+		return path.Dir(p) == scope || scope == "" && path.Dir(p) == "/"
+	}
+	return scope == "" || p == scope || strings.HasPrefix(p, scope+"/")
+}
@@ -0,0 +1,56 @@
+package gdrive
+
+import (
+	"flag"
+	"strings"
+	"time"
+
+	log "github.com/cihub/seelog"
+	"golang.org/x/net/context"
+	"google.golang.org/api/drive/v3"
+)
+
+const (
+	searchRoot = "/.search"
+)
+
+var (
+	searchFolderFlag = flag.Bool("search-folder", false, "Search Drive by opening /.search/<query>/, a read-only folder listing the files whose name or content contains the query.")
+)
+
+// findSearchFolder returns the virtual folder of the search name is in, or
+// the empty /.search folder itself.
+func findSearchFolder(name string) *virtualFolder {
+	if !*searchFolderFlag || *rootFolderIDFlag != "" {
+		return nil
+	}
+	if name == searchRoot {
+		return &virtualFolder{root: searchRoot, list: listNothing, ttl: time.Minute}
+	}
+	if !strings.HasPrefix(name, searchRoot+"/") {
+		return nil
+	}
+	query := strings.SplitN(strings.TrimPrefix(name, searchRoot+"/"), "/", 2)[0]
+	list := func(fs *fileSystem, ctx context.Context) ([]*drive.File, error) {
+		return fs.listSearch(ctx, query)
+	}
+	return &virtualFolder{root: searchRoot + "/" + query, list: list, ttl: 30 * time.Second}
+}
+
+func listNothing(fs *fileSystem, ctx context.Context) ([]*drive.File, error) {
+	return nil, nil
+}
+
+// listSearch returns the files whose name or content contains query.
+func (fs *fileSystem) listSearch(ctx context.Context, query string) ([]*drive.File, error) {
+	q := quoteQueryString(query)
+	r, err := fs.client.Files.List().Spaces("drive").
+		Q("(name contains " + q + " or fullText contains " + q + ") and trashed = false").
+		PageSize(searchDefaultResults).
+		Fields("files(" + fileFields + ")").Context(ctx).Do()
+	if err != nil {
+		log.Errorf("can't search %v: %v", query, err)
+		return nil, err
+	}
+	return r.Files, nil
+}
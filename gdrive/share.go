@@ -0,0 +1,79 @@
+package gdrive
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+
+	log "github.com/cihub/seelog"
+	"golang.org/x/net/context"
+	"google.golang.org/api/drive/v3"
+)
+
+type adminShare struct {
+	Path string `json:"path"`
+	Role string `json:"role"`
+	Link string `json:"link"`
+}
+
+// share lets anyone with the link access the file or folder at p with role,
+// returning the link.
+func (fs *fileSystem) share(ctx context.Context, p string, role string) (string, error) {
+	p = normalizePath(p)
+	if p == "" || isVersionsPath(p) || isVirtualPath(p) {
+		return "", os.ErrPermission
+	}
+	fp, err := fs.getFile(ctx, p, false)
+	if err != nil {
+		return "", err
+	}
+	if skip, err := dryRun("share %v with anyone with the link as %v", p, role); skip {
+		return fp.file.WebViewLink, err
+	}
+
+	perm := &drive.Permission{Type: "anyone", Role: role}
+	if _, err := fs.client.Permissions.Create(fp.file.Id, perm).SupportsAllDrives(true).Context(ctx).Do(); err != nil {
+		return "", err
+	}
+	fs.invalidatePath(p)
+	fs.cache.Delete(cacheKeyPermissions + fp.file.Id)
+	log.Infof("Shared %v with anyone with the link as %v", p, role)
+	return fp.file.WebViewLink, nil
+}
+
+// shareLink creates an "anyone with the link" permission on the file or
+// folder given by the path parameter, with the role given by the role
+// parameter, reader by default, and returns the link.
+func (h *adminHandler) shareLink(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	result := &adminShare{Path: r.FormValue("path"), Role: r.FormValue("role")}
+	switch result.Role {
+	case "":
+		result.Role = "reader"
+	case "reader", "commenter", "writer":
+	default:
+		http.Error(w, "role must be reader, commenter or writer", http.StatusBadRequest)
+		return
+	}
+
+	link, err := h.fs.share(r.Context(), result.Path, result.Role)
+	if err != nil {
+		log.Errorf("can't share %v: %v", result.Path, err)
+		status := errorStatus(err)
+		if os.IsNotExist(err) {
+			status = http.StatusNotFound
+		}
+		if status == 0 {
+			status = http.StatusBadGateway
+		}
+		http.Error(w, http.StatusText(status), status)
+		return
+	}
+	result.Link = link
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
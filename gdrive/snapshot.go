@@ -0,0 +1,146 @@
+package gdrive
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/cihub/seelog"
+	"golang.org/x/net/context"
+)
+
+var (
+	snapshotDirFlag      = flag.String("snapshot-dir", "", "Save a snapshot of the metadata of the whole tree (paths, IDs, sizes, checksums, modification times) to this directory periodically, for audits and for recovery from mass deletions.")
+	snapshotIntervalFlag = flag.Duration("snapshot-interval", 24*time.Hour, "How often --snapshot-dir snapshots are taken.")
+	snapshotFormatFlag   = flag.String("snapshot-format", "json", "Format of --snapshot-dir snapshots: json or csv.")
+	snapshotKeepFlag     = flag.Int("snapshot-keep", 30, "How many --snapshot-dir snapshots are kept, older ones are deleted. 0 keeps all.")
+)
+
+const snapshotPrefix = "snapshot-"
+
+// snapshotEntry is a file of a snapshot.
+type snapshotEntry struct {
+	Path         string `json:"path"`
+	ID           string `json:"id"`
+	MimeType     string `json:"mimeType"`
+	Size         int64  `json:"size"`
+	Md5Checksum  string `json:"md5Checksum,omitempty"`
+	ModifiedTime string `json:"modifiedTime"`
+}
+
+// takeSnapshots saves a snapshot every interval, forever.
+func (fs *fileSystem) takeSnapshots(dir string, interval time.Duration) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		log.Errorf("can't create snapshot directory: %v", err)
+		return
+	}
+	for ; ; time.Sleep(interval) {
+		start := time.Now()
+		name, n, err := fs.snapshot(background(context.Background()), dir)
+		if err != nil {
+			log.Errorf("can't take snapshot: %v", err)
+			continue
+		}
+		log.Infof("Saved snapshot of %v files to %v in %v", n, name, time.Since(start))
+		pruneSnapshots(dir, *snapshotKeepFlag)
+	}
+}
+
+// snapshot saves the metadata of the tree to a new file in dir, returning
+// its name and the number of files.
+func (fs *fileSystem) snapshot(ctx context.Context, dir string) (string, int, error) {
+	root, err := fs.getFile(ctx, "", true)
+	if err != nil {
+		return "", 0, err
+	}
+	entries := []*snapshotEntry{}
+	if err := fs.walkSnapshot(ctx, "", root.file.Id, &entries); err != nil {
+		return "", 0, err
+	}
+
+	var content []byte
+	switch *snapshotFormatFlag {
+	case "json":
+		content, err = json.MarshalIndent(entries, "", " ")
+	case "csv":
+		content, err = snapshotCSV(entries)
+	default:
+		err = fmt.Errorf("unknown snapshot format %q", *snapshotFormatFlag)
+	}
+	if err != nil {
+		return "", 0, err
+	}
+
+	name := filepath.Join(dir, snapshotPrefix+time.Now().UTC().Format("20060102T150405Z")+"."+*snapshotFormatFlag)
+	return name, len(entries), writeFile(name, content)
+}
+
+func (fs *fileSystem) walkSnapshot(ctx context.Context, p string, folderID string, entries *[]*snapshotEntry) error {
+	children, err := fs.listFolder(ctx, folderID)
+	if err != nil {
+		return err
+	}
+	for _, file := range children {
+		q := p + "/" + file.Name
+		*entries = append(*entries, &snapshotEntry{
+			Path:         q,
+			ID:           file.Id,
+			MimeType:     file.MimeType,
+			Size:         file.Size,
+			Md5Checksum:  file.Md5Checksum,
+			ModifiedTime: file.ModifiedTime,
+		})
+		if file.MimeType == mimeTypeFolder {
+			if err := fs.walkSnapshot(ctx, q, file.Id, entries); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func snapshotCSV(entries []*snapshotEntry) ([]byte, error) {
+	var buf bytes.Buffer
+	w := csv.NewWriter(&buf)
+	w.Write([]string{"path", "id", "mimeType", "size", "md5Checksum", "modifiedTime"})
+	for _, e := range entries {
+		w.Write([]string{e.Path, e.ID, e.MimeType, strconv.FormatInt(e.Size, 10), e.Md5Checksum, e.ModifiedTime})
+	}
+	w.Flush()
+	return buf.Bytes(), w.Error()
+}
+
+// pruneSnapshots deletes all but the keep newest snapshots in dir.
+func pruneSnapshots(dir string, keep int) {
+	if keep <= 0 {
+		return
+	}
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		log.Errorf("can't list snapshots: %v", err)
+		return
+	}
+	names := []string{}
+	for _, fi := range infos {
+		if strings.HasPrefix(fi.Name(), snapshotPrefix) {
+			names = append(names, fi.Name())
+		}
+	}
+	// Names sort by time.
+	sort.Strings(names)
+	for len(names) > keep {
+		if err := os.Remove(filepath.Join(dir, names[0])); err != nil {
+			log.Errorf("can't delete snapshot: %v", err)
+		}
+		names = names[1:]
+	}
+}
@@ -0,0 +1,57 @@
+package gdrive
+
+import (
+	"fmt"
+	"strings"
+
+	log "github.com/cihub/seelog"
+	"golang.org/x/net/context"
+	"golang.org/x/net/webdav"
+	"google.golang.org/api/googleapi"
+)
+
+// Check reads the drive info to find bad credentials or a misconfigured
+// project at startup rather than on the first request. The returned error
+// says how to fix the problem. Drive being unreachable is only logged, as
+// it may be temporary.
+func Check(ctx context.Context, fs webdav.FileSystem) error {
+	gfs, ok := driveFS(fs)
+	if !ok {
+		return nil
+	}
+	about, err := gfs.client.About.Get().Fields("user(displayName,emailAddress)").Context(ctx).Do()
+	if err == nil {
+		if about.User != nil {
+			log.Infof("Serving the drive of %v <%v>", about.User.DisplayName, about.User.EmailAddress)
+		}
+		return nil
+	}
+
+	msg := err.Error()
+	switch {
+	case strings.Contains(msg, "invalid_client") || strings.Contains(msg, "unauthorized_client"):
+		return fmt.Errorf("the OAuth client is not valid, check --client-id and --client-secret: %v", err)
+	case strings.Contains(msg, "invalid_grant"):
+		return fmt.Errorf("the saved token was revoked or has expired, run \"gdrive-webdav auth\" to authorize again: %v", err)
+	}
+	if ge, ok := err.(*googleapi.Error); ok {
+		for _, e := range ge.Errors {
+			if e.Reason == "accessNotConfigured" {
+				return fmt.Errorf("the Drive API is not enabled for the project of the OAuth client, enable it in Google Cloud Console: %v", err)
+			}
+		}
+		switch {
+		case ge.Code == 401:
+			return fmt.Errorf("Drive rejected the credentials, run \"gdrive-webdav auth\" to authorize again: %v", err)
+		case ge.Code == 403 && (strings.Contains(ge.Message, "has not been used") || strings.Contains(ge.Message, "is disabled")):
+			return fmt.Errorf("the Drive API is not enabled for the project of the OAuth client, enable it in Google Cloud Console: %v", err)
+		case ge.Code == 403 && strings.Contains(ge.Message, "scope"):
+			return fmt.Errorf("the saved token lacks the scopes needed, run \"gdrive-webdav auth\" to authorize again: %v", err)
+		}
+	}
+	if isUnreachable(err) {
+		log.Warnf("Can't reach Drive at startup: %v", err)
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,189 @@
+package gdrive
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// stats counts what the file system does, for /admin/stats.
+type stats struct {
+	cacheHits       int64
+	cacheMisses     int64
+	cacheEvictions  int64
+	bytesIn         int64
+	bytesOut        int64
+	activeUploads   int64
+	activeDownloads int64
+
+	mu     sync.Mutex
+	calls  map[string]int64
+	errors map[string]int64
+}
+
+// statsSnapshot is the JSON form of stats.
+type statsSnapshot struct {
+	CacheHits       int64            `json:"cacheHits"`
+	CacheMisses     int64            `json:"cacheMisses"`
+	CacheEvictions  int64            `json:"cacheEvictions"`
+	CacheEntries    int              `json:"cacheEntries"`
+	CacheBytes      int64            `json:"cacheBytes,omitempty"`
+	DriveCalls      map[string]int64 `json:"driveCalls"`
+	DriveErrors     map[string]int64 `json:"driveErrors"`
+	BytesIn         int64            `json:"bytesIn"`
+	BytesOut        int64            `json:"bytesOut"`
+	ActiveUploads   int64            `json:"activeUploads"`
+	ActiveDownloads int64            `json:"activeDownloads"`
+}
+
+func newStats() *stats {
+	return &stats{
+		calls:  make(map[string]int64),
+		errors: make(map[string]int64),
+	}
+}
+
+func (s *stats) cacheLookup(hit bool) {
+	if hit {
+		atomic.AddInt64(&s.cacheHits, 1)
+	} else {
+		atomic.AddInt64(&s.cacheMisses, 1)
+	}
+}
+
+func (s *stats) snapshot() *statsSnapshot {
+	snap := &statsSnapshot{
+		CacheHits:       atomic.LoadInt64(&s.cacheHits),
+		CacheMisses:     atomic.LoadInt64(&s.cacheMisses),
+		CacheEvictions:  atomic.LoadInt64(&s.cacheEvictions),
+		DriveCalls:      make(map[string]int64),
+		DriveErrors:     make(map[string]int64),
+		BytesIn:         atomic.LoadInt64(&s.bytesIn),
+		BytesOut:        atomic.LoadInt64(&s.bytesOut),
+		ActiveUploads:   atomic.LoadInt64(&s.activeUploads),
+		ActiveDownloads: atomic.LoadInt64(&s.activeDownloads),
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for k, v := range s.calls {
+		snap.DriveCalls[k] = v
+	}
+	for k, v := range s.errors {
+		snap.DriveErrors[k] = v
+	}
+	return snap
+}
+
+// statsTransport counts Drive API calls, their errors and the bytes they
+// transfer.
+type statsTransport struct {
+	base  http.RoundTripper
+	stats *stats
+}
+
+func (t *statsTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	base := t.base
+	if base == nil {
+		base = http.DefaultTransport
+	}
+
+	t.stats.mu.Lock()
+	t.stats.calls[apiMethod(req)]++
+	t.stats.mu.Unlock()
+
+	if req.Body != nil {
+		req.Body = &countingReadCloser{ReadCloser: req.Body, n: &t.stats.bytesOut}
+	}
+	res, err := base.RoundTrip(req)
+	if err != nil {
+		t.stats.countError("network")
+		return nil, err
+	}
+
+	if res.StatusCode >= 400 {
+		body, _ := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		res.Body = ioutil.NopCloser(bytes.NewReader(body))
+		t.stats.countError(errorReason(res.StatusCode, body))
+	}
+	res.Body = &countingReadCloser{ReadCloser: res.Body, n: &t.stats.bytesIn}
+	return res, nil
+}
+
+func (s *stats) countError(reason string) {
+	s.mu.Lock()
+	s.errors[reason]++
+	s.mu.Unlock()
+}
+
+// errorReason returns the reason of a Drive error response, or its status
+// code if it has none.
+func errorReason(status int, body []byte) string {
+	var e struct {
+		Error struct {
+			Errors []struct {
+				Reason string `json:"reason"`
+			} `json:"errors"`
+		} `json:"error"`
+	}
+	if json.Unmarshal(body, &e) == nil && len(e.Error.Errors) > 0 && e.Error.Errors[0].Reason != "" {
+		return e.Error.Errors[0].Reason
+	}
+	return strconv.Itoa(status)
+}
+
+// apiMethod names the Drive API method called by req, e.g. "files.list".
+func apiMethod(req *http.Request) string {
+	p := req.URL.Path
+	if i := strings.Index(p, "/drive/v3/"); i >= 0 {
+		p = p[i+len("/drive/v3/"):]
+	}
+	segs := strings.Split(strings.Trim(p, "/"), "/")
+
+	resources := []string{}
+	for i := 0; i < len(segs); i += 2 {
+		resources = append(resources, segs[i])
+	}
+	hasID := len(segs)%2 == 0
+	name := strings.Join(resources, ".")
+
+	switch {
+	case name == "about":
+		return "about.get"
+	case strings.HasSuffix(name, ".copy"):
+		return name
+	}
+	switch req.Method {
+	case "GET":
+		if hasID {
+			return name + ".get"
+		}
+		return name + ".list"
+	case "POST":
+		return name + ".create"
+	case "PATCH":
+		return name + ".update"
+	case "PUT":
+		return name + ".upload"
+	case "DELETE":
+		return name + ".delete"
+	}
+	return name + "." + strings.ToLower(req.Method)
+}
+
+type countingReadCloser struct {
+	io.ReadCloser
+	n *int64
+}
+
+func (r *countingReadCloser) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	atomic.AddInt64(r.n, int64(n))
+	return n, err
+}
@@ -0,0 +1,154 @@
+package gdrive
+
+import (
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"sync"
+
+	log "github.com/cihub/seelog"
+	"golang.org/x/net/context"
+	"google.golang.org/api/drive/v3"
+)
+
+type streamedUploadKey struct{}
+
+// withStreamedUpload records in the context of a PUT without Content-Length,
+// sent with Transfer-Encoding: chunked, that its body is to be streamed to
+// Drive instead of being held in memory until it ends. The body records the
+// error which cut it short, if any, as webdav.Handler closes the file
+// written anyway.
+func withStreamedUpload(r *http.Request) *http.Request {
+	if r.ContentLength >= 0 {
+		return r
+	}
+	body := &streamedBody{ReadCloser: r.Body}
+	r = r.WithContext(context.WithValue(r.Context(), streamedUploadKey{}, body))
+	r.Body = body
+	return r
+}
+
+func isStreamedUpload(ctx context.Context) bool {
+	_, ok := ctx.Value(streamedUploadKey{}).(*streamedBody)
+	return ok
+}
+
+// streamedBody is the body of a streamed upload.
+type streamedBody struct {
+	io.ReadCloser
+	mu  sync.Mutex
+	err error
+}
+
+func (b *streamedBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if err != nil && err != io.EOF {
+		b.mu.Lock()
+		if b.err == nil {
+			b.err = err
+		}
+		b.mu.Unlock()
+	}
+	return n, err
+}
+
+// bodyError returns the error which failed reading the body of the
+// streamed upload of ctx, if any.
+func bodyError(ctx context.Context) error {
+	b, ok := ctx.Value(streamedUploadKey{}).(*streamedBody)
+	if !ok {
+		return nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.err
+}
+
+// streamedFile is a file written by a PUT of unknown length, uploaded to
+// Drive while it's received.
+type streamedFile struct {
+	ctx  context.Context
+	fs   *fileSystem
+	name string
+	size int64
+	pw   *io.PipeWriter
+	done chan error
+}
+
+// openStreamed starts the upload of the file name in folder parentID. It
+// returns nil for files the buffered upload handles: compressed ones, those
+// written with the write-back queue and those locked in Drive.
+func (fs *fileSystem) openStreamed(ctx context.Context, name string, parentID string) *streamedFile {
+	if fs.queue != nil || shouldCompress(name) {
+		return nil
+	}
+	meta := &drive.File{Name: path.Base(name), Parents: []string{parentID}}
+	fileID := ""
+	existing, err := fs.getFile(ctx, name, false)
+	if err != nil && err != os.ErrNotExist {
+		return nil
+	}
+	if existing != nil {
+		if restricted, _ := contentRestriction(existing.file); restricted || isCompressed(existing.file) || existing.file.MimeType == mimeTypeFolder {
+			return nil
+		}
+		meta, fileID = &drive.File{}, existing.file.Id
+	}
+
+	log.Debugf("Streaming upload of %v", name)
+	pr, pw := io.Pipe()
+	f := &streamedFile{ctx: ctx, fs: fs, name: name, pw: pw, done: make(chan error, 1)}
+	go func() {
+		_, err := fs.upload(ctx, name, fileID, meta, pr, -1)
+		// Fails the writes still to come.
+		pr.CloseWithError(err)
+		f.done <- err
+	}()
+	return f
+}
+
+func (f *streamedFile) Write(p []byte) (int, error) {
+	n, err := f.pw.Write(p)
+	f.size += int64(n)
+	return n, err
+}
+
+// Close ends the content and waits for Drive to store it. If the request
+// was aborted or its body couldn't be read to the end, the upload is
+// abandoned, so that the file is left as it was.
+func (f *streamedFile) Close() error {
+	if err := f.ctx.Err(); err != nil {
+		f.pw.CloseWithError(err)
+	} else if err := bodyError(f.ctx); err != nil {
+		f.pw.CloseWithError(err)
+	} else {
+		f.pw.Close()
+	}
+	err := <-f.done
+	f.fs.invalidatePath(f.name)
+	f.fs.invalidatePath(path.Dir(f.name))
+	f.fs.cache.Delete(cacheKeyAbout)
+	if err != nil {
+		log.Errorf("can't upload %v: %v", f.name, err)
+		return err
+	}
+	f.fs.mirror.add(mirrorWrite, f.name, "")
+	return nil
+}
+
+func (f *streamedFile) Stat() (os.FileInfo, error) {
+	return &fileInfo{name: path.Base(f.name), size: f.size}, nil
+}
+
+func (f *streamedFile) Readdir(count int) ([]os.FileInfo, error) {
+	return nil, errNotSupported
+}
+
+func (f *streamedFile) Read(p []byte) (int, error) {
+	return 0, errNotSupported
+}
+
+func (f *streamedFile) Seek(offset int64, whence int) (int64, error) {
+	return 0, errNotSupported
+}
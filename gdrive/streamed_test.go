@@ -0,0 +1,75 @@
+package gdrive
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/context"
+	"golang.org/x/net/webdav"
+)
+
+// failingBody returns its content, then fails.
+type failingBody struct {
+	r *strings.Reader
+}
+
+func (b *failingBody) Read(p []byte) (int, error) {
+	if b.r.Len() == 0 {
+		return 0, errors.New("connection reset")
+	}
+	return b.r.Read(p)
+}
+
+func (b *failingBody) Close() error {
+	return nil
+}
+
+func writeTestFile(t *testing.T, fs webdav.FileSystem, name string, content string) {
+	f, err := fs.OpenFile(context.Background(), name, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		t.Fatalf("can't create %v: %v", name, err)
+	}
+	if _, err := f.Write([]byte(content)); err != nil {
+		t.Fatalf("can't write %v: %v", name, err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatalf("can't write %v: %v", name, err)
+	}
+}
+
+func readTestFile(t *testing.T, fs webdav.FileSystem, name string) string {
+	f, err := fs.OpenFile(context.Background(), name, os.O_RDONLY, 0)
+	if err != nil {
+		t.Fatalf("can't open %v: %v", name, err)
+	}
+	defer f.Close()
+	content, err := ioutil.ReadAll(f)
+	if err != nil {
+		t.Fatalf("can't read %v: %v", name, err)
+	}
+	return string(content)
+}
+
+func TestStreamedUploadFailingBody(t *testing.T) {
+	fs := newFakeFS(newFakeDrive())
+	writeTestFile(t, fs, "/file.txt", "old content")
+
+	r := httptest.NewRequest("PUT", "/file.txt", nil)
+	r.Body = &failingBody{r: strings.NewReader("new content, cut short")}
+	r.ContentLength = -1
+	w := httptest.NewRecorder()
+	NewHandler(fs, webdav.NewMemLS()).ServeHTTP(w, r)
+
+	if w.Code < http.StatusBadRequest {
+		t.Errorf("PUT answered %v, want an error", w.Code)
+	}
+	fs.invalidatePath("/file.txt")
+	if got := readTestFile(t, fs, "/file.txt"); got != "old content" {
+		t.Errorf("file has %q after failed PUT, want %q", got, "old content")
+	}
+}
@@ -0,0 +1,438 @@
+package gdrive
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	log "github.com/cihub/seelog"
+	"golang.org/x/net/context"
+	"golang.org/x/net/webdav"
+)
+
+var (
+	syncIntervalFlag = flag.Duration("sync-interval", 30*time.Second, "How often the sync command compares the local and the remote tree. Remote changes trigger a comparison sooner.")
+)
+
+const (
+	// syncStateName is the file keeping the state of the last sync in the
+	// local folder, names starting with syncTempPrefix are downloads in
+	// progress. Neither is synced.
+	syncStateName  = ".gdrive-sync.json"
+	syncTempPrefix = ".gdrive-sync-"
+)
+
+// syncEntry is what a synced path looked like on both sides after the last
+// sync. Paths changed since on one side only are copied to the other.
+type syncEntry struct {
+	Dir        bool  `json:"dir,omitempty"`
+	LocalSize  int64 `json:"localSize,omitempty"`
+	LocalMod   int64 `json:"localMod,omitempty"`
+	RemoteSize int64 `json:"remoteSize,omitempty"`
+	RemoteMod  int64 `json:"remoteMod,omitempty"`
+}
+
+// syncInfo is a path found by a scan.
+type syncInfo struct {
+	dir  bool
+	size int64
+	mod  int64
+}
+
+func (i *syncInfo) changed(size int64, mod int64) bool {
+	return !i.dir && (i.size != size || i.mod != mod)
+}
+
+type syncer struct {
+	fs     webdav.FileSystem
+	local  string
+	remote string
+	state  map[string]*syncEntry
+}
+
+// Sync keeps the local folder and the remote folder of fs in sync until
+// ctx is done. Changes on either side are copied to the other, deletions
+// included. When a file changed on both sides, the local one is kept as a
+// conflict copy.
+func Sync(ctx context.Context, fs webdav.FileSystem, local string, remote string) error {
+	s := &syncer{fs: fs, local: local, remote: normalizePath(remote), state: make(map[string]*syncEntry)}
+	if fi, err := os.Stat(local); err != nil || !fi.IsDir() {
+		return fmt.Errorf("local folder %v not found", local)
+	}
+	if fi, err := fs.Stat(ctx, s.remote); err != nil || !fi.IsDir() {
+		return fmt.Errorf("remote folder %v not found", s.remote+"/")
+	}
+	if content, err := ioutil.ReadFile(filepath.Join(local, syncStateName)); err == nil {
+		if err := json.Unmarshal(content, &s.state); err != nil {
+			return err
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	changed := make(chan struct{}, 1)
+	if gfs, ok := driveFS(fs); ok {
+		if gfs.index == nil && *changesPollIntervalFlag <= 0 {
+			go gfs.pollChanges(*syncIntervalFlag)
+		}
+		events := gfs.events.subscribe()
+		defer gfs.events.unsubscribe(events)
+		go func() {
+			for range events {
+				select {
+				case changed <- struct{}{}:
+				default:
+				}
+			}
+		}()
+	}
+
+	log.Infof("Syncing %v with %v", local, s.remote+"/")
+	for {
+		if err := s.round(ctx); err != nil {
+			log.Errorf("sync failed: %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-changed:
+		case <-time.After(*syncIntervalFlag):
+		}
+	}
+}
+
+// round compares both trees once and copies the changes.
+func (s *syncer) round(ctx context.Context) error {
+	local := make(map[string]*syncInfo)
+	if err := s.scanLocal(local); err != nil {
+		return err
+	}
+	remote := make(map[string]*syncInfo)
+	if err := s.scanRemote(ctx, "", remote); err != nil {
+		return err
+	}
+
+	paths := []string{}
+	for p := range local {
+		paths = append(paths, p)
+	}
+	for p := range remote {
+		if local[p] == nil {
+			paths = append(paths, p)
+		}
+	}
+	for p := range s.state {
+		if local[p] == nil && remote[p] == nil {
+			delete(s.state, p)
+		}
+	}
+	sort.Strings(paths)
+
+	// Folders deleted on one side are deleted on the other once their
+	// content is, which only happens if none was changed meanwhile.
+	removedDirs := []string{}
+	for _, p := range paths {
+		if err := s.syncPath(ctx, p, local[p], remote[p], &removedDirs); err != nil {
+			log.Errorf("can't sync %v: %v", p, err)
+		}
+	}
+	for i := len(removedDirs) - 1; i >= 0; i-- {
+		s.removeDir(ctx, removedDirs[i], local[removedDirs[i]] != nil)
+	}
+	return s.saveState()
+}
+
+func (s *syncer) syncPath(ctx context.Context, p string, l *syncInfo, r *syncInfo, removedDirs *[]string) error {
+	st := s.state[p]
+	switch {
+	case l != nil && r != nil:
+		if l.dir && r.dir {
+			s.state[p] = &syncEntry{Dir: true}
+			return nil
+		}
+		if l.dir != r.dir {
+			return s.conflict(ctx, p, r)
+		}
+		if st == nil || st.Dir {
+			if l.size == r.size {
+				s.record(p, l, r)
+				return nil
+			}
+			return s.conflict(ctx, p, r)
+		}
+		lc, rc := l.changed(st.LocalSize, st.LocalMod), r.changed(st.RemoteSize, st.RemoteMod)
+		switch {
+		case lc && rc && l.size != r.size:
+			return s.conflict(ctx, p, r)
+		case lc && rc:
+			s.record(p, l, r)
+		case lc:
+			return s.upload(ctx, p)
+		case rc:
+			return s.download(ctx, p, r)
+		}
+		return nil
+
+	case l != nil:
+		if st != nil && (l.dir || !l.changed(st.LocalSize, st.LocalMod)) {
+			// Deleted remotely.
+			if l.dir {
+				*removedDirs = append(*removedDirs, p)
+				return nil
+			}
+			log.Infof("sync: deleting local %v", p)
+			delete(s.state, p)
+			return os.Remove(s.localPath(p))
+		}
+		if l.dir {
+			log.Infof("sync: creating remote %v", p)
+			if err := s.mkdirRemote(ctx, p); err != nil && !os.IsExist(err) {
+				return err
+			}
+			s.state[p] = &syncEntry{Dir: true}
+			return nil
+		}
+		return s.upload(ctx, p)
+
+	case r != nil:
+		if st != nil && (r.dir || !r.changed(st.RemoteSize, st.RemoteMod)) {
+			// Deleted locally.
+			if r.dir {
+				*removedDirs = append(*removedDirs, p)
+				return nil
+			}
+			log.Infof("sync: deleting remote %v", p)
+			delete(s.state, p)
+			return s.fs.RemoveAll(ctx, s.remotePath(p))
+		}
+		if r.dir {
+			log.Infof("sync: creating local %v", p)
+			s.state[p] = &syncEntry{Dir: true}
+			return os.MkdirAll(s.localPath(p), 0755)
+		}
+		return s.download(ctx, p, r)
+	}
+	return nil
+}
+
+// removeDir deletes folder p, which is gone from the other side, if it is
+// empty now.
+func (s *syncer) removeDir(ctx context.Context, p string, local bool) {
+	if local {
+		if err := os.Remove(s.localPath(p)); err != nil {
+			log.Debugf("sync: keeping local %v: %v", p, err)
+			return
+		}
+		log.Infof("sync: deleted local %v", p)
+		delete(s.state, p)
+		return
+	}
+
+	f, err := s.fs.OpenFile(ctx, s.remotePath(p), os.O_RDONLY, 0)
+	if err != nil {
+		return
+	}
+	infos, err := f.Readdir(-1)
+	f.Close()
+	if err != nil || len(infos) > 0 {
+		log.Debugf("sync: keeping remote %v", p)
+		return
+	}
+	if err := s.fs.RemoveAll(ctx, s.remotePath(p)); err != nil {
+		log.Errorf("can't delete remote %v: %v", p, err)
+		return
+	}
+	log.Infof("sync: deleted remote %v", p)
+	delete(s.state, p)
+}
+
+// conflict keeps the local version of p under another name, to be uploaded
+// next time, and downloads the remote one.
+func (s *syncer) conflict(ctx context.Context, p string, r *syncInfo) error {
+	ext := path.Ext(p)
+	copyName := strings.TrimSuffix(p, ext) + " (conflict " + time.Now().Format("2006-01-02 150405") + ")" + ext
+	log.Warnf("sync: %v changed on both sides, keeping the local one as %v", p, copyName)
+	if err := os.Rename(s.localPath(p), s.localPath(copyName)); err != nil {
+		return err
+	}
+	delete(s.state, p)
+	if r.dir {
+		s.state[p] = &syncEntry{Dir: true}
+		return os.MkdirAll(s.localPath(p), 0755)
+	}
+	return s.download(ctx, p, r)
+}
+
+func (s *syncer) upload(ctx context.Context, p string) error {
+	log.Infof("sync: uploading %v", p)
+	src, err := os.Open(s.localPath(p))
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	dst, err := s.fs.OpenFile(ctx, s.remotePath(p), os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err == errNoParent {
+		if err = s.mkdirRemote(ctx, path.Dir(p)); err == nil || os.IsExist(err) {
+			dst, err = s.fs.OpenFile(ctx, s.remotePath(p), os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+		}
+	}
+	if err != nil {
+		return err
+	}
+	if _, err := copyBuffered(dst, src); err != nil {
+		dst.Close()
+		return err
+	}
+	if err := dst.Close(); err != nil {
+		return err
+	}
+
+	lfi, err := src.Stat()
+	if err != nil {
+		return err
+	}
+	rfi, err := s.fs.Stat(ctx, s.remotePath(p))
+	if err != nil {
+		return err
+	}
+	s.record(p, newSyncInfo(lfi), newSyncInfo(rfi))
+	return nil
+}
+
+func (s *syncer) download(ctx context.Context, p string, r *syncInfo) error {
+	log.Infof("sync: downloading %v", p)
+	src, err := s.fs.OpenFile(ctx, s.remotePath(p), os.O_RDONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	dir := filepath.Dir(s.localPath(p))
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(dir, syncTempPrefix)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := copyBuffered(tmp, src); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	mod := time.Unix(0, r.mod)
+	if err := os.Chtimes(tmp.Name(), mod, mod); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), s.localPath(p)); err != nil {
+		return err
+	}
+
+	lfi, err := os.Stat(s.localPath(p))
+	if err != nil {
+		return err
+	}
+	s.record(p, newSyncInfo(lfi), r)
+	return nil
+}
+
+func (s *syncer) mkdirRemote(ctx context.Context, p string) error {
+	err := s.fs.Mkdir(ctx, s.remotePath(p), 0755)
+	if err == errNoParent || os.IsNotExist(err) {
+		if err := s.mkdirRemote(ctx, path.Dir(p)); err != nil && !os.IsExist(err) {
+			return err
+		}
+		err = s.fs.Mkdir(ctx, s.remotePath(p), 0755)
+	}
+	return err
+}
+
+func (s *syncer) record(p string, l *syncInfo, r *syncInfo) {
+	s.state[p] = &syncEntry{LocalSize: l.size, LocalMod: l.mod, RemoteSize: r.size, RemoteMod: r.mod}
+}
+
+func (s *syncer) localPath(p string) string {
+	return filepath.Join(s.local, filepath.FromSlash(p))
+}
+
+func (s *syncer) remotePath(p string) string {
+	return s.remote + p
+}
+
+func newSyncInfo(fi os.FileInfo) *syncInfo {
+	return &syncInfo{dir: fi.IsDir(), size: fi.Size(), mod: fi.ModTime().UnixNano()}
+}
+
+func (s *syncer) scanLocal(infos map[string]*syncInfo) error {
+	return filepath.Walk(s.local, func(name string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(s.local, name)
+		if err != nil || rel == "." {
+			return err
+		}
+		if strings.HasPrefix(fi.Name(), syncTempPrefix) || fi.Name() == syncStateName || !fi.IsDir() && !fi.Mode().IsRegular() {
+			return nil
+		}
+		infos["/"+filepath.ToSlash(rel)] = newSyncInfo(fi)
+		return nil
+	})
+}
+
+func (s *syncer) scanRemote(ctx context.Context, p string, infos map[string]*syncInfo) error {
+	f, err := s.fs.OpenFile(ctx, s.remotePath(p), os.O_RDONLY, 0)
+	if err != nil {
+		return err
+	}
+	children, err := f.Readdir(-1)
+	f.Close()
+	if err != nil {
+		return err
+	}
+	for _, fi := range children {
+		q := p + "/" + fi.Name()
+		if p == "" && (strings.HasPrefix(fi.Name(), syncTempPrefix) || fi.Name() == syncStateName) {
+			continue
+		}
+		infos[q] = newSyncInfo(fi)
+		if fi.IsDir() {
+			if err := s.scanRemote(ctx, q, infos); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (s *syncer) saveState() error {
+	content, err := json.Marshal(s.state)
+	if err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(s.local, syncTempPrefix)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(content); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return os.Rename(f.Name(), filepath.Join(s.local, syncStateName))
+}
@@ -0,0 +1,268 @@
+package gdrive
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+
+	log "github.com/cihub/seelog"
+	"golang.org/x/net/context"
+	"golang.org/x/net/webdav"
+	"google.golang.org/api/drive/v3"
+	"google.golang.org/api/googleapi"
+)
+
+// syncTokenPrefix turns Drive change page tokens into the URIs sync tokens
+// are.
+const syncTokenPrefix = nsDrive + "sync/"
+
+// syncCollectionRequest is the body of a sync-collection REPORT (RFC 6578).
+type syncCollectionRequest struct {
+	XMLName   xml.Name `xml:"DAV: sync-collection"`
+	SyncToken string   `xml:"DAV: sync-token"`
+	SyncLevel string   `xml:"DAV: sync-level"`
+	Prop      *struct {
+		Names []struct {
+			XMLName xml.Name
+		} `xml:",any"`
+	} `xml:"DAV: prop"`
+}
+
+// errInvalidSyncToken is returned for sync tokens Drive doesn't know, and
+// for those of changes which can't be told apart from removals of members,
+// so that the client lists the folder again.
+var errInvalidSyncToken = fmt.Errorf("invalid sync token")
+
+// syncScopes are the folders listed for sync-collection since the start,
+// whose members are in the path history.
+type syncScopes struct {
+	mu        sync.Mutex
+	recursive map[string]bool
+}
+
+func newSyncScopes() *syncScopes {
+	return &syncScopes{recursive: make(map[string]bool)}
+}
+
+func (s *syncScopes) add(scope string, recursive bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.recursive[scope] = s.recursive[scope] || recursive
+}
+
+// covers reports whether the members of scope within depth were listed.
+func (s *syncScopes) covers(scope string, depth string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for listed, recursive := range s.recursive {
+		switch {
+		case listed == scope && (recursive || depth == "1"):
+			return true
+		case recursive && (listed == "" || strings.HasPrefix(scope, listed+"/")):
+			return true
+		}
+	}
+	return false
+}
+
+// handleSyncCollection answers a sync-collection REPORT on a folder. Without
+// a sync token it lists the members of the folder, with one it lists those
+// changed and removed since, as told by the Drive changes.
+func (h *handler) handleSyncCollection(w http.ResponseWriter, r *http.Request, fs *fileSystem, body []byte) {
+	var req syncCollectionRequest
+	if err := xml.Unmarshal(body, &req); err != nil {
+		http.Error(w, "bad sync-collection report", http.StatusBadRequest)
+		return
+	}
+	depth := "1"
+	switch strings.TrimSpace(req.SyncLevel) {
+	case "1":
+	case "infinite":
+		depth = "infinity"
+	default:
+		http.Error(w, "sync-level must be 1 or infinite", http.StatusBadRequest)
+		return
+	}
+	names := searchProps
+	if req.Prop != nil {
+		names = nil
+		for _, n := range req.Prop.Names {
+			names = append(names, n.XMLName)
+		}
+	}
+
+	scope := normalizePath(r.URL.Path)
+	fp, err := fs.getFile(r.Context(), scope, false)
+	if err != nil {
+		status := errorStatus(err)
+		if status == 0 {
+			status = http.StatusNotFound
+		}
+		http.Error(w, webdav.StatusText(status), status)
+		return
+	}
+	if fp.file.MimeType != mimeTypeFolder {
+		http.Error(w, "only folders can be synchronized", http.StatusForbidden)
+		return
+	}
+
+	var b bytes.Buffer
+	b.WriteString(`<?xml version="1.0" encoding="UTF-8"?>` + "\n")
+	b.WriteString(`<D:multistatus xmlns:D="DAV:">`)
+	var token string
+	if token = strings.TrimSpace(req.SyncToken); token == "" {
+		token, err = fs.syncMembers(r.Context(), &b, fp.file.Id, scope, depth == "infinity", names)
+	} else if strings.HasPrefix(token, syncTokenPrefix) {
+		token, err = fs.syncChanges(r.Context(), &b, strings.TrimPrefix(token, syncTokenPrefix), scope, depth, names)
+	} else {
+		err = errInvalidSyncToken
+	}
+	if err == errInvalidSyncToken {
+		w.Header().Set("Content-Type", "text/xml; charset=utf-8")
+		w.WriteHeader(http.StatusForbidden)
+		fmt.Fprint(w, `<?xml version="1.0" encoding="UTF-8"?>`+"\n"+`<D:error xmlns:D="DAV:"><D:valid-sync-token/></D:error>`)
+		return
+	}
+	if err != nil {
+		log.Errorf("can't synchronize %v: %v", scope, err)
+		status := errorStatus(err)
+		if status == 0 {
+			status = http.StatusBadGateway
+		}
+		http.Error(w, webdav.StatusText(status), status)
+		return
+	}
+	b.WriteString("<D:sync-token>")
+	xml.EscapeText(&b, []byte(syncTokenPrefix+token))
+	b.WriteString("</D:sync-token></D:multistatus>")
+
+	w.Header().Set("Content-Type", "text/xml; charset=utf-8")
+	w.WriteHeader(webdav.StatusMulti)
+	w.Write(b.Bytes())
+}
+
+// syncMembers writes the members of folder p to b and returns the token of
+// the changes following the listing.
+func (fs *fileSystem) syncMembers(ctx context.Context, b *bytes.Buffer, folderID string, p string, recursive bool, names []xml.Name) (string, error) {
+	// The token is taken first, so that no change is missed while listing.
+	t, err := fs.client.Changes.GetStartPageToken().SupportsAllDrives(true).Context(ctx).Do()
+	if err != nil {
+		return "", err
+	}
+	if err := fs.writeMembers(ctx, b, folderID, p, recursive, names); err != nil {
+		return "", err
+	}
+	fs.synced.add(p, recursive)
+	return t.StartPageToken, nil
+}
+
+func (fs *fileSystem) writeMembers(ctx context.Context, b *bytes.Buffer, folderID string, p string, recursive bool, names []xml.Name) error {
+	children, err := fs.listFolder(ctx, folderID)
+	if err != nil {
+		return err
+	}
+	for _, file := range children {
+		child := p + "/" + file.Name
+		if isFilteredPath(child) {
+			continue
+		}
+		fs.history.add(file.Id, child)
+		fs.writeFileResponse(ctx, b, child, file, names)
+		if recursive && file.MimeType == mimeTypeFolder {
+			if err := fs.writeMembers(ctx, b, file.Id, child, recursive, names); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// syncChanges writes the members of scope changed since token to b, and
+// returns the token of the changes following them.
+func (fs *fileSystem) syncChanges(ctx context.Context, b *bytes.Buffer, token string, scope string, depth string, names []xml.Name) (string, error) {
+	covered := fs.synced.covers(scope, depth)
+	for {
+		r, err := fs.client.Changes.List(token).Spaces(listSpaces()).IncludeRemoved(true).
+			SupportsAllDrives(true).IncludeItemsFromAllDrives(true).
+			Fields("nextPageToken,newStartPageToken,changes(fileId,removed,file(" + fileFields + "))").
+			Context(ctx).Do()
+		if ge, ok := err.(*googleapi.Error); ok && (ge.Code == http.StatusBadRequest || ge.Code == http.StatusNotFound) {
+			return "", errInvalidSyncToken
+		}
+		if err != nil {
+			return "", err
+		}
+		for _, c := range r.Changes {
+			if err := fs.writeChange(ctx, b, c, scope, depth, names, covered); err != nil {
+				return "", err
+			}
+		}
+		if r.NextPageToken == "" {
+			return r.NewStartPageToken, nil
+		}
+		token = r.NextPageToken
+	}
+}
+
+// writeChange writes the member of scope changed by c to b, or the removed
+// member if it was deleted or moved away. Cache entries it makes stale are
+// dropped. The paths a file was at are found in the path history, which
+// holds the members of scope if covered. Otherwise, a change which may have
+// removed a member fails with errInvalidSyncToken.
+func (fs *fileSystem) writeChange(ctx context.Context, b *bytes.Buffer, c *drive.Change, scope string, depth string, names []xml.Name, covered bool) error {
+	inScope := func(p string) bool {
+		return p != scope && inSearchScope(p, scope, depth)
+	}
+
+	former := fs.formerPaths(ctx, c.FileId)
+	for _, old := range former {
+		fs.invalidateTree(old)
+	}
+	p := ""
+	if c.File != nil && !c.Removed {
+		fs.invalidateID(c.FileId, c.File.Parents...)
+		if found, err := fs.pathByID(ctx, c.File); err == nil {
+			p = found
+		}
+	} else {
+		fs.invalidateID(c.FileId)
+	}
+	if len(former) == 0 && !covered && (p == "" || !inScope(p)) {
+		log.Debugf("can't tell where %v was, the client has to list %v again", c.FileId, scope)
+		return errInvalidSyncToken
+	}
+	if p != "" {
+		fs.history.add(c.FileId, p)
+	}
+
+	for _, old := range former {
+		if old == p || !inScope(old) {
+			continue
+		}
+		if fp, err := fs.getFile(ctx, old, false); err == nil && fp.file.Id != c.FileId {
+			// Another file took its place.
+			continue
+		}
+		writeRemoved(b, old)
+	}
+	if p == "" || !inScope(p) || isHiddenPath(p) || isFilteredPath(p) {
+		return nil
+	}
+	fs.invalidatePath(p)
+	if ignoreFile(c.File) {
+		writeRemoved(b, p)
+		return nil
+	}
+	fs.writeFileResponse(ctx, b, p, c.File, names)
+	return nil
+}
+
+func writeRemoved(b *bytes.Buffer, p string) {
+	b.WriteString("<D:response><D:href>")
+	xml.EscapeText(b, []byte((&url.URL{Path: p}).EscapedPath()))
+	fmt.Fprintf(b, "</D:href><D:status>HTTP/1.1 %d %s</D:status></D:response>", http.StatusNotFound, webdav.StatusText(http.StatusNotFound))
+}
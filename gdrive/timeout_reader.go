@@ -11,8 +11,8 @@ const TimeoutTimerInterval = time.Second * 10
 
 type timeoutReaderWrapper func(io.Reader) io.Reader
 
-func getTimeoutReaderWrapperContext(timeout time.Duration) (timeoutReaderWrapper, context.Context) {
-	ctx, cancel := context.WithCancel(context.TODO())
+func getTimeoutReaderWrapperContext(parent context.Context, timeout time.Duration) (timeoutReaderWrapper, context.Context) {
+	ctx, cancel := context.WithCancel(parent)
 	wrapper := func(r io.Reader) io.Reader {
 		// Return untouched reader if timeout is 0
 		if timeout == 0 {
@@ -24,8 +24,8 @@ func getTimeoutReaderWrapperContext(timeout time.Duration) (timeoutReaderWrapper
 	return wrapper, ctx
 }
 
-func getTimeoutReaderContext(r io.Reader, timeout time.Duration) (io.Reader, context.Context) {
-	ctx, cancel := context.WithCancel(context.TODO())
+func getTimeoutReaderContext(parent context.Context, r io.Reader, timeout time.Duration) (io.Reader, context.Context) {
+	ctx, cancel := context.WithCancel(parent)
 
 	// Return untouched reader if timeout is 0
 	if timeout == 0 {
@@ -36,11 +36,15 @@ func getTimeoutReaderContext(r io.Reader, timeout time.Duration) (io.Reader, con
 }
 
 func getTimeoutReader(r io.Reader, cancel context.CancelFunc, timeout time.Duration) io.Reader {
+	interval := TimeoutTimerInterval
+	if timeout < interval {
+		interval = timeout
+	}
 	return &TimeoutReader{
 		reader:         r,
 		cancel:         cancel,
-		mutex:          &sync.Mutex{},
 		maxIdleTimeout: timeout,
+		interval:       interval,
 	}
 }
 
@@ -49,27 +53,39 @@ type TimeoutReader struct {
 	cancel         context.CancelFunc
 	lastActivity   time.Time
 	timer          *time.Timer
-	mutex          *sync.Mutex
+	mutex          sync.Mutex
 	maxIdleTimeout time.Duration
+	interval       time.Duration
 	done           bool
 }
 
 func (self *TimeoutReader) Read(p []byte) (int, error) {
-	if self.timer == nil {
+	// The timer is replaced by the timer callback, so it is only looked at
+	// under the mutex.
+	self.mutex.Lock()
+	started := self.timer != nil
+	if !started {
+		self.lastActivity = time.Now()
+	}
+	self.mutex.Unlock()
+	if !started {
 		self.startTimer()
 	}
 
-	self.mutex.Lock()
-
-	// Read
+	// Read without holding the mutex, otherwise a stalled read would
+	// block the timer callback and the stall would never be detected.
 	n, err := self.reader.Read(p)
 
-	self.lastActivity = time.Now()
+	self.mutex.Lock()
+	// Any progress resets the idle timeout.
+	if n > 0 || err != nil {
+		self.lastActivity = time.Now()
+	}
 	self.done = (err != nil)
-
+	done := self.done
 	self.mutex.Unlock()
 
-	if self.done {
+	if done {
 		self.stopTimer()
 	}
 
@@ -81,7 +97,7 @@ func (self *TimeoutReader) startTimer() {
 	defer self.mutex.Unlock()
 
 	if !self.done {
-		self.timer = time.AfterFunc(TimeoutTimerInterval, self.timeout)
+		self.timer = time.AfterFunc(self.interval, self.timeout)
 	}
 }
 
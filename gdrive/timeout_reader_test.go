@@ -0,0 +1,44 @@
+package gdrive
+
+import (
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// slowReader returns one byte at a time, waiting before each.
+type slowReader struct {
+	r     io.Reader
+	delay time.Duration
+}
+
+func (r *slowReader) Read(p []byte) (int, error) {
+	time.Sleep(r.delay)
+	return r.r.Read(p[:1])
+}
+
+func TestTimeoutReaderActive(t *testing.T) {
+	r, ctx := getTimeoutReaderContext(context.Background(), &slowReader{strings.NewReader("content"), 5 * time.Millisecond}, 20*time.Millisecond)
+	content, err := ioutil.ReadAll(r)
+	if err != nil || string(content) != "content" {
+		t.Fatalf("read %q, %v", content, err)
+	}
+	if ctx.Err() != nil {
+		t.Errorf("context of an active reader is done: %v", ctx.Err())
+	}
+}
+
+func TestTimeoutReaderStalled(t *testing.T) {
+	r, ctx := getTimeoutReaderContext(context.Background(), &slowReader{strings.NewReader("content"), 100 * time.Millisecond}, 20*time.Millisecond)
+	buf := make([]byte, 1)
+	r.Read(buf)
+	select {
+	case <-ctx.Done():
+	case <-time.After(time.Second):
+		t.Errorf("context of a stalled reader isn't done")
+	}
+}
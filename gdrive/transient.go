@@ -0,0 +1,190 @@
+package gdrive
+
+import (
+	"bytes"
+	"flag"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/cihub/seelog"
+	"golang.org/x/net/context"
+	"golang.org/x/net/webdav"
+)
+
+var (
+	skipTransientFlag = flag.Bool("skip-transient", false, "Keep new Office lock files (~$*), vim swap files and *.tmp files in memory instead of storing them in Drive. Clients can read, rename and delete them as usual, renaming one to another name stores it in Drive. They are lost on exit.")
+)
+
+// vimSwap matches vim swap files, and the file vim writes to check that it
+// may create files in a folder.
+var vimSwap = regexp.MustCompile(`^(\..*\.sw[a-p]|4913)$`)
+
+// isTransientName reports whether files called name are editor lock and
+// temporary files.
+func isTransientName(name string) bool {
+	return strings.HasPrefix(name, "~$") || vimSwap.MatchString(name) || strings.HasSuffix(strings.ToLower(name), ".tmp")
+}
+
+// transientStore keeps the content of transient files by path.
+type transientStore struct {
+	mu    sync.Mutex
+	files map[string]*transientFile
+}
+
+type transientFile struct {
+	name    string
+	content []byte
+	modTime time.Time
+}
+
+// newTransientStore returns nil unless --skip-transient is given.
+func newTransientStore() *transientStore {
+	if !*skipTransientFlag {
+		return nil
+	}
+	return &transientStore{files: make(map[string]*transientFile)}
+}
+
+// holds reports whether the file at name is created in s.
+func (s *transientStore) holds(name string) bool {
+	return s != nil && isTransientName(path.Base(name))
+}
+
+func (s *transientStore) get(name string) *transientFile {
+	if s == nil {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.files[name]
+}
+
+func (s *transientStore) put(t *transientFile) {
+	s.mu.Lock()
+	s.files[t.name] = t
+	s.mu.Unlock()
+}
+
+// remove deletes the file at name and those below it, reporting whether
+// name itself was found.
+func (s *transientStore) remove(name string) bool {
+	if s == nil {
+		return false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, found := s.files[name]
+	for p := range s.files {
+		if p == name || strings.HasPrefix(p, name+"/") {
+			delete(s.files, p)
+		}
+	}
+	return found
+}
+
+// in returns the files of folder dir.
+func (s *transientStore) in(dir string) []*transientFile {
+	if s == nil {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	files := []*transientFile{}
+	for p, t := range s.files {
+		if path.Dir(p) == dir || dir == "" && path.Dir(p) == "/" {
+			files = append(files, t)
+		}
+	}
+	return files
+}
+
+func (t *transientFile) info() *fileInfo {
+	return &fileInfo{
+		name:    path.Base(t.name),
+		modTime: t.modTime,
+		size:    int64(len(t.content)),
+	}
+}
+
+// create opens a new transient file for writing.
+func (s *transientStore) create(name string) webdav.File {
+	log.Debugf("Keeping transient %v in memory", name)
+	return &transientWriter{discardFile: discardFile{name: name}, store: s}
+}
+
+// transientWriter writes a transient file, which replaces the previous one
+// on Close.
+type transientWriter struct {
+	discardFile
+	store *transientStore
+	buf   bytes.Buffer
+}
+
+func (w *transientWriter) Write(p []byte) (int, error) {
+	w.size += int64(len(p))
+	return w.buf.Write(p)
+}
+
+func (w *transientWriter) Close() error {
+	w.store.put(&transientFile{name: w.name, content: w.buf.Bytes(), modTime: time.Now()})
+	return nil
+}
+
+// open opens t for reading.
+func (t *transientFile) open() webdav.File {
+	return &transientReader{Reader: bytes.NewReader(t.content), info: t.info()}
+}
+
+type transientReader struct {
+	*bytes.Reader
+	info *fileInfo
+}
+
+func (r *transientReader) Stat() (os.FileInfo, error) {
+	return r.info, nil
+}
+
+func (r *transientReader) Readdir(count int) ([]os.FileInfo, error) {
+	return nil, errNotSupported
+}
+
+func (r *transientReader) Write(p []byte) (int, error) {
+	return 0, errNotSupported
+}
+
+func (r *transientReader) Close() error {
+	return nil
+}
+
+// renameTransient renames the transient file oldName. Renamed to a name
+// that isn't transient, it's stored in Drive.
+func (fs *fileSystem) renameTransient(ctx context.Context, t *transientFile, newName string) error {
+	if fs.transient.holds(newName) {
+		fs.transient.remove(t.name)
+		fs.transient.put(&transientFile{name: newName, content: t.content, modTime: t.modTime})
+		return nil
+	}
+	if _, err := fs.getFile(ctx, newName, false); err != os.ErrNotExist {
+		if err == nil {
+			err = os.ErrExist
+		}
+		return err
+	}
+	w, err := fs.OpenFile(ctx, newName, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(t.content); err != nil {
+		w.Close()
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	fs.transient.remove(t.name)
+	return nil
+}
@@ -0,0 +1,82 @@
+package gdrive
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+
+	log "github.com/cihub/seelog"
+	"golang.org/x/net/context"
+	"google.golang.org/api/drive/v3"
+)
+
+const (
+	trashedSuffix = " (trashed)"
+)
+
+var (
+	showTrashedFlag = flag.Bool("show-trashed", false, "List trashed files next to the others, as \"name (trashed).ext\". Moving one to another name restores it.")
+)
+
+// trashedName returns the name under which a trashed file is listed.
+func trashedName(file *drive.File) string {
+	ext := ""
+	if file.MimeType != mimeTypeFolder {
+		ext = path.Ext(file.Name)
+	}
+	return strings.TrimSuffix(file.Name, ext) + trashedSuffix + ext
+}
+
+// parseTrashedName returns the original name of a file listed as trashed.
+func parseTrashedName(name string) (string, bool) {
+	ext := path.Ext(name)
+	base := strings.TrimSuffix(name, ext)
+	if !strings.HasSuffix(base, trashedSuffix) {
+		// Folders have no extension.
+		ext, base = "", name
+		if !strings.HasSuffix(base, trashedSuffix) {
+			return "", false
+		}
+	}
+	return strings.TrimSuffix(base, trashedSuffix) + ext, true
+}
+
+// markTrashed renames the trashed files of a listing.
+func markTrashed(files []*drive.File) []*drive.File {
+	for i, file := range files {
+		if file.Trashed {
+			marked := *file
+			marked.Name = trashedName(file)
+			files[i] = &marked
+		}
+	}
+	return files
+}
+
+// getTrashed looks up a file listed under a name produced by trashedName.
+func (fs *fileSystem) getTrashed(ctx context.Context, p string, parentID string, name string, onlyFolder bool) (*fileAndPath, error) {
+	query := fmt.Sprintf("%s in parents and %s and trashed = true", quoteQueryString(parentID), nameQuery(name))
+	if onlyFolder {
+		query += " and mimeType=" + quoteQueryString(mimeTypeFolder)
+	}
+	r, err := fs.listFiles().Q(query).Fields("files(" + fileFields + ")").Context(ctx).Do()
+	if err != nil {
+		log.Error(err)
+		return nil, err
+	}
+
+	files := []*drive.File{}
+	for _, file := range normalizeFileNames(r.Files) {
+		if !ignoreFile(file) && trashedName(file) == path.Base(p) {
+			files = append(files, file)
+		}
+	}
+	if len(files) == 0 {
+		return nil, os.ErrNotExist
+	}
+	file := *newestFile(files)
+	file.Name = path.Base(p)
+	return &fileAndPath{file: &file, path: p}, nil
+}
@@ -0,0 +1,87 @@
+package gdrive
+
+import (
+	"flag"
+	"time"
+
+	log "github.com/cihub/seelog"
+	"golang.org/x/net/context"
+	"google.golang.org/api/drive/v3"
+)
+
+var (
+	trashRetentionFlag = flag.Int("trash-retention-days", 0, "Permanently delete files of ours that were in the trash for longer than this many days, anywhere in the drive. Drive only tells since when files of shared drives are trashed, other files are counted from when the server first found them trashed. 0 disables purging.")
+)
+
+const trashPurgeInterval = time.Hour
+
+// trashPurger deletes files that stayed in the trash too long.
+type trashPurger struct {
+	fs        *fileSystem
+	retention time.Duration
+	// seen is when each trashed file without trashedTime was first found.
+	seen map[string]time.Time
+}
+
+func (p *trashPurger) run() {
+	ctx := background(context.Background())
+	for ; ; time.Sleep(trashPurgeInterval) {
+		n, err := p.purge(ctx)
+		if err != nil {
+			log.Errorf("can't purge trash: %v", err)
+		}
+		if n > 0 {
+			log.Infof("Purged %v files from trash", n)
+		}
+	}
+}
+
+// purge deletes the expired files and returns how many.
+func (p *trashPurger) purge(ctx context.Context) (int, error) {
+	now := time.Now()
+	seen := make(map[string]time.Time)
+	expired := []*drive.File{}
+	err := p.fs.listFiles().Q("trashed = true and 'me' in owners").
+		Fields("nextPageToken, files(id,name,explicitlyTrashed,trashedTime)").
+		Pages(ctx, func(r *drive.FileList) error {
+			for _, file := range r.Files {
+				// Files in a trashed folder go with it.
+				if !file.ExplicitlyTrashed {
+					continue
+				}
+				trashed, err := time.Parse(time.RFC3339, file.TrashedTime)
+				if err != nil {
+					if t, ok := p.seen[file.Id]; ok {
+						trashed = t
+					} else {
+						trashed = now
+					}
+					seen[file.Id] = trashed
+				}
+				if now.Sub(trashed) >= p.retention {
+					expired = append(expired, file)
+				}
+			}
+			return nil
+		})
+	if err != nil {
+		return 0, err
+	}
+	// Files restored since are forgotten.
+	p.seen = seen
+
+	n := 0
+	for _, file := range expired {
+		if skip, _ := dryRun("purge %v (%v) from trash", file.Name, file.Id); skip {
+			continue
+		}
+		if err := p.fs.client.Files.Delete(file.Id).SupportsAllDrives(true).Context(ctx).Do(); err != nil {
+			log.Errorf("can't purge %v from trash: %v", file.Name, err)
+			continue
+		}
+		log.Debugf("Purged %v (%v) from trash", file.Name, file.Id)
+		delete(p.seen, file.Id)
+		n++
+	}
+	return n, nil
+}
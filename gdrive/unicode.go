@@ -0,0 +1,49 @@
+package gdrive
+
+import (
+	"flag"
+
+	"golang.org/x/text/unicode/norm"
+	"google.golang.org/api/drive/v3"
+)
+
+var (
+	unicodeNormalizationFlag = flag.Bool("unicode-normalization", false, "Normalize file names to Unicode NFC. Fixes lookups of accented names sent decomposed (NFD) by macOS clients.")
+)
+
+// normalizeName normalizes name according to --unicode-normalization.
+func normalizeName(name string) string {
+	if !*unicodeNormalizationFlag {
+		return name
+	}
+	return norm.NFC.String(name)
+}
+
+// normalizeFileNames normalizes names of files according to
+// --unicode-normalization. Files are copied before being renamed, so that
+// cached Drive metadata is not modified.
+func normalizeFileNames(files []*drive.File) []*drive.File {
+	if !*unicodeNormalizationFlag {
+		return files
+	}
+	for i, file := range files {
+		if name := norm.NFC.String(file.Name); name != file.Name {
+			normalized := *file
+			normalized.Name = name
+			files[i] = &normalized
+		}
+	}
+	return files
+}
+
+// nameQuery returns Drive query condition matching files called name. With
+// --unicode-normalization the decomposed form of name is matched as well.
+func nameQuery(name string) string {
+	query := "name=" + quoteQueryString(name)
+	if *unicodeNormalizationFlag {
+		if decomposed := norm.NFD.String(name); decomposed != name {
+			query = "(" + query + " or name=" + quoteQueryString(decomposed) + ")"
+		}
+	}
+	return query
+}
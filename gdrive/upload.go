@@ -0,0 +1,299 @@
+package gdrive
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/md5"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	log "github.com/cihub/seelog"
+	"golang.org/x/net/context"
+	"google.golang.org/api/drive/v3"
+	"google.golang.org/api/googleapi"
+)
+
+const (
+	// uploadChunkSize is the size of the chunks of resumable uploads, Drive
+	// requires a multiple of 256 KiB. Smaller files are uploaded at once.
+	uploadChunkSize = 8 << 20
+)
+
+var (
+	uploadResumeAttemptsFlag = flag.Int("upload-resume-attempts", 5, "How many times an interrupted upload is resumed from the last byte received by Drive before giving up.")
+	maxConcurrentUploadsFlag = flag.Int("max-concurrent-uploads", 0, "Maximum uploads to Drive running at once, further ones wait. 0 means no limit.")
+)
+
+// upload uploads the content of a new file, if fileID is empty, or of an
+// existing one together with its metadata. size is -1 if unknown, for
+// content streamed as it's received.
+func (fs *fileSystem) upload(ctx context.Context, name string, fileID string, meta *drive.File, r io.Reader, size int64) (*drive.File, error) {
+	release, err := fs.uploads.acquire(ctx, "all users")
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	atomic.AddInt64(&fs.stats.activeUploads, 1)
+	defer atomic.AddInt64(&fs.stats.activeUploads, -1)
+
+	h := md5.New()
+	r = newProgressReader(io.TeeReader(r, h), "Upload", name, 0, size)
+
+	var file *drive.File
+	if size >= 0 && size <= uploadChunkSize {
+		if fileID == "" {
+			file, err = fs.client.Files.Create(meta).SupportsAllDrives(true).Fields(fileFields).Media(r).Context(ctx).Do()
+		} else {
+			file, err = fs.client.Files.Update(fileID, meta).SupportsAllDrives(true).Fields(fileFields).Media(r).Context(ctx).Do()
+		}
+	} else {
+		u := &resumableUpload{
+			fs:   fs,
+			ctx:  ctx,
+			name: name,
+			size: size,
+		}
+		if err = u.start(fileID, meta); err == nil {
+			file, err = u.send(r)
+		}
+	}
+	if err != nil || !*verifyChecksumsFlag {
+		return file, err
+	}
+
+	if err := verifyChecksum(name, file.Md5Checksum, h); err != nil {
+		if fileID == "" {
+			// Don't leave a corrupted copy behind.
+			if err := fs.client.Files.Delete(file.Id).SupportsAllDrives(true).Context(ctx).Do(); err != nil {
+				log.Errorf("can't delete corrupted upload of %v: %v", name, err)
+			}
+		}
+		return nil, err
+	}
+	return file, nil
+}
+
+// resumableUpload sends content with the Drive resumable upload protocol,
+// so that an upload interrupted by a network error resumes from the last
+// byte Drive received instead of failing.
+type resumableUpload struct {
+	fs   *fileSystem
+	ctx  context.Context
+	name string
+	// size is -1 until the end of content of unknown size is read.
+	size int64
+	url  string
+}
+
+// total returns the size for Content-Range, * if it's unknown yet.
+func (u *resumableUpload) total() string {
+	if u.size < 0 {
+		return "*"
+	}
+	return strconv.FormatInt(u.size, 10)
+}
+
+func (u *resumableUpload) client() *http.Client {
+	return &http.Client{Transport: u.fs.roundTripper}
+}
+
+func (u *resumableUpload) do(req *http.Request) (*http.Response, error) {
+	return u.client().Do(req.WithContext(u.ctx))
+}
+
+// start creates the upload session.
+func (u *resumableUpload) start(fileID string, meta *drive.File) error {
+	body, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+
+	base := strings.Replace(u.fs.client.BasePath, "/drive/v3/", "/upload/drive/v3/", 1)
+	method, target := "POST", base+"files"
+	if fileID != "" {
+		method, target = "PATCH", base+"files/"+url.PathEscape(fileID)
+	}
+	target += "?uploadType=resumable&supportsAllDrives=true&fields=" + url.QueryEscape(fileFields)
+
+	req, err := http.NewRequest(method, target, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json; charset=UTF-8")
+	if u.size >= 0 {
+		req.Header.Set("X-Upload-Content-Length", strconv.FormatInt(u.size, 10))
+	}
+
+	res, err := u.do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if err := googleapi.CheckResponse(res); err != nil {
+		return err
+	}
+
+	u.url = res.Header.Get("Location")
+	if u.url == "" {
+		return fmt.Errorf("no upload session URL in response")
+	}
+	return nil
+}
+
+// send sends the content read from r chunk by chunk. A chunk stays in
+// memory until Drive confirms it, so that it can be sent again. When the
+// size is unknown, a byte is read ahead to tell the last chunk, which gives
+// the size to Drive.
+func (u *resumableUpload) send(r io.Reader) (*drive.File, error) {
+	pooled := chunkPool.Get().(*[]byte)
+	defer chunkPool.Put(pooled)
+	chunk := *pooled
+	var ahead *bufio.Reader
+	if u.size < 0 {
+		ahead = bufio.NewReaderSize(r, 16)
+		r = ahead
+	}
+	attempts := 0
+	var offset int64
+	for {
+		n, err := io.ReadFull(r, chunk)
+		if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+			return nil, err
+		}
+		if ahead != nil {
+			last := n < len(chunk)
+			if !last {
+				if _, err := ahead.Peek(1); err == io.EOF {
+					last = true
+				} else if err != nil {
+					return nil, err
+				}
+			}
+			if last {
+				u.size = offset + int64(n)
+			}
+		}
+		if u.size >= 0 && (offset+int64(n) > u.size || (n < len(chunk) && offset+int64(n) < u.size)) {
+			return nil, fmt.Errorf("upload of %v: got %v bytes, expected %v", u.name, offset+int64(n), u.size)
+		}
+
+		start := offset
+		if n == 0 && u.size == offset {
+			// Empty content of unknown size.
+			file, _, err := u.query()
+			if err == nil && file == nil {
+				err = fmt.Errorf("upload of %v not completed by Drive", u.name)
+			}
+			return file, err
+		}
+		for offset < start+int64(n) {
+			file, next, err := u.put(chunk[offset-start:n], offset)
+			if err == nil && file != nil {
+				return file, nil
+			}
+			if err == nil && next > offset {
+				offset = next
+				continue
+			}
+			if err == nil {
+				err = fmt.Errorf("no progress at byte %v", offset)
+			}
+
+			if u.ctx.Err() != nil || !isResumable(err) || attempts >= *uploadResumeAttemptsFlag {
+				log.Errorf("Upload %v failed at byte %v: %v", u.name, offset, err)
+				return nil, err
+			}
+			attempts++
+			log.Warnf("Upload %v interrupted at byte %v, resuming (attempt %v of %v): %v", u.name, offset, attempts, *uploadResumeAttemptsFlag, err)
+			time.Sleep(time.Duration(attempts) * time.Second)
+
+			file, next, err = u.query()
+			if err != nil {
+				log.Errorf("Upload %v can't be resumed: %v", u.name, err)
+				return nil, err
+			}
+			if file != nil {
+				return file, nil
+			}
+			if next < start {
+				return nil, fmt.Errorf("upload of %v: Drive lost confirmed bytes %v-%v", u.name, next, start-1)
+			}
+			offset = next
+		}
+
+		if u.size >= 0 && offset >= u.size {
+			return nil, fmt.Errorf("upload of %v not completed by Drive", u.name)
+		}
+	}
+}
+
+// put sends data at offset. It returns the uploaded file when the upload is
+// complete, otherwise the offset Drive expects next.
+func (u *resumableUpload) put(data []byte, offset int64) (*drive.File, int64, error) {
+	req, err := http.NewRequest("PUT", u.url, bytes.NewReader(data))
+	if err != nil {
+		return nil, 0, err
+	}
+	req.Header.Set("Content-Range", fmt.Sprintf("bytes %d-%d/%s", offset, offset+int64(len(data))-1, u.total()))
+	return u.result(req)
+}
+
+// query asks Drive how much of the content it has received.
+func (u *resumableUpload) query() (*drive.File, int64, error) {
+	req, err := http.NewRequest("PUT", u.url, nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	req.Header.Set("Content-Range", "bytes */"+u.total())
+	return u.result(req)
+}
+
+func (u *resumableUpload) result(req *http.Request) (*drive.File, int64, error) {
+	req.Header.Set("X-GUploader-No-308", "yes")
+	res, err := u.do(req)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode == http.StatusPermanentRedirect || res.Header.Get("X-HTTP-Status-Code-Override") == "308" {
+		// Range is "bytes=0-<last received byte>", absent if none was.
+		rng := strings.TrimPrefix(res.Header.Get("Range"), "bytes=0-")
+		if rng == "" {
+			return nil, 0, nil
+		}
+		last, err := strconv.ParseInt(rng, 10, 64)
+		if err != nil {
+			return nil, 0, fmt.Errorf("bad Range in upload response: %v", res.Header.Get("Range"))
+		}
+		return nil, last + 1, nil
+	}
+
+	if err := googleapi.CheckResponse(res); err != nil {
+		return nil, 0, err
+	}
+
+	file := &drive.File{}
+	if err := json.NewDecoder(res.Body).Decode(file); err != nil {
+		return nil, 0, err
+	}
+	return file, 0, nil
+}
+
+// isResumable reports whether an upload failed with err may succeed if
+// resumed: on network errors and server side errors.
+func isResumable(err error) bool {
+	if ge, ok := err.(*googleapi.Error); ok {
+		return ge.Code >= 500 || ge.Code == http.StatusTooManyRequests
+	}
+	return true
+}
@@ -0,0 +1,50 @@
+package gdrive
+
+import (
+	"flag"
+	"net/http"
+)
+
+var (
+	userAgentFlag = flag.String("user-agent", "", "User-Agent of Drive requests, to tell this instance apart in Google Cloud Console.")
+	quotaUserFlag = flag.String("quota-user", "", "quotaUser parameter of Drive requests, which Drive attributes quota to.")
+)
+
+// identityTransport sets the User-Agent and quotaUser of Drive requests.
+type identityTransport struct {
+	base http.RoundTripper
+}
+
+// withIdentity wraps base if --user-agent or --quota-user is given.
+func withIdentity(base http.RoundTripper) http.RoundTripper {
+	if *userAgentFlag == "" && *quotaUserFlag == "" {
+		return base
+	}
+	return &identityTransport{base: base}
+}
+
+func (t *identityTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	base := t.base
+	if base == nil {
+		base = http.DefaultTransport
+	}
+
+	// RoundTrippers must not modify the request.
+	r := new(http.Request)
+	*r = *req
+	r.Header = make(http.Header, len(req.Header))
+	for k, v := range req.Header {
+		r.Header[k] = v
+	}
+	if *userAgentFlag != "" {
+		r.Header.Set("User-Agent", *userAgentFlag)
+	}
+	if *quotaUserFlag != "" {
+		u := *req.URL
+		q := u.Query()
+		q.Set("quotaUser", *quotaUserFlag)
+		u.RawQuery = q.Encode()
+		r.URL = &u
+	}
+	return base.RoundTrip(r)
+}
@@ -0,0 +1,64 @@
+package gdrive
+
+import (
+	"flag"
+	"net/http"
+	"sync"
+
+	log "github.com/cihub/seelog"
+	"golang.org/x/net/context"
+)
+
+var (
+	maxUserDownloadsFlag = flag.Int("max-user-downloads", 0, "Maximum simultaneous downloads (GET) per user, further ones wait. Users are told apart by the basic auth user name, or the client IP without one. 0 means no limit.")
+	maxUserUploadsFlag   = flag.Int("max-user-uploads", 0, "Maximum simultaneous uploads (PUT) per user, further ones wait. 0 means no limit.")
+)
+
+// transferLimiter caps the transfers each user runs at once.
+type transferLimiter struct {
+	max   int
+	mu    sync.Mutex
+	slots map[string]chan struct{}
+}
+
+func newTransferLimiter(max int) *transferLimiter {
+	if max <= 0 {
+		return nil
+	}
+	return &transferLimiter{max: max, slots: make(map[string]chan struct{})}
+}
+
+// acquire waits for a free slot of user and returns the function releasing
+// it.
+func (l *transferLimiter) acquire(ctx context.Context, user string) (func(), error) {
+	if l == nil {
+		return func() {}, nil
+	}
+	l.mu.Lock()
+	slots := l.slots[user]
+	if slots == nil {
+		slots = make(chan struct{}, l.max)
+		l.slots[user] = slots
+	}
+	l.mu.Unlock()
+
+	select {
+	case slots <- struct{}{}:
+	default:
+		log.Debugf("all %v transfer slots of %v are busy, waiting", l.max, user)
+		select {
+		case slots <- struct{}{}:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	return func() { <-slots }, nil
+}
+
+// requestUser returns who made r: the basic auth user, or the client IP.
+func requestUser(r *http.Request) string {
+	if user, _, ok := r.BasicAuth(); ok && user != "" {
+		return user
+	}
+	return clientIP(r)
+}
@@ -0,0 +1,23 @@
+package gdrive
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// BuildInfo describes the running build.
+type BuildInfo struct {
+	Version   string `json:"version"`
+	Commit    string `json:"commit,omitempty"`
+	Date      string `json:"date,omitempty"`
+	GoVersion string `json:"goVersion"`
+}
+
+// Build is the running build, set by main.
+var Build BuildInfo
+
+// version reports the running build, to be included in bug reports.
+func (h *adminHandler) version(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(&Build)
+}
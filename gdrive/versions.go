@@ -0,0 +1,388 @@
+package gdrive
+
+import (
+	"flag"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	log "github.com/cihub/seelog"
+	"golang.org/x/net/context"
+	"golang.org/x/net/webdav"
+	"google.golang.org/api/drive/v3"
+	"google.golang.org/api/googleapi"
+)
+
+const (
+	// versionsRoot mirrors the tree, with every file turned into a folder
+	// listing its revisions.
+	versionsRoot = "/.versions"
+
+	revisionFields = "id,mimeType,modifiedTime,size,md5Checksum,keepForever,lastModifyingUser(displayName,emailAddress)"
+
+	revisionTimeFormat = "2006-01-02T15-04-05Z"
+)
+
+var (
+	versionsFlag = flag.Bool("versions", false, "Expose revisions of files under /.versions/<path>/. A revision is restored by copying or moving it over the file.")
+)
+
+func isVersionsPath(name string) bool {
+	return *versionsFlag && (name == versionsRoot || strings.HasPrefix(name, versionsRoot+"/"))
+}
+
+// revisionName returns the name a revision of file is listed under: its
+// time and ID followed by the extension of the file.
+func revisionName(file *drive.File, rev *drive.Revision) string {
+	t, err := time.Parse(time.RFC3339, rev.ModifiedTime)
+	if err != nil {
+		log.Errorf("can't parse modification time of revision %v: %v", rev.Id, err)
+	}
+	return t.UTC().Format(revisionTimeFormat) + "_" + rev.Id + path.Ext(file.Name)
+}
+
+// revisionFile describes a revision as a read-only file.
+func revisionFile(file *drive.File, rev *drive.Revision) *drive.File {
+	return &drive.File{
+		Id:           file.Id,
+		Name:         revisionName(file, rev),
+		MimeType:     rev.MimeType,
+		ModifiedTime: rev.ModifiedTime,
+		Size:         rev.Size,
+		Md5Checksum:  rev.Md5Checksum,
+		Capabilities: &drive.FileCapabilities{},
+	}
+}
+
+// resolveVersionsPath resolves a path below versionsRoot to the file or
+// folder of the tree it mirrors and, if it names a revision, the revision.
+func (fs *fileSystem) resolveVersionsPath(ctx context.Context, name string) (*fileAndPath, *drive.Revision, error) {
+	p := strings.TrimPrefix(name, versionsRoot)
+	fp, err := fs.getFile(ctx, p, false)
+	if err != os.ErrNotExist {
+		return fp, nil, err
+	}
+
+	fp, err = fs.getFile(ctx, path.Dir(p), false)
+	if err != nil {
+		return nil, nil, err
+	}
+	if fp.file.MimeType == mimeTypeFolder {
+		return nil, nil, os.ErrNotExist
+	}
+
+	parts := strings.SplitN(path.Base(p), "_", 2)
+	if len(parts) != 2 {
+		return nil, nil, os.ErrNotExist
+	}
+	id := strings.TrimSuffix(parts[1], path.Ext(fp.file.Name))
+	rev, err := fs.client.Revisions.Get(fp.file.Id, id).Fields(revisionFields).Context(ctx).Do()
+	if err != nil {
+		if ge, ok := err.(*googleapi.Error); ok && ge.Code == http.StatusNotFound {
+			return nil, nil, os.ErrNotExist
+		}
+		return nil, nil, err
+	}
+	if revisionName(fp.file, rev) != path.Base(p) {
+		return nil, nil, os.ErrNotExist
+	}
+	return fp, rev, nil
+}
+
+func (fs *fileSystem) listRevisions(ctx context.Context, fileID string) ([]*drive.Revision, error) {
+	revisions := []*drive.Revision{}
+	err := fs.client.Revisions.List(fileID).Fields("nextPageToken, revisions("+revisionFields+")").Pages(ctx, func(r *drive.RevisionList) error {
+		revisions = append(revisions, r.Revisions...)
+		return nil
+	})
+	if err != nil {
+		log.Error("Can't list revisions ", err)
+		return nil, err
+	}
+	return revisions, nil
+}
+
+func (fs *fileSystem) statVersions(ctx context.Context, name string) (os.FileInfo, error) {
+	fp, rev, err := fs.resolveVersionsPath(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	if rev != nil {
+		return newFileInfo(revisionFile(fp.file, rev)), nil
+	}
+	return newVersionsDirInfo(name, fp.file), nil
+}
+
+func (fs *fileSystem) openVersions(ctx context.Context, name string, flag int) (webdav.File, error) {
+	if flag != os.O_RDONLY {
+		return nil, os.ErrPermission
+	}
+
+	fp, rev, err := fs.resolveVersionsPath(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	if rev != nil {
+		return &openReadonlyFile{ctx: ctx, fs: fs, file: revisionFile(fp.file, rev), name: name, revisionID: rev.Id}, nil
+	}
+	return &versionsDir{ctx: ctx, fs: fs, name: name, file: fp.file}, nil
+}
+
+func newVersionsDirInfo(name string, file *drive.File) *fileInfo {
+	fi := newFileInfo(file)
+	fi.name = path.Base(name)
+	fi.isDir = true
+	fi.size = 0
+	fi.readOnly = true
+	return fi
+}
+
+// versionsDir is a folder below versionsRoot. It lists the children of the
+// folder it mirrors, or the revisions of the file it mirrors.
+type versionsDir struct {
+	ctx  context.Context
+	fs   *fileSystem
+	name string
+	file *drive.File
+}
+
+func (d *versionsDir) Readdir(count int) ([]os.FileInfo, error) {
+	files := []os.FileInfo{}
+	if d.file.MimeType == mimeTypeFolder {
+		children, err := d.fs.listFolder(d.ctx, d.file.Id)
+		if err != nil {
+			return nil, err
+		}
+		for _, child := range children {
+			files = append(files, newVersionsDirInfo(child.Name, child))
+		}
+		return files, nil
+	}
+
+	revisions, err := d.fs.listRevisions(d.ctx, d.file.Id)
+	if err != nil {
+		return nil, err
+	}
+	for _, rev := range revisions {
+		files = append(files, newFileInfo(revisionFile(d.file, rev)))
+	}
+	return files, nil
+}
+
+func (d *versionsDir) Stat() (os.FileInfo, error) {
+	return newVersionsDirInfo(d.name, d.file), nil
+}
+
+func (d *versionsDir) Read(p []byte) (int, error) {
+	return 0, errNotSupported
+}
+
+func (d *versionsDir) Write(p []byte) (int, error) {
+	return 0, errNotSupported
+}
+
+func (d *versionsDir) Seek(offset int64, whence int) (int64, error) {
+	return 0, nil
+}
+
+func (d *versionsDir) Close() error {
+	return nil
+}
+
+// restoreRevision copies the content of the revision at src to dst. It
+// reports whether dst was created.
+func (fs *fileSystem) restoreRevision(ctx context.Context, src string, dst string, overwrite bool) (bool, error) {
+	src = normalizePath(src)
+	dst = normalizePath(dst)
+	if isVersionsPath(dst) {
+		return false, os.ErrPermission
+	}
+
+	fp, rev, err := fs.resolveVersionsPath(ctx, src)
+	if err != nil {
+		return false, err
+	}
+	if rev == nil {
+		log.Errorf("%v is not a revision", src)
+		return false, errNotSupported
+	}
+
+	_, err = fs.getFile(ctx, dst, false)
+	if err != nil && err != os.ErrNotExist {
+		return false, err
+	}
+	created := err == os.ErrNotExist
+	if !created && !overwrite {
+		return false, os.ErrExist
+	}
+
+	r := &openReadonlyFile{ctx: ctx, fs: fs, file: revisionFile(fp.file, rev), name: src, revisionID: rev.Id}
+	defer r.Close()
+	w, err := fs.OpenFile(ctx, dst, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return false, err
+	}
+	if _, err := copyBuffered(w, r); err != nil {
+		return false, err
+	}
+	if err := w.Close(); err != nil {
+		return false, err
+	}
+	log.Infof("Restored %v to %v", src, dst)
+	return created, nil
+}
+
+// restoreRevision handles COPY and MOVE of a revision. webdav.Handler can't
+// do it, as it deletes the destination file, and so its revisions, first.
+// The revision is left in place by MOVE.
+func (h *handler) restoreRevision(w http.ResponseWriter, r *http.Request, fs *fileSystem) {
+	// Without a path below the server, the revision would be restored over
+	// the root.
+	hdr := r.Header.Get("Destination")
+	u, err := url.Parse(hdr)
+	if hdr == "" || err != nil || !strings.HasPrefix(u.Path, "/") || normalizePath(u.Path) == "" {
+		http.Error(w, webdav.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	if u.Host != "" && u.Host != r.Host {
+		http.Error(w, webdav.StatusText(http.StatusBadGateway), http.StatusBadGateway)
+		return
+	}
+
+	release, err := h.confirmLocks(r, normalizePath(u.Path))
+	if err != nil {
+		log.Debugf("%v %v: %v", r.Method, r.URL.Path, err)
+		http.Error(w, webdav.StatusText(webdav.StatusLocked), webdav.StatusLocked)
+		return
+	}
+	defer release()
+
+	created, err := fs.restoreRevision(r.Context(), r.URL.Path, u.Path, r.Header.Get("Overwrite") != "F")
+	if err != nil {
+		status := errorStatus(err)
+		switch {
+		case os.IsNotExist(err):
+			status = http.StatusNotFound
+		case os.IsExist(err):
+			status = http.StatusPreconditionFailed
+		case status == 0:
+			status = http.StatusInternalServerError
+		}
+		http.Error(w, webdav.StatusText(status), status)
+		return
+	}
+
+	if created {
+		w.WriteHeader(http.StatusCreated)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// confirmLocks checks that the tokens of the If header allow writing dst,
+// as webdav.Handler does for its own methods. Without an If header, dst is
+// locked for the request, so that it fails on locks of other clients. The
+// returned function releases the confirmation or the lock.
+func (h *handler) confirmLocks(r *http.Request, dst string) (func(), error) {
+	ls := h.dav.LockSystem
+	hdr := r.Header.Get("If")
+	if hdr == "" {
+		now := time.Now()
+		token, err := createTemporaryLock(ls, now, webdav.LockDetails{Root: dst, Duration: -1, ZeroDepth: true})
+		if err != nil {
+			return nil, err
+		}
+		return func() { ls.Unlock(now, token) }, nil
+	}
+
+	lists, ok := parseIfHeader(hdr)
+	if !ok {
+		return nil, fmt.Errorf("bad If header %q", hdr)
+	}
+	// Any of the lists will do.
+	for _, l := range lists {
+		name := dst
+		if l.resourceTag != "" {
+			u, err := url.Parse(l.resourceTag)
+			if err != nil || u.Host != r.Host {
+				continue
+			}
+			name = normalizePath(u.Path)
+		}
+		release, err := ls.Confirm(time.Now(), name, dst, l.conditions...)
+		if err == webdav.ErrConfirmationFailed {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		return release, nil
+	}
+	return nil, webdav.ErrLocked
+}
+
+// ifList is a list of conditions of an If header, with the resource it's
+// tagged with, if any.
+type ifList struct {
+	resourceTag string
+	conditions  []webdav.Condition
+}
+
+// parseIfHeader parses an If header (RFC 4918 section 10.4), which webdav
+// doesn't export.
+func parseIfHeader(s string) ([]ifList, bool) {
+	var lists []ifList
+	tag := ""
+	for s = strings.TrimSpace(s); s != ""; s = strings.TrimSpace(s) {
+		switch s[0] {
+		case '<':
+			i := strings.IndexByte(s, '>')
+			if i < 0 {
+				return nil, false
+			}
+			tag, s = s[1:i], s[i+1:]
+		case '(':
+			l := ifList{resourceTag: tag}
+			s = strings.TrimSpace(s[1:])
+			for s != "" && s[0] != ')' {
+				var c webdav.Condition
+				if strings.HasPrefix(s, "Not") {
+					c.Not = true
+					s = strings.TrimSpace(s[3:])
+				}
+				if s == "" {
+					return nil, false
+				}
+				end := byte('>')
+				if s[0] == '[' {
+					end = ']'
+				} else if s[0] != '<' {
+					return nil, false
+				}
+				i := strings.IndexByte(s, end)
+				if i < 0 {
+					return nil, false
+				}
+				if end == ']' {
+					c.ETag = s[1:i]
+				} else {
+					c.Token = s[1:i]
+				}
+				l.conditions = append(l.conditions, c)
+				s = strings.TrimSpace(s[i+1:])
+			}
+			if s == "" || len(l.conditions) == 0 {
+				return nil, false
+			}
+			lists = append(lists, l)
+			s = s[1:]
+		default:
+			return nil, false
+		}
+	}
+	return lists, len(lists) > 0
+}
@@ -0,0 +1,35 @@
+package gdrive
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"golang.org/x/net/webdav"
+)
+
+func TestRestoreRevisionDestination(t *testing.T) {
+	h := &handler{dav: &webdav.Handler{LockSystem: webdav.NewMemLS()}}
+	tests := []struct {
+		destination string
+		status      int
+	}{
+		{"", http.StatusBadRequest},
+		{"%zz", http.StatusBadRequest},
+		{"http://example.com", http.StatusBadRequest},
+		{"http://example.com/", http.StatusBadRequest},
+		{"relative.txt", http.StatusBadRequest},
+		{"http://other.com/file.txt", http.StatusBadGateway},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("COPY", "http://example.com/.versions/file.txt/1", nil)
+		if tt.destination != "" {
+			r.Header.Set("Destination", tt.destination)
+		}
+		w := httptest.NewRecorder()
+		h.restoreRevision(w, r, nil)
+		if w.Code != tt.status {
+			t.Errorf("Destination %q answered %v, want %v", tt.destination, w.Code, tt.status)
+		}
+	}
+}
@@ -0,0 +1,255 @@
+package gdrive
+
+import (
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	log "github.com/cihub/seelog"
+	"golang.org/x/net/context"
+	"golang.org/x/net/webdav"
+	"google.golang.org/api/drive/v3"
+)
+
+// virtualFolder is a read-only folder at the root of the tree listing files
+// found by a search, wherever they are in the tree. It shadows a real file
+// of the same name.
+type virtualFolder struct {
+	root string
+	list func(fs *fileSystem, ctx context.Context) ([]*drive.File, error)
+	// ttl is how long the listing is cached.
+	ttl time.Duration
+	// movable is set if files may be moved out of the folder into the tree.
+	movable bool
+}
+
+var (
+	recentFolder   = &virtualFolder{root: recentRoot, list: (*fileSystem).listRecent, ttl: 5 * time.Second}
+	orphanedFolder = &virtualFolder{root: orphanedRoot, list: (*fileSystem).listOrphaned, ttl: time.Minute, movable: true}
+)
+
+// virtualFolders returns the virtual folders enabled by flags. They list
+// files from anywhere in the drive, so they are unavailable when only a
+// folder is served.
+func virtualFolders() []*virtualFolder {
+	folders := []*virtualFolder{}
+	if *rootFolderIDFlag != "" {
+		return folders
+	}
+	if *recentFlag > 0 {
+		folders = append(folders, recentFolder)
+	}
+	if *orphanedFlag {
+		folders = append(folders, orphanedFolder)
+	}
+	return folders
+}
+
+// findVirtualFolder returns the virtual folder name is in, if any.
+func findVirtualFolder(name string) *virtualFolder {
+	for _, vf := range virtualFolders() {
+		if name == vf.root || strings.HasPrefix(name, vf.root+"/") {
+			return vf
+		}
+	}
+	return findSearchFolder(name)
+}
+
+func isVirtualPath(name string) bool {
+	return findVirtualFolder(name) != nil
+}
+
+// files returns the files listed in vf, cached for vf.ttl. Files sharing a
+// name are told apart as with --duplicates=suffix.
+func (vf *virtualFolder) files(ctx context.Context, fs *fileSystem) ([]*drive.File, error) {
+	key := cacheKeyDir + vf.root
+	if lookup, found := fs.cache.Get(key); found {
+		return lookup.(*fileLookupResult).fp.files, nil
+	}
+
+	files, err := vf.list(fs, ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	visible := []*drive.File{}
+	for _, file := range files {
+		if !ignoreFile(file) {
+			visible = append(visible, file)
+		}
+	}
+	visible = uniqueNames(normalizeFileNames(visible))
+
+	fs.cache.Set(key, &fileLookupResult{fp: &fileAndPath{path: vf.root, files: visible}}, vf.ttl)
+	return visible, nil
+}
+
+// uniqueNames renames all but the first of the files sharing a name with
+// duplicateName, keeping the order of files.
+func uniqueNames(files []*drive.File) []*drive.File {
+	seen := make(map[string]bool)
+	result := make([]*drive.File, 0, len(files))
+	for _, file := range files {
+		if seen[file.Name] {
+			dup := *file
+			dup.Name = duplicateName(file)
+			file = &dup
+		}
+		seen[file.Name] = true
+		result = append(result, file)
+	}
+	return result
+}
+
+// resolve returns the file at name below vf. Files of folders listed in vf
+// are looked up among their children.
+func (vf *virtualFolder) resolve(ctx context.Context, fs *fileSystem, name string) (*drive.File, error) {
+	parts := strings.Split(strings.TrimPrefix(name, vf.root+"/"), "/")
+	files, err := vf.files(ctx, fs)
+	for i, part := range parts {
+		if err != nil {
+			return nil, err
+		}
+		file := findFileByName(files, part)
+		if file == nil {
+			return nil, os.ErrNotExist
+		}
+		if i == len(parts)-1 {
+			return file, nil
+		}
+		if file.MimeType != mimeTypeFolder {
+			return nil, os.ErrNotExist
+		}
+		files, err = fs.listFolder(ctx, file.Id)
+	}
+	return nil, os.ErrNotExist
+}
+
+func findFileByName(files []*drive.File, name string) *drive.File {
+	for _, file := range files {
+		if file.Name == name {
+			return file
+		}
+	}
+	return nil
+}
+
+func (vf *virtualFolder) info() *fileInfo {
+	return &fileInfo{
+		name:     path.Base(vf.root),
+		isDir:    true,
+		modTime:  time.Now(),
+		readOnly: true,
+	}
+}
+
+func (fs *fileSystem) statVirtual(ctx context.Context, vf *virtualFolder, name string) (os.FileInfo, error) {
+	if name == vf.root {
+		return vf.info(), nil
+	}
+	file, err := vf.resolve(ctx, fs, name)
+	if err != nil {
+		return nil, err
+	}
+	return fs.fileInfo(file), nil
+}
+
+// openVirtual opens a file below vf. Files can only be read, or have their
+// properties patched.
+func (fs *fileSystem) openVirtual(ctx context.Context, vf *virtualFolder, name string, flag int) (webdav.File, error) {
+	if flag != os.O_RDONLY && flag != os.O_RDWR {
+		log.Errorf("can't write %v", name)
+		return nil, os.ErrPermission
+	}
+	if name == vf.root {
+		return &virtualDir{ctx: ctx, fs: fs, folder: vf}, nil
+	}
+	file, err := vf.resolve(ctx, fs, name)
+	if err != nil {
+		return nil, err
+	}
+	return &openReadonlyFile{ctx: ctx, fs: fs, file: file, name: name}, nil
+}
+
+// renameVirtual moves a file out of a movable virtual folder to newName.
+func (fs *fileSystem) renameVirtual(ctx context.Context, vf *virtualFolder, oldName, newName string) error {
+	if !vf.movable || oldName == vf.root {
+		return os.ErrPermission
+	}
+
+	file, err := vf.resolve(ctx, fs, oldName)
+	if err != nil {
+		return err
+	}
+
+	if _, err := fs.getFile(ctx, newName, false); err != os.ErrNotExist {
+		if err == nil {
+			err = os.ErrExist
+		}
+		return err
+	}
+	newParentID, err := fs.getFileID(ctx, path.Dir(newName), true)
+	if err == os.ErrNotExist {
+		return errNoParent
+	}
+	if err != nil {
+		return err
+	}
+	if skip, err := dryRun("move %v to %v", oldName, newName); skip {
+		return err
+	}
+
+	q := fs.client.Files.Update(file.Id, &drive.File{Name: path.Base(newName)}).SupportsAllDrives(true).AddParents(newParentID)
+	if len(file.Parents) > 0 {
+		q.RemoveParents(strings.Join(file.Parents, ","))
+	}
+	if _, err := q.Context(ctx).Do(); err != nil {
+		log.Errorf("can't move %v to %v: %v", oldName, newName, err)
+		return err
+	}
+
+	fs.cache.Delete(cacheKeyDir + vf.root)
+	fs.invalidatePath(newName)
+	fs.invalidatePath(path.Dir(newName))
+	return nil
+}
+
+// virtualDir is an open virtualFolder.
+type virtualDir struct {
+	ctx    context.Context
+	fs     *fileSystem
+	folder *virtualFolder
+}
+
+func (d *virtualDir) Readdir(count int) ([]os.FileInfo, error) {
+	files, err := d.folder.files(d.ctx, d.fs)
+	if err != nil {
+		return nil, err
+	}
+	infos := []os.FileInfo{}
+	for _, file := range files {
+		infos = append(infos, d.fs.fileInfo(file))
+	}
+	return infos, nil
+}
+
+func (d *virtualDir) Stat() (os.FileInfo, error) {
+	return d.folder.info(), nil
+}
+
+func (d *virtualDir) Read(p []byte) (int, error) {
+	return 0, errNotSupported
+}
+
+func (d *virtualDir) Write(p []byte) (int, error) {
+	return 0, errNotSupported
+}
+
+func (d *virtualDir) Seek(offset int64, whence int) (int64, error) {
+	return 0, nil
+}
+
+func (d *virtualDir) Close() error {
+	return nil
+}
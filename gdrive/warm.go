@@ -0,0 +1,62 @@
+package gdrive
+
+import (
+	"flag"
+	"strings"
+	"time"
+
+	log "github.com/cihub/seelog"
+	"golang.org/x/net/context"
+)
+
+// warmPaths is a list of folders given with a repeated flag.
+type warmPaths []string
+
+var warmPathsValue warmPaths
+
+var (
+	warmIntervalFlag = flag.Duration("warm-interval", time.Minute, "How often the --warm folders are listed again.")
+)
+
+func init() {
+	flag.Var(&warmPathsValue, "warm", "List this folder periodically, so that it is always served from the cache. May be repeated.")
+}
+
+func (v *warmPaths) String() string {
+	return strings.Join(*v, ",")
+}
+
+func (v *warmPaths) Set(value string) error {
+	*v = append(*v, normalizePath(value))
+	return nil
+}
+
+// warmFolders lists the --warm folders every interval, forever. Their
+// listings are cached until the next round.
+func (fs *fileSystem) warmFolders(paths []string, interval time.Duration) {
+	ctx := background(context.Background())
+	for ; ; time.Sleep(interval) {
+		for _, p := range paths {
+			if err := fs.warmFolder(ctx, p, 2*interval); err != nil {
+				log.Errorf("can't list %v: %v", p, err)
+			}
+		}
+	}
+}
+
+func (fs *fileSystem) warmFolder(ctx context.Context, p string, ttl time.Duration) error {
+	folder, err := fs.getFile(ctx, p, true)
+	if err != nil {
+		return err
+	}
+	files, err := fs.listFolder0(ctx, folder.file.Id)
+	if err != nil {
+		return err
+	}
+	fs.cacheFolder(folder.file.Id, files, ttl)
+	for _, file := range files {
+		fs.cacheFile(p+"/"+file.Name, file)
+	}
+	log.Tracef("Warmed %v", p)
+	return nil
+}
@@ -0,0 +1,57 @@
+package gdrive
+
+import (
+	"encoding/xml"
+	"flag"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	nsMicrosoft = "urn:schemas-microsoft-com:"
+
+	// windowsCreationDateFormat is the format of creationdate the
+	// mini-redirector parses, which has no fractions of seconds.
+	windowsCreationDateFormat = "2006-01-02T15:04:05Z"
+)
+
+var (
+	win32LastModifiedTimeProp = xml.Name{Space: nsMicrosoft, Local: "Win32LastModifiedTime"}
+
+	windowsCompatFlag = flag.Bool("windows-compat", false, "Adjust responses for the Windows WebDAV mini-redirector (net use).")
+)
+
+// setWindowsHeaders adds headers the mini-redirector expects before it
+// treats the server as writable WebDAV share.
+func setWindowsHeaders(w http.ResponseWriter, r *http.Request) {
+	if r.Method == "OPTIONS" {
+		w.Header().Set("MS-Author-Via", "DAV")
+	}
+}
+
+// wantsSource reports whether r asks with "Translate: f" for the file as
+// stored rather than rendered for display, as Windows clients do. Such
+// requests aren't taken for those of a browser, whatever their User-Agent.
+func wantsSource(r *http.Request) bool {
+	return strings.EqualFold(strings.TrimSpace(r.Header.Get("Translate")), "f")
+}
+
+// isWindowsProp reports whether name is one of the Win32* properties the
+// mini-redirector sets after every upload. They are accepted without being
+// stored, as storing them would waste the app properties Drive allows per
+// file, and rejecting them makes Explorer fail the whole copy. The
+// modification time of Win32LastModifiedTime is kept as that of the file.
+func isWindowsProp(name xml.Name) bool {
+	return name.Space == nsMicrosoft
+}
+
+// parseWindowsTime parses the RFC 1123 dates of the Win32* properties.
+func parseWindowsTime(s string) (time.Time, error) {
+	s = strings.TrimSpace(s)
+	t, err := time.Parse(time.RFC1123, s)
+	if err != nil {
+		t, err = time.Parse(time.RFC1123Z, s)
+	}
+	return t, err
+}
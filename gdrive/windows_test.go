@@ -0,0 +1,56 @@
+package gdrive
+
+import (
+	"net/http"
+	"testing"
+
+	"golang.org/x/net/webdav"
+)
+
+func TestWindowsLastModifiedTime(t *testing.T) {
+	saved := *windowsCompatFlag
+	*windowsCompatFlag = true
+	defer func() { *windowsCompatFlag = saved }()
+
+	patches := []webdav.Proppatch{{Props: []webdav.Property{{
+		XMLName:  win32LastModifiedTimeProp,
+		InnerXML: []byte("Tue, 03 Mar 2020 10:11:12 GMT"),
+	}}}}
+	update, propstats := preparePatch(patches)
+	if want := "2020-03-03T10:11:12.000Z"; update.ModifiedTime != want {
+		t.Errorf("ModifiedTime = %q, want %q", update.ModifiedTime, want)
+	}
+	if len(propstats) != 1 || propstats[0].Status != http.StatusOK {
+		t.Errorf("propstats = %+v, want the property accepted", propstats)
+	}
+
+	patches[0].Props[0].InnerXML = []byte("yesterday")
+	update, propstats = preparePatch(patches)
+	if update.ModifiedTime != "" {
+		t.Errorf("ModifiedTime = %q for an unparsable date, want none", update.ModifiedTime)
+	}
+	if len(propstats) != 1 || propstats[0].Status != http.StatusOK {
+		t.Errorf("propstats = %+v, want the property accepted", propstats)
+	}
+}
+
+func TestWindowsTranslateHeader(t *testing.T) {
+	saved := *windowsCompatFlag
+	defer func() { *windowsCompatFlag = saved }()
+
+	r, _ := http.NewRequest("GET", "/file.txt", nil)
+	r.Header.Set("User-Agent", "Mozilla/4.0 (compatible; MSIE 6.0; Windows NT 10.0)")
+	r.Header.Set("Translate", "f")
+	for _, tt := range []struct {
+		compat  bool
+		browser bool
+	}{
+		{false, true},
+		{true, false},
+	} {
+		*windowsCompatFlag = tt.compat
+		if got := isBrowser(r); got != tt.browser {
+			t.Errorf("isBrowser with --windows-compat=%v = %v, want %v", tt.compat, got, tt.browser)
+		}
+	}
+}
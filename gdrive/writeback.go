@@ -0,0 +1,421 @@
+package gdrive
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/cihub/seelog"
+	"golang.org/x/net/context"
+	"golang.org/x/net/webdav"
+	"google.golang.org/api/googleapi"
+)
+
+const (
+	// writeBackWaitTimeout bounds how long an operation waits for the
+	// spooled uploads it depends on.
+	writeBackWaitTimeout = 2 * time.Minute
+)
+
+var (
+	writeBackDirFlag   = flag.String("write-back-dir", "", "Complete uploads at once by spooling them to this directory, from which they are sent to Drive in the background. Spooled uploads survive restarts.")
+	writeBackRetryFlag = flag.Duration("write-back-retry", 30*time.Second, "Delay before a failed background upload is tried again.")
+)
+
+// uploadQueue sends spooled uploads to Drive in the order they were made.
+// Each one is journaled as <id>.json next to its content in <id>.data, so
+// that the queue is reloaded after a crash.
+type uploadQueue struct {
+	fs      *fileSystem
+	dir     string
+	mu      sync.Mutex
+	done    *sync.Cond
+	entries []*queuedUpload
+	lastID  int64
+	wake    chan struct{}
+}
+
+type queuedUpload struct {
+	ID            string            `json:"id"`
+	Name          string            `json:"name"`
+	Size          int64             `json:"size"`
+	AppProperties map[string]string `json:"appProperties,omitempty"`
+	Queued        time.Time         `json:"queued"`
+	Attempts      int               `json:"attempts"`
+	LastError     string            `json:"lastError,omitempty"`
+	retryAt       time.Time
+	uploading     bool
+}
+
+// newUploadQueue loads the uploads spooled in dir.
+func newUploadQueue(fs *fileSystem, dir string) (*uploadQueue, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	q := &uploadQueue{fs: fs, dir: dir, wake: make(chan struct{}, 1)}
+	q.done = sync.NewCond(&q.mu)
+
+	names, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		e := &queuedUpload{}
+		data, err := ioutil.ReadFile(name)
+		if err == nil {
+			err = json.Unmarshal(data, e)
+		}
+		if err == nil {
+			_, err = os.Stat(q.dataFile(e))
+		}
+		if err != nil {
+			log.Errorf("Dropping broken spooled upload %v: %v", name, err)
+			os.Remove(name)
+			continue
+		}
+		q.entries = append(q.entries, e)
+	}
+	if len(q.entries) > 0 {
+		log.Infof("Resuming %v spooled uploads", len(q.entries))
+	}
+	return q, nil
+}
+
+func (q *uploadQueue) dataFile(e *queuedUpload) string {
+	return filepath.Join(q.dir, e.ID+".data")
+}
+
+func (q *uploadQueue) journalFile(e *queuedUpload) string {
+	return filepath.Join(q.dir, e.ID+".json")
+}
+
+// writeFile writes data to name atomically, once it is on disk.
+func writeFile(name string, data []byte) error {
+	f, err := ioutil.TempFile(filepath.Dir(name), ".tmp")
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), name)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return err
+}
+
+func (q *uploadQueue) save(e *queuedUpload) error {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	return writeFile(q.journalFile(e), data)
+}
+
+func (q *uploadQueue) remove(e *queuedUpload) {
+	os.Remove(q.journalFile(e))
+	os.Remove(q.dataFile(e))
+}
+
+// add spools content to be uploaded to name. It replaces the uploads of the
+// same name not started yet.
+func (q *uploadQueue) add(name string, appProperties map[string]string, content []byte) error {
+	name = normalizePath(name)
+
+	q.mu.Lock()
+	id := time.Now().UnixNano()
+	if id <= q.lastID {
+		id = q.lastID + 1
+	}
+	q.lastID = id
+	q.mu.Unlock()
+
+	e := &queuedUpload{
+		ID:            fmt.Sprintf("%020d", id),
+		Name:          name,
+		Size:          int64(len(content)),
+		AppProperties: appProperties,
+		Queued:        time.Now().UTC(),
+	}
+	if err := writeFile(q.dataFile(e), content); err != nil {
+		log.Errorf("can't spool upload of %v: %v", name, err)
+		return err
+	}
+	if err := q.save(e); err != nil {
+		log.Errorf("can't spool upload of %v: %v", name, err)
+		os.Remove(q.dataFile(e))
+		return err
+	}
+
+	q.mu.Lock()
+	entries := []*queuedUpload{}
+	for _, old := range q.entries {
+		if old.Name == name && !old.uploading {
+			q.remove(old)
+			continue
+		}
+		entries = append(entries, old)
+	}
+	q.entries = append(entries, e)
+	q.mu.Unlock()
+
+	log.Debugf("Spooled upload of %v, %v bytes", name, e.Size)
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// run uploads the spooled files, forever.
+func (q *uploadQueue) run() {
+	for {
+		e := q.next()
+		if e == nil {
+			select {
+			case <-q.wake:
+			case <-time.After(*writeBackRetryFlag):
+			}
+			continue
+		}
+
+		err := q.upload(e)
+
+		q.mu.Lock()
+		e.uploading = false
+		switch {
+		case err == os.ErrNotExist || err == errNoParent:
+			log.Errorf("Dropping spooled upload of %v, its folder is gone", e.Name)
+		case err != nil && isPermanentUploadError(err):
+			log.Errorf("Dropping spooled upload of %v: %v", e.Name, err)
+		case err != nil && q.superseded(e):
+			log.Warnf("Dropping failed upload of %v, a newer one is spooled: %v", e.Name, err)
+		case err != nil:
+			e.Attempts++
+			e.LastError = err.Error()
+			e.retryAt = time.Now().Add(*writeBackRetryFlag)
+			log.Warnf("Upload of %v failed, retrying in %v: %v", e.Name, *writeBackRetryFlag, err)
+			if err := q.save(e); err != nil {
+				log.Errorf("can't update journal of %v: %v", e.Name, err)
+			}
+			q.mu.Unlock()
+			continue
+		}
+		q.remove(e)
+		for i, other := range q.entries {
+			if other == e {
+				q.entries = append(q.entries[:i], q.entries[i+1:]...)
+				break
+			}
+		}
+		q.done.Broadcast()
+		q.mu.Unlock()
+	}
+}
+
+// next returns the first upload due, marked as uploading. An upload waits
+// for the older uploads of the same name, so that they don't overwrite it.
+func (q *uploadQueue) next() *queuedUpload {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	now := time.Now()
+	older := make(map[string]bool)
+	for _, e := range q.entries {
+		if !older[e.Name] && !e.retryAt.After(now) {
+			e.uploading = true
+			return e
+		}
+		older[e.Name] = true
+	}
+	return nil
+}
+
+// superseded reports whether a newer upload of the same name as e is
+// spooled.
+func (q *uploadQueue) superseded(e *queuedUpload) bool {
+	for i := len(q.entries) - 1; i >= 0 && q.entries[i] != e; i-- {
+		if q.entries[i].Name == e.Name {
+			return true
+		}
+	}
+	return false
+}
+
+// isPermanentUploadError reports whether trying a failed upload again can't
+// help, as when the file is too large or the storage quota is used up.
+func isPermanentUploadError(err error) bool {
+	status := errorStatus(err)
+	if ge, ok := err.(*googleapi.Error); ok {
+		if hasErrorReason(ge, "rateLimitExceeded") || hasErrorReason(ge, "userRateLimitExceeded") {
+			return false
+		}
+		if status == 0 {
+			status = ge.Code
+		}
+	}
+	switch status {
+	case http.StatusBadRequest, http.StatusForbidden, http.StatusRequestEntityTooLarge, webdav.StatusInsufficientStorage:
+		return true
+	}
+	return false
+}
+
+func (q *uploadQueue) upload(e *queuedUpload) error {
+	content, err := ioutil.ReadFile(q.dataFile(e))
+	if err != nil {
+		return err
+	}
+	f := &openWritableFile{
+		ctx:           background(context.Background()),
+		fileSystem:    q.fs,
+		buffer:        bytes.NewBuffer(content),
+		name:          e.Name,
+		size:          int64(len(content)),
+		appProperties: e.AppProperties,
+	}
+	return f.flush()
+}
+
+// pending returns the latest upload spooled for name, if any.
+func (q *uploadQueue) pending(name string) *queuedUpload {
+	if q == nil {
+		return nil
+	}
+	name = normalizePath(name)
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for i := len(q.entries) - 1; i >= 0; i-- {
+		if q.entries[i].Name == name {
+			return q.entries[i]
+		}
+	}
+	return nil
+}
+
+// pendingIn returns the latest uploads spooled for files of folder dir.
+func (q *uploadQueue) pendingIn(dir string) []*queuedUpload {
+	if q == nil {
+		return nil
+	}
+	dir = normalizePath(dir)
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	latest := make(map[string]*queuedUpload)
+	for _, e := range q.entries {
+		if path.Dir(e.Name) == dir || dir == "" && path.Dir(e.Name) == "/" {
+			latest[e.Name] = e
+		}
+	}
+	result := []*queuedUpload{}
+	for _, e := range latest {
+		result = append(result, e)
+	}
+	return result
+}
+
+// wait blocks until the uploads of name, and of files below it, are done.
+// It is called before operations on name which need it to be in Drive. It
+// gives up with errUploadsPending when ctx is done or after
+// writeBackWaitTimeout.
+func (q *uploadQueue) wait(ctx context.Context, name string) error {
+	if q == nil {
+		return nil
+	}
+	name = normalizePath(name)
+	ctx, cancel := context.WithTimeout(ctx, writeBackWaitTimeout)
+	defer cancel()
+	go func() {
+		<-ctx.Done()
+		q.mu.Lock()
+		q.done.Broadcast()
+		q.mu.Unlock()
+	}()
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for q.hasPending(name) {
+		if ctx.Err() != nil {
+			log.Errorf("Gave up waiting for spooled uploads of %v", name)
+			return errUploadsPending
+		}
+		log.Debugf("Waiting for spooled uploads of %v", name)
+		q.done.Wait()
+	}
+	return nil
+}
+
+func (q *uploadQueue) hasPending(name string) bool {
+	for _, e := range q.entries {
+		if name == "" || e.Name == name || strings.HasPrefix(e.Name, name+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// status returns a copy of the queue.
+func (q *uploadQueue) status() []queuedUpload {
+	result := []queuedUpload{}
+	if q == nil {
+		return result
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for _, e := range q.entries {
+		result = append(result, *e)
+	}
+	return result
+}
+
+func (e *queuedUpload) info() *fileInfo {
+	return &fileInfo{
+		name:    path.Base(e.Name),
+		modTime: e.Queued,
+		size:    e.Size,
+	}
+}
+
+// open opens the spooled content of e.
+func (q *uploadQueue) open(e *queuedUpload) (*spooledFile, error) {
+	f, err := os.Open(q.dataFile(e))
+	if err != nil {
+		return nil, err
+	}
+	return &spooledFile{File: f, info: e.info()}, nil
+}
+
+// spooledFile is the content of a file not uploaded yet.
+type spooledFile struct {
+	*os.File
+	info *fileInfo
+}
+
+func (f *spooledFile) Stat() (os.FileInfo, error) {
+	return f.info, nil
+}
+
+func (f *spooledFile) Readdir(count int) ([]os.FileInfo, error) {
+	return nil, errNotSupported
+}
+
+func (f *spooledFile) Write(p []byte) (int, error) {
+	return 0, errNotSupported
+}
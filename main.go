@@ -8,18 +8,38 @@ import (
 	"os"
 	"runtime"
 	"strings"
+	"time"
 
 	"./gdrive"
+	"./s3gw"
+	"./sftpfs"
 	log "github.com/cihub/seelog"
 	"golang.org/x/net/context"
 	"golang.org/x/net/webdav"
 )
 
 var (
-	loglevel	 = flag.String("loglevel", "info", "Logging level")
+	loglevel     = flag.String("loglevel", "info", "Logging level")
 	addr         = flag.String("addr", ":8765", "WebDAV service address")
 	clientID     = flag.String("client-id", "", "OAuth client id")
 	clientSecret = flag.String("client-secret", "", "OAuth client secret")
+	fakeDrive    = flag.Bool("fake-drive", false, "Serve an in-memory fake of Google Drive instead of the real one, for testing. Same as --backend=fake.")
+	backend      = flag.String("backend", "drive", "Storage to serve: drive, fake (in-memory fake of Drive) or local (directory at --local-root through a fake of Drive)")
+	localRoot    = flag.String("local-root", "", "Directory served by --backend=local")
+	showVersion  = flag.Bool("version", false, "Print the version and build info and exit")
+
+	readHeaderTimeout = flag.Duration("read-header-timeout", 30*time.Second, "Maximum time to read the headers of a request. 0 means no limit.")
+	readTimeout       = flag.Duration("read-timeout", 0, "Maximum time to read a whole request, including uploaded content. 0 means no limit.")
+	writeTimeout      = flag.Duration("write-timeout", 0, "Maximum time to write a response, including downloaded content. 0 means no limit.")
+	idleTimeout       = flag.Duration("idle-timeout", 2*time.Minute, "How long idle keep-alive connections are kept open. 0 means no limit.")
+)
+
+// Build info, set at build time with
+// -ldflags "-X main.version=... -X main.commit=... -X main.buildDate=...".
+var (
+	version   = "dev"
+	commit    = ""
+	buildDate = ""
 )
 
 func main() {
@@ -31,30 +51,181 @@ func main() {
 		os.Exit(-1)
 	}
 
+	flag.Usage = usage
 	flag.Parse()
+	if err := loadConfig(); err != nil {
+		fmt.Fprintf(os.Stderr, "Can't read config: %v\n", err)
+		os.Exit(-1)
+	}
+
+	gdrive.Build = gdrive.BuildInfo{
+		Version:   version,
+		Commit:    commit,
+		Date:      buildDate,
+		GoVersion: runtime.Version(),
+	}
+	if *showVersion {
+		printVersion()
+		return
+	}
+
+	args := flag.Args()
+	if len(args) == 0 {
+		args = []string{"serve"}
+	}
+	switch cmd, args := args[0], args[1:]; cmd {
+	case "serve":
+		fs := newFS()
+		if err := gdrive.Check(context.Background(), fs); err != nil {
+			log.Errorf("Can't access Drive: %v", err)
+			os.Exit(-1)
+		}
+		serve(fs)
+	case "setup":
+		if err := setup(); err != nil {
+			fmt.Fprintf(os.Stderr, "setup: %v\n", err)
+			os.Exit(1)
+		}
+	case "auth":
+		checkClientFlags()
+		if err := gdrive.Authorize(context.Background(), *clientID, *clientSecret); err != nil {
+			log.Errorf("Error authorizing: %v", err)
+			os.Exit(-1)
+		}
+	case "ls", "get", "put":
+		if err := runFileCommand(newFS(), cmd, args); err != nil {
+			fmt.Fprintf(os.Stderr, "%v: %v\n", cmd, err)
+			os.Exit(1)
+		}
+	case "sync":
+		if len(args) < 1 || len(args) > 2 {
+			usage()
+		}
+		remote := "/"
+		if len(args) == 2 {
+			remote = args[1]
+		}
+		if err := gdrive.Sync(context.Background(), newFS(), args[0], remote); err != nil {
+			log.Errorf("Error syncing %v: %v", args[0], err)
+			os.Exit(-1)
+		}
+	case "reconcile":
+		if err := gdrive.Reconcile(context.Background(), newFS()); err != nil {
+			log.Errorf("Error reconciling mirror: %v", err)
+			os.Exit(-1)
+		}
+	case "mount":
+		if len(args) != 1 {
+			usage()
+		}
+		if err := mount(newFS(), args[0]); err != nil {
+			log.Errorf("Error mounting %v: %v", args[0], err)
+			os.Exit(-1)
+		}
+	case "version":
+		printVersion()
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command %q\n", cmd)
+		usage()
+	}
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, `usage: gdrive-webdav [flags] [command]
+
+commands:
+  serve                     serve WebDAV (default)
+  setup                     set up credentials and options interactively
+  auth                      authorize access to Drive, or refresh the saved token
+  ls [path]                 list a folder
+  get <path> [local|-]      download a file
+  put <local|-> <path>      upload a file
+  mount <dir>               mount the drive with FUSE
+  sync <dir> [path]         keep a local folder in sync with a folder of the drive
+  reconcile                 make the mirror of --mirror-token-file match the drive
+  version                   print the version and build info
+
+flags:`)
+	flag.PrintDefaults()
+	os.Exit(2)
+}
+
+func printVersion() {
+	b := gdrive.Build
+	fmt.Printf("gdrive-webdav %v", b.Version)
+	if b.Commit != "" {
+		fmt.Printf(" (%v)", b.Commit)
+	}
+	if b.Date != "" {
+		fmt.Printf(", built %v", b.Date)
+	}
+	fmt.Printf(" with %v\n", b.GoVersion)
+}
 
+func newFS() webdav.FileSystem {
+	switch {
+	case *fakeDrive || *backend == "fake":
+		return gdrive.NewFakeFS(context.Background())
+	case *backend == "local":
+		if *localRoot == "" {
+			fmt.Fprintln(os.Stderr, "--backend=local requires --local-root.")
+			os.Exit(-1)
+		}
+		return gdrive.NewLocalFS(context.Background(), *localRoot)
+	case *backend != "drive":
+		fmt.Fprintf(os.Stderr, "unknown backend %q\n", *backend)
+		os.Exit(-1)
+	}
+
+	checkClientFlags()
+	return gdrive.NewFS(context.Background(), *clientID, *clientSecret)
+}
+
+func checkClientFlags() {
 	if *clientID == "" {
-		fmt.Fprintln(os.Stderr, "--client-id is not specified. See https://developers.google.com/drive/quickstart-go for step-by-step guide.")
+		fmt.Fprintln(os.Stderr, "--client-id is not specified. Run \"gdrive-webdav setup\" to set up the credentials, or see https://developers.google.com/drive/quickstart-go for step-by-step guide.")
 		os.Exit(-1)
 	}
 
 	if *clientSecret == "" {
-		fmt.Fprintln(os.Stderr, "--client-secret is not specified. See https://developers.google.com/drive/quickstart-go for step-by-step guide.")
+		fmt.Fprintln(os.Stderr, "--client-secret is not specified. Run \"gdrive-webdav setup\" to set up the credentials, or see https://developers.google.com/drive/quickstart-go for step-by-step guide.")
 		os.Exit(-1)
 	}
+}
 
-	handler := &webdav.Handler{
-		FileSystem: gdrive.NewFS(context.Background(), *clientID, *clientSecret),
-		LockSystem: gdrive.NewLS(),
-	}
+func serve(fs webdav.FileSystem) {
+	handler := gdrive.NewHandler(fs, gdrive.NewLS(fs))
 
 	http.HandleFunc("/debug/gc", gcHandler)
 	http.HandleFunc("/favicon.ico", notFoundHandler)
-	http.HandleFunc("/", handler.ServeHTTP)
+	if admin := gdrive.NewAdminHandler(fs); admin != nil {
+		http.Handle("/admin/", admin)
+	}
+	if events := gdrive.NewEventsHandler(fs); events != nil {
+		http.Handle("/events", events)
+	}
+	http.Handle("/", handler)
+
+	if err := sftpfs.Start(fs); err != nil {
+		log.Errorf("Error starting SFTP server: %v", err)
+		os.Exit(-1)
+	}
+	if err := s3gw.Start(fs); err != nil {
+		log.Errorf("Error starting S3 server: %v", err)
+		os.Exit(-1)
+	}
 
 	log.Info("Listening on: ", *addr)
 
-	err = http.ListenAndServe(*addr, nil)
+	server := &http.Server{
+		Addr:              *addr,
+		Handler:           gdrive.Recover(http.DefaultServeMux),
+		ReadHeaderTimeout: *readHeaderTimeout,
+		ReadTimeout:       *readTimeout,
+		WriteTimeout:      *writeTimeout,
+		IdleTimeout:       *idleTimeout,
+	}
+	err := server.ListenAndServe()
 	if err != nil {
 		log.Errorf("Error starting HTTP server: %v", err)
 		os.Exit(-1)
@@ -0,0 +1,13 @@
+//go:build linux || darwin || freebsd
+// +build linux darwin freebsd
+
+package main
+
+import (
+	"./fusefs"
+	"golang.org/x/net/webdav"
+)
+
+func mount(fs webdav.FileSystem, dir string) error {
+	return fusefs.Mount(fs, dir)
+}
@@ -0,0 +1,14 @@
+//go:build !linux && !darwin && !freebsd
+// +build !linux,!darwin,!freebsd
+
+package main
+
+import (
+	"errors"
+
+	"golang.org/x/net/webdav"
+)
+
+func mount(fs webdav.FileSystem, dir string) error {
+	return errors.New("mount is not supported on this platform")
+}
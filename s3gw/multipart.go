@@ -0,0 +1,212 @@
+package s3gw
+
+import (
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+
+	log "github.com/cihub/seelog"
+)
+
+// uploads keeps the parts of multipart uploads in temporary files until
+// they are completed. The file system then sends the whole content to Drive
+// with a resumable upload.
+type uploads struct {
+	mu      sync.Mutex
+	uploads map[string]*upload
+}
+
+type upload struct {
+	key   string
+	parts map[int]*part
+}
+
+type part struct {
+	file string
+	etag string
+}
+
+func newUploads() *uploads {
+	return &uploads{uploads: make(map[string]*upload)}
+}
+
+func (u *uploads) get(id string, key string) *upload {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	up := u.uploads[id]
+	if up == nil || up.key != key {
+		return nil
+	}
+	return up
+}
+
+// remove forgets an upload and deletes its parts.
+func (u *uploads) remove(id string) {
+	u.mu.Lock()
+	up := u.uploads[id]
+	delete(u.uploads, id)
+	u.mu.Unlock()
+	if up == nil {
+		return
+	}
+	for _, p := range up.parts {
+		os.Remove(p.file)
+	}
+}
+
+type initiateMultipartUploadResult struct {
+	XMLName  xml.Name `xml:"InitiateMultipartUploadResult"`
+	Xmlns    string   `xml:"xmlns,attr"`
+	Bucket   string
+	Key      string
+	UploadID string `xml:"UploadId"`
+}
+
+func (s *server) createMultipartUpload(w http.ResponseWriter, r *http.Request, key string) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		writeFSError(w, r, err)
+		return
+	}
+	id := hex.EncodeToString(b)
+
+	s.uploads.mu.Lock()
+	s.uploads.uploads[id] = &upload{key: key, parts: make(map[int]*part)}
+	s.uploads.mu.Unlock()
+
+	writeXML(w, &initiateMultipartUploadResult{Xmlns: s3Namespace, Bucket: *bucketFlag, Key: key, UploadID: id})
+}
+
+func (s *server) uploadPart(w http.ResponseWriter, r *http.Request, key string) {
+	id := r.URL.Query().Get("uploadId")
+	up := s.uploads.get(id, key)
+	if up == nil {
+		writeError(w, r, http.StatusNotFound, "NoSuchUpload", "")
+		return
+	}
+	number, err := strconv.Atoi(r.URL.Query().Get("partNumber"))
+	if err != nil || number < 1 || number > 10000 {
+		writeError(w, r, http.StatusBadRequest, "InvalidArgument", "bad partNumber")
+		return
+	}
+
+	body, err := requestBody(r)
+	if err != nil {
+		writeBodyError(w, r, err)
+		return
+	}
+	defer body.Close()
+	f, err := ioutil.TempFile("", "s3part")
+	if err != nil {
+		writeFSError(w, r, err)
+		return
+	}
+	h := md5.New()
+	_, err = io.Copy(io.MultiWriter(f, h), body)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		writeError(w, r, http.StatusBadRequest, "IncompleteBody", err.Error())
+		return
+	}
+
+	p := &part{file: f.Name(), etag: fmt.Sprintf(`"%x"`, h.Sum(nil))}
+	s.uploads.mu.Lock()
+	if old := up.parts[number]; old != nil {
+		os.Remove(old.file)
+	}
+	up.parts[number] = p
+	s.uploads.mu.Unlock()
+
+	w.Header().Set("ETag", p.etag)
+	w.WriteHeader(http.StatusOK)
+}
+
+type completeMultipartUpload struct {
+	Parts []struct {
+		PartNumber int
+		ETag       string
+	} `xml:"Part"`
+}
+
+type completeMultipartUploadResult struct {
+	XMLName xml.Name `xml:"CompleteMultipartUploadResult"`
+	Xmlns   string   `xml:"xmlns,attr"`
+	Bucket  string
+	Key     string
+	ETag    string
+}
+
+func (s *server) completeMultipartUpload(w http.ResponseWriter, r *http.Request, key string) {
+	id := r.URL.Query().Get("uploadId")
+	up := s.uploads.get(id, key)
+	if up == nil {
+		writeError(w, r, http.StatusNotFound, "NoSuchUpload", "")
+		return
+	}
+
+	// Read whole, so that the payload hash is checked.
+	data, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		writeBodyError(w, r, err)
+		return
+	}
+	var req completeMultipartUpload
+	if err := xml.Unmarshal(data, &req); err != nil || len(req.Parts) == 0 {
+		writeError(w, r, http.StatusBadRequest, "MalformedXML", "")
+		return
+	}
+	sort.Slice(req.Parts, func(i, j int) bool { return req.Parts[i].PartNumber < req.Parts[j].PartNumber })
+
+	s.uploads.mu.Lock()
+	files := []string{}
+	for _, rp := range req.Parts {
+		p := up.parts[rp.PartNumber]
+		if p == nil || p.etag != rp.ETag && `"`+rp.ETag+`"` != p.etag {
+			s.uploads.mu.Unlock()
+			writeError(w, r, http.StatusBadRequest, "InvalidPart", fmt.Sprintf("part %v", rp.PartNumber))
+			return
+		}
+		files = append(files, p.file)
+	}
+	s.uploads.mu.Unlock()
+
+	readers := []io.Reader{}
+	for _, name := range files {
+		f, err := os.Open(name)
+		if err != nil {
+			writeFSError(w, r, err)
+			return
+		}
+		defer f.Close()
+		readers = append(readers, f)
+	}
+	if err := s.write(r.Context(), key, io.MultiReader(readers...)); err != nil {
+		writeFSError(w, r, err)
+		return
+	}
+	s.uploads.remove(id)
+	log.Infof("S3 multipart upload of %v completed from %v parts", key, len(files))
+
+	result := &completeMultipartUploadResult{Xmlns: s3Namespace, Bucket: *bucketFlag, Key: key}
+	if fi, err := s.fs.Stat(r.Context(), "/"+key); err == nil {
+		result.ETag = etag(r.Context(), fi)
+	}
+	writeXML(w, result)
+}
+
+func (s *server) abortMultipartUpload(w http.ResponseWriter, r *http.Request) {
+	s.uploads.remove(r.URL.Query().Get("uploadId"))
+	w.WriteHeader(http.StatusNoContent)
+}
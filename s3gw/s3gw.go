@@ -0,0 +1,470 @@
+// Package s3gw serves a webdav.FileSystem through a minimal S3 API: one
+// bucket holding the whole tree, with objects listed, read, written and
+// deleted by path.
+package s3gw
+
+import (
+	"encoding/xml"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/cihub/seelog"
+	"golang.org/x/net/context"
+	"golang.org/x/net/webdav"
+)
+
+const (
+	s3Namespace = "http://s3.amazonaws.com/doc/2006-03-01/"
+	timeFormat  = "2006-01-02T15:04:05.000Z"
+)
+
+var (
+	addrFlag      = flag.String("s3-addr", "", "Also serve the drive through an S3 compatible API at this address, e.g. :9000.")
+	bucketFlag    = flag.String("s3-bucket", "drive", "Name of the S3 bucket holding the drive.")
+	accessKeyFlag = flag.String("s3-access-key", "", "Access key ID S3 clients sign requests with.")
+	secretKeyFlag = flag.String("s3-secret-key", "", "Secret access key S3 clients sign requests with.")
+)
+
+type server struct {
+	fs      webdav.FileSystem
+	uploads *uploads
+}
+
+// Start serves fs through the S3 API in the background if --s3-addr is given.
+func Start(fs webdav.FileSystem) error {
+	if *addrFlag == "" {
+		return nil
+	}
+	if *accessKeyFlag == "" || *secretKeyFlag == "" {
+		return errors.New("--s3-addr requires --s3-access-key and --s3-secret-key")
+	}
+
+	s := &server{fs: fs, uploads: newUploads()}
+	l := &http.Server{Addr: *addrFlag, Handler: s}
+	log.Info("Serving S3 on: ", *addrFlag)
+	go func() {
+		if err := l.ListenAndServe(); err != nil {
+			log.Errorf("S3 server failed: %v", err)
+		}
+	}()
+	return nil
+}
+
+func (s *server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	log.Debugf("S3 %v %v", r.Method, r.URL)
+	if err := verifySignature(r, *accessKeyFlag, *secretKeyFlag); err != nil {
+		log.Debugf("S3 request rejected: %v", err)
+		writeError(w, r, http.StatusForbidden, "SignatureDoesNotMatch", err.Error())
+		return
+	}
+
+	bucket, key := splitPath(r.URL.Path)
+	if bucket == "" {
+		if r.Method != "GET" {
+			writeError(w, r, http.StatusMethodNotAllowed, "MethodNotAllowed", "")
+			return
+		}
+		s.listBuckets(w, r)
+		return
+	}
+	if bucket != *bucketFlag {
+		writeError(w, r, http.StatusNotFound, "NoSuchBucket", "")
+		return
+	}
+
+	q := r.URL.Query()
+	_, initiate := q["uploads"]
+	switch {
+	case key == "" && r.Method == "GET":
+		s.listObjects(w, r)
+	case key == "" && r.Method == "HEAD":
+		w.WriteHeader(http.StatusOK)
+	case key == "":
+		writeError(w, r, http.StatusNotImplemented, "NotImplemented", "")
+	case r.Method == "POST" && initiate:
+		s.createMultipartUpload(w, r, key)
+	case r.Method == "PUT" && q.Get("uploadId") != "":
+		s.uploadPart(w, r, key)
+	case r.Method == "POST" && q.Get("uploadId") != "":
+		s.completeMultipartUpload(w, r, key)
+	case r.Method == "DELETE" && q.Get("uploadId") != "":
+		s.abortMultipartUpload(w, r)
+	case r.Method == "GET" || r.Method == "HEAD":
+		s.getObject(w, r, key)
+	case r.Method == "PUT" && r.Header.Get("X-Amz-Copy-Source") != "":
+		writeError(w, r, http.StatusNotImplemented, "NotImplemented", "copying objects is not supported")
+	case r.Method == "PUT":
+		s.putObject(w, r, key)
+	case r.Method == "DELETE":
+		s.deleteObject(w, r, key)
+	default:
+		writeError(w, r, http.StatusNotImplemented, "NotImplemented", "")
+	}
+}
+
+// splitPath splits a path-style request path into bucket and key.
+func splitPath(p string) (string, string) {
+	p = strings.TrimPrefix(p, "/")
+	parts := strings.SplitN(p, "/", 2)
+	if len(parts) == 1 {
+		return parts[0], ""
+	}
+	return parts[0], parts[1]
+}
+
+type s3Error struct {
+	XMLName  xml.Name `xml:"Error"`
+	Code     string
+	Message  string
+	Resource string
+}
+
+func writeError(w http.ResponseWriter, r *http.Request, status int, code string, message string) {
+	if message == "" {
+		message = http.StatusText(status)
+	}
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	if r.Method == "HEAD" {
+		return
+	}
+	io.WriteString(w, xml.Header)
+	xml.NewEncoder(w).Encode(&s3Error{Code: code, Message: message, Resource: r.URL.Path})
+}
+
+// writeBodyError answers a request whose body can't be read or fails its
+// payload check.
+func writeBodyError(w http.ResponseWriter, r *http.Request, err error) {
+	if err == errContentSHA256Mismatch {
+		writeError(w, r, http.StatusBadRequest, "XAmzContentSHA256Mismatch", err.Error())
+		return
+	}
+	writeError(w, r, http.StatusBadRequest, "IncompleteBody", err.Error())
+}
+
+// writeFSError answers a request which failed with a file system error.
+func writeFSError(w http.ResponseWriter, r *http.Request, err error) {
+	switch {
+	case os.IsNotExist(err):
+		writeError(w, r, http.StatusNotFound, "NoSuchKey", "")
+	case os.IsPermission(err):
+		writeError(w, r, http.StatusForbidden, "AccessDenied", "")
+	default:
+		log.Errorf("S3 %v %v: %v", r.Method, r.URL.Path, err)
+		writeError(w, r, http.StatusInternalServerError, "InternalError", err.Error())
+	}
+}
+
+func writeXML(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/xml")
+	io.WriteString(w, xml.Header)
+	xml.NewEncoder(w).Encode(v)
+}
+
+type listAllMyBucketsResult struct {
+	XMLName xml.Name `xml:"ListAllMyBucketsResult"`
+	Xmlns   string   `xml:"xmlns,attr"`
+	Owner   struct {
+		ID          string
+		DisplayName string
+	}
+	Buckets []bucket `xml:"Buckets>Bucket"`
+}
+
+type bucket struct {
+	Name         string
+	CreationDate string
+}
+
+func (s *server) listBuckets(w http.ResponseWriter, r *http.Request) {
+	result := &listAllMyBucketsResult{Xmlns: s3Namespace}
+	result.Owner.ID = "gdrive-webdav"
+	result.Owner.DisplayName = "gdrive-webdav"
+	result.Buckets = []bucket{{Name: *bucketFlag, CreationDate: time.Unix(0, 0).UTC().Format(timeFormat)}}
+	writeXML(w, result)
+}
+
+type listBucketResult struct {
+	XMLName               xml.Name `xml:"ListBucketResult"`
+	Xmlns                 string   `xml:"xmlns,attr"`
+	Name                  string
+	Prefix                string
+	Delimiter             string `xml:",omitempty"`
+	MaxKeys               int
+	IsTruncated           bool
+	Marker                string   `xml:",omitempty"`
+	NextMarker            string   `xml:",omitempty"`
+	KeyCount              int      `xml:",omitempty"`
+	ContinuationToken     string   `xml:",omitempty"`
+	NextContinuationToken string   `xml:",omitempty"`
+	StartAfter            string   `xml:",omitempty"`
+	Contents              []object `xml:"Contents"`
+	CommonPrefixes        []prefix `xml:"CommonPrefixes"`
+}
+
+type object struct {
+	Key          string
+	LastModified string
+	ETag         string
+	Size         int64
+	StorageClass string
+}
+
+type prefix struct {
+	Prefix string
+}
+
+// listObjects answers ListObjects and ListObjectsV2 requests.
+func (s *server) listObjects(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	v2 := q.Get("list-type") == "2"
+	pfx := q.Get("prefix")
+	delimiter := q.Get("delimiter")
+	if delimiter != "" && delimiter != "/" {
+		writeError(w, r, http.StatusNotImplemented, "NotImplemented", "only / is supported as delimiter")
+		return
+	}
+	maxKeys := 1000
+	if m, err := strconv.Atoi(q.Get("max-keys")); err == nil && m >= 0 && m < maxKeys {
+		maxKeys = m
+	}
+	after := q.Get("marker")
+	if v2 {
+		after = q.Get("start-after")
+		if token := q.Get("continuation-token"); token != "" {
+			after = token
+		}
+	}
+
+	entries, err := s.walk(r.Context(), pfx, delimiter != "")
+	if err != nil {
+		writeFSError(w, r, err)
+		return
+	}
+
+	result := &listBucketResult{
+		Xmlns:     s3Namespace,
+		Name:      *bucketFlag,
+		Prefix:    pfx,
+		Delimiter: delimiter,
+		MaxKeys:   maxKeys,
+	}
+	if v2 {
+		result.ContinuationToken = q.Get("continuation-token")
+		result.StartAfter = q.Get("start-after")
+	} else {
+		result.Marker = q.Get("marker")
+	}
+
+	last := ""
+	for _, e := range entries {
+		if e.key <= after {
+			continue
+		}
+		if len(result.Contents)+len(result.CommonPrefixes) == maxKeys {
+			result.IsTruncated = true
+			break
+		}
+		last = e.key
+		if e.info.IsDir() {
+			result.CommonPrefixes = append(result.CommonPrefixes, prefix{Prefix: e.key})
+			continue
+		}
+		result.Contents = append(result.Contents, object{
+			Key:          e.key,
+			LastModified: e.info.ModTime().UTC().Format(timeFormat),
+			ETag:         etag(r.Context(), e.info),
+			Size:         e.info.Size(),
+			StorageClass: "STANDARD",
+		})
+	}
+	if result.IsTruncated {
+		result.NextMarker = last
+		if v2 {
+			result.NextContinuationToken = last
+		}
+	}
+	result.KeyCount = len(result.Contents) + len(result.CommonPrefixes)
+	writeXML(w, result)
+}
+
+type entry struct {
+	key  string
+	info os.FileInfo
+}
+
+// walk returns the objects with keys starting with pfx sorted by key. If
+// delimited, only the folder the prefix ends in is listed and its folders
+// are returned with keys ending in a slash.
+func (s *server) walk(ctx context.Context, pfx string, delimited bool) ([]entry, error) {
+	dir := ""
+	if i := strings.LastIndex(pfx, "/"); i >= 0 {
+		dir = pfx[:i]
+	}
+
+	entries := []entry{}
+	var visit func(dir string) error
+	visit = func(dir string) error {
+		f, err := s.fs.OpenFile(ctx, "/"+dir, os.O_RDONLY, 0)
+		if err != nil {
+			return err
+		}
+		infos, err := f.Readdir(-1)
+		f.Close()
+		if err != nil {
+			return err
+		}
+		for _, fi := range infos {
+			key := strings.TrimPrefix(path.Join(dir, fi.Name()), "/")
+			if fi.IsDir() {
+				key += "/"
+				if !strings.HasPrefix(key, pfx) && !strings.HasPrefix(pfx, key) {
+					continue
+				}
+				if delimited {
+					if strings.HasPrefix(key, pfx) {
+						entries = append(entries, entry{key: key, info: fi})
+					}
+					continue
+				}
+				if err := visit(strings.TrimSuffix(key, "/")); err != nil {
+					return err
+				}
+				continue
+			}
+			if strings.HasPrefix(key, pfx) {
+				entries = append(entries, entry{key: key, info: fi})
+			}
+		}
+		return nil
+	}
+
+	if err := visit(dir); err != nil {
+		if os.IsNotExist(err) {
+			return entries, nil
+		}
+		return nil, err
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].key < entries[j].key })
+	return entries, nil
+}
+
+// etag returns the entity tag of a file, as webdav.Handler computes it.
+func etag(ctx context.Context, fi os.FileInfo) string {
+	if e, ok := fi.(webdav.ETager); ok {
+		if tag, err := e.ETag(ctx); err == nil {
+			return tag
+		}
+	}
+	return fmt.Sprintf(`"%x%x"`, fi.ModTime().UnixNano(), fi.Size())
+}
+
+func (s *server) getObject(w http.ResponseWriter, r *http.Request, key string) {
+	ctx := r.Context()
+	fi, err := s.fs.Stat(ctx, "/"+key)
+	if err != nil {
+		writeFSError(w, r, err)
+		return
+	}
+	if fi.IsDir() {
+		writeError(w, r, http.StatusNotFound, "NoSuchKey", "")
+		return
+	}
+	f, err := s.fs.OpenFile(ctx, "/"+key, os.O_RDONLY, 0)
+	if err != nil {
+		writeFSError(w, r, err)
+		return
+	}
+	defer f.Close()
+
+	w.Header().Set("ETag", etag(ctx, fi))
+	if ct, ok := fi.(webdav.ContentTyper); ok {
+		if t, err := ct.ContentType(ctx); err == nil {
+			w.Header().Set("Content-Type", t)
+		}
+	}
+	http.ServeContent(w, r, path.Base(key), fi.ModTime(), f)
+}
+
+func (s *server) putObject(w http.ResponseWriter, r *http.Request, key string) {
+	if strings.HasSuffix(key, "/") {
+		// Folder marker objects.
+		if err := s.mkdirAll(r.Context(), key); err != nil {
+			writeFSError(w, r, err)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	body, err := requestBody(r)
+	if err != nil {
+		writeBodyError(w, r, err)
+		return
+	}
+	defer body.Close()
+	if err := s.write(r.Context(), key, body); err != nil {
+		writeFSError(w, r, err)
+		return
+	}
+	if fi, err := s.fs.Stat(r.Context(), "/"+key); err == nil {
+		w.Header().Set("ETag", etag(r.Context(), fi))
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// write replaces the content of key with the content read from r, creating
+// the folders above it as needed.
+func (s *server) write(ctx context.Context, key string, r io.Reader) error {
+	if err := s.mkdirAll(ctx, path.Dir(key)); err != nil {
+		return err
+	}
+	f, err := s.fs.OpenFile(ctx, "/"+key, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func (s *server) mkdirAll(ctx context.Context, dir string) error {
+	dir = strings.Trim(dir, "/")
+	if dir == "" || dir == "." {
+		return nil
+	}
+	if fi, err := s.fs.Stat(ctx, "/"+dir); err == nil {
+		if !fi.IsDir() {
+			return os.ErrExist
+		}
+		return nil
+	}
+	if err := s.mkdirAll(ctx, path.Dir(dir)); err != nil {
+		return err
+	}
+	err := s.fs.Mkdir(ctx, "/"+dir, 0755)
+	if os.IsExist(err) {
+		return nil
+	}
+	return err
+}
+
+func (s *server) deleteObject(w http.ResponseWriter, r *http.Request, key string) {
+	err := s.fs.RemoveAll(r.Context(), "/"+strings.TrimSuffix(key, "/"))
+	if err != nil && !os.IsNotExist(err) {
+		writeFSError(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,306 @@
+package s3gw
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	sigV4Algorithm   = "AWS4-HMAC-SHA256"
+	streamingPayload = "STREAMING-AWS4-HMAC-SHA256-PAYLOAD"
+	unsignedPayload  = "UNSIGNED-PAYLOAD"
+	amzDateFormat    = "20060102T150405Z"
+
+	// maxClockSkew is how far the time a request was signed at may be from
+	// the time of the server, as with S3.
+	maxClockSkew = 15 * time.Minute
+	// maxChunkSize bounds the chunks of streaming uploads, which are held in
+	// memory until their signature is checked.
+	maxChunkSize = 64 << 20
+
+	emptySHA256 = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+)
+
+var errContentSHA256Mismatch = errors.New("content doesn't match X-Amz-Content-Sha256")
+
+// verifySignature checks the AWS Signature Version 4 of a request signed in
+// its Authorization header, and that it was signed recently. The body of r
+// is replaced by one checking the content against the payload hash, or
+// decoding the aws-chunked encoding of streaming uploads and checking the
+// signature of each chunk. Those fail when they reach a mismatch.
+func verifySignature(r *http.Request, accessKey, secretKey string) error {
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, sigV4Algorithm+" ") {
+		return errors.New("request is not signed with " + sigV4Algorithm)
+	}
+
+	fields := make(map[string]string)
+	for _, f := range strings.Split(strings.TrimPrefix(auth, sigV4Algorithm+" "), ",") {
+		kv := strings.SplitN(strings.TrimSpace(f), "=", 2)
+		if len(kv) == 2 {
+			fields[kv[0]] = kv[1]
+		}
+	}
+	credential := strings.SplitN(fields["Credential"], "/", 2)
+	if len(credential) != 2 || credential[0] != accessKey {
+		return errors.New("unknown access key")
+	}
+	scope := credential[1]
+	scopeParts := strings.Split(scope, "/")
+	if len(scopeParts) != 4 {
+		return errors.New("bad credential scope")
+	}
+
+	date := r.Header.Get("X-Amz-Date")
+	if date == "" {
+		return errors.New("missing X-Amz-Date")
+	}
+	signed, err := time.Parse(amzDateFormat, date)
+	if err != nil {
+		return errors.New("bad X-Amz-Date")
+	}
+	if skew := time.Since(signed); skew > maxClockSkew || skew < -maxClockSkew {
+		return errors.New("request time too skewed")
+	}
+	payloadHash := r.Header.Get("X-Amz-Content-Sha256")
+	if payloadHash == "" {
+		payloadHash = unsignedPayload
+	}
+	if payloadHash != unsignedPayload && payloadHash != streamingPayload {
+		if b, err := hex.DecodeString(payloadHash); err != nil || len(b) != sha256.Size {
+			return errors.New("bad X-Amz-Content-Sha256")
+		}
+	}
+
+	signedHeaders := strings.Split(fields["SignedHeaders"], ";")
+	var canonicalHeaders strings.Builder
+	for _, name := range signedHeaders {
+		value := r.Header.Get(name)
+		if name == "host" {
+			value = r.Host
+		}
+		if name == "content-length" && value == "" {
+			value = strconv.FormatInt(r.ContentLength, 10)
+		}
+		fmt.Fprintf(&canonicalHeaders, "%s:%s\n", name, strings.Join(strings.Fields(value), " "))
+	}
+
+	canonicalRequest := strings.Join([]string{
+		r.Method,
+		uriEncode(r.URL.Path, false),
+		canonicalQuery(r),
+		canonicalHeaders.String(),
+		fields["SignedHeaders"],
+		payloadHash,
+	}, "\n")
+	stringToSign := strings.Join([]string{sigV4Algorithm, date, scope, hexSHA256(canonicalRequest)}, "\n")
+
+	key := []byte("AWS4" + secretKey)
+	for _, part := range scopeParts {
+		key = hmacSHA256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+	if !hmac.Equal([]byte(signature), []byte(fields["Signature"])) {
+		return errors.New("signature mismatch")
+	}
+
+	switch payloadHash {
+	case unsignedPayload:
+	case streamingPayload:
+		r.Body = &chunkedReader{
+			body:      r.Body,
+			r:         bufio.NewReader(r.Body),
+			key:       key,
+			date:      date,
+			scope:     scope,
+			signature: signature,
+		}
+	default:
+		r.Body = &hashedBody{ReadCloser: r.Body, h: sha256.New(), want: strings.ToLower(payloadHash)}
+	}
+	return nil
+}
+
+// hashedBody fails at the end of the content if it doesn't have the
+// SHA-256 hash wanted.
+type hashedBody struct {
+	io.ReadCloser
+	h    hash.Hash
+	want string
+}
+
+func (b *hashedBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.h.Write(p[:n])
+	if err == io.EOF && hex.EncodeToString(b.h.Sum(nil)) != b.want {
+		return n, errContentSHA256Mismatch
+	}
+	return n, err
+}
+
+func canonicalQuery(r *http.Request) string {
+	q := r.URL.Query()
+	keys := make([]string, 0, len(q))
+	for k := range q {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	params := []string{}
+	for _, k := range keys {
+		values := q[k]
+		sort.Strings(values)
+		for _, v := range values {
+			params = append(params, uriEncode(k, true)+"="+uriEncode(v, true))
+		}
+	}
+	return strings.Join(params, "&")
+}
+
+// uriEncode escapes s as AWS does when signing: everything but unreserved
+// characters, and slashes unless encodeSlash.
+func uriEncode(s string, encodeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~':
+			b.WriteByte(c)
+		case c == '/' && !encodeSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+func hexSHA256(data string) string {
+	sum := sha256.Sum256([]byte(data))
+	return hex.EncodeToString(sum[:])
+}
+
+// requestBody returns the content of a request, as checked by the body
+// verifySignature set. It's read whole into a temporary file first, so that
+// nothing of a body failing the check is written. The file is removed when
+// the body is closed.
+func requestBody(r *http.Request) (io.ReadCloser, error) {
+	f, err := ioutil.TempFile("", "s3body")
+	if err != nil {
+		return nil, err
+	}
+	body := &spooledBody{File: f}
+	if _, err := io.Copy(f, r.Body); err != nil {
+		body.Close()
+		return nil, err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		body.Close()
+		return nil, err
+	}
+	return body, nil
+}
+
+type spooledBody struct {
+	*os.File
+}
+
+func (b *spooledBody) Close() error {
+	err := b.File.Close()
+	os.Remove(b.File.Name())
+	return err
+}
+
+// chunkedReader decodes the aws-chunked encoding of a streaming upload. The
+// signature of each chunk chains to that of the previous one, starting with
+// the signature of the request.
+type chunkedReader struct {
+	body      io.Closer
+	r         *bufio.Reader
+	key       []byte
+	date      string
+	scope     string
+	signature string
+
+	chunk []byte
+	done  bool
+}
+
+func (c *chunkedReader) Read(p []byte) (int, error) {
+	for len(c.chunk) == 0 {
+		if c.done {
+			return 0, io.EOF
+		}
+		if err := c.nextChunk(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, c.chunk)
+	c.chunk = c.chunk[n:]
+	return n, nil
+}
+
+func (c *chunkedReader) Close() error {
+	return c.body.Close()
+}
+
+// nextChunk reads a chunk, "<hex size>;chunk-signature=<sig>\r\n<data>\r\n",
+// and checks its signature.
+func (c *chunkedReader) nextChunk() error {
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		return io.ErrUnexpectedEOF
+	}
+	parts := strings.SplitN(strings.TrimSpace(line), ";", 2)
+	n, err := strconv.ParseInt(parts[0], 16, 64)
+	if err != nil || n < 0 || n > maxChunkSize || len(parts) != 2 || !strings.HasPrefix(parts[1], "chunk-signature=") {
+		return fmt.Errorf("bad chunk header %q", line)
+	}
+	data := make([]byte, n)
+	if _, err := io.ReadFull(c.r, data); err != nil {
+		return io.ErrUnexpectedEOF
+	}
+	if n > 0 {
+		if err := c.readCRLF(); err != nil {
+			return err
+		}
+	}
+
+	stringToSign := strings.Join([]string{sigV4Algorithm + "-PAYLOAD", c.date, c.scope, c.signature, emptySHA256, hexSHA256(string(data))}, "\n")
+	signature := hex.EncodeToString(hmacSHA256(c.key, stringToSign))
+	if !hmac.Equal([]byte(signature), []byte(strings.TrimPrefix(parts[1], "chunk-signature="))) {
+		return errors.New("chunk signature mismatch")
+	}
+	c.signature = signature
+	c.chunk = data
+	c.done = n == 0
+	return nil
+}
+
+func (c *chunkedReader) readCRLF() error {
+	b := make([]byte, 2)
+	if _, err := io.ReadFull(c.r, b); err != nil || string(b) != "\r\n" {
+		return errors.New("bad chunk trailer")
+	}
+	return nil
+}
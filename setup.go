@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"./gdrive"
+	"golang.org/x/net/context"
+)
+
+// setup asks for the client credentials and the main options, authorizes
+// access to Drive and saves the answers to the config file.
+func setup() error {
+	in := bufio.NewReader(os.Stdin)
+	p := configPath()
+	if p == "" {
+		return fmt.Errorf("can't find the home directory, use --config")
+	}
+
+	fmt.Println(`This sets up gdrive-webdav, saving the settings to ` + p + `.
+
+gdrive-webdav needs an OAuth client of a Google Cloud project with the Drive
+API enabled. See https://developers.google.com/drive/quickstart-go to create
+one, choosing the "Desktop app" type.
+`)
+	id, err := ask(in, "Client ID", *clientID)
+	if err != nil {
+		return err
+	}
+	secret, err := ask(in, "Client secret", *clientSecret)
+	if err != nil {
+		return err
+	}
+	if id == "" || secret == "" {
+		return fmt.Errorf("the client ID and secret are required")
+	}
+	appData, err := ask(in, "Serve the application data folder at /.appdata, which needs an additional scope (y/n)", flag.Lookup("app-data").Value.String())
+	if err != nil {
+		return err
+	}
+	appData = fmt.Sprint(strings.HasPrefix(strings.ToLower(appData), "y") || appData == "true")
+	root, err := ask(in, "ID of the folder to serve, empty for the whole drive", flag.Lookup("root-folder-id").Value.String())
+	if err != nil {
+		return err
+	}
+
+	values := map[string]string{
+		"client-id":      id,
+		"client-secret":  secret,
+		"app-data":       appData,
+		"root-folder-id": root,
+	}
+	order := []string{"client-id", "client-secret", "app-data", "root-folder-id"}
+	for _, name := range order {
+		if err := flag.Set(name, values[name]); err != nil {
+			return err
+		}
+	}
+
+	ctx := context.Background()
+	if err := gdrive.Authorize(ctx, id, secret); err != nil {
+		return err
+	}
+	if err := gdrive.Check(ctx, gdrive.NewFS(ctx, id, secret)); err != nil {
+		return err
+	}
+
+	if err := writeConfig(p, values, order); err != nil {
+		return err
+	}
+	fmt.Printf("Saved %v. Run gdrive-webdav to serve the drive at %v.\n", p, *addr)
+	return nil
+}
+
+// ask prompts for a value, returning def if the answer is empty.
+func ask(in *bufio.Reader, prompt string, def string) (string, error) {
+	if def != "" {
+		fmt.Printf("%v [%v]: ", prompt, def)
+	} else {
+		fmt.Printf("%v: ", prompt)
+	}
+	line, err := in.ReadString('\n')
+	if err != nil && line == "" {
+		return "", err
+	}
+	if line = strings.TrimSpace(line); line == "" {
+		return def, nil
+	}
+	return line, nil
+}
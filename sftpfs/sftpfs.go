@@ -0,0 +1,318 @@
+// Package sftpfs serves a webdav.FileSystem over SFTP.
+package sftpfs
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"sync"
+
+	log "github.com/cihub/seelog"
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/net/context"
+	"golang.org/x/net/webdav"
+)
+
+var (
+	addrFlag           = flag.String("sftp-addr", "", "Also serve the drive over SFTP at this address, e.g. :2022.")
+	hostKeyFlag        = flag.String("sftp-host-key", "", "Private key file of the SFTP server.")
+	userFlag           = flag.String("sftp-user", "", "User name SFTP clients log in with.")
+	passwordFlag       = flag.String("sftp-password", "", "Password SFTP clients log in with.")
+	authorizedKeysFlag = flag.String("sftp-authorized-keys", "", "File of public keys SFTP clients may log in with, in authorized_keys format.")
+)
+
+// Start serves fs over SFTP in the background if --sftp-addr is given.
+func Start(fs webdav.FileSystem) error {
+	if *addrFlag == "" {
+		return nil
+	}
+	config, err := serverConfig()
+	if err != nil {
+		return err
+	}
+	l, err := net.Listen("tcp", *addrFlag)
+	if err != nil {
+		return err
+	}
+	log.Info("Serving SFTP on: ", *addrFlag)
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				log.Errorf("SFTP accept failed: %v", err)
+				continue
+			}
+			go serveConn(conn, config, fs)
+		}
+	}()
+	return nil
+}
+
+func serverConfig() (*ssh.ServerConfig, error) {
+	if *hostKeyFlag == "" || *userFlag == "" || (*passwordFlag == "" && *authorizedKeysFlag == "") {
+		return nil, errors.New("--sftp-addr requires --sftp-host-key, --sftp-user and --sftp-password or --sftp-authorized-keys")
+	}
+
+	config := &ssh.ServerConfig{}
+	if *passwordFlag != "" {
+		config.PasswordCallback = func(c ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+			if c.User() == *userFlag && subtle.ConstantTimeCompare(password, []byte(*passwordFlag)) == 1 {
+				return nil, nil
+			}
+			return nil, fmt.Errorf("password rejected for %v", c.User())
+		}
+	}
+	if *authorizedKeysFlag != "" {
+		keys, err := readAuthorizedKeys(*authorizedKeysFlag)
+		if err != nil {
+			return nil, err
+		}
+		config.PublicKeyCallback = func(c ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if c.User() == *userFlag && keys[string(key.Marshal())] {
+				return nil, nil
+			}
+			return nil, fmt.Errorf("key rejected for %v", c.User())
+		}
+	}
+
+	pem, err := ioutil.ReadFile(*hostKeyFlag)
+	if err != nil {
+		return nil, err
+	}
+	signer, err := ssh.ParsePrivateKey(pem)
+	if err != nil {
+		return nil, err
+	}
+	config.AddHostKey(signer)
+	return config, nil
+}
+
+func readAuthorizedKeys(name string) (map[string]bool, error) {
+	data, err := ioutil.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	keys := make(map[string]bool)
+	for len(bytes.TrimSpace(data)) > 0 {
+		key, _, _, rest, err := ssh.ParseAuthorizedKey(data)
+		if err != nil {
+			return nil, err
+		}
+		keys[string(key.Marshal())] = true
+		data = rest
+	}
+	return keys, nil
+}
+
+func serveConn(conn net.Conn, config *ssh.ServerConfig, fs webdav.FileSystem) {
+	sconn, chans, reqs, err := ssh.NewServerConn(conn, config)
+	if err != nil {
+		log.Debugf("SFTP handshake with %v failed: %v", conn.RemoteAddr(), err)
+		conn.Close()
+		return
+	}
+	defer sconn.Close()
+	go ssh.DiscardRequests(reqs)
+
+	for newChannel := range chans {
+		if newChannel.ChannelType() != "session" {
+			newChannel.Reject(ssh.UnknownChannelType, "unknown channel type")
+			continue
+		}
+		channel, requests, err := newChannel.Accept()
+		if err != nil {
+			log.Errorf("SFTP channel not accepted: %v", err)
+			continue
+		}
+		go func(in <-chan *ssh.Request) {
+			for req := range in {
+				// Payload of a subsystem request is the length prefixed name.
+				req.Reply(req.Type == "subsystem" && len(req.Payload) > 4 && string(req.Payload[4:]) == "sftp", nil)
+			}
+		}(requests)
+
+		h := &handlers{fs: fs}
+		server := sftp.NewRequestServer(channel, sftp.Handlers{FileGet: h, FilePut: h, FileCmd: h, FileList: h})
+		if err := server.Serve(); err != nil && err != io.EOF {
+			log.Debugf("SFTP session ended: %v", err)
+		}
+		server.Close()
+	}
+}
+
+type handlers struct {
+	fs webdav.FileSystem
+}
+
+func (h *handlers) ctx(r *sftp.Request) context.Context {
+	if ctx := r.Context(); ctx != nil {
+		return ctx
+	}
+	return context.Background()
+}
+
+func (h *handlers) Fileread(r *sftp.Request) (io.ReaderAt, error) {
+	f, err := h.fs.OpenFile(h.ctx(r), r.Filepath, os.O_RDONLY, 0)
+	if err != nil {
+		return nil, err
+	}
+	return &readerAt{f: f}, nil
+}
+
+// Filewrite opens a file for writing. The file system only takes whole
+// files written in order, while clients send several writes at once, so the
+// content is spooled to a temporary file and replaces the file when closed.
+func (h *handlers) Filewrite(r *sftp.Request) (io.WriterAt, error) {
+	ctx := h.ctx(r)
+	if _, err := h.fs.Stat(ctx, path.Dir(r.Filepath)); err != nil {
+		return nil, err
+	}
+	tmp, err := ioutil.TempFile("", "sftp")
+	if err != nil {
+		return nil, err
+	}
+	return &writerAt{ctx: ctx, fs: h.fs, name: r.Filepath, tmp: tmp}, nil
+}
+
+func (h *handlers) Filecmd(r *sftp.Request) error {
+	ctx := h.ctx(r)
+	switch r.Method {
+	case "Setstat":
+		return nil
+	case "Rename":
+		return h.fs.Rename(ctx, r.Filepath, r.Target)
+	case "Rmdir", "Remove":
+		return h.fs.RemoveAll(ctx, r.Filepath)
+	case "Mkdir":
+		return h.fs.Mkdir(ctx, r.Filepath, 0755)
+	}
+	return sftp.ErrSSHFxOpUnsupported
+}
+
+func (h *handlers) Filelist(r *sftp.Request) (sftp.ListerAt, error) {
+	ctx := h.ctx(r)
+	switch r.Method {
+	case "List":
+		f, err := h.fs.OpenFile(ctx, r.Filepath, os.O_RDONLY, 0)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		infos, err := f.Readdir(-1)
+		if err != nil {
+			return nil, err
+		}
+		return listerAt(infos), nil
+	case "Stat":
+		fi, err := h.fs.Stat(ctx, r.Filepath)
+		if err != nil {
+			return nil, err
+		}
+		return listerAt{namedInfo{fi, path.Base(r.Filepath)}}, nil
+	}
+	return nil, sftp.ErrSSHFxOpUnsupported
+}
+
+type listerAt []os.FileInfo
+
+func (l listerAt) ListAt(ls []os.FileInfo, offset int64) (int, error) {
+	if offset >= int64(len(l)) {
+		return 0, io.EOF
+	}
+	n := copy(ls, l[offset:])
+	if n < len(ls) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// namedInfo gives the root, which the file system calls "", a name.
+type namedInfo struct {
+	os.FileInfo
+	name string
+}
+
+func (fi namedInfo) Name() string {
+	return fi.name
+}
+
+type readerAt struct {
+	mu sync.Mutex
+	f  webdav.File
+}
+
+func (r *readerAt) ReadAt(p []byte, off int64) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, err := r.f.Seek(off, io.SeekStart); err != nil {
+		return 0, err
+	}
+	n, err := io.ReadFull(r.f, p)
+	if err == io.ErrUnexpectedEOF {
+		err = io.EOF
+	}
+	return n, err
+}
+
+func (r *readerAt) Close() error {
+	return r.f.Close()
+}
+
+// writerAt spools a file written in any order. Nothing is written to the
+// file system if a write failed.
+type writerAt struct {
+	ctx  context.Context
+	fs   webdav.FileSystem
+	name string
+
+	mu  sync.Mutex
+	tmp *os.File
+	err error
+}
+
+func (w *writerAt) WriteAt(p []byte, off int64) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.err != nil {
+		return 0, w.err
+	}
+	n, err := w.tmp.WriteAt(p, off)
+	if err != nil {
+		w.err = err
+	}
+	return n, err
+}
+
+func (w *writerAt) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	defer os.Remove(w.tmp.Name())
+	defer w.tmp.Close()
+	if w.err != nil {
+		log.Errorf("Discarding %v after a failed write: %v", w.name, w.err)
+		return w.err
+	}
+	if _, err := w.tmp.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	f, err := w.fs.OpenFile(w.ctx, w.name, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, w.tmp); err != nil {
+		// Not closing f drops what was copied.
+		log.Errorf("Discarding %v: %v", w.name, err)
+		return err
+	}
+	return f.Close()
+}